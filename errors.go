@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"go.cryptoscope.co/margaret"
 	refs "go.mindeco.de/ssb-refs"
@@ -22,6 +23,40 @@ func (e ErrOutOfReach) Error() string {
 	return fmt.Sprintf("ssb/graph: peer not in reach. d:%d, max:%d", e.Dist, e.Max)
 }
 
+// ErrDenied is returned by authorizers for feeds an operator put on the deny-list.
+type ErrDenied struct {
+	Who *refs.FeedRef
+}
+
+func (e ErrDenied) Error() string {
+	return fmt.Sprintf("ssb/graph: peer %s is administratively denied", e.Who.ShortRef())
+}
+
+// ErrRetryLater wraps an authorization error with a hint that the peer shouldn't be connected to again before After passed.
+// The network layer uses it to refuse connections to and from that peer early, see RetryAfter.
+type ErrRetryLater struct {
+	Err   error
+	After time.Duration
+}
+
+func (e ErrRetryLater) Error() string {
+	return fmt.Sprintf("%s (retry after %s)", e.Err, e.After)
+}
+
+func (e ErrRetryLater) Unwrap() error { return e.Err }
+
+// RetryAfter returns the hint of the error, see ErrRetryLater.
+func (e ErrRetryLater) RetryAfter() time.Duration { return e.After }
+
+// RetryAfter returns the retry hint of the first error in the chain of err that has one.
+func RetryAfter(err error) (time.Duration, bool) {
+	var hinter interface{ RetryAfter() time.Duration }
+	if errors.As(err, &hinter) {
+		return hinter.RetryAfter(), true
+	}
+	return 0, false
+}
+
 func IsMessageUnusable(err error) bool {
 	if errors.Is(err, ErrWrongType{}) {
 		return true
@@ -3,7 +3,11 @@
 package ssb
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
 	"fmt"
+	"sort"
 	"sync"
 
 	"go.cryptoscope.co/librarian"
@@ -15,6 +19,11 @@ import (
 
 type strFeedMap map[librarian.Addr]struct{}
 
+var (
+	_ encoding.BinaryMarshaler   = (*StrFeedSet)(nil)
+	_ encoding.BinaryUnmarshaler = (*StrFeedSet)(nil)
+)
+
 type StrFeedSet struct {
 	mu  *sync.Mutex
 	set strFeedMap
@@ -76,3 +85,131 @@ func (fs StrFeedSet) Has(ref *refs.FeedRef) bool {
 	_, has := fs.set[storedrefs.Feed(ref)]
 	return has
 }
+
+// Intersection returns a new set with the feeds that are in both fs and other.
+func (fs *StrFeedSet) Intersection(other *StrFeedSet) *StrFeedSet {
+	if fs == other {
+		return &StrFeedSet{mu: new(sync.Mutex), set: fs.snapshot()}
+	}
+
+	// only one lock is held at a time, so that a∩b and b∩a can run concurrently
+	theirs := other.snapshot()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	small, big := fs.set, theirs
+	if len(big) < len(small) {
+		small, big = big, small
+	}
+
+	both := NewFeedSet(len(small))
+	for feed := range small {
+		if _, has := big[feed]; has {
+			both.set[feed] = struct{}{}
+		}
+	}
+	return both
+}
+
+// Difference returns a new set with the feeds of fs that are not in other.
+func (fs *StrFeedSet) Difference(other *StrFeedSet) *StrFeedSet {
+	if fs == other {
+		return NewFeedSet(0)
+	}
+
+	theirs := other.snapshot()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	only := NewFeedSet(0)
+	for feed := range fs.set {
+		if _, has := theirs[feed]; !has {
+			only.set[feed] = struct{}{}
+		}
+	}
+	return only
+}
+
+// snapshot returns a copy of the feeds in fs
+func (fs *StrFeedSet) snapshot() strFeedMap {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	cpy := make(strFeedMap, len(fs.set))
+	for feed := range fs.set {
+		cpy[feed] = struct{}{}
+	}
+	return cpy
+}
+
+// MarshalBinary encodes the set as the number of feeds followed by each of them,
+// prefixed with their length and in their compact tfk encoding (like storedrefs.Feed), all lengths are uvarints.
+// The feeds are sorted so that the same set always has the same encoding.
+func (fs *StrFeedSet) MarshalBinary() ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	feeds := make([]string, 0, len(fs.set))
+	for feed := range fs.set {
+		feeds = append(feeds, string(feed))
+	}
+	sort.Strings(feeds)
+
+	var (
+		buf    bytes.Buffer
+		lenBuf [binary.MaxVarintLen64]byte
+	)
+	n := binary.PutUvarint(lenBuf[:], uint64(len(feeds)))
+	buf.Write(lenBuf[:n])
+	for _, feed := range feeds {
+		n = binary.PutUvarint(lenBuf[:], uint64(len(feed)))
+		buf.Write(lenBuf[:n])
+		buf.WriteString(feed)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the contents of the set with the feeds encoded by MarshalBinary.
+func (fs *StrFeedSet) UnmarshalBinary(data []byte) error {
+	rd := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return fmt.Errorf("feedset: failed to read count: %w", err)
+	}
+	if count > uint64(len(data)) {
+		return fmt.Errorf("feedset: invalid count %d for %d bytes", count, len(data))
+	}
+
+	set := make(strFeedMap, count)
+	for i := uint64(0); i < count; i++ {
+		feedLen, err := binary.ReadUvarint(rd)
+		if err != nil {
+			return fmt.Errorf("feedset: failed to read length of entry %d: %w", i, err)
+		}
+		if feedLen > uint64(rd.Len()) {
+			return fmt.Errorf("feedset: entry %d is longer than the remaining data", i)
+		}
+		feed := make([]byte, feedLen)
+		if _, err := rd.Read(feed); err != nil {
+			return fmt.Errorf("feedset: failed to read entry %d: %w", i, err)
+		}
+
+		var sr tfk.Feed
+		if err := sr.UnmarshalBinary(feed); err != nil {
+			return fmt.Errorf("feedset: invalid entry %d: %w", i, err)
+		}
+		set[librarian.Addr(feed)] = struct{}{}
+	}
+	if rd.Len() != 0 {
+		return fmt.Errorf("feedset: %d bytes of trailing data", rd.Len())
+	}
+
+	if fs.mu == nil {
+		fs.mu = new(sync.Mutex)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.set = set
+	return nil
+}
@@ -3,6 +3,8 @@
 package ssb
 
 import (
+	"encoding/json"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -53,3 +55,114 @@ func TestFeedSetCount(t *testing.T) {
 	r.NoError(err)
 	r.Len(lst, 50, "some len(List()) wrong")
 }
+
+func TestFeedSetIntersection(t *testing.T) {
+	r := require.New(t)
+	kps := make([]*KeyPair, 4)
+	for i := range kps {
+		var err error
+		kps[i], err = NewKeyPair(nil)
+		r.NoError(err)
+	}
+
+	a := NewFeedSet(3)
+	r.NoError(a.AddRef(kps[0].Id))
+	r.NoError(a.AddRef(kps[1].Id))
+	r.NoError(a.AddRef(kps[2].Id))
+
+	b := NewFeedSet(3)
+	r.NoError(b.AddRef(kps[1].Id))
+	r.NoError(b.AddRef(kps[2].Id))
+	r.NoError(b.AddRef(kps[3].Id))
+
+	both := a.Intersection(b)
+	r.Equal(2, both.Count())
+	r.True(both.Has(kps[1].Id))
+	r.True(both.Has(kps[2].Id))
+
+	r.Equal(0, a.Intersection(NewFeedSet(0)).Count())
+	r.Equal(3, a.Intersection(a).Count())
+
+	// opposite orders at the same time mustn't deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() { a.Intersection(b); b.Difference(a); wg.Done() }()
+		go func() { b.Intersection(a); a.Difference(b); wg.Done() }()
+	}
+	wg.Wait()
+}
+
+func TestFeedSetDifference(t *testing.T) {
+	r := require.New(t)
+	kps := make([]*KeyPair, 4)
+	for i := range kps {
+		var err error
+		kps[i], err = NewKeyPair(nil)
+		r.NoError(err)
+	}
+
+	a := NewFeedSet(3)
+	r.NoError(a.AddRef(kps[0].Id))
+	r.NoError(a.AddRef(kps[1].Id))
+	r.NoError(a.AddRef(kps[2].Id))
+
+	b := NewFeedSet(2)
+	r.NoError(b.AddRef(kps[2].Id))
+	r.NoError(b.AddRef(kps[3].Id))
+
+	onlyA := a.Difference(b)
+	r.Equal(2, onlyA.Count())
+	r.True(onlyA.Has(kps[0].Id))
+	r.True(onlyA.Has(kps[1].Id))
+
+	onlyB := b.Difference(a)
+	r.Equal(1, onlyB.Count())
+	r.True(onlyB.Has(kps[3].Id))
+
+	r.Equal(0, a.Difference(a).Count())
+	r.Equal(3, a.Difference(NewFeedSet(0)).Count())
+}
+
+func TestFeedSetBinaryRoundtrip(t *testing.T) {
+	r := require.New(t)
+
+	fs := NewFeedSet(20)
+	var refs []string
+	for i := 0; i < 20; i++ {
+		kp, err := NewKeyPair(nil)
+		r.NoError(err)
+		r.NoError(fs.AddRef(kp.Id))
+		refs = append(refs, kp.Id.Ref())
+	}
+
+	data, err := fs.MarshalBinary()
+	r.NoError(err)
+
+	var decoded StrFeedSet
+	r.NoError(decoded.UnmarshalBinary(data))
+	r.Equal(20, decoded.Count())
+
+	lst, err := fs.List()
+	r.NoError(err)
+	for _, ref := range lst {
+		r.True(decoded.Has(ref), "missing %s", ref.Ref())
+	}
+
+	again, err := decoded.MarshalBinary()
+	r.NoError(err)
+	r.Equal(data, again, "encoding not stable")
+
+	// compared to a list of string references
+	jsonData, err := json.Marshal(refs)
+	r.NoError(err)
+	r.True(len(data) < len(jsonData), "binary(%d) not smaller than json(%d)", len(data), len(jsonData))
+
+	// empty and broken data
+	empty, err := NewFeedSet(0).MarshalBinary()
+	r.NoError(err)
+	r.NoError(decoded.UnmarshalBinary(empty))
+	r.Equal(0, decoded.Count())
+
+	r.Error(decoded.UnmarshalBinary(data[:len(data)-5]))
+}
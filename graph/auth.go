@@ -5,6 +5,7 @@ package graph
 import (
 	"fmt"
 	"math"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -12,11 +13,30 @@ import (
 	refs "go.mindeco.de/ssb-refs"
 )
 
+// HopsAuthorizer is an ssb.Authorizer that can also check against other hop limits than the one it was made with.
+// The authorizers returned by the builders implement it.
+type HopsAuthorizer interface {
+	ssb.Authorizer
+
+	// AuthorizeWithHops is like Authorize but allows feeds that are at most hops away
+	AuthorizeWithHops(to *refs.FeedRef, hops int) error
+}
+
+var _ HopsAuthorizer = (*authorizer)(nil)
+
 type authorizer struct {
 	b       Builder
 	from    *refs.FeedRef
 	maxHops int
 	log     log.Logger
+
+	// cacheLookups keeps the distances from from until Build returns another graph.
+	// Only the badger builder makes a new graph for every change, the log builder changes it in place.
+	cacheLookups bool
+
+	mu          sync.Mutex
+	cachedGraph *Graph
+	cachedDists *Lookup
 }
 
 // ErrNoSuchFrom should only happen if you reconstruct your existing log from the network
@@ -29,6 +49,20 @@ func (nsf ErrNoSuchFrom) Error() string {
 }
 
 func (a *authorizer) Authorize(to *refs.FeedRef) error {
+	return a.AuthorizeWithHops(to, a.maxHops)
+}
+
+// AuthorizeWithHops checks to against hops instead of the limit the authorizer was made with.
+// The distances are computed once for all the hop limits and reused until the contacts change.
+func (a *authorizer) AuthorizeWithHops(to *refs.FeedRef, maxHops int) error {
+	denied, err := a.b.IsDenied(to)
+	if err != nil {
+		return fmt.Errorf("graph/Authorize: failed to check deny-list: %w", err)
+	}
+	if denied {
+		return ssb.ErrDenied{Who: to}
+	}
+
 	fg, err := a.b.Build()
 	if err != nil {
 		return fmt.Errorf("graph/Authorize: failed to make friendgraph: %w", err)
@@ -46,8 +80,7 @@ func (a *authorizer) Authorize(to *refs.FeedRef) error {
 
 	// TODO we need to check that `from` is in the graph, instead of checking if it's empty
 	// only important in the _resync existing feed_ case. should maybe not construct this authorizer then?
-	var distLookup *Lookup
-	distLookup, err = fg.MakeDijkstra(a.from)
+	distLookup, err := a.distances(fg)
 	if err != nil {
 		return fmt.Errorf("graph/Authorize: failed to construct dijkstra: %w", err)
 	}
@@ -57,12 +90,33 @@ func (a *authorizer) Authorize(to *refs.FeedRef) error {
 	// len(p) == 4
 	p, d := distLookup.Dist(to)
 	hops := len(p) - 2
-	if math.IsInf(d, -1) || math.IsInf(d, 1) || hops < 0 || hops > a.maxHops {
+	if math.IsInf(d, -1) || math.IsInf(d, 1) || hops < 0 || hops > maxHops {
 		// d == -Inf: peer not connected to the graph
 		// d == +Inf: peer directly blocked
 		//level.Debug(a.log).Log("event", "out-of-reach", "d", d, "p", fmt.Sprintf("%v", p), "to", to.ShortRef())
-		return &ssb.ErrOutOfReach{Dist: hops, Max: a.maxHops}
+		return &ssb.ErrOutOfReach{Dist: hops, Max: maxHops}
 	}
 	return nil
 
 }
+
+// distances returns the shortest paths from a.from in fg, from the cache if fg didn't change.
+func (a *authorizer) distances(fg *Graph) (*Lookup, error) {
+	if !a.cacheLookups {
+		return fg.MakeDijkstra(a.from)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.cachedDists != nil && a.cachedGraph == fg {
+		return a.cachedDists, nil
+	}
+
+	dists, err := fg.MakeDijkstra(a.from)
+	if err != nil {
+		return nil, err
+	}
+	a.cachedGraph = fg
+	a.cachedDists = dists
+	return dists, nil
+}
@@ -5,16 +5,23 @@ package graph
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	kitlog "github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
 	"go.cryptoscope.co/librarian"
 	libbadger "go.cryptoscope.co/librarian/badger"
+	"go.cryptoscope.co/luigi"
 	"go.cryptoscope.co/margaret"
+	"go.cryptoscope.co/margaret/multilog"
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/path"
 	"gonum.org/v1/gonum/graph/simple"
@@ -31,60 +38,326 @@ type Builder interface {
 	// Build a complete graph of all follow/block relations
 	Build() (*Graph, error)
 
+	// BuildFiltered is like Build but only includes the edges selected by opts
+	BuildFiltered(opts BuildOpts) (*Graph, error)
+
+	// BuildSubgraph is like Build but only includes the members and the relations between them
+	BuildSubgraph(members *ssb.StrFeedSet) (*Graph, error)
+
+	// BuildAsOf replays the contact messages of the receive log before beforeSeq
+	// and returns the graph how it looked at that point. It doesn't touch the index.
+	BuildAsOf(receiveLog margaret.Log, beforeSeq int64) (*Graph, error)
+
+	// EdgeProvenance returns the key and feed sequence of the contact message that set the current state of the edge from -> to.
+	// It only reads the sublog of from in userFeeds. It returns ErrNoProvenance if there is none.
+	EdgeProvenance(ctx context.Context, from, to *refs.FeedRef, receiveLog margaret.Log, userFeeds multilog.MultiLog) (*refs.MessageRef, int64, error)
+
 	// Follows returns a set of all people ref follows
 	Follows(*refs.FeedRef) (*ssb.StrFeedSet, error)
 
+	// DoesFollow checks if a follows b, without looking at the other follows of a
+	DoesFollow(a, b *refs.FeedRef) (bool, error)
+
+	// DoesBlock checks if a blocks b, without looking at the other contacts of a
+	DoesBlock(a, b *refs.FeedRef) (bool, error)
+
+	// FollowsStream calls fn for every feed ref follows, without collecting them first
+	FollowsStream(ctx context.Context, ref *refs.FeedRef, fn func(*refs.FeedRef) error) error
+
+	// FollowedButBlockedBy returns the feeds that me follows but which block me
+	FollowedButBlockedBy(me *refs.FeedRef) (*ssb.StrFeedSet, error)
+
+	// CommonFollows returns the set of feeds that both a and b follow
+	CommonFollows(a, b *refs.FeedRef) (*ssb.StrFeedSet, error)
+
+	// ReciprocityRate returns the fraction of the feeds that feed follows which follow it back
+	ReciprocityRate(feed *refs.FeedRef) (float64, error)
+
+	// CommunityGaps returns the members of a community that me doesn't follow yet
+	CommunityGaps(me *refs.FeedRef, members *ssb.StrFeedSet) (*ssb.StrFeedSet, error)
+
+	// PopularAmongFollows returns the feeds that are followed by at least the threshold fraction of the feeds me follows
+	PopularAmongFollows(me *refs.FeedRef, threshold float64) (*ssb.StrFeedSet, error)
+
+	// Suggestions is like PopularAmongFollows but with more options
+	Suggestions(me *refs.FeedRef, opts SuggestionOpts) (*ssb.StrFeedSet, error)
+
+	// Classify returns the Relationship of me to each of the feeds, keyed by their Ref()
+	Classify(me *refs.FeedRef, feeds []*refs.FeedRef) (map[string]Relationship, error)
+
+	// Components returns the connected components of the follow graph, largest first. See Graph.Components.
+	Components() ([][]*refs.FeedRef, error)
+
+	// NeighborhoodGraph returns the graph of focus and the feeds that are at most hops away from it
+	NeighborhoodGraph(focus *refs.FeedRef, hops int) (*Graph, error)
+
+	// RankFeedsForPeer orders feeds by their follow distance from peer and whether they follow each other, most relevant first
+	RankFeedsForPeer(peer *refs.FeedRef, feeds *ssb.StrFeedSet) ([]*refs.FeedRef, error)
+
+	// PathToFollow returns the shortest chain of follows from from to target, if target is at most maxHops away
+	PathToFollow(from, target *refs.FeedRef, maxHops int) ([]*refs.FeedRef, error)
+
 	Hops(*refs.FeedRef, int) *ssb.StrFeedSet
 
+	// EstimateReplication returns the number of feeds that are at most maxHops away from from
+	// and the sum of their messages in userFeeds, for instance to tell what raising the hops would pull in
+	EstimateReplication(from *refs.FeedRef, maxHops int, userFeeds multilog.MultiLog) (feeds int, totalMessages int64, err error)
+
+	// LiveReplicationSet is like Hops but returns a set that stays current as the contacts change
+	LiveReplicationSet(me *refs.FeedRef, hops int) (*LiveReplicationSet, error)
+
+	// FollowsLive returns the current follows of forRef and a source of FollowEvents as they change.
+	// The source also implements io.Closer.
+	FollowsLive(forRef *refs.FeedRef) (initial *ssb.StrFeedSet, updates luigi.Source, err error)
+
 	Authorizer(from *refs.FeedRef, maxHops int) ssb.Authorizer
 
+	// WithDenyList replaces the deny-list with the passed feeds.
+	// Authorizers reject denied feeds before looking at the graph, no matter if they are followed or not.
+	WithDenyList([]*refs.FeedRef) error
+
+	// AddDeny puts a feed on the deny-list
+	AddDeny(*refs.FeedRef) error
+
+	// RemoveDeny takes a feed off the deny-list
+	RemoveDeny(*refs.FeedRef) error
+
+	// IsDenied checks if a feed is on the deny-list
+	IsDenied(*refs.FeedRef) (bool, error)
+
+	// DenyList returns all the feeds on the deny-list
+	DenyList() (*ssb.StrFeedSet, error)
+
 	DeleteAuthor(who *refs.FeedRef) error
+
+	// PruneBeyondHops deletes the contacts of the feeds that are more than maxHops away from from and returns how many were dropped
+	PruneBeyondHops(from *refs.FeedRef, maxHops int) (int, error)
+
+	// Reindex drops the contacts and replays all of receiveLog, reporting how far it got to progress
+	Reindex(ctx context.Context, receiveLog margaret.Log, progress ReindexProgressFunc) error
+
+	// ImportEdges seeds the graph with edges that don't come from contact messages, like the ones of an invite bundle.
+	// They are replaced once the contact messages for them are indexed.
+	ImportEdges(edges []Edge) error
+
+	// Close makes sure the indexed contacts are written to disk. It should be called before the index is closed.
+	Close() error
+}
+
+// BuildOpts selects which kind of edges end up in a graph.
+// Build() uses both follows and blocks and doesn't track orphans.
+type BuildOpts struct {
+	IncludeFollows bool
+	IncludeBlocks  bool
+
+	// TrackOrphans records nodes that only have inbound edges, see Graph.Orphans()
+	TrackOrphans bool
+}
+
+func (opts BuildOpts) includes(w float64) bool {
+	if math.IsInf(w, 1) {
+		return opts.IncludeBlocks
+	}
+	if w == 1 {
+		return opts.IncludeFollows
+	}
+	return false
 }
 
 type IndexingBuilder interface {
 	Builder
 
 	OpenIndex() (librarian.SeqSetterIndex, librarian.SinkIndex)
+
+	// SwapDB replaces the database of the builder, for instance with a compacted copy.
+	// The old database is returned and has to be closed by the caller.
+	SwapDB(newDB *badger.DB) (*badger.DB, error)
+
+	// SelfTest compares the sequence the index processed with the latest one of the receive log.
+	// It doesn't look at the contents, it just reports if reindexing is advisable.
+	SelfTest(ctx context.Context, receiveLog margaret.Log) (needsReindex bool, err error)
 }
 
 type builder struct {
-	kv *badger.DB
+	kvMu   sync.RWMutex
+	kv     *badger.DB
+	layout IndexLayout
 
-	idx     librarian.SeqSetterIndex
-	idxSink librarian.SinkIndex
+	idx      *swappableIndex
+	contacts *DerivedIndex
 
 	log kitlog.Logger
 
+	// idxCtr counts how index updates were handled, it can be nil
+	idxCtr metrics.Counter
+
+	// cacheLock serializes the writers (the index, DeleteAuthor, imports and swaps) with Build and BuildFiltered.
+	// Each of them reads or writes badger in a single transaction, so a graph is always built from one snapshot.
+	// The writers drop the caches after their transaction committed, readers that don't take the lock
+	// (Follows, Hops and the live sets) could otherwise fill them again with what was just removed.
 	cacheLock   sync.Mutex
 	cachedGraph *Graph
+
+	neighborhoods *neighborhoodCache
+
+	// live are patched as contacts are indexed, see LiveReplicationSet
+	live liveSets
+
+	// readOnly builders refuse all writes, see NewReadOnlyBuilder
+	readOnly bool
+
+	// closed builders refuse index updates, see Close
+	closed bool
+
+	// expiry drops the caches when temporary follows end, see followTTL
+	expiry expiryTimer
+
+	// owner is set by WithOwnerBlocks, the feeds it blocks are left out of Follows
+	owner       *refs.FeedRef
+	ownerBlocks ownerBlocks
 }
 
+// ErrReadOnly is returned by the methods of a read-only builder that would write to the database.
+var ErrReadOnly = errors.New("ssb/graph: builder is read-only")
+
 // NewBuilder creates a Builder that is backed by a badger database
-func NewBuilder(log kitlog.Logger, db *badger.DB) *builder {
+// The counter is optional and gets an event for each processed message, see countIndexEvent.
+func NewBuilder(log kitlog.Logger, db *badger.DB, ctr metrics.Counter, opts ...BuilderOption) *builder {
+	return NewBuilderWithLayout(log, db, LayoutValues, ctr, opts...)
+}
+
+// NewBuilderWithLayout is like NewBuilder but stores the contacts in the passed layout.
+// Use MigrateToPackedLayout before switching an existing database to LayoutPacked.
+func NewBuilderWithLayout(log kitlog.Logger, db *badger.DB, layout IndexLayout, ctr metrics.Counter, opts ...BuilderOption) *builder {
 	b := &builder{
-		kv:  db,
-		idx: libbadger.NewIndex(db, 0),
-		log: log,
+		kv:     db,
+		layout: layout,
+		idx:    newSwappableIndex(libbadger.NewIndex(db, 0)),
+		log:    log,
+		idxCtr: ctr,
+
+		neighborhoods: newNeighborhoodCache(neighborhoodCacheSize),
+	}
+	b.contacts = b.newContactIndex()
+	for _, o := range opts {
+		o(b)
 	}
 	return b
 }
 
+// NewReadOnlyBuilder opens the contacts database in dir with badger's ReadOnly option and returns a builder over it that never writes.
+// Build, Follows, Hops and the other queries work as usual. DeleteAuthor and the deny-list changes return ErrReadOnly
+// and so do the index and the sink returned by OpenIndex. Close closes the database.
+func NewReadOnlyBuilder(log kitlog.Logger, dir string) (*builder, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.ReadOnly = true
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, fmt.Errorf("ssb/graph: failed to open contacts read-only: %w", err)
+	}
+	b := NewBuilder(log, db, nil)
+	b.readOnly = true
+	return b, nil
+}
+
+// the events indexUpdateFunc reports to the counter.
+// skipped_nonmsg is for values that aren't contact messages, skipped_parse for contact messages that can't be parsed.
+const (
+	idxEventSkippedNonMsg = "skipped_nonmsg"
+	idxEventSkippedParse  = "skipped_parse"
+	idxEventSkippedRef    = "skipped_invalid_ref"
+	idxEventSkippedStale  = "skipped_stale"
+	idxEventFollow        = "indexed_follow"
+	idxEventBlock         = "indexed_block"
+	idxEventUnfollow      = "indexed_unfollow"
+)
+
+// invalidate drops the cached graphs after the contacts changed. It expects cacheLock to be held.
+func (b *builder) invalidate() {
+	b.cachedGraph = nil
+	b.neighborhoods.purge()
+	b.ownerBlocks.purge()
+}
+
+func (b *builder) countIndexEvent(evt string) {
+	if b.idxCtr == nil {
+		return
+	}
+	b.idxCtr.With("event", evt).Add(1)
+}
+
+// checkFeedRef returns an error if ref isn't a feed of a format the index can store
+func checkFeedRef(ref *refs.FeedRef) error {
+	if ref == nil {
+		return fmt.Errorf("missing feed ref")
+	}
+	switch ref.Algo {
+	case refs.RefAlgoFeedSSB1, refs.RefAlgoFeedGabby:
+	default:
+		return fmt.Errorf("unsupported feed format %q", ref.Algo)
+	}
+	if n := len(ref.ID); n != 32 {
+		return fmt.Errorf("feed ref has %d bytes instead of 32", n)
+	}
+	return nil
+}
+
+// indexUpdateFunc processes one message of the receive log, see newContactIndex.
 func (b *builder) indexUpdateFunc(ctx context.Context, seq margaret.Seq, val interface{}, idx librarian.SetterIndex) error {
-	b.cacheLock.Lock()
-	defer b.cacheLock.Unlock()
+	return b.contacts.update(ctx, seq, val, idx)
+}
 
-	if nulled, ok := val.(error); ok {
-		if margaret.IsErrNulled(nulled) {
+// newContactIndex returns the DerivedIndex that stores the contact messages for b.
+// Each update holds cacheLock and invalidates the caches once it was written.
+func (b *builder) newContactIndex() *DerivedIndex {
+	di := newDerivedIndex(b.db, b.idx, b.log, b.classifyContact)
+	di.lock = &b.cacheLock
+	di.skipped = func() { b.countIndexEvent(idxEventSkippedNonMsg) }
+	// the state of an edge and its sequence are written in one transaction, so that they can't disagree
+	di.write = func(_ context.Context, _ librarian.SetterIndex, ops []IndexOp) error {
+		return b.db().Update(func(txn *badger.Txn) error {
+			for _, op := range ops {
+				if err := b.setContactOp(txn, op); err != nil {
+					return err
+				}
+			}
 			return nil
-		}
-		return nulled
+		})
 	}
+	di.applied = b.contactApplied
+	return di
+}
 
-	abs, ok := val.(refs.Message)
-	if !ok {
-		err := fmt.Errorf("graph/idx: invalid msg value %T", val)
-		level.Warn(b.log).Log("msg", "contact eval failed", "reason", err)
-		return err
+// setContactOp stores op in txn like the index does, or in the packed layout for the edges of LayoutPacked.
+func (b *builder) setContactOp(txn *badger.Txn, op IndexOp) error {
+	if b.layout == LayoutPacked && !isEdgeSeqKey([]byte(op.Addr)) {
+		return setPacked(txn, []byte(op.Addr), packedStates[op.Value.(int)], op.TTL)
+	}
+	v, err := json.Marshal(op.Value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %w", err)
+	}
+	e := badger.NewEntry([]byte(op.Addr), v)
+	if op.TTL > 0 {
+		e = e.WithTTL(op.TTL)
+	}
+	return txn.SetEntry(e)
+}
+
+// classifyContact is the Classifier of the contact index
+func (b *builder) classifyContact(abs refs.Message) ([]IndexOp, error) {
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(abs.ContentBytes(), &typed); err != nil || typed.Type != "contact" {
+		// not a contact message, which includes encrypted ones
+		b.countIndexEvent(idxEventSkippedNonMsg)
+		return nil, nil
 	}
 
 	var c refs.Contact
@@ -92,52 +365,165 @@ func (b *builder) indexUpdateFunc(ctx context.Context, seq margaret.Seq, val int
 	if err != nil {
 		// just ignore invalid messages, nothing to do with them (unless you are debugging something)
 		//level.Warn(b.log).Log("msg", "skipped contact message", "reason", err)
-		return nil
+		b.countIndexEvent(idxEventSkippedParse)
+		return nil, nil
+	}
+
+	// storing a broken ref would add a node nobody can reach
+	if err := checkFeedRef(abs.Author()); err != nil {
+		level.Debug(b.log).Log("msg", "skipped contact message", "reason", fmt.Errorf("author: %w", err))
+		b.countIndexEvent(idxEventSkippedRef)
+		return nil, nil
+	}
+	if err := checkFeedRef(c.Contact); err != nil {
+		level.Debug(b.log).Log("msg", "skipped contact message", "reason", fmt.Errorf("contact: %w", err))
+		b.countIndexEvent(idxEventSkippedRef)
+		return nil, nil
 	}
 
 	addr := storedrefs.Feed(abs.Author())
 	addr += storedrefs.Feed(c.Contact)
+
+	// an older message of the author can't undo a newer one
+	seq := abs.Seq()
+	last, has, err := b.edgeSeq([]byte(addr))
+	if err != nil {
+		return nil, err
+	}
+	if has && last > seq {
+		b.countIndexEvent(idxEventSkippedStale)
+		return nil, nil
+	}
+
+	// cryptix: deleting the entry on unfollow also removes the node if this is the only follow from that peer
+	// 3 state handling seems saner
+	state := EdgeNeutral
+	var ttl time.Duration
 	switch {
 	case c.Following:
-		err = idx.Set(ctx, addr, 1)
+		state = EdgeFollow
+		// temporary follows that are already over are stored like an unfollow
+		var expired bool
+		ttl, expired = followTTL(abs.ContentBytes(), time.Now())
+		if expired {
+			state = EdgeNeutral
+		}
 	case c.Blocking:
-		err = idx.Set(ctx, addr, 2)
-	default:
-		err = idx.Set(ctx, addr, 0)
-		// cryptix: not sure why this doesn't work
-		// it also removes the node if this is the only follow from that peer
-		// 3 state handling seems saner
-		// err = idx.Delete(ctx, librarian.Addr(addr))
-	}
-	if err != nil {
-		return fmt.Errorf("db/idx contacts: failed to update index. %+v: %w", c, err)
+		state = EdgeBlock
 	}
+	return []IndexOp{
+		{Addr: addr, Value: state, TTL: ttl},
+		{Addr: edgeSeqKey([]byte(addr)), Value: seq},
+	}, nil
+}
 
+// contactApplied drops the caches and tells the live sets about the stored contact.
+// The blocks of the owner are only read again if the contact is one of the owner's.
+func (b *builder) contactApplied(abs refs.Message, ops []IndexOp) {
 	b.cachedGraph = nil
+	b.neighborhoods.purge()
+	if b.owner != nil && b.owner.Equal(abs.Author()) {
+		b.ownerBlocks.purge()
+	}
+	for _, op := range ops {
+		if isEdgeSeqKey([]byte(op.Addr)) {
+			continue
+		}
+		if op.TTL > 0 {
+			b.scheduleExpiry(time.Now().Add(op.TTL))
+		}
+		var to tfk.Feed
+		if err := to.UnmarshalBinary([]byte(op.Addr[contactKeyLen/2:])); err != nil {
+			// can't tell which edge it was
+			b.live.markStale()
+			continue
+		}
+
+		evt := idxEventUnfollow
+		switch op.Value {
+		case EdgeFollow:
+			evt = idxEventFollow
+		case EdgeBlock:
+			evt = idxEventBlock
+		}
+		b.contactChanged(abs.Author(), to.Feed(), op.Value == EdgeFollow)
+		b.countIndexEvent(evt)
+	}
 	// TODO: patch existing graph instead of invalidating
-	return nil
 }
 
 func (b *builder) OpenIndex() (librarian.SeqSetterIndex, librarian.SinkIndex) {
-	if b.idxSink == nil {
-		b.idxSink = librarian.NewSinkIndex(b.indexUpdateFunc, b.idx)
+	if b.readOnly {
+		refuse := func(context.Context, margaret.Seq, interface{}, librarian.SetterIndex) error {
+			return ErrReadOnly
+		}
+		ro := readOnlyIndex{b.idx}
+		return ro, librarian.NewSinkIndex(refuse, ro)
 	}
-	return b.idx, b.idxSink
+	return b.contacts.OpenIndex()
+}
+
+// SelfTest is meant to be used on startup, before the index is served.
+func (b *builder) SelfTest(ctx context.Context, receiveLog margaret.Log) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	idxSeq, err := b.idx.GetSeq()
+	if err != nil {
+		return false, fmt.Errorf("graph/selftest: failed to get index sequence: %w", err)
+	}
+
+	rxV, err := receiveLog.Seq().Value()
+	if err != nil {
+		return false, fmt.Errorf("graph/selftest: failed to get receive log sequence: %w", err)
+	}
+	rxSeq, ok := rxV.(margaret.Seq)
+	if !ok {
+		return false, fmt.Errorf("graph/selftest: unexpected receive log sequence type: %T", rxV)
+	}
+
+	processed := int64(-1)
+	if idxSeq != nil {
+		processed = idxSeq.Seq()
+	}
+
+	if processed < rxSeq.Seq() {
+		level.Warn(b.log).Log("msg", "contact index is behind the receive log", "idx", processed, "rxlog", rxSeq.Seq())
+		return true, nil
+	}
+	return false, nil
 }
 
 func (b *builder) DeleteAuthor(who *refs.FeedRef) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
 	b.cacheLock.Lock()
 	defer b.cacheLock.Unlock()
-	b.cachedGraph = nil
-	return b.kv.Update(func(txn *badger.Txn) error {
+	err := b.retryTxn("deleteAuthor", func() error {
+		if err := b.deleteAuthor(who); err != nil {
+			return err
+		}
+		return b.deleteEdgeSeqs(who)
+	})
+	b.invalidate()
+	b.live.markStale()
+	return err
+}
+
+func (b *builder) deleteAuthor(who *refs.FeedRef) error {
+	if b.layout == LayoutPacked {
+		return b.deleteAuthorPacked(who)
+	}
+	return b.db().Update(func(txn *badger.Txn) error {
 		iter := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer iter.Close()
 
 		prefix := []byte(storedrefs.Feed(who))
 		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
-			it := iter.Item()
-
-			k := it.Key()
+			// the key of the item is reused by the iterator, the transaction needs its own
+			k := iter.Item().KeyCopy(nil)
 			if err := txn.Delete(k); err != nil {
 				return fmt.Errorf("DeleteAuthor: failed to drop record %x: %w", k, err)
 			}
@@ -152,12 +538,12 @@ func (b *builder) Authorizer(from *refs.FeedRef, maxHops int) ssb.Authorizer {
 		from:    from,
 		maxHops: maxHops,
 		log:     b.log,
+
+		cacheLookups: true,
 	}
 }
 
 func (b *builder) Build() (*Graph, error) {
-	dg := NewGraph()
-
 	b.cacheLock.Lock()
 	defer b.cacheLock.Unlock()
 
@@ -165,90 +551,263 @@ func (b *builder) Build() (*Graph, error) {
 		return b.cachedGraph, nil
 	}
 
-	err := b.kv.View(func(txn *badger.Txn) error {
+	dg, err := b.buildGraph(BuildOpts{IncludeFollows: true, IncludeBlocks: true})
+	b.cachedGraph = dg
+	return dg, err
+}
+
+// BuildFiltered isn't cached since the moderation views it is meant for are rare
+func (b *builder) BuildFiltered(opts BuildOpts) (*Graph, error) {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	return b.buildGraph(opts)
+}
+
+func (b *builder) buildGraph(opts BuildOpts) (*Graph, error) {
+	if b.layout == LayoutPacked {
+		return b.buildPackedGraph(opts)
+	}
+
+	var edges []storedEdge
+	err := b.db().View(func(txn *badger.Txn) error {
 		iter := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer iter.Close()
 
 		for iter.Rewind(); iter.Valid(); iter.Next() {
 			it := iter.Item()
-			k := it.Key()
-			if len(k) != 68 {
+			if len(it.Key()) != 68 {
 				continue
 			}
+			k := it.KeyCopy(nil)
+			b.scheduleExpiryAt(it.ExpiresAt())
 
-			rawFrom := k[:34]
-			rawTo := k[34:]
-
-			if bytes.Equal(rawFrom, rawTo) {
-				// contact self?!
-				continue
+			w := math.Inf(-1)
+			err := it.Value(func(v []byte) error {
+				var err error
+				w, err = contactWeight(v)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to get value from item:%q: %w", string(k), err)
 			}
 
-			var to, from tfk.Feed
-			if err := from.UnmarshalBinary(rawFrom); err != nil {
-				return fmt.Errorf("builder: couldnt idx key value (from): %w", err)
-			}
-			if err := to.UnmarshalBinary(rawTo); err != nil {
-				return fmt.Errorf("builder: couldnt idx key value (to): %w", err)
+			if !opts.includes(w) {
+				w = math.Inf(-1)
 			}
 
-			bfrom := librarian.Addr(rawFrom)
-			nFrom, has := dg.lookup[bfrom]
-			if !has {
-				fromRef := from.Feed()
+			edges = append(edges, storedEdge{from: k[:34], to: k[34:], w: w})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-				nFrom = &contactNode{dg.NewNode(), fromRef.Copy(), ""}
-				dg.AddNode(nFrom)
-				dg.lookup[bfrom] = nFrom
-			}
+	dg := NewGraph()
+	if err := dg.addContactEdges(edges); err != nil {
+		return nil, err
+	}
 
-			bto := librarian.Addr(rawTo)
-			nTo, has := dg.lookup[bto]
-			if !has {
-				toRef := to.Feed()
-				nTo = &contactNode{dg.NewNode(), toRef.Copy(), ""}
-				dg.AddNode(nTo)
-				dg.lookup[bto] = nTo
-			}
+	if opts.TrackOrphans {
+		dg.markOrphans()
+	}
+	return dg, nil
+}
+
+// contactWeight turns a stored contact state into the weight of the edge.
+// -Inf means there is no edge.
+func contactWeight(v []byte) (float64, error) {
+	w := math.Inf(-1)
+	if len(v) >= 1 {
+		switch v[0] {
+		case '0': // not following
+		case '1':
+			w = 1
+		case '2':
+			w = math.Inf(1)
+		default:
+			return w, fmt.Errorf("barbage value in graph strore")
+		}
+	}
+	return w, nil
+}
 
-			if nFrom.ID() == nTo.ID() {
+// storedEdge is a contact between two stored feed references, as read from the index
+type storedEdge struct {
+	from, to []byte
+	w        float64
+}
+
+// addContactEdges adds all the edges like addContactEdge but creates the nodes first, sorted by their stored references.
+// This way the node IDs only depend on the feeds in the graph and not on the order the edges were read in,
+// so two builds of the same contacts can be compared.
+func (dg *Graph) addContactEdges(edges []storedEdge) error {
+	var feeds []string
+	seen := make(map[string]struct{})
+	for _, e := range edges {
+		if bytes.Equal(e.from, e.to) {
+			continue
+		}
+		for _, raw := range [][]byte{e.from, e.to} {
+			if _, has := seen[string(raw)]; has {
 				continue
 			}
+			seen[string(raw)] = struct{}{}
+			feeds = append(feeds, string(raw))
+		}
+	}
+	sort.Strings(feeds)
 
-			w := math.Inf(-1)
-			err := it.Value(func(v []byte) error {
-				if len(v) >= 1 {
-					switch v[0] {
-					case '0': // not following
-					case '1':
-						w = 1
-					case '2':
-						w = math.Inf(1)
-					default:
-						return fmt.Errorf("barbage value in graph strore")
-					}
-				}
-				return nil
-			})
-			if err != nil {
-				return fmt.Errorf("failed to get value from item:%q: %w", string(k), err)
+	for _, f := range feeds {
+		if _, err := dg.feedNode([]byte(f)); err != nil {
+			return fmt.Errorf("builder: couldnt idx key value: %w", err)
+		}
+	}
+
+	for _, e := range edges {
+		if err := dg.addContactEdge(e.from, e.to, e.w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// feedNode returns the node of the stored feed reference, it is created if it isn't in the graph yet.
+func (dg *Graph) feedNode(raw []byte) (*contactNode, error) {
+	addr := librarian.Addr(raw)
+	if n, has := dg.lookup[addr]; has {
+		return n, nil
+	}
+
+	var sr tfk.Feed
+	if err := sr.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+
+	n := &contactNode{dg.NewNode(), sr.Feed().Copy(), ""}
+	dg.AddNode(n)
+	dg.lookup[addr] = n
+	return n, nil
+}
+
+// addContactEdge adds an edge between the two stored feed references to the graph, creating the nodes if necessary.
+func (dg *Graph) addContactEdge(rawFrom, rawTo []byte, w float64) error {
+	if bytes.Equal(rawFrom, rawTo) {
+		// contact self?!
+		return nil
+	}
+
+	nFrom, err := dg.feedNode(rawFrom)
+	if err != nil {
+		return fmt.Errorf("builder: couldnt idx key value (from): %w", err)
+	}
+	dg.sources[librarian.Addr(rawFrom)] = struct{}{}
+
+	nTo, err := dg.feedNode(rawTo)
+	if err != nil {
+		return fmt.Errorf("builder: couldnt idx key value (to): %w", err)
+	}
+
+	if nFrom.ID() == nTo.ID() {
+		return nil
+	}
+
+	if math.IsInf(w, -1) {
+		//dg.RemoveEdge(nFrom.ID(), nTo.ID())
+		return nil
+	}
+
+	dg.SetWeightedEdge(contactEdge{
+		WeightedEdge: simple.WeightedEdge{F: nFrom, T: nTo, W: w},
+		isBlock:      math.IsInf(w, 1),
+	})
+	return nil
+}
+
+func (b *builder) BuildSubgraph(members *ssb.StrFeedSet) (*Graph, error) {
+	g, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return g.Subgraph(members), nil
+}
+
+func (b *builder) BuildAsOf(receiveLog margaret.Log, beforeSeq int64) (*Graph, error) {
+	return buildAsOf(receiveLog, beforeSeq)
+}
+
+// buildAsOf keeps the contact state of each pair of feeds in memory, like the index would,
+// and turns it into a graph once all the messages before beforeSeq are processed.
+func buildAsOf(receiveLog margaret.Log, beforeSeq int64) (*Graph, error) {
+	ctx := context.TODO()
+
+	src, err := receiveLog.Query(margaret.Lt(margaret.BaseSeq(beforeSeq)))
+	if err != nil {
+		return nil, fmt.Errorf("buildAsOf: failed to query receive log: %w", err)
+	}
+
+	states := make(map[string]float64)
+	for {
+		v, err := src.Next(ctx)
+		if err != nil {
+			if luigi.IsEOS(err) {
+				break
 			}
+			return nil, fmt.Errorf("buildAsOf: failed to get next message: %w", err)
+		}
 
-			if math.IsInf(w, -1) {
-				//dg.RemoveEdge(nFrom.ID(), nTo.ID())
+		if nulled, ok := v.(error); ok {
+			if margaret.IsErrNulled(nulled) {
 				continue
 			}
+			return nil, nulled
+		}
 
-			dg.SetWeightedEdge(contactEdge{
-				WeightedEdge: simple.WeightedEdge{F: nFrom, T: nTo, W: w},
-				isBlock:      math.IsInf(w, 1),
-			})
+		abs, ok := v.(refs.Message)
+		if !ok {
+			return nil, fmt.Errorf("buildAsOf: invalid msg value %T", v)
 		}
-		return nil
-	})
 
-	b.cachedGraph = dg
-	return dg, err
+		var c refs.Contact
+		err = c.UnmarshalJSON(abs.ContentBytes())
+		if err != nil {
+			// not a (valid) contact message
+			continue
+		}
+
+		addr := storedrefs.Feed(abs.Author())
+		addr += storedrefs.Feed(c.Contact)
+		switch {
+		case c.Following:
+			states[string(addr)] = 1
+		case c.Blocking:
+			states[string(addr)] = math.Inf(1)
+		default:
+			states[string(addr)] = math.Inf(-1)
+		}
+	}
+
+	// sort the pairs to add the edges in the same order as Build() would
+	keys := make([]string, 0, len(states))
+	for k := range states {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	edges := make([]storedEdge, 0, len(keys))
+	for _, k := range keys {
+		if len(k) != 68 {
+			continue
+		}
+		edges = append(edges, storedEdge{from: []byte(k[:34]), to: []byte(k[34:]), w: states[k]})
+	}
+
+	dg := NewGraph()
+	if err := dg.addContactEdges(edges); err != nil {
+		return nil, err
+	}
+	return dg, nil
 }
 
 type Lookup struct {
@@ -269,16 +828,47 @@ func (b *builder) Follows(forRef *refs.FeedRef) (*ssb.StrFeedSet, error) {
 	if forRef == nil {
 		panic("nil feed ref")
 	}
+	pruned, err := b.ownerBlocked()
+	if err != nil {
+		return nil, fmt.Errorf("follows(%s): %w", forRef.Ref(), err)
+	}
+
 	fs := ssb.NewFeedSet(50)
-	err := b.kv.View(func(txn *badger.Txn) error {
+	err = b.FollowsStream(context.Background(), forRef, func(ref *refs.FeedRef) error {
+		if pruned.Has(ref) {
+			return nil
+		}
+		if err := fs.AddRef(ref); err != nil {
+			return fmt.Errorf("follows(%s): couldn't add parsed ref feed: %w", forRef.Ref(), err)
+		}
+		return nil
+	})
+	return fs, err
+}
+
+// FollowsStream calls fn for every feed forRef follows while scanning the index.
+// It stops if the context is canceled or fn returns an error.
+func (b *builder) FollowsStream(ctx context.Context, forRef *refs.FeedRef, fn func(*refs.FeedRef) error) error {
+	if forRef == nil {
+		panic("nil feed ref")
+	}
+	if b.layout == LayoutPacked {
+		return b.followsStreamPacked(ctx, forRef, fn)
+	}
+	return b.db().View(func(txn *badger.Txn) error {
 		iter := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer iter.Close()
 
 		prefix := []byte(storedrefs.Feed(forRef))
 		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			it := iter.Item()
 			k := it.Key()
 
+			var followed *refs.FeedRef
 			err := it.Value(func(v []byte) error {
 				if len(v) >= 1 && v[0] == '1' {
 					// extract 2nd feed ref out of db key
@@ -288,19 +878,288 @@ func (b *builder) Follows(forRef *refs.FeedRef) (*ssb.StrFeedSet, error) {
 					if err != nil {
 						return fmt.Errorf("follows(%s): invalid ref entry in db for feed: %w", forRef.Ref(), err)
 					}
-					if err := fs.AddRef(sr.Feed()); err != nil {
-						return fmt.Errorf("follows(%s): couldn't add parsed ref feed: %w", forRef.Ref(), err)
-					}
+					followed = sr.Feed()
 				}
 				return nil
 			})
 			if err != nil {
 				return fmt.Errorf("failed to get value from iter: %w", err)
 			}
+
+			if followed == nil {
+				continue
+			}
+			if err := fn(followed); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	return fs, err
+}
+
+func (b *builder) FollowedButBlockedBy(me *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	blockedBy := ssb.NewFeedSet(0)
+	err := b.FollowsStream(context.Background(), me, func(followed *refs.FeedRef) error {
+		w, err := b.edgeWeight(followed, me)
+		if err != nil {
+			return err
+		}
+		if math.IsInf(w, 1) {
+			return blockedBy.AddRef(followed)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("followedButBlockedBy: %w", err)
+	}
+	return blockedBy, nil
+}
+
+// edgeWeight looks up the stored state between the two feeds directly and returns the weight of the edge.
+func (b *builder) edgeWeight(from, to *refs.FeedRef) (float64, error) {
+	pair := []byte(storedrefs.Feed(from) + storedrefs.Feed(to))
+
+	w := math.Inf(-1)
+	err := b.db().View(func(txn *badger.Txn) error {
+		if b.layout == LayoutPacked {
+			for _, p := range packedPrefixes {
+				_, err := txn.Get(packedKey(p, pair))
+				if err == badger.ErrKeyNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				w, _ = packedWeight(packedKey(p, pair))
+				return nil
+			}
+			return nil
+		}
+
+		it, err := txn.Get(pair)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return it.Value(func(v []byte) error {
+			var err error
+			w, err = contactWeight(v)
+			return err
+		})
+	})
+	if err != nil {
+		return w, fmt.Errorf("failed to look up contact state: %w", err)
+	}
+	return w, nil
+}
+
+// DoesFollow looks up the single contact entry of a and b instead of scanning all the follows of a.
+func (b *builder) DoesFollow(a, c *refs.FeedRef) (bool, error) {
+	w, err := b.edgeWeight(a, c)
+	if err != nil {
+		return false, fmt.Errorf("DoesFollow: %w", err)
+	}
+	return w == 1, nil
+}
+
+// DoesBlock is like DoesFollow but for blocks
+func (b *builder) DoesBlock(a, c *refs.FeedRef) (bool, error) {
+	w, err := b.edgeWeight(a, c)
+	if err != nil {
+		return false, fmt.Errorf("DoesBlock: %w", err)
+	}
+	return math.IsInf(w, 1), nil
+}
+
+func (b *builder) CommonFollows(a, c *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	return commonFollows(b, a, c)
+}
+
+func commonFollows(bld Builder, a, b *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	aFollows, err := bld.Follows(a)
+	if err != nil {
+		return nil, fmt.Errorf("commonFollows: follows of a failed: %w", err)
+	}
+	bFollows, err := bld.Follows(b)
+	if err != nil {
+		return nil, fmt.Errorf("commonFollows: follows of b failed: %w", err)
+	}
+	return aFollows.Intersection(bFollows), nil
+}
+
+func (b *builder) ReciprocityRate(feed *refs.FeedRef) (float64, error) {
+	return reciprocityRate(b, feed)
+}
+
+// reciprocityRate returns 0 if feed doesn't follow anyone
+func reciprocityRate(bld Builder, feed *refs.FeedRef) (float64, error) {
+	follows, err := bld.Follows(feed)
+	if err != nil {
+		return 0, fmt.Errorf("reciprocityRate: follows of feed failed: %w", err)
+	}
+	lst, err := follows.List()
+	if err != nil {
+		return 0, fmt.Errorf("reciprocityRate: invalid entry in feed set: %w", err)
+	}
+	if len(lst) == 0 {
+		return 0, nil
+	}
+
+	var back int
+	for _, followed := range lst {
+		theirs, err := bld.Follows(followed)
+		if err != nil {
+			return 0, fmt.Errorf("reciprocityRate: follows of %s failed: %w", followed.ShortRef(), err)
+		}
+		if theirs.Has(feed) {
+			back++
+		}
+	}
+	return float64(back) / float64(len(lst)), nil
+}
+
+func (b *builder) CommunityGaps(me *refs.FeedRef, members *ssb.StrFeedSet) (*ssb.StrFeedSet, error) {
+	return communityGaps(b, me, members)
+}
+
+func communityGaps(bld Builder, me *refs.FeedRef, members *ssb.StrFeedSet) (*ssb.StrFeedSet, error) {
+	withMe := ssb.NewFeedSet(members.Count() + 1)
+	lst, err := members.List()
+	if err != nil {
+		return nil, fmt.Errorf("communityGaps: invalid member: %w", err)
+	}
+	for _, m := range lst {
+		withMe.AddRef(m)
+	}
+	withMe.AddRef(me)
+
+	g, err := bld.BuildSubgraph(withMe)
+	if err != nil {
+		return nil, fmt.Errorf("communityGaps: failed to build community graph: %w", err)
+	}
+
+	gaps := ssb.NewFeedSet(0)
+	for _, m := range lst {
+		if m.Equal(me) || g.Follows(me, m) {
+			continue
+		}
+		if err := gaps.AddRef(m); err != nil {
+			return nil, err
+		}
+	}
+	return gaps, nil
+}
+
+func (b *builder) PopularAmongFollows(me *refs.FeedRef, threshold float64) (*ssb.StrFeedSet, error) {
+	return suggestions(b, me, SuggestionOpts{Threshold: threshold})
+}
+
+func (b *builder) Suggestions(me *refs.FeedRef, opts SuggestionOpts) (*ssb.StrFeedSet, error) {
+	return suggestions(b, me, opts)
+}
+
+// SuggestionOpts configures Suggestions
+type SuggestionOpts struct {
+	// Threshold is the fraction of the feeds me follows that have to follow a feed for it to be suggested.
+	// It has to be above 0 and at most 1.
+	Threshold float64
+
+	// RespectCommunityBlocks leaves out feeds that are blocked by more than half of the feeds me follows,
+	// not only the ones me blocks itself.
+	RespectCommunityBlocks bool
+}
+
+// suggestions counts how many of the feeds me follows follow each other feed.
+// Feeds that me already follows or blocks and me itself are left out.
+func suggestions(bld Builder, me *refs.FeedRef, opts SuggestionOpts) (*ssb.StrFeedSet, error) {
+	threshold := opts.Threshold
+	if threshold <= 0 || threshold > 1 {
+		return nil, fmt.Errorf("suggestions: threshold %v is not in (0, 1]", threshold)
+	}
+
+	myFollows, err := bld.Follows(me)
+	if err != nil {
+		return nil, fmt.Errorf("suggestions: follows of me failed: %w", err)
+	}
+	lst, err := myFollows.List()
+	if err != nil {
+		return nil, fmt.Errorf("suggestions: invalid entry in feed set: %w", err)
+	}
+
+	popular := ssb.NewFeedSet(0)
+	if len(lst) == 0 {
+		return popular, nil
+	}
+
+	var (
+		counts     = make(map[string]int)
+		candidates = make(map[string]*refs.FeedRef)
+	)
+	for _, followed := range lst {
+		theirs, err := bld.Follows(followed)
+		if err != nil {
+			return nil, fmt.Errorf("suggestions: follows of %s failed: %w", followed.ShortRef(), err)
+		}
+		theirLst, err := theirs.List()
+		if err != nil {
+			return nil, fmt.Errorf("suggestions: invalid entry in feed set: %w", err)
+		}
+		for _, c := range theirLst {
+			if c.Equal(me) || myFollows.Has(c) {
+				continue
+			}
+			counts[c.Ref()]++
+			candidates[c.Ref()] = c
+		}
+	}
+
+	g, err := bld.Build()
+	if err != nil {
+		return nil, fmt.Errorf("suggestions: failed to build graph: %w", err)
+	}
+
+	var blockedBy map[string]int
+	if opts.RespectCommunityBlocks {
+		blockedBy = make(map[string]int)
+		for _, followed := range lst {
+			blocked, err := g.BlockedList(followed).List()
+			if err != nil {
+				return nil, fmt.Errorf("suggestions: invalid entry in blocked set: %w", err)
+			}
+			for _, bl := range blocked {
+				blockedBy[bl.Ref()]++
+			}
+		}
+	}
+
+	for ref, cnt := range counts {
+		if float64(cnt)/float64(len(lst)) < threshold {
+			continue
+		}
+		c := candidates[ref]
+		if g.Blocks(me, c) {
+			continue
+		}
+		if 2*blockedBy[ref] > len(lst) {
+			continue
+		}
+		if err := popular.AddRef(c); err != nil {
+			return nil, err
+		}
+	}
+	return popular, nil
+}
+
+func (b *builder) Components() ([][]*refs.FeedRef, error) {
+	return components(b)
+}
+
+func components(bld Builder) ([][]*refs.FeedRef, error) {
+	g, err := bld.Build()
+	if err != nil {
+		return nil, fmt.Errorf("components: failed to build graph: %w", err)
+	}
+	return g.Components(), nil
 }
 
 // Hops returns a slice of feed refrences that are in a particulare range of from
@@ -308,58 +1167,88 @@ func (b *builder) Follows(forRef *refs.FeedRef) (*ssb.StrFeedSet, error) {
 // max == 1: max:0 + follows of friends of from
 // max == 2: max:1 + follows of their friends
 func (b *builder) Hops(from *refs.FeedRef, max int) *ssb.StrFeedSet {
-	max++
-	walked := ssb.NewFeedSet(0)
-	visited := make(map[string]struct{}) // tracks the nodes we already recursed from (so we don't do them multiple times on common friends)
-	err := b.recurseHops(walked, visited, from, max)
+	walked, err := b.walkHops(from, max, nil)
 	if err != nil {
-		b.log.Log("event", "error", "msg", "recurse failed", "err", err)
+		b.log.Log("event", "error", "msg", "walking hops failed", "err", err)
 		return nil
 	}
 	walked.Delete(from)
 	return walked
 }
 
-func (b *builder) recurseHops(walked *ssb.StrFeedSet, vis map[string]struct{}, from *refs.FeedRef, depth int) error {
-	if depth == 0 {
-		return nil
+// HopsWithDistance is like Hops but returns how many hops each feed is away from from, keyed by their reference.
+// Direct follows of from are 0 hops away.
+func (b *builder) HopsWithDistance(from *refs.FeedRef, max int) (map[string]int, error) {
+	dists := make(map[string]int)
+	_, err := b.walkHops(from, max, dists)
+	if err != nil {
+		return nil, err
 	}
+	delete(dists, from.Ref())
+	return dists, nil
+}
 
-	if _, ok := vis[from.Ref()]; ok {
-		return nil
-	}
+type hopsQueueEntry struct {
+	feed  *refs.FeedRef
+	depth int
+}
 
-	fromFollows, err := b.Follows(from)
-	if err != nil {
-		return fmt.Errorf("recurseHops(%d): from follow listing failed: %w", depth, err)
+// walkHops walks the friends of from breadth first, using an explicit queue instead of recursion.
+// The follows of every friend that is at most max hops away are added to the returned set.
+// If dists is not nil, it is filled with the smallest distance each of the walked feeds was found at.
+func (b *builder) walkHops(from *refs.FeedRef, max int, dists map[string]int) (*ssb.StrFeedSet, error) {
+	walked := ssb.NewFeedSet(0)
+	if max < 0 {
+		return walked, nil
 	}
 
-	followLst, err := fromFollows.List()
-	if err != nil {
-		return fmt.Errorf("recurseHops(%d): invalid entry in feed set: %w", depth, err)
-	}
+	queued := map[string]struct{}{from.Ref(): {}}
+	queue := []hopsQueueEntry{{feed: from, depth: 0}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
 
-	for i, followedByFrom := range followLst {
-		err := walked.AddRef(followedByFrom)
+		currentFollows, err := b.Follows(current.feed)
 		if err != nil {
-			return fmt.Errorf("recurseHops(%d): add list entry(%d) failed: %w", depth, i, err)
+			return nil, fmt.Errorf("walkHops(%d): from follow listing failed: %w", current.depth, err)
 		}
 
-		dstFollows, err := b.Follows(followedByFrom)
+		followLst, err := currentFollows.List()
 		if err != nil {
-			return fmt.Errorf("recurseHops(%d): follows from entry(%d) failed: %w", depth, i, err)
+			return nil, fmt.Errorf("walkHops(%d): invalid entry in feed set: %w", current.depth, err)
 		}
 
-		isF := dstFollows.Has(from)
-		if isF { // found a friend, recurse
-			if err := b.recurseHops(walked, vis, followedByFrom, depth-1); err != nil {
-				return err
+		for i, followed := range followLst {
+			err := walked.AddRef(followed)
+			if err != nil {
+				return nil, fmt.Errorf("walkHops(%d): add list entry(%d) failed: %w", current.depth, i, err)
+			}
+
+			if dists != nil {
+				if _, has := dists[followed.Ref()]; !has {
+					dists[followed.Ref()] = current.depth
+				}
+			}
+
+			if current.depth >= max {
+				continue
+			}
+
+			if _, has := queued[followed.Ref()]; has {
+				continue
+			}
+
+			dstFollows, err := b.Follows(followed)
+			if err != nil {
+				return nil, fmt.Errorf("walkHops(%d): follows from entry(%d) failed: %w", current.depth, i, err)
+			}
+
+			if dstFollows.Has(current.feed) { // found a friend, walk their follows next
+				queued[followed.Ref()] = struct{}{}
+				queue = append(queue, hopsQueueEntry{feed: followed, depth: current.depth + 1})
 			}
 		}
-		// b.log.Log("depth", depth, "from", from.ShortRef(), "follows", followedByFrom.ShortRef(), "friend", isF, "cnt", dstFollows.Count())
 	}
 
-	vis[from.Ref()] = struct{}{}
-
-	return nil
+	return walked, nil
 }
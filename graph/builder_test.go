@@ -8,76 +8,1295 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/dgraph-io/badger"
+	"github.com/go-kit/kit/metrics"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.cryptoscope.co/librarian"
 	"go.cryptoscope.co/luigi"
 	"go.cryptoscope.co/margaret"
 	"go.cryptoscope.co/margaret/multilog"
+	refs "go.mindeco.de/ssb-refs"
 
 	"go.cryptoscope.co/ssb"
 	"go.cryptoscope.co/ssb/internal/ctxutils"
+	"go.cryptoscope.co/ssb/internal/storedrefs"
 	"go.cryptoscope.co/ssb/internal/testutils"
+	"go.cryptoscope.co/ssb/message/legacy"
 	"go.cryptoscope.co/ssb/multilogs"
 	"go.cryptoscope.co/ssb/repo"
 )
 
-func makeBadger(t *testing.T) testStore {
+func makeBadger(t testing.TB) testStore {
+	return makeBadgerWithOpts(t)
+}
+
+func makeBadgerWithOpts(t testing.TB, opts ...BuilderOption) testStore {
 	r := require.New(t)
 	info := testutils.NewRelativeTimeLogger(nil)
 
 	tRepoPath, err := ioutil.TempDir("", "badgerTest")
 	r.NoError(err)
 
-	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+
+	tRepo := repo.New(tRepoPath)
+	tRootLog, err := repo.OpenLog(tRepo)
+	r.NoError(err)
+	// TODO: try this
+	// tRootLog := mem.New()
+	uf, serveUF, err := multilogs.OpenUserFeeds(tRepo)
+	r.NoError(err)
+	ufErrc := serveLog(ctx, "user feeds", tRootLog, serveUF, true)
+
+	var builder *builder
+
+	var tc testStore
+	tc.idxCounter = newTestCounter()
+	_, sinkIdx, serve, err := repo.OpenBadgerIndex(tRepo, "contacts", func(db *badger.DB) (librarian.SeqSetterIndex, librarian.SinkIndex) {
+		builder = NewBuilder(info, db, tc.idxCounter, opts...)
+		return builder.OpenIndex()
+	})
+	r.NoError(err)
+	cErrc := serveLog(ctx, "badgerContacts", tRootLog, serve, true)
+	tc.root = tRootLog
+	tc.gbuilder = builder
+	tc.userLogs = uf
+
+	tc.close = func() {
+		r.NoError(uf.Close())
+		r.NoError(sinkIdx.Close())
+		cancel()
+
+		for err := range mergedErrors(ufErrc, cErrc) {
+			r.NoError(err, "from chan")
+		}
+		t.Log("closed scenary")
+	}
+	return tc
+}
+
+func TestBadger(t *testing.T) {
+	tc := makeBadger(t)
+	t.Run("scene1", tc.theScenario)
+	tc.close()
+}
+
+func TestBuildAsOf(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	myself := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+
+	myself.follow(alice.key.Id)
+	alice.follow(myself.key.Id)
+
+	cutoffV, err := tc.root.Seq().Value()
+	r.NoError(err)
+	cutoff := cutoffV.(margaret.Seq).Seq()
+
+	myself.follow(bob.key.Id)
+	alice.unfollow(myself.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	g, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.True(g.Follows(myself.key.Id, bob.key.Id))
+	r.False(g.Follows(alice.key.Id, myself.key.Id))
+
+	past, err := tc.gbuilder.BuildAsOf(tc.root, cutoff+1)
+	r.NoError(err)
+	r.Equal(2, past.NodeCount())
+	r.True(past.Follows(myself.key.Id, alice.key.Id))
+	r.True(past.Follows(alice.key.Id, myself.key.Id))
+	r.False(past.Follows(myself.key.Id, bob.key.Id), "follow after the cutoff")
+
+	// the live index is untouched
+	g, err = tc.gbuilder.Build()
+	r.NoError(err)
+	r.Equal(3, g.NodeCount())
+	r.True(g.Follows(myself.key.Id, bob.key.Id))
+}
+
+func TestBuildFiltered(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	myself := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	myself.follow(alice.key.Id)
+	myself.follow(bob.key.Id)
+	alice.follow(bob.key.Id)
+	myself.block(claire.key.Id)
+	bob.block(claire.key.Id)
+
+	time.Sleep(time.Second / 10)
+	bld := tc.gbuilder
+
+	g, err := bld.Build()
+	r.NoError(err)
+	r.Equal(5, g.Edges().Len())
+
+	all, err := bld.BuildFiltered(BuildOpts{IncludeFollows: true, IncludeBlocks: true})
+	r.NoError(err)
+	r.Equal(5, all.Edges().Len())
+
+	follows, err := bld.BuildFiltered(BuildOpts{IncludeFollows: true})
+	r.NoError(err)
+	r.Equal(3, follows.Edges().Len())
+	r.True(follows.Follows(alice.key.Id, bob.key.Id))
+	r.False(follows.Blocks(myself.key.Id, claire.key.Id))
+
+	blocks, err := bld.BuildFiltered(BuildOpts{IncludeBlocks: true})
+	r.NoError(err)
+	r.Equal(2, blocks.Edges().Len())
+	r.True(blocks.Blocks(bob.key.Id, claire.key.Id))
+	r.False(blocks.Follows(myself.key.Id, alice.key.Id))
+
+	none, err := bld.BuildFiltered(BuildOpts{})
+	r.NoError(err)
+	r.Equal(0, none.Edges().Len())
+}
+
+func TestCommonFollows(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	a := tc.newPublisher(t)
+	b := tc.newPublisher(t)
+	x := tc.newPublisher(t)
+	y := tc.newPublisher(t)
+	z := tc.newPublisher(t)
+	w := tc.newPublisher(t)
+
+	a.follow(x.key.Id)
+	a.follow(y.key.Id)
+	a.follow(z.key.Id)
+
+	b.follow(y.key.Id)
+	b.follow(z.key.Id)
+	b.follow(w.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	common, err := tc.gbuilder.CommonFollows(a.key.Id, b.key.Id)
+	r.NoError(err)
+	r.Equal(2, common.Count())
+	r.True(common.Has(y.key.Id))
+	r.True(common.Has(z.key.Id))
+	r.False(common.Has(x.key.Id))
+	r.False(common.Has(w.key.Id))
+}
+
+func TestCommunityGaps(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	outsider := tc.newPublisher(t)
+
+	members := ssb.NewFeedSet(5)
+	var community []*publisher
+	for i := 0; i < 5; i++ {
+		m := tc.newPublisher(t)
+		community = append(community, m)
+		r.NoError(members.AddRef(m.key.Id))
+	}
+
+	me.follow(community[0].key.Id)
+	me.follow(community[1].key.Id)
+	me.follow(community[2].key.Id)
+	me.follow(outsider.key.Id)
+	community[3].follow(community[4].key.Id)
+	community[4].follow(outsider.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	gaps, err := tc.gbuilder.CommunityGaps(me.key.Id, members)
+	r.NoError(err)
+	r.Equal(2, gaps.Count())
+	r.True(gaps.Has(community[3].key.Id))
+	r.True(gaps.Has(community[4].key.Id))
+
+	sub, err := tc.gbuilder.BuildSubgraph(members)
+	r.NoError(err)
+	r.Equal(5, sub.Nodes().Len())
+	r.Equal(1, sub.Edges().Len())
+	r.True(sub.Follows(community[3].key.Id, community[4].key.Id))
+	r.False(sub.Follows(community[4].key.Id, outsider.key.Id))
+}
+
+func TestDenyList(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	friend := tc.newPublisher(t)
+	other := tc.newPublisher(t)
+
+	me.follow(friend.key.Id)
+	time.Sleep(time.Second / 10)
+
+	auth := tc.gbuilder.Authorizer(me.key.Id, 2)
+	r.NoError(auth.Authorize(friend.key.Id))
+
+	r.NoError(tc.gbuilder.AddDeny(friend.key.Id))
+
+	// still a friend, but denied
+	g, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.True(g.Follows(me.key.Id, friend.key.Id))
+	r.False(g.Blocks(me.key.Id, friend.key.Id))
+
+	err = auth.Authorize(friend.key.Id)
+	r.Error(err)
+	var denied ssb.ErrDenied
+	r.True(errors.As(err, &denied), "wrong error: %v", err)
+	r.True(denied.Who.Equal(friend.key.Id))
+	r.Contains(err.Error(), "administratively denied")
+
+	r.NoError(tc.gbuilder.RemoveDeny(friend.key.Id))
+	r.NoError(auth.Authorize(friend.key.Id))
+
+	r.NoError(tc.gbuilder.WithDenyList([]*refs.FeedRef{friend.key.Id, other.key.Id}))
+	lst, err := tc.gbuilder.DenyList()
+	r.NoError(err)
+	r.Equal(2, lst.Count())
+
+	// the list is stored with the contacts and doesn't show up in the graph
+	reopened := NewBuilder(testutils.NewRelativeTimeLogger(nil), tc.gbuilder.(*builder).kv, nil)
+	isDenied, err := reopened.IsDenied(friend.key.Id)
+	r.NoError(err)
+	r.True(isDenied)
+	g, err = reopened.Build()
+	r.NoError(err)
+	r.Equal(2, g.NodeCount())
+
+	r.NoError(tc.gbuilder.WithDenyList(nil))
+	isDenied, err = tc.gbuilder.IsDenied(other.key.Id)
+	r.NoError(err)
+	r.False(isDenied)
+}
+
+func TestRankFeedsForPeer(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	peer := tc.newPublisher(t)
+	a := tc.newPublisher(t)
+	b := tc.newPublisher(t)
+	c := tc.newPublisher(t)
+	mutual := tc.newPublisher(t)
+	stranger := tc.newPublisher(t)
+
+	peer.follow(a.key.Id)
+	a.follow(b.key.Id)
+	b.follow(c.key.Id)
+	peer.follow(mutual.key.Id)
+	mutual.follow(peer.key.Id)
+	stranger.follow(a.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	feeds := ssb.NewFeedSet(6)
+	for _, p := range []*publisher{c, stranger, b, a, mutual, peer} {
+		r.NoError(feeds.AddRef(p.key.Id))
+	}
+
+	ranked, err := tc.gbuilder.RankFeedsForPeer(peer.key.Id, feeds)
+	r.NoError(err)
+	r.Len(ranked, 6)
+
+	want := []*publisher{peer, mutual, a, b, c, stranger}
+	for i, p := range want {
+		r.True(p.key.Id.Equal(ranked[i]), "wrong feed at %d: %s", i, ranked[i].ShortRef())
+	}
+
+	// a peer that isn't in the graph yet still gets all the feeds
+	newcomer := tc.newPublisher(t)
+	ranked, err = tc.gbuilder.RankFeedsForPeer(newcomer.key.Id, feeds)
+	r.NoError(err)
+	r.Len(ranked, 6)
+}
+
+func TestReciprocityRate(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	lonely := tc.newPublisher(t)
+
+	var friends []*publisher
+	for i := 0; i < 4; i++ {
+		f := tc.newPublisher(t)
+		me.follow(f.key.Id)
+		friends = append(friends, f)
+	}
+	for _, f := range friends[:3] {
+		f.follow(me.key.Id)
+	}
+	// not a follow back
+	friends[3].follow(friends[0].key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	rate, err := tc.gbuilder.ReciprocityRate(me.key.Id)
+	r.NoError(err)
+	r.Equal(0.75, rate)
+
+	rate, err = tc.gbuilder.ReciprocityRate(lonely.key.Id)
+	r.NoError(err)
+	r.Equal(0.0, rate)
+}
+
+func TestPopularAmongFollows(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	var mine []*publisher
+	for i := 0; i < 4; i++ {
+		p := tc.newPublisher(t)
+		me.follow(p.key.Id)
+		mine = append(mine, p)
+	}
+	popular := tc.newPublisher(t)
+	lonely := tc.newPublisher(t)
+	blocked := tc.newPublisher(t)
+
+	for _, p := range mine[:3] {
+		p.follow(popular.key.Id)
+	}
+	mine[0].follow(lonely.key.Id)
+	for _, p := range mine {
+		p.follow(blocked.key.Id)
+		p.follow(me.key.Id)
+	}
+	me.block(blocked.key.Id)
+
+	// my follows follow each other, too
+	mine[1].follow(mine[0].key.Id)
+	time.Sleep(time.Second / 10)
+
+	set, err := tc.gbuilder.PopularAmongFollows(me.key.Id, 0.5)
+	r.NoError(err)
+	r.True(set.Has(popular.key.Id))
+	r.False(set.Has(lonely.key.Id))
+	r.False(set.Has(blocked.key.Id), "blocked by me")
+	r.False(set.Has(me.key.Id))
+	r.False(set.Has(mine[0].key.Id), "already followed")
+	r.Equal(1, set.Count())
+
+	set, err = tc.gbuilder.PopularAmongFollows(me.key.Id, 1)
+	r.NoError(err)
+	r.Equal(0, set.Count())
+
+	_, err = tc.gbuilder.PopularAmongFollows(me.key.Id, 0)
+	r.Error(err)
+}
+
+func TestNeighborhoodGraph(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	me.follow(alice.key.Id)
+	alice.follow(bob.key.Id)
+	bob.follow(claire.key.Id)
+	time.Sleep(time.Second / 10)
+
+	g, err := tc.gbuilder.NeighborhoodGraph(me.key.Id, 1)
+	r.NoError(err)
+	r.Equal(3, g.NodeCount())
+	r.True(g.Follows(alice.key.Id, bob.key.Id))
+
+	again, err := tc.gbuilder.NeighborhoodGraph(me.key.Id, 1)
+	r.NoError(err)
+	r.True(g == again, "expected the cached graph")
+
+	other, err := tc.gbuilder.NeighborhoodGraph(me.key.Id, 2)
+	r.NoError(err)
+	r.True(g != other, "the hops are part of the key")
+	r.Equal(4, other.NodeCount())
+
+	// a new follow drops the cached graphs
+	me.follow(claire.key.Id)
+	time.Sleep(time.Second / 10)
+
+	updated, err := tc.gbuilder.NeighborhoodGraph(me.key.Id, 1)
+	r.NoError(err)
+	r.True(g != updated, "expected a new graph after the follow")
+	r.Equal(4, updated.NodeCount())
+	r.True(updated.Follows(me.key.Id, claire.key.Id))
+}
+
+func TestNeighborhoodCacheEviction(t *testing.T) {
+	r := require.New(t)
+
+	nc := newNeighborhoodCache(2)
+	a, b, c := neighborhoodKey{"a", 1}, neighborhoodKey{"b", 1}, neighborhoodKey{"c", 1}
+
+	_, gen, _ := nc.get(a)
+	nc.put(a, NewGraph(), gen)
+	nc.put(b, NewGraph(), gen)
+
+	// using a makes b the least recently used one
+	_, _, has := nc.get(a)
+	r.True(has)
+	nc.put(c, NewGraph(), gen)
+	r.Equal(2, nc.len())
+	_, _, has = nc.get(b)
+	r.False(has, "b should be evicted")
+	_, _, has = nc.get(a)
+	r.True(has)
+
+	// graphs built before a purge aren't stored
+	nc.purge()
+	nc.put(a, NewGraph(), gen)
+	r.Equal(0, nc.len())
+}
+
+func TestReadOnlyBuilder(t *testing.T) {
+	r := require.New(t)
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	dir, err := ioutil.TempDir("", "readOnlyTest")
+	r.NoError(err)
+
+	alice, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+	bob, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	// write a follow with a normal builder first
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	r.NoError(err)
+	rw := NewBuilder(info, db, nil)
+	addr := librarian.Addr(storedrefs.Feed(alice.Id) + storedrefs.Feed(bob.Id))
+	r.NoError(rw.idx.Set(context.TODO(), addr, 1))
+	r.NoError(db.Close())
+
+	ro, err := NewReadOnlyBuilder(info, dir)
+	r.NoError(err)
+	defer ro.Close()
+
+	roIdx, _ := ro.OpenIndex()
+	r.True(errors.Is(roIdx.Set(context.TODO(), addr, 0), ErrReadOnly))
+	r.True(errors.Is(roIdx.Delete(context.TODO(), addr), ErrReadOnly))
+
+	r.True(errors.Is(ro.DeleteAuthor(alice.Id), ErrReadOnly))
+	r.True(errors.Is(ro.AddDeny(bob.Id), ErrReadOnly))
+
+	g, err := ro.Build()
+	r.NoError(err)
+	r.True(g.Follows(alice.Id, bob.Id))
+
+	follows, err := ro.Follows(alice.Id)
+	r.NoError(err)
+	r.Equal(1, follows.Count())
+
+	hops := ro.Hops(alice.Id, 1)
+	r.NotNil(hops)
+	r.True(hops.Has(bob.Id))
+}
+
+func TestCloseSyncsContacts(t *testing.T) {
+	r := require.New(t)
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	dir, err := ioutil.TempDir("", "closeTest")
+	r.NoError(err)
+
+	alice, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	var followed []*refs.FeedRef
+	for i := 0; i < 5; i++ {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		followed = append(followed, kp.Id)
+	}
+
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	r.NoError(err)
+	b := NewBuilder(info, db, nil)
+
+	contact := func(seq int, to *refs.FeedRef) legacy.StoredMessage {
+		return legacy.StoredMessage{
+			Author_:   alice.Id,
+			Sequence_: margaret.BaseSeq(seq),
+			Raw_:      []byte(`{"content":{"type":"contact","contact":"` + to.Ref() + `","following":true}}`),
+		}
+	}
+	for i, f := range followed {
+		err := b.indexUpdateFunc(context.TODO(), margaret.BaseSeq(i), contact(i+1, f), b.idx)
+		r.NoError(err)
+	}
+
+	r.NoError(b.Close())
+	r.NoError(b.Close(), "closing twice failed")
+	err = b.indexUpdateFunc(context.TODO(), margaret.BaseSeq(5), contact(6, alice.Id), b.idx)
+	r.True(errors.Is(err, ErrClosed), "wrong error: %v", err)
+	r.NoError(db.Close())
+
+	db, err = badger.Open(opts)
+	r.NoError(err)
+	defer db.Close()
+
+	follows, err := NewBuilder(info, db, nil).Follows(alice.Id)
+	r.NoError(err)
+	r.Equal(len(followed), follows.Count())
+	for _, f := range followed {
+		r.True(follows.Has(f), "lost follow of %s", f.ShortRef())
+	}
+}
+
+func TestSwapDB(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	alice.follow(bob.key.Id)
+	bob.follow(alice.key.Id)
+	bob.follow(claire.key.Id)
+	claire.block(alice.key.Id)
+	time.Sleep(time.Second / 10)
+
+	before, err := tc.gbuilder.Build()
+	r.NoError(err)
+
+	b := tc.gbuilder.(*builder)
+	oldDB := b.kv
+
+	// copy everything over to a fresh database, like a compaction would
+	dir, err := ioutil.TempDir("", "swapTest")
+	r.NoError(err)
+	opts := badger.DefaultOptions(dir)
+	opts.Logger = nil
+	newDB, err := badger.Open(opts)
+	r.NoError(err)
+	// after tc.close, which stops the index on it
+	t.Cleanup(func() { newDB.Close() })
+
+	err = oldDB.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		return newDB.Update(func(wtxn *badger.Txn) error {
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				it := iter.Item()
+				v, err := it.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if err := wtxn.Set(it.KeyCopy(nil), v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	r.NoError(err)
+
+	returned, err := b.SwapDB(newDB)
+	r.NoError(err)
+	r.True(returned == oldDB)
+	r.NoError(returned.Close())
+
+	after, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.True(before != after, "expected the cached graph to be dropped")
+	r.Equal(before.NodeCount(), after.NodeCount())
+	r.Equal(before.Edges().Len(), after.Edges().Len())
+	for _, from := range []*publisher{alice, bob, claire} {
+		for _, to := range []*publisher{alice, bob, claire} {
+			r.Equal(before.Follows(from.key.Id, to.key.Id), after.Follows(from.key.Id, to.key.Id))
+			r.Equal(before.Blocks(from.key.Id, to.key.Id), after.Blocks(from.key.Id, to.key.Id))
+		}
+	}
+
+	// new contacts are written to the new database
+	claire.follow(bob.key.Id)
+	time.Sleep(time.Second / 10)
+	follows, err := tc.gbuilder.Follows(claire.key.Id)
+	r.NoError(err)
+	r.True(follows.Has(bob.key.Id))
+
+	_, err = b.SwapDB(nil)
+	r.Error(err)
+}
+
+func TestSelfTest(t *testing.T) {
+	r := require.New(t)
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	tRepoPath, err := ioutil.TempDir("", "selfTest")
+	r.NoError(err)
+	defer os.RemoveAll(tRepoPath)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	tRepo := repo.New(tRepoPath)
+	tRootLog, err := repo.OpenLog(tRepo)
+	r.NoError(err)
+
+	uf, serveUF, err := multilogs.OpenUserFeeds(tRepo)
+	r.NoError(err)
+	defer uf.Close()
+	serveLog(ctx, "user feeds", tRootLog, serveUF, true)
+
+	var bld *builder
+	_, sinkIdx, serve, err := repo.OpenBadgerIndex(tRepo, "contacts", func(db *badger.DB) (librarian.SeqSetterIndex, librarian.SinkIndex) {
+		bld = NewBuilder(info, db, nil)
+		return bld.OpenIndex()
+	})
+	r.NoError(err)
+	defer sinkIdx.Close()
+
+	alice := newPublisher(t, tRootLog, uf)
+	bob := newPublisher(t, tRootLog, uf)
+	alice.follow(bob.key.Id)
+	bob.follow(alice.key.Id)
+
+	// the contact index wasn't served yet, so it lags behind
+	needsReindex, err := bld.SelfTest(ctx, tRootLog)
+	r.NoError(err)
+	r.True(needsReindex)
+
+	errc := serveLog(ctx, "contacts", tRootLog, serve, false)
+	r.NoError(<-errc)
+
+	needsReindex, err = bld.SelfTest(ctx, tRootLog)
+	r.NoError(err)
+	r.False(needsReindex)
+}
+
+func TestFollowsStreamCancel(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	pub := tc.newPublisher(t)
+	for i := 0; i < 20; i++ {
+		other := tc.newPublisher(t)
+		pub.follow(other.key.Id)
+	}
+	time.Sleep(time.Second / 10)
+
+	var all int
+	err := tc.gbuilder.FollowsStream(context.TODO(), pub.key.Id, func(*refs.FeedRef) error {
+		all++
+		return nil
+	})
+	r.NoError(err)
+	r.Equal(20, all)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	var seen int
+	err = tc.gbuilder.FollowsStream(ctx, pub.key.Id, func(*refs.FeedRef) error {
+		seen++
+		if seen == 3 {
+			cancel()
+		}
+		return nil
+	})
+	r.True(errors.Is(err, context.Canceled), "wrong error: %v", err)
+	r.Equal(3, seen, "scan didn't stop")
+}
+
+func TestFollowedButBlockedBy(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	x := tc.newPublisher(t)
+	y := tc.newPublisher(t)
+	z := tc.newPublisher(t)
+
+	// x: I follow them and they block me
+	me.follow(x.key.Id)
+	x.block(me.key.Id)
+
+	// y: blocks me but I don't follow them
+	y.block(me.key.Id)
+
+	// z: I follow them and they follow me
+	me.follow(z.key.Id)
+	z.follow(me.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	blockedBy, err := tc.gbuilder.FollowedButBlockedBy(me.key.Id)
+	r.NoError(err)
+	r.Equal(1, blockedBy.Count())
+	r.True(blockedBy.Has(x.key.Id))
+	r.False(blockedBy.Has(y.key.Id))
+	r.False(blockedBy.Has(z.key.Id))
+}
+
+func TestOrphans(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	alice.follow(bob.key.Id)
+	bob.follow(alice.key.Id)
+	claire.follow(bob.key.Id)
+
+	time.Sleep(time.Second / 10)
+	bld := tc.gbuilder
+
+	g, err := bld.BuildFiltered(BuildOpts{IncludeFollows: true, IncludeBlocks: true, TrackOrphans: true})
+	r.NoError(err)
+	r.Len(g.Orphans(), 0)
+
+	// bob's own records are gone but the edges pointing to him are left
+	r.NoError(bld.DeleteAuthor(bob.key.Id))
+
+	g, err = bld.Build()
+	r.NoError(err)
+	r.Len(g.Orphans(), 0, "not tracked by default")
+
+	g, err = bld.BuildFiltered(BuildOpts{IncludeFollows: true, IncludeBlocks: true, TrackOrphans: true})
+	r.NoError(err)
+	orphans := g.Orphans()
+	r.Len(orphans, 1)
+	r.True(orphans[0].Equal(bob.key.Id))
+	r.True(g.Follows(claire.key.Id, bob.key.Id), "edges to orphans are kept")
+}
+
+func TestDeleteAuthorDuringBuild(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	bob := tc.newPublisher(t)
+	var followed []*refs.FeedRef
+	for i := 0; i < 5; i++ {
+		p := tc.newPublisher(t)
+		bob.follow(p.key.Id)
+		followed = append(followed, p.key.Id)
+	}
+
+	time.Sleep(time.Second / 10)
+	bld := tc.gbuilder
+
+	live, err := bld.LiveReplicationSet(bob.key.Id, 1)
+	r.NoError(err)
+	defer live.Close()
+
+	// every graph has all of bob's follows or none of them
+	countFollows := func(g *Graph) int {
+		n := 0
+		for _, f := range followed {
+			if g.Follows(bob.key.Id, f) {
+				n++
+			}
+		}
+		return n
+	}
+
+	var (
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+		partial = make(chan int, 8)
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var g *Graph
+				var err error
+				if i%2 == 0 {
+					g, err = bld.Build()
+				} else {
+					g, err = bld.BuildFiltered(BuildOpts{IncludeFollows: true})
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n := countFollows(g); n != 0 && n != len(followed) {
+					partial <- n
+					return
+				}
+				bld.Hops(bob.key.Id, 1)
+				live.Has(followed[0])
+			}
+		}(i)
+	}
+
+	time.Sleep(time.Second / 20)
+	r.NoError(bld.DeleteAuthor(bob.key.Id))
+	time.Sleep(time.Second / 20)
+	close(done)
+	wg.Wait()
+
+	select {
+	case n := <-partial:
+		t.Fatalf("built a graph with %d of %d follows", n, len(followed))
+	default:
+	}
+
+	g, err := bld.Build()
+	r.NoError(err)
+	r.Equal(0, countFollows(g), "deleted follows came back")
+
+	follows, err := bld.Follows(bob.key.Id)
+	r.NoError(err)
+	r.Equal(0, follows.Count())
+	hops := bld.Hops(bob.key.Id, 1)
+	r.NotNil(hops)
+	for _, f := range followed {
+		r.False(hops.Has(f))
+		r.False(live.Has(f))
+	}
+}
+
+func TestPruneBeyondHops(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	eve := tc.newPublisher(t)
+	carl := tc.newPublisher(t)
+	dan := tc.newPublisher(t)
+
+	// in range: alice is a friend, bob is followed by her and follows eve
+	me.follow(alice.key.Id)
+	alice.follow(me.key.Id)
+	alice.follow(bob.key.Id)
+	bob.follow(eve.key.Id)
+
+	// out of range: carl and dan only know each other
+	carl.follow(dan.key.Id)
+	dan.follow(carl.key.Id)
+
+	time.Sleep(time.Second / 10)
+	bld := tc.gbuilder
+
+	before := bld.Hops(me.key.Id, 1)
+	r.NotNil(before)
+	r.True(before.Has(bob.key.Id))
+
+	n, err := bld.PruneBeyondHops(me.key.Id, 1)
+	r.NoError(err)
+	r.Equal(2, n)
+
+	g, err := bld.Build()
+	r.NoError(err)
+	r.False(g.Follows(carl.key.Id, dan.key.Id))
+	r.False(g.Follows(dan.key.Id, carl.key.Id))
+	r.True(g.Follows(me.key.Id, alice.key.Id))
+	r.True(g.Follows(alice.key.Id, me.key.Id))
+	r.True(g.Follows(alice.key.Id, bob.key.Id))
+	r.True(g.Follows(bob.key.Id, eve.key.Id))
+
+	after := bld.Hops(me.key.Id, 1)
+	r.NotNil(after)
+	r.Equal(before.Count(), after.Count())
+	r.True(after.Has(bob.key.Id))
+
+	// nothing left to prune
+	n, err = bld.PruneBeyondHops(me.key.Id, 1)
+	r.NoError(err)
+	r.Equal(0, n)
+}
+
+func TestEdgeProvenance(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	followRef, err := alice.publish.Publish(refs.NewContactFollow(bob.key.Id))
+	r.NoError(err)
+	_, err = alice.publish.Publish(map[string]interface{}{"type": "post", "text": "hello"})
+	r.NoError(err)
+	claire.follow(bob.key.Id)
+
+	time.Sleep(time.Second / 10)
+	bld := tc.gbuilder
+
+	ref, seq, err := bld.EdgeProvenance(context.Background(), alice.key.Id, bob.key.Id, tc.root, tc.userLogs)
+	r.NoError(err)
+	r.True(followRef.Equal(ref), "wrong message: %s", ref.Ref())
+	r.EqualValues(1, seq)
+
+	// the latest message about bob replaces the follow
+	blockRef, err := alice.publish.Publish(refs.NewContactBlock(bob.key.Id))
+	r.NoError(err)
+
+	ref, seq, err = bld.EdgeProvenance(context.Background(), alice.key.Id, bob.key.Id, tc.root, tc.userLogs)
+	r.NoError(err)
+	r.True(blockRef.Equal(ref), "wrong message: %s", ref.Ref())
+	r.EqualValues(3, seq)
+
+	_, _, err = bld.EdgeProvenance(context.Background(), bob.key.Id, alice.key.Id, tc.root, tc.userLogs)
+	r.True(errors.Is(err, ErrNoProvenance), "wrong error: %v", err)
+}
+
+func TestClassify(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	following := tc.newPublisher(t)
+	follower := tc.newPublisher(t)
+	friend := tc.newPublisher(t)
+	blocked := tc.newPublisher(t)
+	none := tc.newPublisher(t)
+
+	me.follow(following.key.Id)
+	follower.follow(me.key.Id)
+	me.follow(friend.key.Id)
+	friend.follow(me.key.Id)
+	me.block(blocked.key.Id)
+	blocked.follow(me.key.Id)
+	// blocking me doesn't make a relationship
+	none.block(me.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	feeds := []*refs.FeedRef{
+		following.key.Id,
+		follower.key.Id,
+		friend.key.Id,
+		blocked.key.Id,
+		none.key.Id,
+	}
+	classes, err := tc.gbuilder.Classify(me.key.Id, feeds)
+	r.NoError(err)
+	r.Equal(map[string]Relationship{
+		following.key.Id.Ref(): RelationshipFollowing,
+		follower.key.Id.Ref():  RelationshipFollower,
+		friend.key.Id.Ref():    RelationshipFriend,
+		blocked.key.Id.Ref():   RelationshipBlocked,
+		none.key.Id.Ref():      RelationshipNone,
+	}, classes)
+	r.Equal("friend", classes[friend.key.Id.Ref()].String())
+}
+
+func TestDoesFollowAndBlock(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+	dan := tc.newPublisher(t)
+
+	alice.follow(bob.key.Id)
+	alice.block(claire.key.Id)
+	// a follow that was taken back
+	alice.follow(dan.key.Id)
+	alice.unfollow(dan.key.Id)
+	time.Sleep(time.Second / 10)
+
+	for _, c := range []struct {
+		to              *refs.FeedRef
+		follows, blocks bool
+	}{
+		{bob.key.Id, true, false},
+		{claire.key.Id, false, true},
+		{dan.key.Id, false, false},
+		// no contact at all
+		{alice.key.Id, false, false},
+	} {
+		follows, err := tc.gbuilder.DoesFollow(alice.key.Id, c.to)
+		r.NoError(err)
+		r.Equal(c.follows, follows, "wrong follow state for %s", c.to.ShortRef())
+
+		blocks, err := tc.gbuilder.DoesBlock(alice.key.Id, c.to)
+		r.NoError(err)
+		r.Equal(c.blocks, blocks, "wrong block state for %s", c.to.ShortRef())
+	}
+
+	// the other direction has no contacts
+	follows, err := tc.gbuilder.DoesFollow(bob.key.Id, alice.key.Id)
+	r.NoError(err)
+	r.False(follows)
+}
+
+func TestExpiringFollow(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+	dan := tc.newPublisher(t)
+
+	followUntil := func(to *refs.FeedRef, until time.Time) {
+		_, err := alice.publish.Append(map[string]interface{}{
+			"type":      "contact",
+			"contact":   to.Ref(),
+			"following": true,
+			"expires":   until.UnixNano() / int64(time.Millisecond),
+		})
+		r.NoError(err)
+	}
+	followUntil(bob.key.Id, time.Now().Add(1500*time.Millisecond))
+	// already over when it's indexed
+	followUntil(claire.key.Id, time.Now().Add(-time.Minute))
+	alice.follow(dan.key.Id)
+	time.Sleep(time.Second / 10)
+
+	follows, err := tc.gbuilder.Follows(alice.key.Id)
+	r.NoError(err)
+	r.True(follows.Has(bob.key.Id))
+	r.False(follows.Has(claire.key.Id))
+	g, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.True(g.Follows(alice.key.Id, bob.key.Id))
+
+	r.Eventually(func() bool {
+		follows, err := tc.gbuilder.Follows(alice.key.Id)
+		r.NoError(err)
+		return !follows.Has(bob.key.Id)
+	}, 5*time.Second, 100*time.Millisecond, "follow didn't expire")
+
+	follows, err = tc.gbuilder.Follows(alice.key.Id)
+	r.NoError(err)
+	r.True(follows.Has(dan.key.Id), "the normal follow is gone, too")
+
+	// the cached graph was dropped
+	r.Eventually(func() bool {
+		g, err := tc.gbuilder.Build()
+		r.NoError(err)
+		return !g.Follows(alice.key.Id, bob.key.Id)
+	}, time.Second, 50*time.Millisecond, "graph still has the expired follow")
+	g, err = tc.gbuilder.Build()
+	r.NoError(err)
+	r.True(g.Follows(alice.key.Id, dan.key.Id))
+}
+
+func TestFollowTTL(t *testing.T) {
+	r := require.New(t)
+	now := time.Unix(1600000000, 0)
+
+	ttl, expired := followTTL([]byte(`{"type":"contact"}`), now)
+	r.False(expired)
+	r.Zero(ttl)
+
+	ttl, expired = followTTL([]byte(`{"expires":1600000060000}`), now)
+	r.False(expired)
+	r.Equal(time.Minute, ttl)
+
+	_, expired = followTTL([]byte(`{"expires":1599999999999}`), now)
+	r.True(expired)
+
+	// far in the future instead of wrapping around into the past
+	ttl, expired = followTTL([]byte(`{"expires":9223372036854775807}`), now)
+	r.False(expired)
+	r.Equal(time.Duration(math.MaxInt64), ttl)
+}
+
+func TestIndexMetrics(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	alice.follow(bob.key.Id)
+	alice.block(claire.key.Id)
+	alice.unfollow(bob.key.Id)
+	_, err := alice.publish.Append(map[string]interface{}{"type": "post", "text": "not a contact"})
+	r.NoError(err)
+	_, err = alice.publish.Append(map[string]interface{}{"type": "contact", "contact": "not a feed", "following": true})
+	r.NoError(err)
+
+	time.Sleep(time.Second / 10)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+	err = b.indexUpdateFunc(context.TODO(), margaret.BaseSeq(0), "not a message", nil)
+	r.Error(err)
+
+	for evt, want := range map[string]float64{
+		idxEventSkippedNonMsg: 2, // the post and the value that isn't a message
+		idxEventSkippedParse:  1,
+		idxEventFollow:        1,
+		idxEventBlock:         1,
+		idxEventUnfollow:      1,
+	} {
+		r.Equal(want, tc.idxCounter.value("event", evt), "wrong count for %s", evt)
+	}
+}
+
+func TestIndexInvalidRefs(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+
+	raw := []byte(`{"content":{"type":"contact","contact":"` + bob.key.Id.Ref() + `","following":true}}`)
+	for i, author := range []*refs.FeedRef{
+		{ID: alice.key.Id.ID[:5], Algo: refs.RefAlgoFeedSSB1},
+		{ID: alice.key.Id.ID, Algo: "bamboo"},
+	} {
+		msg := legacy.StoredMessage{
+			Author_:   author,
+			Sequence_: margaret.BaseSeq(1),
+			Raw_:      raw,
+		}
+		err := b.indexUpdateFunc(context.TODO(), margaret.BaseSeq(i), msg, b.idx)
+		r.NoError(err)
+	}
+	r.Equal(float64(2), tc.idxCounter.value("event", idxEventSkippedRef))
+	r.Equal(float64(0), tc.idxCounter.value("event", idxEventFollow))
+
+	// nothing was indexed for them
+	g, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.Equal(0, g.NodeCount())
+
+	// contacts are checked the same way
+	r.Error(checkFeedRef(&refs.FeedRef{ID: bob.key.Id.ID[:31], Algo: refs.RefAlgoFeedSSB1}))
+	r.Error(checkFeedRef(nil))
+	r.NoError(checkFeedRef(bob.key.Id))
+}
+
+func TestIndexOutOfOrderContacts(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+
+	var rxSeq int64
+	index := func(seq int64, content string) {
+		msg := legacy.StoredMessage{
+			Author_:   alice.key.Id,
+			Sequence_: margaret.BaseSeq(seq),
+			Raw_:      []byte(`{"content":{"type":"contact","contact":"` + bob.key.Id.Ref() + `",` + content + `}}`),
+		}
+		err := b.indexUpdateFunc(context.TODO(), margaret.BaseSeq(rxSeq), msg, b.idx)
+		r.NoError(err)
+		rxSeq++
+	}
+
+	// the block is processed before the older follow
+	index(5, `"blocking":true`)
+	index(3, `"following":true`)
 
-	tRepo := repo.New(tRepoPath)
-	tRootLog, err := repo.OpenLog(tRepo)
-	r.NoError(err)
-	// TODO: try this
-	// tRootLog := mem.New()
-	uf, serveUF, err := multilogs.OpenUserFeeds(tRepo)
+	g, err := tc.gbuilder.Build()
 	r.NoError(err)
-	ufErrc := serveLog(ctx, "user feeds", tRootLog, serveUF, true)
-
-	var builder *builder
+	r.True(g.Blocks(alice.key.Id, bob.key.Id), "older follow replaced the block")
+	r.False(g.Follows(alice.key.Id, bob.key.Id))
+	r.Equal(float64(1), tc.idxCounter.value("event", idxEventSkippedStale))
 
-	var tc testStore
-	_, sinkIdx, serve, err := repo.OpenBadgerIndex(tRepo, "contacts", func(db *badger.DB) (librarian.SeqSetterIndex, librarian.SinkIndex) {
-		builder = NewBuilder(info, db)
-		return builder.OpenIndex()
-	})
+	// a newer one still counts
+	index(6, `"following":true`)
+	g, err = tc.gbuilder.Build()
 	r.NoError(err)
-	cErrc := serveLog(ctx, "badgerContacts", tRootLog, serve, true)
-	tc.root = tRootLog
-	tc.gbuilder = builder
-	tc.userLogs = uf
+	r.True(g.Follows(alice.key.Id, bob.key.Id))
+	r.False(g.Blocks(alice.key.Id, bob.key.Id))
+}
 
-	tc.close = func() {
-		r.NoError(uf.Close())
-		r.NoError(sinkIdx.Close())
-		cancel()
+// testCounter is a metrics.Counter that keeps the values for each set of labels
+type testCounter struct {
+	mu     *sync.Mutex
+	values map[string]float64
+	lvs    []string
+}
 
-		for err := range mergedErrors(ufErrc, cErrc) {
-			r.NoError(err, "from chan")
-		}
-		t.Log("closed scenary")
+func newTestCounter() *testCounter {
+	return &testCounter{
+		mu:     new(sync.Mutex),
+		values: make(map[string]float64),
 	}
-	return tc
 }
 
-func TestBadger(t *testing.T) {
-	tc := makeBadger(t)
-	t.Run("scene1", tc.theScenario)
-	tc.close()
+func (tc *testCounter) With(labelValues ...string) metrics.Counter {
+	return &testCounter{
+		mu:     tc.mu,
+		values: tc.values,
+		lvs:    append(append([]string{}, tc.lvs...), labelValues...),
+	}
+}
+
+func (tc *testCounter) Add(delta float64) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.values[strings.Join(tc.lvs, ",")] += delta
 }
 
-func makeTypedLog(t *testing.T) testStore {
+func (tc *testCounter) value(labelValues ...string) float64 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.values[strings.Join(labelValues, ",")]
+}
+
+func makeTypedLog(t testing.TB) testStore {
 	r := require.New(t)
 	// info := testutils.NewRelativeTimeLogger(nil)
 
@@ -138,10 +1357,13 @@ type testStore struct {
 
 	gbuilder Builder
 
+	// idxCounter is only set for badger backed stores
+	idxCounter *testCounter
+
 	close func()
 }
 
-func (tc testStore) newPublisher(t *testing.T) *publisher {
+func (tc testStore) newPublisher(t testing.TB) *publisher {
 	return newPublisher(t, tc.root, tc.userLogs)
 }
 
@@ -297,3 +1519,535 @@ func mergedErrors(cs ...<-chan error) <-chan error {
 	}()
 	return out
 }
+
+func TestImportEdges(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	me.follow(claire.key.Id)
+	time.Sleep(time.Second / 10)
+
+	err := tc.gbuilder.ImportEdges([]Edge{
+		{From: me.key.Id, To: alice.key.Id, State: EdgeFollow},
+		{From: alice.key.Id, To: me.key.Id, State: EdgeFollow},
+		{From: alice.key.Id, To: bob.key.Id, State: EdgeFollow},
+		// already verified, has to be skipped
+		{From: me.key.Id, To: claire.key.Id, State: EdgeBlock},
+	})
+	r.NoError(err)
+
+	set := tc.gbuilder.Hops(me.key.Id, 1)
+	r.NotNil(set)
+	r.True(set.Has(alice.key.Id))
+	r.True(set.Has(bob.key.Id))
+	r.True(set.Has(claire.key.Id))
+
+	b := tc.gbuilder.(*builder)
+	imported, err := b.isImported(me.key.Id, alice.key.Id)
+	r.NoError(err)
+	r.True(imported)
+	imported, err = b.isImported(me.key.Id, claire.key.Id)
+	r.NoError(err)
+	r.False(imported)
+
+	// the real contact message replaces the imported edge
+	me.unfollow(alice.key.Id)
+	time.Sleep(time.Second / 10)
+
+	imported, err = b.isImported(me.key.Id, alice.key.Id)
+	r.NoError(err)
+	r.False(imported)
+
+	set = tc.gbuilder.Hops(me.key.Id, 1)
+	r.NotNil(set)
+	r.False(set.Has(alice.key.Id))
+	r.False(set.Has(bob.key.Id))
+	r.True(set.Has(claire.key.Id))
+
+	err = tc.gbuilder.ImportEdges([]Edge{{From: me.key.Id, To: bob.key.Id, State: 3}})
+	r.Error(err)
+}
+
+func TestComponents(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	var left, right []*publisher
+	for i := 0; i < 3; i++ {
+		left = append(left, tc.newPublisher(t))
+	}
+	for i := 0; i < 2; i++ {
+		right = append(right, tc.newPublisher(t))
+	}
+
+	left[0].follow(left[1].key.Id)
+	left[2].follow(left[1].key.Id)
+	right[0].follow(right[1].key.Id)
+	right[1].follow(right[0].key.Id)
+
+	// blocks don't connect the clusters
+	left[0].block(right[0].key.Id)
+	time.Sleep(time.Second / 10)
+
+	comps, err := tc.gbuilder.Components()
+	r.NoError(err)
+	r.Len(comps, 2)
+
+	r.ElementsMatch(pubRefs(left), refStrings(comps[0]))
+	r.ElementsMatch(pubRefs(right), refStrings(comps[1]))
+
+	// one follow joins them
+	right[1].follow(left[2].key.Id)
+	time.Sleep(time.Second / 10)
+
+	comps, err = tc.gbuilder.Components()
+	r.NoError(err)
+	r.Len(comps, 1)
+	r.Len(comps[0], 5)
+}
+
+func pubRefs(pubs []*publisher) []string {
+	refs := make([]string, len(pubs))
+	for i, p := range pubs {
+		refs[i] = p.key.Id.Ref()
+	}
+	return refs
+}
+
+func TestPathToFollow(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	// a line of follows: line[0] -> line[1] -> ... -> line[4]
+	var line []*publisher
+	for i := 0; i < 5; i++ {
+		line = append(line, tc.newPublisher(t))
+	}
+	for i := 0; i < len(line)-1; i++ {
+		line[i].follow(line[i+1].key.Id)
+	}
+	blocked := tc.newPublisher(t)
+	line[4].block(blocked.key.Id)
+	time.Sleep(time.Second / 10)
+
+	chain, err := tc.gbuilder.PathToFollow(line[0].key.Id, line[4].key.Id, 3)
+	r.NoError(err)
+	r.Equal(pubRefs(line[1:]), refStrings(chain))
+
+	chain, err = tc.gbuilder.PathToFollow(line[0].key.Id, line[1].key.Id, 0)
+	r.NoError(err)
+	r.Equal(pubRefs(line[1:2]), refStrings(chain))
+
+	_, err = tc.gbuilder.PathToFollow(line[0].key.Id, line[4].key.Id, 2)
+	r.True(errors.Is(err, ErrNoFollowPath), "wrong error: %v", err)
+
+	_, err = tc.gbuilder.PathToFollow(line[0].key.Id, blocked.key.Id, 10)
+	r.True(errors.Is(err, ErrNoFollowPath), "wrong error: %v", err)
+
+	// nothing is reachable against the direction of the follows
+	_, err = tc.gbuilder.PathToFollow(line[4].key.Id, line[0].key.Id, 10)
+	r.True(errors.Is(err, ErrNoFollowPath), "wrong error: %v", err)
+}
+
+func TestReindex(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	me.follow(alice.key.Id)
+	me.follow(bob.key.Id)
+	alice.follow(me.key.Id)
+	alice.block(claire.key.Id)
+	me.unfollow(bob.key.Id)
+	bob.follow(claire.key.Id)
+	time.Sleep(time.Second / 10)
+
+	r.NoError(tc.gbuilder.AddDeny(claire.key.Id))
+
+	before, err := tc.gbuilder.Build()
+	r.NoError(err)
+
+	var reports [][2]int64
+	err = tc.gbuilder.Reindex(context.Background(), tc.root, func(done, total int64) {
+		reports = append(reports, [2]int64{done, total})
+	})
+	r.NoError(err)
+	r.NotEmpty(reports)
+	r.Equal([2]int64{6, 6}, reports[len(reports)-1])
+
+	after, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.Equal(before.NodeCount(), after.NodeCount())
+	all := []*publisher{me, alice, bob, claire}
+	for _, from := range all {
+		for _, to := range all {
+			r.Equal(before.Follows(from.key.Id, to.key.Id), after.Follows(from.key.Id, to.key.Id))
+			r.Equal(before.Blocks(from.key.Id, to.key.Id), after.Blocks(from.key.Id, to.key.Id))
+		}
+	}
+
+	denied, err := tc.gbuilder.IsDenied(claire.key.Id)
+	r.NoError(err)
+	r.True(denied, "the deny-list should be kept")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = tc.gbuilder.Reindex(ctx, tc.root, nil)
+	r.True(errors.Is(err, context.Canceled), "wrong error: %v", err)
+}
+
+func TestSuggestionsCommunityBlocks(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	var mine []*publisher
+	for i := 0; i < 5; i++ {
+		p := tc.newPublisher(t)
+		me.follow(p.key.Id)
+		mine = append(mine, p)
+	}
+	candidate := tc.newPublisher(t)
+	friendly := tc.newPublisher(t)
+
+	mine[0].follow(candidate.key.Id)
+	mine[1].follow(candidate.key.Id)
+	for _, p := range mine[2:] {
+		p.block(candidate.key.Id)
+	}
+	mine[0].follow(friendly.key.Id)
+	mine[1].follow(friendly.key.Id)
+	// a single block isn't a majority
+	mine[2].block(friendly.key.Id)
+	time.Sleep(time.Second / 10)
+
+	set, err := tc.gbuilder.Suggestions(me.key.Id, SuggestionOpts{Threshold: 0.4})
+	r.NoError(err)
+	r.True(set.Has(candidate.key.Id))
+	r.True(set.Has(friendly.key.Id))
+
+	set, err = tc.gbuilder.Suggestions(me.key.Id, SuggestionOpts{Threshold: 0.4, RespectCommunityBlocks: true})
+	r.NoError(err)
+	r.False(set.Has(candidate.key.Id), "blocked by most of my follows")
+	r.True(set.Has(friendly.key.Id))
+	r.Equal(1, set.Count())
+}
+
+func TestRetryTxn(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	me.follow(alice.key.Id)
+	time.Sleep(time.Second / 10)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+
+	// conflicts twice before it commits
+	var attempts int
+	err := b.retryTxn("test", func() error {
+		attempts++
+		if attempts <= 2 {
+			return fmt.Errorf("contention: %w", badger.ErrConflict)
+		}
+		return b.db().Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(storedrefs.Feed(me.key.Id) + storedrefs.Feed(alice.key.Id)))
+		})
+	})
+	r.NoError(err)
+	r.Equal(3, attempts)
+	b.invalidate()
+	g, err := b.Build()
+	r.NoError(err)
+	r.False(g.Follows(me.key.Id, alice.key.Id))
+
+	// other errors aren't retried
+	errBroken := errors.New("broken")
+	attempts = 0
+	err = b.retryTxn("test", func() error {
+		attempts++
+		return errBroken
+	})
+	r.Equal(errBroken, err)
+	r.Equal(1, attempts)
+
+	// the last conflict is returned once the attempts are used up
+	attempts = 0
+	err = b.retryTxn("test", func() error {
+		attempts++
+		return badger.ErrConflict
+	})
+	r.True(errors.Is(err, badger.ErrConflict))
+	r.Equal(txnAttempts, attempts)
+}
+
+func TestReindexSkipUnchanged(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+
+	me.follow(alice.key.Id)
+	me.follow(bob.key.Id)
+	alice.block(bob.key.Id)
+	time.Sleep(time.Second / 10)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+	r.EqualValues(2, tc.idxCounter.value("event", idxEventFollow))
+	r.EqualValues(1, tc.idxCounter.value("event", idxEventBlock))
+
+	// nothing to write for a correct index
+	err := b.ReindexWithOpts(context.Background(), tc.root, ReindexOpts{SkipUnchanged: true})
+	r.NoError(err)
+	r.EqualValues(2, tc.idxCounter.value("event", idxEventFollow))
+	r.EqualValues(1, tc.idxCounter.value("event", idxEventBlock))
+
+	// break one of the edges
+	addr := storedrefs.Feed(me.key.Id) + storedrefs.Feed(alice.key.Id)
+	err = b.db().Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(addr), []byte("0"))
+	})
+	r.NoError(err)
+
+	err = b.ReindexWithOpts(context.Background(), tc.root, ReindexOpts{SkipUnchanged: true})
+	r.NoError(err)
+	r.EqualValues(3, tc.idxCounter.value("event", idxEventFollow), "only the broken edge should be written")
+	r.EqualValues(1, tc.idxCounter.value("event", idxEventBlock))
+
+	g, err := b.Build()
+	r.NoError(err)
+	r.True(g.Follows(me.key.Id, alice.key.Id))
+	r.True(g.Follows(me.key.Id, bob.key.Id))
+	r.True(g.Blocks(alice.key.Id, bob.key.Id))
+}
+
+// BenchmarkReindexSkipUnchanged reindexes a store that is already correct, which is the best case for skipping
+func BenchmarkReindexSkipUnchanged(b *testing.B) {
+	tc := makeBadger(b)
+	defer tc.close()
+
+	const n = 30
+	pubs := make([]*publisher, n)
+	for i := range pubs {
+		pubs[i] = tc.newPublisher(b)
+	}
+	for i, p := range pubs {
+		for j := 1; j <= 5; j++ {
+			p.follow(pubs[(i+j)%n].key.Id)
+		}
+		p.block(pubs[(i+6)%n].key.Id)
+	}
+	time.Sleep(time.Second / 2)
+
+	bld := tc.gbuilder.(*builder)
+	for _, bc := range []struct {
+		name string
+		opts ReindexOpts
+	}{
+		{"always-write", ReindexOpts{}},
+		{"skip-unchanged", ReindexOpts{SkipUnchanged: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := bld.ReindexWithOpts(context.Background(), tc.root, bc.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeWithHops(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	me.follow(alice.key.Id)
+	alice.follow(bob.key.Id)
+	bob.follow(claire.key.Id)
+	time.Sleep(time.Second / 10)
+
+	auth, ok := tc.gbuilder.Authorizer(me.key.Id, 0).(HopsAuthorizer)
+	r.True(ok)
+
+	err := auth.AuthorizeWithHops(claire.key.Id, 1)
+	var outOfReach *ssb.ErrOutOfReach
+	r.True(errors.As(err, &outOfReach), "wrong error: %v", err)
+	r.Equal(1, outOfReach.Max)
+
+	r.NoError(auth.AuthorizeWithHops(claire.key.Id, 3))
+	r.Error(auth.Authorize(claire.key.Id), "the default hops should still apply")
+
+	// the distances are reused until the contacts change
+	a := auth.(*authorizer)
+	first := a.cachedDists
+	r.NotNil(first)
+	r.NoError(auth.AuthorizeWithHops(bob.key.Id, 1))
+	r.True(first == a.cachedDists)
+
+	me.follow(bob.key.Id)
+	time.Sleep(time.Second / 10)
+	r.NoError(auth.AuthorizeWithHops(claire.key.Id, 1))
+	r.True(first != a.cachedDists)
+}
+
+func TestFindAlgoConflicts(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+
+	// the same key as a gabby grove feed
+	gabbyAlice := &refs.FeedRef{ID: alice.key.Id.ID, Algo: refs.RefAlgoFeedGabby}
+
+	me.follow(alice.key.Id)
+	me.follow(bob.key.Id)
+	bob.follow(gabbyAlice)
+	time.Sleep(time.Second / 10)
+
+	g, err := tc.gbuilder.Build()
+	r.NoError(err)
+
+	conflicts := g.FindAlgoConflicts()
+	r.Len(conflicts, 1)
+	r.Equal(alice.key.Id.ID, conflicts[0].Key)
+	r.Len(conflicts[0].Feeds, 2)
+
+	var algos []refs.RefAlgo
+	for _, f := range conflicts[0].Feeds {
+		algos = append(algos, f.Algo)
+	}
+	r.ElementsMatch([]refs.RefAlgo{refs.RefAlgoFeedSSB1, refs.RefAlgoFeedGabby}, algos)
+}
+
+func TestEstimateReplication(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	post := func(p *publisher, n int) {
+		for i := 0; i < n; i++ {
+			_, err := p.publish.Append(map[string]interface{}{"type": "post", "i": i})
+			r.NoError(err)
+		}
+	}
+
+	me.follow(alice.key.Id)
+	alice.follow(bob.key.Id)
+	bob.follow(claire.key.Id)
+	post(alice, 2)
+	post(bob, 4)
+	post(claire, 10)
+	time.Sleep(time.Second / 10)
+
+	// alice and bob with their follow messages
+	feeds, total, err := tc.gbuilder.EstimateReplication(me.key.Id, 1, tc.userLogs)
+	r.NoError(err)
+	r.Equal(2, feeds)
+	r.EqualValues(3+5, total)
+
+	feeds, total, err = tc.gbuilder.EstimateReplication(me.key.Id, 2, tc.userLogs)
+	r.NoError(err)
+	r.Equal(3, feeds)
+	r.EqualValues(3+5+10, total)
+}
+
+func TestOwnerBlocks(t *testing.T) {
+	r := require.New(t)
+
+	ownerKP, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+	tc := makeBadgerWithOpts(t, WithOwnerBlocks(ownerKP.Id))
+	defer tc.close()
+
+	owner := newPublisherWithKP(t, tc.root, tc.userLogs, ownerKP)
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+
+	me.follow(alice.key.Id)
+	alice.follow(me.key.Id)
+	alice.follow(bob.key.Id)
+	me.follow(claire.key.Id)
+
+	hasEventually := func(want bool, feed *refs.FeedRef, msg string) {
+		r.Eventually(func() bool {
+			hops := tc.gbuilder.Hops(me.key.Id, 1)
+			return hops != nil && hops.Has(feed) == want
+		}, 5*time.Second, 50*time.Millisecond, msg)
+	}
+	hasEventually(true, bob.key.Id, "bob should be reachable through alice")
+	hasEventually(true, claire.key.Id, "claire is followed directly")
+
+	live, err := tc.gbuilder.LiveReplicationSet(me.key.Id, 1)
+	r.NoError(err)
+	defer live.Close()
+	r.True(live.Has(bob.key.Id))
+
+	suggested, err := tc.gbuilder.Suggestions(me.key.Id, SuggestionOpts{Threshold: 1})
+	r.NoError(err)
+	r.True(suggested.Has(bob.key.Id))
+
+	owner.block(bob.key.Id)
+	owner.block(claire.key.Id)
+	hasEventually(false, bob.key.Id, "blocked by the owner but still reachable")
+	hasEventually(false, claire.key.Id, "blocked by the owner but still followed")
+
+	follows, err := tc.gbuilder.Follows(me.key.Id)
+	r.NoError(err)
+	r.Equal(1, follows.Count())
+	r.True(follows.Has(alice.key.Id))
+
+	r.False(live.Has(bob.key.Id))
+	r.False(live.Has(claire.key.Id))
+	r.True(live.Has(alice.key.Id))
+
+	suggested, err = tc.gbuilder.Suggestions(me.key.Id, SuggestionOpts{Threshold: 1})
+	r.NoError(err)
+	r.False(suggested.Has(bob.key.Id))
+
+	// the graph still has the edges
+	g, err := tc.gbuilder.Build()
+	r.NoError(err)
+	r.True(g.Follows(alice.key.Id, bob.key.Id))
+
+	// unblocking brings them back
+	owner.unblock(bob.key.Id)
+	hasEventually(true, bob.key.Id, "bob was unblocked")
+}
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/dgraph-io/badger"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+)
+
+// Relationship is how a feed relates to another one, see Builder.Classify
+type Relationship uint
+
+const (
+	// RelationshipNone means neither follows the other
+	RelationshipNone Relationship = iota
+
+	// RelationshipFollowing means me follows the feed but not the other way around
+	RelationshipFollowing
+
+	// RelationshipFollower means the feed follows me but not the other way around
+	RelationshipFollower
+
+	// RelationshipFriend means both follow each other
+	RelationshipFriend
+
+	// RelationshipBlocked means me blocks the feed, no matter what the feed does
+	RelationshipBlocked
+)
+
+func (r Relationship) String() string {
+	switch r {
+	case RelationshipNone:
+		return "none"
+	case RelationshipFollowing:
+		return "following"
+	case RelationshipFollower:
+		return "follower"
+	case RelationshipFriend:
+		return "friend"
+	case RelationshipBlocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("Relationship(%d)", uint(r))
+}
+
+func relationship(outgoing, incoming float64) Relationship {
+	switch {
+	case math.IsInf(outgoing, 1):
+		return RelationshipBlocked
+	case outgoing == 1 && incoming == 1:
+		return RelationshipFriend
+	case outgoing == 1:
+		return RelationshipFollowing
+	case incoming == 1:
+		return RelationshipFollower
+	}
+	return RelationshipNone
+}
+
+// Classify reads the outgoing contacts of me once and then only looks up the contact of each feed about me.
+// The result is keyed by the Ref() of the feeds.
+func (b *builder) Classify(me *refs.FeedRef, feeds []*refs.FeedRef) (map[string]Relationship, error) {
+	outgoing, err := b.outgoingWeights(me)
+	if err != nil {
+		return nil, fmt.Errorf("classify: %w", err)
+	}
+
+	classes := make(map[string]Relationship, len(feeds))
+	for _, f := range feeds {
+		out, has := outgoing[string(storedrefs.Feed(f))]
+		if !has {
+			out = math.Inf(-1)
+		}
+
+		in := math.Inf(-1)
+		if !math.IsInf(out, 1) {
+			in, err = b.edgeWeight(f, me)
+			if err != nil {
+				return nil, fmt.Errorf("classify(%s): %w", f.ShortRef(), err)
+			}
+		}
+		classes[f.Ref()] = relationship(out, in)
+	}
+	return classes, nil
+}
+
+// outgoingWeights returns the weights of all the stored contacts of who, keyed by the stored ref of the contact.
+func (b *builder) outgoingWeights(who *refs.FeedRef) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	err := b.db().View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = b.layout != LayoutPacked
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		if b.layout == LayoutPacked {
+			for _, p := range packedPrefixes {
+				prefix := packedKey(p, []byte(storedrefs.Feed(who)))
+				for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+					k := iter.Item().Key()
+					w, ok := packedWeight(k)
+					if !ok {
+						continue
+					}
+					weights[string(k[35:])] = w
+				}
+			}
+			return nil
+		}
+
+		prefix := []byte(storedrefs.Feed(who))
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			it := iter.Item()
+			k := it.Key()
+			if len(k) != contactKeyLen {
+				continue
+			}
+			err := it.Value(func(v []byte) error {
+				w, err := contactWeight(v)
+				if err != nil {
+					return err
+				}
+				weights[string(k[34:])] = w
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to get value from iter: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("contacts of %s: %w", who.ShortRef(), err)
+	}
+	return weights, nil
+}
+
+// Classify uses the graph of the log builder, which has all the edges in memory already.
+func (b *logBuilder) Classify(me *refs.FeedRef, feeds []*refs.FeedRef) (map[string]Relationship, error) {
+	g, err := b.Build()
+	if err != nil {
+		return nil, fmt.Errorf("classify: %w", err)
+	}
+
+	weight := func(from, to *refs.FeedRef) float64 {
+		switch {
+		case g.Blocks(from, to):
+			return math.Inf(1)
+		case g.Follows(from, to):
+			return 1
+		}
+		return math.Inf(-1)
+	}
+
+	classes := make(map[string]Relationship, len(feeds))
+	for _, f := range feeds {
+		classes[f.Ref()] = relationship(weight(me, f), weight(f, me))
+	}
+	return classes, nil
+}
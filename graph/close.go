@@ -0,0 +1,32 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned by the index of a builder after Close was called.
+// The message isn't marked as indexed, so whoever feeds the index should stop quietly on it, like on a canceled context.
+var ErrClosed = errors.New("ssb/graph: builder is closed")
+
+// Close waits for the index update that is in progress, refuses the ones after it and syncs the database to disk,
+// so that the index doesn't lag behind on the next start. The database is closed with the index returned by OpenIndex.
+func (b *builder) Close() error {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	if b.readOnly {
+		// opened by NewReadOnlyBuilder
+		return b.db().Close()
+	}
+	if err := b.db().Sync(); err != nil {
+		return fmt.Errorf("ssb/graph: failed to sync contacts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+	"go.mindeco.de/ssb-refs/tfk"
+)
+
+// denyPrefix marks the entries of the deny-list in badger.
+// The keys are shorter than the contact entries of both layouts, so building the graph skips them.
+var denyPrefix = []byte("deny:")
+
+func denyKey(feed *refs.FeedRef) []byte {
+	k := make([]byte, 0, len(denyPrefix)+34)
+	k = append(k, denyPrefix...)
+	return append(k, storedrefs.Feed(feed)...)
+}
+
+// WithDenyList replaces the deny-list with feeds.
+func (b *builder) WithDenyList(feeds []*refs.FeedRef) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	return b.update("withDenyList", func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		var old [][]byte
+		for iter.Seek(denyPrefix); iter.ValidForPrefix(denyPrefix); iter.Next() {
+			old = append(old, iter.Item().KeyCopy(nil))
+		}
+		iter.Close()
+
+		for _, k := range old {
+			if err := txn.Delete(k); err != nil {
+				return fmt.Errorf("deny-list: failed to drop entry %x: %w", k, err)
+			}
+		}
+
+		for _, feed := range feeds {
+			if err := txn.Set(denyKey(feed), nil); err != nil {
+				return fmt.Errorf("deny-list: failed to add %s: %w", feed.ShortRef(), err)
+			}
+		}
+		return nil
+	})
+}
+
+// AddDeny puts feed on the deny-list.
+func (b *builder) AddDeny(feed *refs.FeedRef) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	return b.db().Update(func(txn *badger.Txn) error {
+		if err := txn.Set(denyKey(feed), nil); err != nil {
+			return fmt.Errorf("deny-list: failed to add %s: %w", feed.ShortRef(), err)
+		}
+		return nil
+	})
+}
+
+// RemoveDeny takes feed off the deny-list. It's not an error if it wasn't on it.
+func (b *builder) RemoveDeny(feed *refs.FeedRef) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	return b.db().Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(denyKey(feed)); err != nil {
+			return fmt.Errorf("deny-list: failed to remove %s: %w", feed.ShortRef(), err)
+		}
+		return nil
+	})
+}
+
+// IsDenied returns true if feed is on the deny-list.
+func (b *builder) IsDenied(feed *refs.FeedRef) (bool, error) {
+	var denied bool
+	err := b.db().View(func(txn *badger.Txn) error {
+		_, err := txn.Get(denyKey(feed))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("deny-list: failed to look up %s: %w", feed.ShortRef(), err)
+		}
+		denied = true
+		return nil
+	})
+	return denied, err
+}
+
+// DenyList returns all the feeds on the deny-list.
+func (b *builder) DenyList() (*ssb.StrFeedSet, error) {
+	set := ssb.NewFeedSet(0)
+	err := b.db().View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+
+		for iter.Seek(denyPrefix); iter.ValidForPrefix(denyPrefix); iter.Next() {
+			k := iter.Item().Key()
+
+			var sr tfk.Feed
+			if err := sr.UnmarshalBinary(k[len(denyPrefix):]); err != nil {
+				return fmt.Errorf("deny-list: invalid entry %x: %w", k, err)
+			}
+			if err := set.AddRef(sr.Feed()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// memDenyList keeps the deny-list of the logBuilder, which has no storage of its own.
+type memDenyList struct {
+	mu    sync.Mutex
+	feeds map[string]*refs.FeedRef
+}
+
+func (dl *memDenyList) set(feeds []*refs.FeedRef) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.feeds = make(map[string]*refs.FeedRef, len(feeds))
+	for _, f := range feeds {
+		dl.feeds[f.Ref()] = f
+	}
+}
+
+func (dl *memDenyList) add(feed *refs.FeedRef) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.feeds == nil {
+		dl.feeds = make(map[string]*refs.FeedRef)
+	}
+	dl.feeds[feed.Ref()] = feed
+}
+
+func (dl *memDenyList) remove(feed *refs.FeedRef) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	delete(dl.feeds, feed.Ref())
+}
+
+func (dl *memDenyList) has(feed *refs.FeedRef) bool {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	_, has := dl.feeds[feed.Ref()]
+	return has
+}
+
+func (dl *memDenyList) list() (*ssb.StrFeedSet, error) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	set := ssb.NewFeedSet(len(dl.feeds))
+	for _, f := range dl.feeds {
+		if err := set.AddRef(f); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
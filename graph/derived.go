@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"go.cryptoscope.co/librarian"
+	libbadger "go.cryptoscope.co/librarian/badger"
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// IndexOp is a change to a derived index, Value is stored under Addr.
+type IndexOp struct {
+	Addr  librarian.Addr
+	Value interface{}
+
+	// TTL makes the entry disappear after that time, zero keeps it
+	TTL time.Duration
+}
+
+// Classifier returns the changes msg makes to a derived index, none if it doesn't concern the index.
+// An error stops the indexing, so messages that can't be parsed should just be skipped.
+type Classifier func(msg refs.Message) ([]IndexOp, error)
+
+// DerivedIndex stores what a Classifier extracts from the messages of the receive log in badger.
+// The contacts of the graph builder are indexed by one, NewDerivedIndex makes others, like an index of about names.
+type DerivedIndex struct {
+	db       func() *badger.DB
+	idx      librarian.SeqSetterIndex
+	classify Classifier
+	log      kitlog.Logger
+
+	sinkOnce sync.Once
+	sink     librarian.SinkIndex
+
+	// lock is held while a message is processed, it can be nil
+	lock sync.Locker
+
+	// write stores the ops of one message, it defaults to setting them on the index one by one
+	write func(ctx context.Context, idx librarian.SetterIndex, ops []IndexOp) error
+
+	// skipped is called for values that aren't messages, it can be nil
+	skipped func()
+
+	// applied is called after the ops of msg were written, it can be nil
+	applied func(msg refs.Message, ops []IndexOp)
+}
+
+// NewDerivedIndex returns an index of db that is updated with the ops classify returns for each message.
+// The values are stored as JSON, see Lookup.
+func NewDerivedIndex(db *badger.DB, log kitlog.Logger, classify Classifier) *DerivedIndex {
+	return newDerivedIndex(func() *badger.DB { return db }, libbadger.NewIndex(db, 0), log, classify)
+}
+
+func newDerivedIndex(db func() *badger.DB, idx librarian.SeqSetterIndex, log kitlog.Logger, classify Classifier) *DerivedIndex {
+	di := &DerivedIndex{
+		db:       db,
+		idx:      idx,
+		classify: classify,
+		log:      log,
+	}
+	di.write = func(ctx context.Context, idx librarian.SetterIndex, ops []IndexOp) error {
+		for _, op := range ops {
+			var err error
+			if op.TTL > 0 {
+				err = di.setWithTTL(op)
+			} else {
+				err = idx.Set(ctx, op.Addr, op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return di
+}
+
+// setWithTTL stores op like the index does but with an expiry, which the index has no support for.
+func (di *DerivedIndex) setWithTTL(op IndexOp) error {
+	v, err := json.Marshal(op.Value)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %w", err)
+	}
+	return di.db().Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(op.Addr), v).WithTTL(op.TTL))
+	})
+}
+
+// OpenIndex returns the index and the sink that updates it, like the ones passed to repo.OpenBadgerIndex.
+func (di *DerivedIndex) OpenIndex() (librarian.SeqSetterIndex, librarian.SinkIndex) {
+	di.sinkOnce.Do(func() {
+		di.sink = librarian.NewSinkIndex(di.update, di.idx)
+	})
+	return di.idx, di.sink
+}
+
+// Lookup decodes the value stored under addr into v. It returns false if there is none.
+func (di *DerivedIndex) Lookup(addr librarian.Addr, v interface{}) (bool, error) {
+	var found bool
+	err := di.db().View(func(txn *badger.Txn) error {
+		it, err := txn.Get([]byte(addr))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		found = true
+		return it.Value(func(val []byte) error {
+			return json.Unmarshal(val, v)
+		})
+	})
+	if err != nil {
+		return false, fmt.Errorf("derived index: lookup failed: %w", err)
+	}
+	return found, nil
+}
+
+func (di *DerivedIndex) update(ctx context.Context, seq margaret.Seq, val interface{}, idx librarian.SetterIndex) error {
+	if di.lock != nil {
+		di.lock.Lock()
+		defer di.lock.Unlock()
+	}
+
+	if nulled, ok := val.(error); ok {
+		if margaret.IsErrNulled(nulled) {
+			di.skip()
+			return nil
+		}
+		return nulled
+	}
+
+	msg, ok := val.(refs.Message)
+	if !ok {
+		di.skip()
+		err := fmt.Errorf("derived index: invalid msg value %T", val)
+		level.Warn(di.log).Log("msg", "message eval failed", "reason", err)
+		return err
+	}
+
+	ops, err := di.classify(msg)
+	if err != nil {
+		return fmt.Errorf("derived index: failed to classify message %d: %w", seq.Seq(), err)
+	}
+	if len(ops) > 0 {
+		if err := di.write(ctx, idx, ops); err != nil {
+			return fmt.Errorf("derived index: failed to update index: %w", err)
+		}
+	}
+	if len(ops) > 0 && di.applied != nil {
+		di.applied(msg, ops)
+	}
+	return nil
+}
+
+func (di *DerivedIndex) skip() {
+	if di.skipped != nil {
+		di.skipped()
+	}
+}
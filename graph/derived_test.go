@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/librarian"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/ctxutils"
+	"go.cryptoscope.co/ssb/internal/testutils"
+	"go.cryptoscope.co/ssb/multilogs"
+	"go.cryptoscope.co/ssb/repo"
+)
+
+func TestDerivedIndexAboutNames(t *testing.T) {
+	r := require.New(t)
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	tRepoPath, err := ioutil.TempDir("", "derivedIndex")
+	r.NoError(err)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	tRepo := repo.New(tRepoPath)
+	tRootLog, err := repo.OpenLog(tRepo)
+	r.NoError(err)
+
+	uf, serveUF, err := multilogs.OpenUserFeeds(tRepo)
+	r.NoError(err)
+	defer uf.Close()
+	serveLog(ctx, "user feeds", tRootLog, serveUF, true)
+
+	// the names feeds gave themselves
+	names := func(msg refs.Message) ([]IndexOp, error) {
+		var about struct {
+			Type  string        `json:"type"`
+			About *refs.FeedRef `json:"about"`
+			Name  string        `json:"name"`
+		}
+		if err := json.Unmarshal(msg.ContentBytes(), &about); err != nil || about.Type != "about" {
+			return nil, nil
+		}
+		if about.Name == "" || about.About == nil || !about.About.Equal(msg.Author()) {
+			return nil, nil
+		}
+		return []IndexOp{{Addr: librarian.Addr(msg.Author().Ref() + ":name"), Value: about.Name}}, nil
+	}
+
+	var idx *DerivedIndex
+	_, sinkIdx, serve, err := repo.OpenBadgerIndex(tRepo, "names", func(db *badger.DB) (librarian.SeqSetterIndex, librarian.SinkIndex) {
+		idx = NewDerivedIndex(db, info, names)
+		return idx.OpenIndex()
+	})
+	r.NoError(err)
+	defer sinkIdx.Close()
+
+	alice := newPublisher(t, tRootLog, uf)
+	bob := newPublisher(t, tRootLog, uf)
+	claire := newPublisher(t, tRootLog, uf)
+
+	setName := func(p *publisher, about *refs.FeedRef, name string) {
+		_, err := p.publish.Append(map[string]interface{}{
+			"type":  "about",
+			"about": about.Ref(),
+			"name":  name,
+		})
+		r.NoError(err)
+	}
+	setName(alice, alice.key.Id, "alice")
+	setName(bob, bob.key.Id, "bob")
+	setName(alice, alice.key.Id, "ally")
+	// only names for the own feed count
+	setName(claire, bob.key.Id, "robert")
+	alice.follow(bob.key.Id)
+
+	errc := serveLog(ctx, "names", tRootLog, serve, false)
+	r.NoError(<-errc)
+
+	for _, tc := range []struct {
+		feed *refs.FeedRef
+		name string
+	}{
+		{alice.key.Id, "ally"},
+		{bob.key.Id, "bob"},
+		{claire.key.Id, ""},
+	} {
+		var name string
+		has, err := idx.Lookup(librarian.Addr(tc.feed.Ref()+":name"), &name)
+		r.NoError(err)
+		r.Equal(tc.name != "", has, "wrong presence for %s", tc.feed.ShortRef())
+		r.Equal(tc.name, name)
+	}
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	"go.cryptoscope.co/librarian"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// edgeSeqPrefix marks the entries that hold the sequence of the contact message which set the state of an edge.
+// Contact messages of the same author can be indexed out of order, for instance during a reindex.
+// Only the newest one of each pair of feeds should count, the older ones are skipped.
+var edgeSeqPrefix = []byte("cseq:")
+
+// edgeSeqKey returns the key of the sequence entry for the pair of stored feed refs
+func edgeSeqKey(pair []byte) librarian.Addr {
+	k := make([]byte, 0, len(edgeSeqPrefix)+len(pair))
+	k = append(k, edgeSeqPrefix...)
+	k = append(k, pair...)
+	return librarian.Addr(k)
+}
+
+// edgeSeq returns the sequence of the contact message that set the state of the pair of feeds, false if none was indexed.
+func (b *builder) edgeSeq(pair []byte) (int64, bool, error) {
+	var (
+		seq   int64
+		found bool
+	)
+	err := b.db().View(func(txn *badger.Txn) error {
+		it, err := txn.Get([]byte(edgeSeqKey(pair)))
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+		found = true
+		return it.Value(func(v []byte) error {
+			return json.Unmarshal(v, &seq)
+		})
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get edge sequence: %w", err)
+	}
+	return seq, found, nil
+}
+
+// deleteEdgeSeqs drops the sequence entries of the contacts of who
+func (b *builder) deleteEdgeSeqs(who *refs.FeedRef) error {
+	return b.db().Update(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		prefix := []byte(edgeSeqKey([]byte(storedrefs.Feed(who))))
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			k := iter.Item().KeyCopy(nil)
+			if err := txn.Delete(k); err != nil {
+				return fmt.Errorf("failed to drop edge sequence %x: %w", k, err)
+			}
+		}
+		return nil
+	})
+}
+
+func isEdgeSeqKey(k []byte) bool {
+	return bytes.HasPrefix(k, edgeSeqPrefix)
+}
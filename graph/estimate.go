@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+
+	"go.cryptoscope.co/librarian"
+	"go.cryptoscope.co/margaret"
+	"go.cryptoscope.co/margaret/multilog"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// EstimateReplication returns how many feeds are at most maxHops away from from and how many messages of them are in userFeeds.
+// Like Hops, from itself isn't counted. Feeds we don't have any messages of count as empty.
+func (b *builder) EstimateReplication(from *refs.FeedRef, maxHops int, userFeeds multilog.MultiLog) (int, int64, error) {
+	return estimateReplication(b, from, maxHops, userFeeds)
+}
+
+// EstimateReplication is the same as for the badger builder.
+func (b *logBuilder) EstimateReplication(from *refs.FeedRef, maxHops int, userFeeds multilog.MultiLog) (int, int64, error) {
+	return estimateReplication(b, from, maxHops, userFeeds)
+}
+
+func estimateReplication(bld Builder, from *refs.FeedRef, maxHops int, userFeeds multilog.MultiLog) (int, int64, error) {
+	hops := bld.Hops(from, maxHops)
+	if hops == nil {
+		return 0, 0, fmt.Errorf("estimateReplication: failed to get hops of %s", from.ShortRef())
+	}
+
+	feeds, err := hops.List()
+	if err != nil {
+		return 0, 0, fmt.Errorf("estimateReplication: failed to list hops: %w", err)
+	}
+
+	var total int64
+	for _, feed := range feeds {
+		n, err := feedLength(userFeeds, feed)
+		if err != nil {
+			return 0, 0, fmt.Errorf("estimateReplication: %w", err)
+		}
+		total += n
+	}
+	return len(feeds), total, nil
+}
+
+// feedLength returns the number of messages of feed in userFeeds
+func feedLength(userFeeds multilog.MultiLog, feed *refs.FeedRef) (int64, error) {
+	subLog, err := userFeeds.Get(storedrefs.Feed(feed))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open sublog of %s: %w", feed.ShortRef(), err)
+	}
+
+	v, err := subLog.Seq().Value()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get sequence of %s: %w", feed.ShortRef(), err)
+	}
+
+	switch seq := v.(type) {
+	case librarian.UnsetValue:
+		return 0, nil
+	case margaret.Seq:
+		// sublogs are 0-indexed and empty ones are at -1
+		return seq.Seq() + 1, nil
+	default:
+		return 0, fmt.Errorf("unexpected sequence type %T for %s", v, feed.ShortRef())
+	}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// contactExpiry is the optional field of a contact message that makes a follow temporary.
+// Expires is the time the follow ends, in milliseconds since the epoch like the timestamps of messages.
+// The entry is stored with a badger TTL, so it disappears without an unfollow.
+type contactExpiry struct {
+	Expires int64 `json:"expires"`
+}
+
+// followTTL returns how long the follow in content lasts, zero if it doesn't expire.
+// expired is true if the time is already over.
+func followTTL(content []byte, now time.Time) (ttl time.Duration, expired bool) {
+	var ce contactExpiry
+	if err := json.Unmarshal(content, &ce); err != nil || ce.Expires <= 0 {
+		return 0, false
+	}
+	// split into seconds first, multiplying the milliseconds into nanoseconds overflows for times past 2262
+	expires := time.Unix(ce.Expires/1000, (ce.Expires%1000)*int64(time.Millisecond))
+	ttl = expires.Sub(now)
+	if ttl <= 0 {
+		return 0, true
+	}
+	return ttl, false
+}
+
+// expiryTimer drops the caches of the builder when the next temporary follow expires.
+// Badger hides expired entries by itself, but the cached graphs and the live sets need to be told.
+type expiryTimer struct {
+	mu    sync.Mutex
+	next  time.Time
+	timer *time.Timer
+}
+
+// scheduleExpiry makes sure the caches are dropped at the latest at.
+func (b *builder) scheduleExpiry(at time.Time) {
+	b.expiry.mu.Lock()
+	defer b.expiry.mu.Unlock()
+	if !b.expiry.next.IsZero() && !at.Before(b.expiry.next) {
+		return
+	}
+	if b.expiry.timer != nil {
+		b.expiry.timer.Stop()
+	}
+	b.expiry.next = at
+	b.expiry.timer = time.AfterFunc(time.Until(at), b.followsExpired)
+}
+
+// scheduleExpiryAt is scheduleExpiry for the ExpiresAt of a badger item, which is zero for entries without a TTL.
+func (b *builder) scheduleExpiryAt(expiresAt uint64) {
+	if expiresAt == 0 {
+		return
+	}
+	b.scheduleExpiry(time.Unix(int64(expiresAt), 0))
+}
+
+// followsExpired drops the caches. The later expiries are scheduled again as the graph is rebuilt.
+func (b *builder) followsExpired() {
+	b.expiry.mu.Lock()
+	b.expiry.next = time.Time{}
+	b.expiry.timer = nil
+	b.expiry.mu.Unlock()
+
+	b.cacheLock.Lock()
+	b.invalidate()
+	b.cacheLock.Unlock()
+	b.live.markStale()
+}
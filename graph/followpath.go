@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// ErrNoFollowPath is returned by PathToFollow if the target can't be reached within the hops.
+var ErrNoFollowPath = errors.New("ssb/graph: no follow path to target")
+
+// PathToFollow returns the shortest chain of follows that brings target within maxHops of from, see the builder.
+func (b *builder) PathToFollow(from, target *refs.FeedRef, maxHops int) ([]*refs.FeedRef, error) {
+	return pathToFollow(b, from, target, maxHops)
+}
+
+// PathToFollow returns the shortest chain of follows that brings target within maxHops of from, see the builder.
+func (b *logBuilder) PathToFollow(from, target *refs.FeedRef, maxHops int) ([]*refs.FeedRef, error) {
+	return pathToFollow(b, from, target, maxHops)
+}
+
+// pathToFollow walks the shortest follow path from from to target.
+// The returned feeds start with the one from has to follow (or already follows) and end with target.
+// Like for the Authorizer, a direct follow is zero hops away and blocks break a path.
+func pathToFollow(bld Builder, from, target *refs.FeedRef, maxHops int) ([]*refs.FeedRef, error) {
+	if from.Equal(target) {
+		return nil, fmt.Errorf("pathToFollow: target is from itself")
+	}
+
+	g, err := bld.Build()
+	if err != nil {
+		return nil, fmt.Errorf("pathToFollow: failed to build graph: %w", err)
+	}
+
+	dist, err := g.MakeDijkstra(from)
+	if err != nil {
+		var nsf ErrNoSuchFrom
+		if errors.As(err, &nsf) {
+			return nil, fmt.Errorf("pathToFollow: %s doesn't follow anyone: %w", from.ShortRef(), ErrNoFollowPath)
+		}
+		return nil, fmt.Errorf("pathToFollow: failed to construct dijkstra: %w", err)
+	}
+
+	// the path includes from and target
+	p, d := dist.Dist(target)
+	hops := len(p) - 2
+	if math.IsInf(d, 0) || hops < 0 {
+		return nil, fmt.Errorf("pathToFollow: %s can't reach %s: %w", from.ShortRef(), target.ShortRef(), ErrNoFollowPath)
+	}
+	if hops > maxHops {
+		return nil, fmt.Errorf("pathToFollow: %s is %d hops away from %s, more than %d: %w", target.ShortRef(), hops, from.ShortRef(), maxHops, ErrNoFollowPath)
+	}
+
+	chain := make([]*refs.FeedRef, 0, len(p)-1)
+	for _, n := range p[1:] {
+		cn, ok := n.(*contactNode)
+		if !ok {
+			return nil, fmt.Errorf("pathToFollow: unexpected node type %T", n)
+		}
+		chain = append(chain, cn.feed)
+	}
+	return chain, nil
+}
@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"go.cryptoscope.co/luigi"
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+// FollowEvent is sent on the updates of FollowsLive when a feed was followed or stopped being followed.
+type FollowEvent struct {
+	Feed      *refs.FeedRef
+	Following bool
+}
+
+// followsWatcher keeps the follows of one feed current and queues the changes as FollowEvents.
+// It is the luigi.Source that FollowsLive returns.
+type followsWatcher struct {
+	of      *refs.FeedRef
+	follows func(*refs.FeedRef) (*ssb.StrFeedSet, error)
+
+	unregister func()
+
+	mu      sync.Mutex
+	current *ssb.StrFeedSet
+	queue   []FollowEvent
+	closed  bool
+
+	// wake has room for one signal, that a reader waiting in Next should look at the queue again
+	wake chan struct{}
+}
+
+var (
+	_ luigi.Source = (*followsWatcher)(nil)
+	_ liveListener = (*followsWatcher)(nil)
+)
+
+func newFollowsWatcher(of *refs.FeedRef, follows func(*refs.FeedRef) (*ssb.StrFeedSet, error)) *followsWatcher {
+	return &followsWatcher{
+		of:      of.Copy(),
+		follows: follows,
+		current: ssb.NewFeedSet(0),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// start registers the watcher and reads the initial follows, while holding the lock so that no change is missed or sent twice.
+// register starts the delivery of changes to the watcher and returns a function that stops it.
+func (fw *followsWatcher) start(register func() func()) (*ssb.StrFeedSet, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.unregister = register()
+
+	initial, err := fw.follows(fw.of)
+	if err != nil {
+		fw.unregister()
+		return nil, err
+	}
+	lst, err := initial.List()
+	if err != nil {
+		fw.unregister()
+		return nil, err
+	}
+	for _, f := range lst {
+		fw.current.AddRef(f)
+	}
+	return initial, nil
+}
+
+func (fw *followsWatcher) edgeChanged(from, to *refs.FeedRef, following bool) {
+	if !from.Equal(fw.of) {
+		return
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.apply(to, following)
+}
+
+// apply queues an event if following changes the state of feed. It expects fw.mu to be held.
+func (fw *followsWatcher) apply(feed *refs.FeedRef, following bool) {
+	if fw.closed || fw.current.Has(feed) == following {
+		return
+	}
+
+	if following {
+		fw.current.AddRef(feed)
+	} else {
+		fw.current.Delete(feed)
+	}
+	fw.queue = append(fw.queue, FollowEvent{Feed: feed.Copy(), Following: following})
+
+	select {
+	case fw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// markStale reads the follows again and queues the differences.
+// It is called while the builder holds its locks, so it does that in the background.
+func (fw *followsWatcher) markStale() {
+	go fw.resync()
+}
+
+func (fw *followsWatcher) resync() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed {
+		return
+	}
+
+	now, err := fw.follows(fw.of)
+	if err != nil {
+		return
+	}
+	nowLst, err := now.List()
+	if err != nil {
+		return
+	}
+	prevLst, err := fw.current.List()
+	if err != nil {
+		return
+	}
+
+	for _, f := range prevLst {
+		if !now.Has(f) {
+			fw.apply(f, false)
+		}
+	}
+	for _, f := range nowLst {
+		fw.apply(f, true)
+	}
+}
+
+// Next returns the next FollowEvent. It blocks until there is one, ctx is canceled or the watcher is closed.
+func (fw *followsWatcher) Next(ctx context.Context) (interface{}, error) {
+	for {
+		fw.mu.Lock()
+		if len(fw.queue) > 0 {
+			evt := fw.queue[0]
+			fw.queue = fw.queue[1:]
+			fw.mu.Unlock()
+			return evt, nil
+		}
+		closed := fw.closed
+		fw.mu.Unlock()
+
+		if closed {
+			return nil, luigi.EOS{}
+		}
+
+		select {
+		case <-fw.wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Close stops the updates, Next returns luigi.EOS once the queued events are read.
+func (fw *followsWatcher) Close() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed {
+		return nil
+	}
+	fw.closed = true
+	fw.unregister()
+
+	select {
+	case fw.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// FollowsLive returns the feeds forRef follows and a source of FollowEvents as its contact messages are indexed.
+// Only actual changes are sent, following a feed twice results in one event.
+// The updates source also implements io.Closer, close it once it isn't needed anymore.
+func (b *builder) FollowsLive(forRef *refs.FeedRef) (*ssb.StrFeedSet, luigi.Source, error) {
+	fw := newFollowsWatcher(forRef, b.Follows)
+	initial, err := fw.start(func() func() {
+		return b.live.add(fw)
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("FollowsLive: %w", err)
+	}
+	return initial, fw, nil
+}
+
+// FollowsLive is like the one of the badger builder.
+// The log builder reads the whole contacts log again on every Build, so the changes are taken from a live query of the new contact messages instead.
+func (b *logBuilder) FollowsLive(forRef *refs.FeedRef) (*ssb.StrFeedSet, luigi.Source, error) {
+	sv, err := b.contactsLog.Seq().Value()
+	if err != nil {
+		return nil, nil, fmt.Errorf("FollowsLive: failed to get contacts sequence: %w", err)
+	}
+	seq, ok := sv.(margaret.Seq)
+	if !ok {
+		return nil, nil, fmt.Errorf("FollowsLive: wrong sequence type: %T", sv)
+	}
+
+	fw := newFollowsWatcher(forRef, b.Follows)
+	initial, err := fw.start(func() func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		go b.watchContacts(ctx, seq, fw)
+		return cancel
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("FollowsLive: %w", err)
+	}
+	return initial, fw, nil
+}
+
+// watchContacts passes the contact messages after seq to fw until ctx is canceled.
+func (b *logBuilder) watchContacts(ctx context.Context, seq margaret.Seq, fw *followsWatcher) {
+	src, err := b.contactsLog.Query(margaret.Gt(seq), margaret.Live(true))
+	if err != nil {
+		level.Error(b.logger).Log("event", "follows live query failed", "err", err)
+		return
+	}
+
+	snk := luigi.FuncSink(func(ctx context.Context, v interface{}, err error) error {
+		if err != nil {
+			if luigi.IsEOS(err) {
+				return nil
+			}
+			return err
+		}
+
+		msg, ok := v.(refs.Message)
+		if !ok {
+			return fmt.Errorf("graph/follows live: invalid msg value %T", v)
+		}
+		var c refs.Contact
+		if err := c.UnmarshalJSON(msg.ContentBytes()); err != nil {
+			// ignore invalid messages, like buildGraph
+			return nil
+		}
+		fw.edgeChanged(msg.Author(), c.Contact, c.Following)
+		return nil
+	})
+
+	err = luigi.Pump(ctx, snk, src)
+	if err != nil && ctx.Err() == nil {
+		level.Error(b.logger).Log("event", "follows live pump failed", "err", err)
+	}
+}
@@ -5,6 +5,7 @@ package graph
 
 import (
 	"math"
+	"sort"
 	"sync"
 
 	"go.cryptoscope.co/librarian"
@@ -14,6 +15,7 @@ import (
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/path"
 	"gonum.org/v1/gonum/graph/simple"
+	"gonum.org/v1/gonum/graph/topo"
 )
 
 type key2node map[librarian.Addr]*contactNode
@@ -22,13 +24,47 @@ type Graph struct {
 	sync.Mutex
 	*simple.WeightedDirectedGraph
 	lookup key2node
+
+	// sources holds every feed that has a contact record of its own
+	sources map[librarian.Addr]struct{}
+	orphans []*refs.FeedRef
 }
 
 func NewGraph() *Graph {
 	return &Graph{
 		WeightedDirectedGraph: simple.NewWeightedDirectedGraph(0, math.Inf(1)),
 		lookup:                make(key2node),
+		sources:               make(map[librarian.Addr]struct{}),
+	}
+}
+
+// Orphans returns the feeds that only have inbound edges and no contact record of their own,
+// for instance because they were deleted from the index.
+// It is only filled if the graph was built with BuildOpts.TrackOrphans.
+func (g *Graph) Orphans() []*refs.FeedRef {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	orphans := make([]*refs.FeedRef, len(g.orphans))
+	copy(orphans, g.orphans)
+	return orphans
+}
+
+// markOrphans collects the nodes that have inbound edges but never showed up as a source.
+// The caller needs to hold the lock.
+func (g *Graph) markOrphans() {
+	g.orphans = nil
+	for addr, n := range g.lookup {
+		if _, isSource := g.sources[addr]; isSource {
+			continue
+		}
+		if g.To(n.ID()).Len() == 0 {
+			continue
+		}
+		g.orphans = append(g.orphans, n.feed)
 	}
+	sort.Slice(g.orphans, func(i, j int) bool {
+		return g.orphans[i].Ref() < g.orphans[j].Ref()
+	})
 }
 
 func (g *Graph) getEdge(from, to *refs.FeedRef) (graph.WeightedEdge, bool) {
@@ -87,6 +123,113 @@ func (g *Graph) BlockedList(from *refs.FeedRef) *ssb.StrFeedSet {
 	return blocked
 }
 
+// Subgraph returns a new graph that only holds the members and the edges between them.
+func (g *Graph) Subgraph(members *ssb.StrFeedSet) *Graph {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	sub := NewGraph()
+	for k, n := range g.lookup {
+		if !members.Has(n.feed) {
+			continue
+		}
+		sub.AddNode(n)
+		sub.lookup[k] = n
+		if _, isSource := g.sources[k]; isSource {
+			sub.sources[k] = struct{}{}
+		}
+	}
+
+	edges := g.WeightedEdges()
+	for edges.Next() {
+		edg := edges.WeightedEdge()
+		if sub.Node(edg.From().ID()) == nil || sub.Node(edg.To().ID()) == nil {
+			continue
+		}
+		sub.SetWeightedEdge(edg)
+	}
+	return sub
+}
+
+// Components returns the connected components of the follow graph, ignoring the direction of the follows.
+// Blocks don't connect feeds, a feed that has no follows in either direction is a component of its own.
+// The components are sorted by size, largest first, and the feeds in them by their reference.
+func (g *Graph) Components() [][]*refs.FeedRef {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	follows := simple.NewUndirectedGraph()
+	nodes := g.Nodes()
+	for nodes.Next() {
+		follows.AddNode(nodes.Node())
+	}
+
+	edges := g.WeightedEdges()
+	for edges.Next() {
+		edg := edges.WeightedEdge()
+		if edg.Weight() != 1 || edg.From().ID() == edg.To().ID() {
+			continue
+		}
+		follows.SetEdge(follows.NewEdge(edg.From(), edg.To()))
+	}
+
+	var comps [][]*refs.FeedRef
+	for _, cc := range topo.ConnectedComponents(follows) {
+		comp := make([]*refs.FeedRef, 0, len(cc))
+		for _, n := range cc {
+			comp = append(comp, n.(*contactNode).feed)
+		}
+		sort.Slice(comp, func(i, j int) bool {
+			return comp[i].Ref() < comp[j].Ref()
+		})
+		comps = append(comps, comp)
+	}
+	sort.SliceStable(comps, func(i, j int) bool {
+		if len(comps[i]) != len(comps[j]) {
+			return len(comps[i]) > len(comps[j])
+		}
+		return comps[i][0].Ref() < comps[j][0].Ref()
+	})
+	return comps
+}
+
+// KeyConflict is a public key that shows up in the graph as feeds of different formats.
+type KeyConflict struct {
+	Key []byte
+
+	// Feeds holds the nodes of the key, sorted by their reference
+	Feeds []*refs.FeedRef
+}
+
+// FindAlgoConflicts returns the public keys that are used by more than one node of the graph.
+// They are different feeds but can point to a bug where one of them was indexed with the wrong format.
+// The conflicts are sorted by the reference of their first feed.
+func (g *Graph) FindAlgoConflicts() []KeyConflict {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	byKey := make(map[string][]*refs.FeedRef)
+	for _, n := range g.lookup {
+		k := string(n.feed.ID)
+		byKey[k] = append(byKey[k], n.feed)
+	}
+
+	var conflicts []KeyConflict
+	for k, feeds := range byKey {
+		if len(feeds) < 2 {
+			continue
+		}
+		sort.Slice(feeds, func(i, j int) bool {
+			return feeds[i].Ref() < feeds[j].Ref()
+		})
+		conflicts = append(conflicts, KeyConflict{Key: []byte(k), Feeds: feeds})
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Feeds[0].Ref() < conflicts[j].Feeds[0].Ref()
+	})
+	return conflicts
+}
+
 func (g *Graph) MakeDijkstra(from *refs.FeedRef) (*Lookup, error) {
 	g.Mutex.Lock()
 	defer g.Mutex.Unlock()
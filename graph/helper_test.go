@@ -21,14 +21,14 @@ type publisher struct {
 	publish ssb.Publisher
 }
 
-func newPublisher(t *testing.T, root margaret.Log, users multilog.MultiLog) *publisher {
+func newPublisher(t testing.TB, root margaret.Log, users multilog.MultiLog) *publisher {
 	r := require.New(t)
 	kp, err := ssb.NewKeyPair(nil)
 	r.NoError(err)
 	return newPublisherWithKP(t, root, users, kp)
 }
 
-func newPublisherWithKP(t *testing.T, root margaret.Log, users multilog.MultiLog, kp *ssb.KeyPair) *publisher {
+func newPublisherWithKP(t testing.TB, root margaret.Log, users multilog.MultiLog, kp *ssb.KeyPair) *publisher {
 	p := &publisher{}
 	p.r = require.New(t)
 	p.key = kp
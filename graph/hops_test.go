@@ -3,11 +3,20 @@
 package graph
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"sort"
+	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/luigi"
+	refs "go.mindeco.de/ssb-refs"
 
 	"github.com/stretchr/testify/assert"
+
+	"go.cryptoscope.co/ssb"
 )
 
 var hopsScenarios = []PeopleTestCase{
@@ -155,3 +164,285 @@ func dumpMap(m map[string]bool, s *testState) {
 		s.t.Logf("%v:%v", s.refToName[k], v)
 	}
 }
+
+func TestHopsDeepChain(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	// a long line of friends: 0 <-> 1 <-> 2 <-> ... <-> n-1
+	const n = 40
+	chain := make([]*publisher, n)
+	for i := range chain {
+		chain[i] = tc.newPublisher(t)
+	}
+	for i := 1; i < n; i++ {
+		chain[i-1].follow(chain[i].key.Id)
+		chain[i].follow(chain[i-1].key.Id)
+	}
+	time.Sleep(time.Second / 2)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+
+	start := chain[0].key.Id
+
+	// the recursive version walks back and forth along the chain, which grows exponentially with max
+	for _, max := range []int{0, 1, 2, 5, 8} {
+		want := ssb.NewFeedSet(0)
+		err := recurseHopsReference(b, want, make(map[string]struct{}), start, max+1)
+		r.NoError(err)
+		want.Delete(start)
+
+		got := b.Hops(start, max)
+		r.NotNil(got)
+		r.Equal(sortedRefs(t, want), sortedRefs(t, got), "max:%d", max)
+		r.Equal(max+1, got.Count())
+	}
+
+	for _, max := range []int{n - 2, n, 2 * n} {
+		got := b.Hops(start, max)
+		r.NotNil(got)
+		r.Equal(n-1, got.Count(), "max:%d", max)
+	}
+
+	dists, err := b.HopsWithDistance(start, n)
+	r.NoError(err)
+	r.Len(dists, n-1)
+	for i := 1; i < n; i++ {
+		r.Equal(i-1, dists[chain[i].key.Id.Ref()], "wrong distance for %d", i)
+	}
+}
+
+func TestHopsMinTrust(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	carl := tc.newPublisher(t)
+	wellConnected := tc.newPublisher(t)
+	weak := tc.newPublisher(t)
+	weaker := tc.newPublisher(t)
+
+	for _, friend := range []*publisher{alice, bob, carl} {
+		me.follow(friend.key.Id)
+		friend.follow(me.key.Id)
+	}
+
+	// followed by two of my friends
+	alice.follow(wellConnected.key.Id)
+	bob.follow(wellConnected.key.Id)
+
+	// only reachable through carl, and further down the line through weak
+	carl.follow(weak.key.Id)
+	weak.follow(carl.key.Id)
+	weak.follow(weaker.key.Id)
+
+	time.Sleep(time.Second / 10)
+
+	b, ok := tc.gbuilder.(*builder)
+	r.True(ok)
+
+	all, err := b.HopsWithOpts(me.key.Id, 2, HopsOpts{})
+	r.NoError(err)
+	r.Equal(sortedRefs(t, b.Hops(me.key.Id, 2)), sortedRefs(t, all))
+	r.Equal(6, all.Count())
+
+	pruned, err := b.HopsWithOpts(me.key.Id, 2, HopsOpts{MinTrust: 0.3})
+	r.NoError(err)
+	r.Equal(4, pruned.Count())
+	for _, kept := range []*publisher{alice, bob, carl, wellConnected} {
+		r.True(pruned.Has(kept.key.Id))
+	}
+	r.False(pruned.Has(weak.key.Id), "single link should be below the threshold")
+	r.False(pruned.Has(weaker.key.Id), "long single path should be below the threshold")
+
+	dists, err := b.HopsWithDistance(me.key.Id, 2)
+	r.NoError(err)
+	scores, err := b.trustScores(me.key.Id, dists)
+	r.NoError(err)
+	r.InDelta(0.5, scores[alice.key.Id.Ref()], 0.0001)
+	r.InDelta(0.4375, scores[wellConnected.key.Id.Ref()], 0.0001)
+	r.InDelta(0.25, scores[weak.key.Id.Ref()], 0.0001)
+	r.InDelta(0.125, scores[weaker.key.Id.Ref()], 0.0001)
+}
+
+// recurseHopsReference is the recursive implementation Hops used to have
+func recurseHopsReference(b *builder, walked *ssb.StrFeedSet, vis map[string]struct{}, from *refs.FeedRef, depth int) error {
+	if depth == 0 {
+		return nil
+	}
+
+	if _, ok := vis[from.Ref()]; ok {
+		return nil
+	}
+
+	fromFollows, err := b.Follows(from)
+	if err != nil {
+		return err
+	}
+
+	followLst, err := fromFollows.List()
+	if err != nil {
+		return err
+	}
+
+	for _, followedByFrom := range followLst {
+		err := walked.AddRef(followedByFrom)
+		if err != nil {
+			return err
+		}
+
+		dstFollows, err := b.Follows(followedByFrom)
+		if err != nil {
+			return err
+		}
+
+		if dstFollows.Has(from) {
+			if err := recurseHopsReference(b, walked, vis, followedByFrom, depth-1); err != nil {
+				return err
+			}
+		}
+	}
+
+	vis[from.Ref()] = struct{}{}
+	return nil
+}
+
+func sortedRefs(t *testing.T, fs *ssb.StrFeedSet) []string {
+	lst, err := fs.List()
+	require.NoError(t, err)
+	strs := make([]string, len(lst))
+	for i, ref := range lst {
+		strs[i] = ref.Ref()
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+func TestLiveReplicationSet(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+	claire := tc.newPublisher(t)
+	dan := tc.newPublisher(t)
+
+	live, err := tc.gbuilder.LiveReplicationSet(me.key.Id, 1)
+	r.NoError(err)
+	defer live.Close()
+
+	checkLive := func(step string) {
+		time.Sleep(time.Second / 10)
+		want := tc.gbuilder.Hops(me.key.Id, 1)
+		r.NotNil(want)
+		got, err := live.Set()
+		r.NoError(err, step)
+
+		wantLst, err := want.List()
+		r.NoError(err)
+		gotLst, err := got.List()
+		r.NoError(err)
+		r.ElementsMatch(refStrings(wantLst), refStrings(gotLst), step)
+	}
+
+	checkLive("empty")
+
+	me.follow(alice.key.Id)
+	checkLive("direct follow")
+
+	alice.follow(bob.key.Id)
+	checkLive("alice isn't a friend yet")
+	r.False(live.Has(bob.key.Id))
+
+	alice.follow(me.key.Id)
+	checkLive("alice became a friend")
+	r.True(live.Has(bob.key.Id))
+
+	bob.follow(alice.key.Id)
+	bob.follow(claire.key.Id)
+	checkLive("bob is two hops away")
+	r.False(live.Has(claire.key.Id))
+
+	dan.follow(claire.key.Id)
+	checkLive("unrelated follow")
+
+	alice.unfollow(me.key.Id)
+	checkLive("alice unfollowed")
+	r.False(live.Has(bob.key.Id))
+
+	alice.follow(me.key.Id)
+	me.block(alice.key.Id)
+	checkLive("blocked alice")
+	r.False(live.Has(alice.key.Id))
+
+	live.Close()
+	me.follow(dan.key.Id)
+	time.Sleep(time.Second / 10)
+	r.Len(tc.gbuilder.(*builder).live.sets, 0)
+}
+
+func TestFollowsLive(t *testing.T) {
+	r := require.New(t)
+	tc := makeBadger(t)
+	defer tc.close()
+
+	me := tc.newPublisher(t)
+	alice := tc.newPublisher(t)
+	bob := tc.newPublisher(t)
+
+	me.follow(alice.key.Id)
+	time.Sleep(time.Second / 10)
+
+	initial, updates, err := tc.gbuilder.FollowsLive(me.key.Id)
+	r.NoError(err)
+	r.Equal(1, initial.Count())
+	r.True(initial.Has(alice.key.Id))
+
+	next := func(step string) FollowEvent {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		v, err := updates.Next(ctx)
+		r.NoError(err, step)
+		evt, ok := v.(FollowEvent)
+		r.True(ok, "wrong type: %T", v)
+		return evt
+	}
+
+	// changes of other feeds and follows we already have aren't sent
+	alice.follow(bob.key.Id)
+	me.follow(alice.key.Id)
+
+	me.follow(bob.key.Id)
+	evt := next("follow bob")
+	r.True(evt.Feed.Equal(bob.key.Id))
+	r.True(evt.Following)
+
+	me.block(alice.key.Id)
+	evt = next("block alice")
+	r.True(evt.Feed.Equal(alice.key.Id))
+	r.False(evt.Following)
+
+	closer, ok := updates.(io.Closer)
+	r.True(ok, "updates should be closable")
+	r.NoError(closer.Close())
+	me.unfollow(bob.key.Id)
+
+	_, err = updates.Next(context.Background())
+	r.True(luigi.IsEOS(err), "expected end of stream: %v", err)
+	r.Len(tc.gbuilder.(*builder).live.sets, 0)
+}
+
+func refStrings(lst []*refs.FeedRef) []string {
+	strs := make([]string, len(lst))
+	for i, ref := range lst {
+		strs[i] = ref.Ref()
+	}
+	return strs
+}
@@ -0,0 +1,242 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/dgraph-io/badger"
+	"gonum.org/v1/gonum/graph/simple"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// The states of an Edge, the same ones that are stored for contact messages
+const (
+	EdgeNeutral = 0
+	EdgeFollow  = 1
+	EdgeBlock   = 2
+)
+
+// Edge is a contact between two feeds that doesn't come from a verified contact message,
+// like the follows listed in an invite bundle. See ImportEdges.
+type Edge struct {
+	From, To *refs.FeedRef
+	State    int
+}
+
+func (e Edge) check() error {
+	if e.From == nil || e.To == nil {
+		return fmt.Errorf("ssb/graph: edge without feed")
+	}
+	if e.State < EdgeNeutral || e.State > EdgeBlock {
+		return fmt.Errorf("ssb/graph: invalid state %d for edge %s -> %s", e.State, e.From.ShortRef(), e.To.ShortRef())
+	}
+	return nil
+}
+
+// importedMarker is stored with imported edges to tell them apart from the ones of verified contact messages.
+// In the values layout it follows the state, in the packed layout it is the value.
+const importedMarker = 'i'
+
+var packedStates = [...]byte{EdgeNeutral: packedNeutral, EdgeFollow: packedFollow, EdgeBlock: packedBlock}
+
+// ImportEdges writes edges into the index, as if contact messages for them had been indexed.
+// They are marked as imported and are replaced once the real contact messages for the same pairs of feeds are indexed.
+// Edges for pairs that already have a verified contact message are skipped.
+func (b *builder) ImportEdges(edges []Edge) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	for _, e := range edges {
+		if err := e.check(); err != nil {
+			return err
+		}
+	}
+
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	var imported []Edge
+	err := b.update("importEdges", func(txn *badger.Txn) error {
+		imported = nil
+		for _, e := range edges {
+			if e.From.Equal(e.To) {
+				continue
+			}
+			addr := []byte(storedrefs.Feed(e.From) + storedrefs.Feed(e.To))
+
+			var err error
+			if b.layout == LayoutPacked {
+				err = importPacked(txn, addr, e.State)
+			} else {
+				err = importValue(txn, addr, e.State)
+			}
+			if err == errVerifiedEdge {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("ssb/graph: failed to import %s -> %s: %w", e.From.ShortRef(), e.To.ShortRef(), err)
+			}
+			imported = append(imported, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.invalidate()
+	for _, e := range imported {
+		b.contactChanged(e.From, e.To, e.State == EdgeFollow)
+	}
+	return nil
+}
+
+var errVerifiedEdge = errors.New("ssb/graph: edge is verified")
+
+func importValue(txn *badger.Txn, addr []byte, state int) error {
+	it, err := txn.Get(addr)
+	if err == nil {
+		verified := true
+		err = it.Value(func(v []byte) error {
+			verified = !isImportedValue(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if verified {
+			return errVerifiedEdge
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	return txn.Set(addr, []byte{'0' + byte(state), importedMarker})
+}
+
+func importPacked(txn *badger.Txn, addr []byte, state int) error {
+	for _, p := range packedPrefixes {
+		it, err := txn.Get(packedKey(p, addr))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		verified := true
+		err = it.Value(func(v []byte) error {
+			verified = !(len(v) == 1 && v[0] == importedMarker)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if verified {
+			return errVerifiedEdge
+		}
+		if err := txn.Delete(packedKey(p, addr)); err != nil {
+			return err
+		}
+	}
+	return txn.Set(packedKey(packedStates[state], addr), []byte{importedMarker})
+}
+
+func isImportedValue(v []byte) bool {
+	return len(v) == 2 && v[1] == importedMarker
+}
+
+// isImported returns true if the edge from -> to was imported and not replaced by a contact message yet.
+func (b *builder) isImported(from, to *refs.FeedRef) (bool, error) {
+	addr := []byte(storedrefs.Feed(from) + storedrefs.Feed(to))
+	var imported bool
+	err := b.db().View(func(txn *badger.Txn) error {
+		if b.layout == LayoutPacked {
+			for _, p := range packedPrefixes {
+				it, err := txn.Get(packedKey(p, addr))
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				return it.Value(func(v []byte) error {
+					imported = len(v) == 1 && v[0] == importedMarker
+					return nil
+				})
+			}
+			return nil
+		}
+
+		it, err := txn.Get(addr)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return it.Value(func(v []byte) error {
+			imported = isImportedValue(v)
+			return nil
+		})
+	})
+	return imported, err
+}
+
+// ImportEdges adds edges to the graph, see the badger builder.
+// The log builder only keeps them in memory, until a contact message for the same pair of feeds replaces them.
+func (b *logBuilder) ImportEdges(edges []Edge) error {
+	for _, e := range edges {
+		if err := e.check(); err != nil {
+			return err
+		}
+	}
+
+	g := b.graph()
+	g.Lock()
+	defer g.Unlock()
+	dg := g.WeightedDirectedGraph
+
+	for _, e := range edges {
+		if e.From.Equal(e.To) {
+			continue
+		}
+
+		bfrom := storedrefs.Feed(e.From)
+		g.sources[bfrom] = struct{}{}
+		nFrom, has := g.lookup[bfrom]
+		if !has {
+			nFrom = &contactNode{dg.NewNode(), e.From.Copy(), ""}
+			dg.AddNode(nFrom)
+			g.lookup[bfrom] = nFrom
+		}
+
+		bto := storedrefs.Feed(e.To)
+		nTo, has := g.lookup[bto]
+		if !has {
+			nTo = &contactNode{dg.NewNode(), e.To.Copy(), ""}
+			dg.AddNode(nTo)
+			g.lookup[bto] = nTo
+		}
+
+		if e.State == EdgeNeutral {
+			if dg.HasEdgeFromTo(nFrom.ID(), nTo.ID()) {
+				dg.RemoveEdge(nFrom.ID(), nTo.ID())
+			}
+			continue
+		}
+
+		w := 1.0
+		if e.State == EdgeBlock {
+			w = math.Inf(1)
+		}
+		dg.SetWeightedEdge(contactEdge{
+			WeightedEdge: simple.WeightedEdge{F: nFrom, T: nTo, W: w},
+			isBlock:      e.State == EdgeBlock,
+		})
+	}
+	return nil
+}
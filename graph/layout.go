@@ -0,0 +1,237 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+	"go.mindeco.de/ssb-refs/tfk"
+)
+
+// IndexLayout defines how the contact states are stored in badger.
+type IndexLayout uint
+
+const (
+	// LayoutValues stores the pair of feeds as the key and the state ('0', '1' or '2') as the value.
+	LayoutValues IndexLayout = iota
+
+	// LayoutPacked prefixes the pair of feeds with the state and stores no value.
+	// This way the edges can be classified by only looking at the keys, which is much faster to scan.
+	LayoutPacked
+)
+
+// key prefixes of the packed layout
+const (
+	packedNeutral byte = 'N'
+	packedFollow  byte = 'F'
+	packedBlock   byte = 'B'
+)
+
+var packedPrefixes = []byte{packedNeutral, packedFollow, packedBlock}
+
+// 1 byte state prefix + 2 stored feed refs
+const packedKeyLen = 1 + 68
+
+func packedKey(state byte, pair []byte) []byte {
+	k := make([]byte, 1+len(pair))
+	k[0] = state
+	copy(k[1:], pair)
+	return k
+}
+
+// packedWeight returns the weight of the edge for a packed key and false if the key isn't a contact entry
+func packedWeight(k []byte) (float64, bool) {
+	if len(k) != packedKeyLen {
+		return 0, false
+	}
+	switch k[0] {
+	case packedNeutral:
+		return math.Inf(-1), true
+	case packedFollow:
+		return 1, true
+	case packedBlock:
+		return math.Inf(1), true
+	}
+	return 0, false
+}
+
+// setPacked replaces the state for the pair of feeds in addr in txn. A ttl above zero makes the entry expire.
+func setPacked(txn *badger.Txn, addr []byte, state byte, ttl time.Duration) error {
+	for _, p := range packedPrefixes {
+		if p == state {
+			continue
+		}
+		if err := txn.Delete(packedKey(p, addr)); err != nil {
+			return err
+		}
+	}
+	e := badger.NewEntry(packedKey(state, addr), nil)
+	if ttl > 0 {
+		e = e.WithTTL(ttl)
+	}
+	return txn.SetEntry(e)
+}
+
+func (b *builder) buildPackedGraph(opts BuildOpts) (*Graph, error) {
+	var edges []storedEdge
+	err := b.db().View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		for _, p := range packedPrefixes {
+			prefix := []byte{p}
+			for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+				k := iter.Item().Key()
+				w, ok := packedWeight(k)
+				if !ok {
+					continue
+				}
+				b.scheduleExpiryAt(iter.Item().ExpiresAt())
+
+				if !opts.includes(w) {
+					w = math.Inf(-1)
+				}
+
+				k = iter.Item().KeyCopy(nil)
+				edges = append(edges, storedEdge{from: k[1:35], to: k[35:], w: w})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dg := NewGraph()
+	if err := dg.addContactEdges(edges); err != nil {
+		return nil, err
+	}
+
+	if opts.TrackOrphans {
+		dg.markOrphans()
+	}
+	return dg, nil
+}
+
+func (b *builder) followsStreamPacked(ctx context.Context, forRef *refs.FeedRef, fn func(*refs.FeedRef) error) error {
+	return b.db().View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		prefix := packedKey(packedFollow, []byte(storedrefs.Feed(forRef)))
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			k := iter.Item().Key()
+			if len(k) != packedKeyLen {
+				continue
+			}
+
+			var sr tfk.Feed
+			err := sr.UnmarshalBinary(k[35:])
+			if err != nil {
+				return fmt.Errorf("follows(%s): invalid ref entry in db for feed: %w", forRef.Ref(), err)
+			}
+			if err := fn(sr.Feed()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *builder) deleteAuthorPacked(who *refs.FeedRef) error {
+	return b.db().Update(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		for _, p := range packedPrefixes {
+			prefix := packedKey(p, []byte(storedrefs.Feed(who)))
+			for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+				k := iter.Item().KeyCopy(nil)
+				if err := txn.Delete(k); err != nil {
+					return fmt.Errorf("DeleteAuthor: failed to drop record %x: %w", k, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateToPackedLayout rewrites all the contact entries of the LayoutValues format in db into LayoutPacked.
+// The sequence of the index is not touched, so the index doesn't need to be rebuild afterwards.
+func MigrateToPackedLayout(db *badger.DB) error {
+	type entry struct {
+		old, packed []byte
+	}
+	var entries []entry
+
+	err := db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			it := iter.Item()
+			k := it.Key()
+			if len(k) != 68 {
+				continue
+			}
+
+			var state byte
+			err := it.Value(func(v []byte) error {
+				w, err := contactWeight(v)
+				if err != nil {
+					return err
+				}
+				switch {
+				case w == 1:
+					state = packedFollow
+				case math.IsInf(w, 1):
+					state = packedBlock
+				default:
+					state = packedNeutral
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("migrate: failed to get value from item:%q: %w", string(k), err)
+			}
+
+			entries = append(entries, entry{
+				old:    it.KeyCopy(nil),
+				packed: packedKey(state, k),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, e := range entries {
+		if err := wb.Set(e.packed, nil); err != nil {
+			return fmt.Errorf("migrate: failed to set packed key: %w", err)
+		}
+		if err := wb.Delete(e.old); err != nil {
+			return fmt.Errorf("migrate: failed to delete old key: %w", err)
+		}
+	}
+	return wb.Flush()
+}
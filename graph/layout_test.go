@@ -0,0 +1,181 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/librarian"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	"go.cryptoscope.co/ssb/internal/testutils"
+	"go.cryptoscope.co/ssb/repo"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// openLayoutDB returns an empty badger database for a contacts index
+func openLayoutDB(t testing.TB) *badger.DB {
+	r := require.New(t)
+	tRepoPath, err := ioutil.TempDir("", "layoutTest")
+	r.NoError(err)
+
+	db, _, _, err := repo.OpenBadgerIndex(repo.New(tRepoPath), "contacts", func(db *badger.DB) (librarian.SeqSetterIndex, librarian.SinkIndex) {
+		return NewBuilder(testutils.NewRelativeTimeLogger(nil), db, nil).OpenIndex()
+	})
+	r.NoError(err)
+	return db
+}
+
+// fillValueLayout writes n feeds, that each follow the next one and block the one after that, in the old layout
+func fillValueLayout(t testing.TB, db *badger.DB, n int) []*refs.FeedRef {
+	r := require.New(t)
+
+	feeds := make([]*refs.FeedRef, n)
+	for i := range feeds {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		feeds[i] = kp.Id
+	}
+
+	wb := db.NewWriteBatch()
+	for i := range feeds {
+		from := storedrefs.Feed(feeds[i])
+		follow := from + storedrefs.Feed(feeds[(i+1)%n])
+		r.NoError(wb.Set([]byte(follow), []byte("1")))
+		block := from + storedrefs.Feed(feeds[(i+2)%n])
+		r.NoError(wb.Set([]byte(block), []byte("2")))
+	}
+	r.NoError(wb.Flush())
+	return feeds
+}
+
+func TestMigrateToPackedLayout(t *testing.T) {
+	r := require.New(t)
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	db := openLayoutDB(t)
+	defer db.Close()
+
+	const n = 50
+	feeds := fillValueLayout(t, db, n)
+
+	valuesGraph, err := NewBuilder(info, db, nil).Build()
+	r.NoError(err)
+	r.Equal(n, valuesGraph.NodeCount())
+	r.Equal(2*n, valuesGraph.Edges().Len())
+
+	r.NoError(MigrateToPackedLayout(db))
+
+	packed := NewBuilderWithLayout(info, db, LayoutPacked, nil)
+	packedGraph, err := packed.Build()
+	r.NoError(err)
+	r.Equal(n, packedGraph.NodeCount())
+	r.Equal(2*n, packedGraph.Edges().Len())
+
+	for i := range feeds {
+		next, afterNext := feeds[(i+1)%n], feeds[(i+2)%n]
+		r.True(packedGraph.Follows(feeds[i], next))
+		r.True(packedGraph.Blocks(feeds[i], afterNext))
+
+		follows, err := packed.Follows(feeds[i])
+		r.NoError(err)
+		r.Equal(1, follows.Count())
+		r.True(follows.Has(next))
+	}
+
+	// the old layout is gone
+	emptyGraph, err := NewBuilder(info, db, nil).Build()
+	r.NoError(err)
+	r.Equal(0, emptyGraph.NodeCount())
+
+	r.NoError(packed.DeleteAuthor(feeds[0]))
+	follows, err := packed.Follows(feeds[0])
+	r.NoError(err)
+	r.Equal(0, follows.Count())
+}
+
+func TestBuildNodeIDsDeterministic(t *testing.T) {
+	r := require.New(t)
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	db := openLayoutDB(t)
+	defer db.Close()
+
+	const n = 30
+	fillValueLayout(t, db, n)
+
+	nodeIDs := func(g *Graph) map[int64]string {
+		ids := make(map[int64]string, len(g.lookup))
+		for _, cn := range g.lookup {
+			ids[cn.ID()] = cn.feed.Ref()
+		}
+		return ids
+	}
+
+	first, err := NewBuilder(info, db, nil).Build()
+	r.NoError(err)
+	second, err := NewBuilder(info, db, nil).Build()
+	r.NoError(err)
+	r.True(first != second, "expected two separate builds")
+	want := nodeIDs(first)
+	r.Len(want, n)
+	r.Equal(want, nodeIDs(second))
+
+	// the IDs follow the order of the stored references
+	var addrs []string
+	for addr := range first.lookup {
+		addrs = append(addrs, string(addr))
+	}
+	sort.Strings(addrs)
+	for i, addr := range addrs {
+		r.EqualValues(i, first.lookup[librarian.Addr(addr)].ID(), "wrong id for %d", i)
+	}
+
+	// the packed layout reads the edges in a different order
+	r.NoError(MigrateToPackedLayout(db))
+	packedGraph, err := NewBuilderWithLayout(info, db, LayoutPacked, nil).Build()
+	r.NoError(err)
+	r.Equal(want, nodeIDs(packedGraph))
+}
+
+func BenchmarkBuildLayouts(b *testing.B) {
+	info := testutils.NewRelativeTimeLogger(nil)
+
+	valuesDB := openLayoutDB(b)
+	defer valuesDB.Close()
+	fillValueLayout(b, valuesDB, 10000)
+
+	packedDB := openLayoutDB(b)
+	defer packedDB.Close()
+	fillValueLayout(b, packedDB, 10000)
+	if err := MigrateToPackedLayout(packedDB); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		bld  *builder
+	}{
+		{"values", NewBuilder(info, valuesDB, nil)},
+		{"packed", NewBuilderWithLayout(info, packedDB, LayoutPacked, nil)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// skip the cache of Build()
+				g, err := bc.bld.buildGraph(BuildOpts{IncludeFollows: true, IncludeBlocks: true})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if g.NodeCount() != 10000 {
+					b.Fatal("wrong node count", g.NodeCount())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+	"sync"
+
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+// LiveReplicationSet is the result of Hops(me, hops) that is kept current while contact messages are indexed.
+//
+// Added follows are patched into the set by walking on from the changed edge.
+// Removed follows (unfollows and blocks) can only shrink the set if they touch one of the friends that are walked,
+// in that case the set is walked again from scratch on the next read. All other changes are ignored.
+type LiveReplicationSet struct {
+	me   *refs.FeedRef
+	hops int
+
+	// follows is used to walk the graph
+	follows func(*refs.FeedRef) (*ssb.StrFeedSet, error)
+
+	// rewalk replaces the whole walk if the builder can't tell which edges changed.
+	// If it is set, the set is computed on every read.
+	rewalk func() (*ssb.StrFeedSet, error)
+
+	unregister func()
+
+	mu sync.Mutex
+
+	// friends are the feeds whose follows are part of the set, by their distance from me
+	friends map[string]int
+	set     *ssb.StrFeedSet
+	stale   bool
+}
+
+// Set returns a copy of the current replication set, without me.
+func (ls *LiveReplicationSet) Set() (*ssb.StrFeedSet, error) {
+	if ls.rewalk != nil {
+		return ls.rewalk()
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.stale {
+		if err := ls.walk(); err != nil {
+			return nil, err
+		}
+	}
+
+	lst, err := ls.set.List()
+	if err != nil {
+		return nil, err
+	}
+	cpy := ssb.NewFeedSet(len(lst))
+	for _, ref := range lst {
+		if ref.Equal(ls.me) {
+			continue
+		}
+		if err := cpy.AddRef(ref); err != nil {
+			return nil, err
+		}
+	}
+	return cpy, nil
+}
+
+// Has returns true if feed is in the replication set.
+func (ls *LiveReplicationSet) Has(feed *refs.FeedRef) bool {
+	set, err := ls.Set()
+	if err != nil {
+		return false
+	}
+	return set.Has(feed)
+}
+
+// Close stops the updates. The set shouldn't be used afterwards.
+func (ls *LiveReplicationSet) Close() error {
+	if ls.unregister != nil {
+		ls.unregister()
+	}
+	return nil
+}
+
+// walk recomputes the set from scratch. It expects ls.mu to be held.
+func (ls *LiveReplicationSet) walk() error {
+	ls.friends = make(map[string]int)
+	ls.set = ssb.NewFeedSet(0)
+	ls.stale = true
+	if err := ls.reach(ls.me, 0); err != nil {
+		return err
+	}
+	ls.stale = false
+	return nil
+}
+
+// reach records that from is a friend at depth and walks on from it, like walkHops does.
+// Friends that were already found at the same or a smaller depth are not walked again.
+// It expects ls.mu to be held.
+func (ls *LiveReplicationSet) reach(from *refs.FeedRef, depth int) error {
+	if d, has := ls.friends[from.Ref()]; has && d <= depth {
+		return nil
+	}
+	ls.friends[from.Ref()] = depth
+
+	queue := []hopsQueueEntry{{feed: from, depth: depth}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		currentFollows, err := ls.follows(current.feed)
+		if err != nil {
+			return fmt.Errorf("live hops(%d): follow listing failed: %w", current.depth, err)
+		}
+		followLst, err := currentFollows.List()
+		if err != nil {
+			return fmt.Errorf("live hops(%d): invalid entry in feed set: %w", current.depth, err)
+		}
+
+		for _, followed := range followLst {
+			if err := ls.set.AddRef(followed); err != nil {
+				return err
+			}
+
+			if current.depth >= ls.hops {
+				continue
+			}
+			if d, has := ls.friends[followed.Ref()]; has && d <= current.depth+1 {
+				continue
+			}
+
+			dstFollows, err := ls.follows(followed)
+			if err != nil {
+				return fmt.Errorf("live hops(%d): follows of %s failed: %w", current.depth, followed.ShortRef(), err)
+			}
+			if dstFollows.Has(current.feed) {
+				ls.friends[followed.Ref()] = current.depth + 1
+				queue = append(queue, hopsQueueEntry{feed: followed, depth: current.depth + 1})
+			}
+		}
+	}
+	return nil
+}
+
+// edgeChanged is called after the contact from->to was indexed.
+func (ls *LiveReplicationSet) edgeChanged(from, to *refs.FeedRef, following bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.stale {
+		return
+	}
+
+	fromDepth, fromIsFriend := ls.friends[from.Ref()]
+	toDepth, toIsFriend := ls.friends[to.Ref()]
+	if !fromIsFriend && !toIsFriend {
+		return
+	}
+
+	if !following {
+		ls.stale = true
+		return
+	}
+
+	err := ls.patchFollow(from, to, fromDepth, fromIsFriend, toDepth, toIsFriend)
+	if err != nil {
+		// try again from scratch on the next read
+		ls.stale = true
+	}
+}
+
+func (ls *LiveReplicationSet) patchFollow(from, to *refs.FeedRef, fromDepth int, fromIsFriend bool, toDepth int, toIsFriend bool) error {
+	if fromIsFriend {
+		if err := ls.set.AddRef(to); err != nil {
+			return err
+		}
+	}
+
+	// the new follow might have made from and to friends
+	toFollows, err := ls.follows(to)
+	if err != nil {
+		return err
+	}
+	if !toFollows.Has(from) {
+		return nil
+	}
+
+	if fromIsFriend && fromDepth < ls.hops {
+		if err := ls.reach(to, fromDepth+1); err != nil {
+			return err
+		}
+	}
+	if toIsFriend && toDepth < ls.hops {
+		if err := ls.reach(from, toDepth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markStale makes the set walk again on the next read
+func (ls *LiveReplicationSet) markStale() {
+	ls.mu.Lock()
+	ls.stale = true
+	ls.mu.Unlock()
+}
+
+// liveListener is told about the contact changes of a builder, see liveSets
+type liveListener interface {
+	// edgeChanged is called after the contact from->to was indexed
+	edgeChanged(from, to *refs.FeedRef, following bool)
+
+	// markStale is called if the builder can't tell which contacts changed, like after a reindex
+	markStale()
+}
+
+// liveSets are the live replication sets and follow watchers of a builder
+type liveSets struct {
+	mu   sync.Mutex
+	sets map[liveListener]struct{}
+}
+
+// add registers l and returns a function to unregister it again
+func (lss *liveSets) add(l liveListener) func() {
+	lss.mu.Lock()
+	defer lss.mu.Unlock()
+	if lss.sets == nil {
+		lss.sets = make(map[liveListener]struct{})
+	}
+	lss.sets[l] = struct{}{}
+	return func() {
+		lss.mu.Lock()
+		defer lss.mu.Unlock()
+		delete(lss.sets, l)
+	}
+}
+
+func (lss *liveSets) edgeChanged(from, to *refs.FeedRef, following bool) {
+	lss.mu.Lock()
+	defer lss.mu.Unlock()
+	for l := range lss.sets {
+		l.edgeChanged(from, to, following)
+	}
+}
+
+// markStale makes all sets walk again on their next read
+func (lss *liveSets) markStale() {
+	lss.mu.Lock()
+	defer lss.mu.Unlock()
+	for l := range lss.sets {
+		l.markStale()
+	}
+}
+
+// LiveReplicationSet returns the feeds that are at most hops away from me, see Hops.
+// The set is patched as contact messages are indexed, instead of walking the graph again on every change.
+// Close it once it isn't needed anymore.
+func (b *builder) LiveReplicationSet(me *refs.FeedRef, hops int) (*LiveReplicationSet, error) {
+	ls := &LiveReplicationSet{
+		me:      me.Copy(),
+		hops:    hops,
+		follows: b.Follows,
+	}
+
+	// register first, so that no change is missed while walking
+	ls.unregister = b.live.add(ls)
+
+	ls.mu.Lock()
+	err := ls.walk()
+	ls.mu.Unlock()
+	if err != nil {
+		ls.unregister()
+		return nil, fmt.Errorf("LiveReplicationSet: %w", err)
+	}
+	return ls, nil
+}
+
+// LiveReplicationSet returns the feeds that are at most hops away from me.
+// The log builder doesn't know which contacts changed, so the returned set calls Hops on every read.
+func (b *logBuilder) LiveReplicationSet(me *refs.FeedRef, hops int) (*LiveReplicationSet, error) {
+	me = me.Copy()
+	return &LiveReplicationSet{
+		me:   me,
+		hops: hops,
+		rewalk: func() (*ssb.StrFeedSet, error) {
+			set := b.Hops(me, hops)
+			if set == nil {
+				return nil, fmt.Errorf("LiveReplicationSet: failed to walk hops of %s", me.ShortRef())
+			}
+			set.Delete(me)
+			return set, nil
+		},
+	}, nil
+}
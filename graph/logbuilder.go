@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	kitlog "github.com/go-kit/kit/log"
@@ -26,9 +27,13 @@ type logBuilder struct {
 
 	contactsLog margaret.Log
 
-	current *Graph
-
+	// mu guards current and currentQueryCancel, the graph itself has its own lock
+	mu                 sync.Mutex
+	current            *Graph
 	currentQueryCancel context.CancelFunc
+
+	// denied is only kept in memory
+	denied memDenyList
 }
 
 // NewLogBuilder is a much nicer abstraction than the direct k:v implementation.
@@ -66,17 +71,29 @@ func (b *logBuilder) startQuery(ctx context.Context) {
 
 // DeleteAuthor just triggers a rebuild (and expects the author to have dissapeard from the message source)
 func (b *logBuilder) DeleteAuthor(who *refs.FeedRef) error {
-	b.current.Lock()
-	defer b.current.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	b.currentQueryCancel()
-	b.current = nil
+	b.current = NewGraph()
+	b.restartQuery()
+	return nil
+}
 
+// restartQuery cancels the running live query and starts a new one. It expects mu to be held.
+func (b *logBuilder) restartQuery() {
+	if b.currentQueryCancel != nil {
+		b.currentQueryCancel()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	go b.startQuery(ctx)
 	b.currentQueryCancel = cancel
+}
 
-	return nil
+// graph returns the current graph, it is replaced by DeleteAuthor and Reindex.
+func (b *logBuilder) graph() *Graph {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current
 }
 
 func (b *logBuilder) Authorizer(from *refs.FeedRef, maxHops int) ssb.Authorizer {
@@ -88,16 +105,81 @@ func (b *logBuilder) Authorizer(from *refs.FeedRef, maxHops int) ssb.Authorizer
 	}
 }
 
-func (b *logBuilder) Build() (*Graph, error) {
-	b.current.Lock()
-	defer b.current.Unlock()
+// WithDenyList replaces the deny-list. Unlike the badger builder, the log builder doesn't persist it.
+func (b *logBuilder) WithDenyList(feeds []*refs.FeedRef) error {
+	b.denied.set(feeds)
+	return nil
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	go b.startQuery(ctx)
-	b.currentQueryCancel = cancel
+func (b *logBuilder) AddDeny(feed *refs.FeedRef) error {
+	b.denied.add(feed)
+	return nil
+}
+
+func (b *logBuilder) RemoveDeny(feed *refs.FeedRef) error {
+	b.denied.remove(feed)
+	return nil
+}
+
+func (b *logBuilder) IsDenied(feed *refs.FeedRef) (bool, error) {
+	return b.denied.has(feed), nil
+}
+
+func (b *logBuilder) DenyList() (*ssb.StrFeedSet, error) {
+	return b.denied.list()
+}
+
+func (b *logBuilder) Build() (*Graph, error) {
+	b.mu.Lock()
+	b.restartQuery()
+	b.mu.Unlock()
 
 	time.Sleep(1 * time.Second)
-	return b.current, nil
+	return b.graph(), nil
+}
+
+func (b *logBuilder) BuildFiltered(opts BuildOpts) (*Graph, error) {
+	g, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	filtered := NewGraph()
+	for k, n := range g.lookup {
+		filtered.AddNode(n)
+		filtered.lookup[k] = n
+	}
+	for k := range g.sources {
+		filtered.sources[k] = struct{}{}
+	}
+
+	edges := g.WeightedEdges()
+	for edges.Next() {
+		edg := edges.WeightedEdge()
+		if opts.includes(edg.Weight()) {
+			filtered.SetWeightedEdge(edg)
+		}
+	}
+
+	if opts.TrackOrphans {
+		filtered.markOrphans()
+	}
+	return filtered, nil
+}
+
+func (b *logBuilder) BuildSubgraph(members *ssb.StrFeedSet) (*Graph, error) {
+	g, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	return g.Subgraph(members), nil
+}
+
+func (b *logBuilder) BuildAsOf(receiveLog margaret.Log, beforeSeq int64) (*Graph, error) {
+	return buildAsOf(receiveLog, beforeSeq)
 }
 
 func (b *logBuilder) buildGraph(ctx context.Context, v interface{}, err error) error {
@@ -108,9 +190,10 @@ func (b *logBuilder) buildGraph(ctx context.Context, v interface{}, err error) e
 		return err
 	}
 
-	b.current.Lock()
-	defer b.current.Unlock()
-	dg := b.current.WeightedDirectedGraph
+	g := b.graph()
+	g.Lock()
+	defer g.Unlock()
+	dg := g.WeightedDirectedGraph
 
 	abs, ok := v.(refs.Message)
 	if !ok {
@@ -127,6 +210,10 @@ func (b *logBuilder) buildGraph(ctx context.Context, v interface{}, err error) e
 
 	author := abs.Author()
 	contact := c.Contact
+	if checkFeedRef(author) != nil || checkFeedRef(contact) != nil {
+		// like the badger builder, don't add nodes for broken refs
+		return nil
+	}
 
 	if author.Equal(contact) {
 		// contact self?!
@@ -134,19 +221,20 @@ func (b *logBuilder) buildGraph(ctx context.Context, v interface{}, err error) e
 	}
 
 	bfrom := storedrefs.Feed(author)
-	nFrom, has := b.current.lookup[bfrom]
+	g.sources[bfrom] = struct{}{}
+	nFrom, has := g.lookup[bfrom]
 	if !has {
 		nFrom = &contactNode{dg.NewNode(), author.Copy(), ""}
 		dg.AddNode(nFrom)
-		b.current.lookup[bfrom] = nFrom
+		g.lookup[bfrom] = nFrom
 	}
 
 	bto := storedrefs.Feed(contact)
-	nTo, has := b.current.lookup[bto]
+	nTo, has := g.lookup[bto]
 	if !has {
 		nTo = &contactNode{dg.NewNode(), contact.Copy(), ""}
 		dg.AddNode(nTo)
-		b.current.lookup[bto] = nTo
+		g.lookup[bto] = nTo
 	}
 
 	w := math.Inf(-1)
@@ -198,13 +286,97 @@ func (b *logBuilder) Follows(from *refs.FeedRef) (*ssb.StrFeedSet, error) {
 	return refs, nil
 }
 
+func (b *logBuilder) FollowsStream(ctx context.Context, from *refs.FeedRef, fn func(*refs.FeedRef) error) error {
+	fs, err := b.Follows(from)
+	if err != nil {
+		return err
+	}
+	lst, err := fs.List()
+	if err != nil {
+		return err
+	}
+	for _, ref := range lst {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *logBuilder) FollowedButBlockedBy(me *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	g, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	follows, err := b.Follows(me)
+	if err != nil {
+		return nil, err
+	}
+	lst, err := follows.List()
+	if err != nil {
+		return nil, err
+	}
+	blockedBy := ssb.NewFeedSet(0)
+	for _, followed := range lst {
+		if g.Blocks(followed, me) {
+			blockedBy.AddRef(followed)
+		}
+	}
+	return blockedBy, nil
+}
+
+// DoesFollow checks the graph, the log builder has no index to look up a single entry in
+func (b *logBuilder) DoesFollow(a, c *refs.FeedRef) (bool, error) {
+	g, err := b.Build()
+	if err != nil {
+		return false, fmt.Errorf("DoesFollow: %w", err)
+	}
+	return g.Follows(a, c), nil
+}
+
+// DoesBlock is like DoesFollow but for blocks
+func (b *logBuilder) DoesBlock(a, c *refs.FeedRef) (bool, error) {
+	g, err := b.Build()
+	if err != nil {
+		return false, fmt.Errorf("DoesBlock: %w", err)
+	}
+	return g.Blocks(a, c), nil
+}
+
+func (b *logBuilder) CommonFollows(a, c *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	return commonFollows(b, a, c)
+}
+
+func (b *logBuilder) ReciprocityRate(feed *refs.FeedRef) (float64, error) {
+	return reciprocityRate(b, feed)
+}
+
+func (b *logBuilder) CommunityGaps(me *refs.FeedRef, members *ssb.StrFeedSet) (*ssb.StrFeedSet, error) {
+	return communityGaps(b, me, members)
+}
+
+func (b *logBuilder) PopularAmongFollows(me *refs.FeedRef, threshold float64) (*ssb.StrFeedSet, error) {
+	return suggestions(b, me, SuggestionOpts{Threshold: threshold})
+}
+
+func (b *logBuilder) Suggestions(me *refs.FeedRef, opts SuggestionOpts) (*ssb.StrFeedSet, error) {
+	return suggestions(b, me, opts)
+}
+
+func (b *logBuilder) Components() ([][]*refs.FeedRef, error) {
+	return components(b)
+}
+
 func (b *logBuilder) Hops(from *refs.FeedRef, max int) *ssb.StrFeedSet {
 	g, err := b.Build()
 	if err != nil {
 		panic(err)
 	}
-	b.current.Lock()
-	defer b.current.Unlock()
+	g.Lock()
+	defer g.Unlock()
 	fb := storedrefs.Feed(from)
 	nFrom, has := g.lookup[fb]
 	if !has {
@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// neighborhoodCacheSize is the number of neighborhood graphs the badger builder keeps around
+const neighborhoodCacheSize = 32
+
+// NeighborhoodGraph returns the graph of focus and the feeds that are at most hops away from it, see Hops.
+// The results are cached until the next contact message is indexed.
+func (b *builder) NeighborhoodGraph(focus *refs.FeedRef, hops int) (*Graph, error) {
+	key := neighborhoodKey{focus: focus.Ref(), hops: hops}
+	g, gen, has := b.neighborhoods.get(key)
+	if has {
+		return g, nil
+	}
+
+	g, err := neighborhoodGraph(b, focus, hops)
+	if err != nil {
+		return nil, err
+	}
+	b.neighborhoods.put(key, g, gen)
+	return g, nil
+}
+
+// NeighborhoodGraph returns the graph of focus and the feeds that are at most hops away from it, see Hops.
+func (b *logBuilder) NeighborhoodGraph(focus *refs.FeedRef, hops int) (*Graph, error) {
+	return neighborhoodGraph(b, focus, hops)
+}
+
+func neighborhoodGraph(bld Builder, focus *refs.FeedRef, hops int) (*Graph, error) {
+	members := bld.Hops(focus, hops)
+	if members == nil {
+		return nil, fmt.Errorf("neighborhoodGraph: failed to walk hops of %s", focus.ShortRef())
+	}
+	if err := members.AddRef(focus); err != nil {
+		return nil, err
+	}
+	return bld.BuildSubgraph(members)
+}
+
+type neighborhoodKey struct {
+	focus string
+	hops  int
+}
+
+type neighborhoodEntry struct {
+	key neighborhoodKey
+	g   *Graph
+}
+
+// neighborhoodCache is a least recently used cache of neighborhood graphs
+type neighborhoodCache struct {
+	mu   sync.Mutex
+	size int
+
+	// gen is increased by purge, so that graphs that were built before it aren't put back in
+	gen uint64
+
+	order   *list.List // front is the most recently used
+	entries map[neighborhoodKey]*list.Element
+}
+
+func newNeighborhoodCache(size int) *neighborhoodCache {
+	return &neighborhoodCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[neighborhoodKey]*list.Element),
+	}
+}
+
+// get returns the cached graph for key. The returned generation has to be passed to put.
+func (nc *neighborhoodCache) get(key neighborhoodKey) (*Graph, uint64, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	el, has := nc.entries[key]
+	if !has {
+		return nil, nc.gen, false
+	}
+	nc.order.MoveToFront(el)
+	return el.Value.(*neighborhoodEntry).g, nc.gen, true
+}
+
+// put adds g unless the cache was purged since gen was handed out by get
+func (nc *neighborhoodCache) put(key neighborhoodKey, g *Graph, gen uint64) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if gen != nc.gen {
+		return
+	}
+	if el, has := nc.entries[key]; has {
+		el.Value.(*neighborhoodEntry).g = g
+		nc.order.MoveToFront(el)
+		return
+	}
+	nc.entries[key] = nc.order.PushFront(&neighborhoodEntry{key: key, g: g})
+	for nc.order.Len() > nc.size {
+		oldest := nc.order.Back()
+		nc.order.Remove(oldest)
+		delete(nc.entries, oldest.Value.(*neighborhoodEntry).key)
+	}
+}
+
+func (nc *neighborhoodCache) purge() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.gen++
+	nc.order.Init()
+	nc.entries = make(map[neighborhoodKey]*list.Element)
+}
+
+func (nc *neighborhoodCache) len() int {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.order.Len()
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	refs "go.mindeco.de/ssb-refs"
+	"go.mindeco.de/ssb-refs/tfk"
+
+	"go.cryptoscope.co/ssb"
+)
+
+// BuilderOption configures optional behaviour of NewBuilder
+type BuilderOption func(*builder)
+
+// WithOwnerBlocks makes the builder leave out the feeds that owner blocks from the results of Follows.
+// Since Hops, LiveReplicationSet and Suggestions are computed from it, those feeds are pruned from them as well, even if they are reachable.
+// Nothing else is filtered: Build and the graph it returns, FollowsStream, DoesFollow and DoesBlock still see all the edges.
+func WithOwnerBlocks(owner *refs.FeedRef) BuilderOption {
+	return func(b *builder) {
+		b.owner = owner.Copy()
+	}
+}
+
+// ownerBlocks caches the feeds the owner blocks.
+// Indexing a contact only purges it if the owner published it, everything else that rewrites the index purges it always.
+type ownerBlocks struct {
+	mu      sync.Mutex
+	blocked *ssb.StrFeedSet
+}
+
+func (ob *ownerBlocks) purge() {
+	ob.mu.Lock()
+	ob.blocked = nil
+	ob.mu.Unlock()
+}
+
+// ownerBlocked returns the feeds the owner blocks, an empty set if no owner is configured.
+// It doesn't use cacheLock, so that it can be used while the index is updated.
+func (b *builder) ownerBlocked() (*ssb.StrFeedSet, error) {
+	if b.owner == nil {
+		return ssb.NewFeedSet(0), nil
+	}
+
+	b.ownerBlocks.mu.Lock()
+	defer b.ownerBlocks.mu.Unlock()
+	if b.ownerBlocks.blocked != nil {
+		return b.ownerBlocks.blocked, nil
+	}
+
+	blocked, err := b.blocksOf(b.owner)
+	if err != nil {
+		return nil, fmt.Errorf("owner blocks: %w", err)
+	}
+	b.ownerBlocks.blocked = blocked
+	return blocked, nil
+}
+
+// blocksOf reads the feeds who blocks from the index.
+func (b *builder) blocksOf(who *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	weights, err := b.outgoingWeights(who)
+	if err != nil {
+		return nil, fmt.Errorf("blocks: %w", err)
+	}
+
+	blocked := ssb.NewFeedSet(0)
+	for k, w := range weights {
+		if !math.IsInf(w, 1) {
+			continue
+		}
+		var sr tfk.Feed
+		if err := sr.UnmarshalBinary([]byte(k)); err != nil {
+			return nil, fmt.Errorf("blocks(%s): invalid ref entry in db for feed: %w", who.Ref(), err)
+		}
+		if err := blocked.AddRef(sr.Feed()); err != nil {
+			return nil, err
+		}
+	}
+	return blocked, nil
+}
+
+// contactChanged tells the live sets about an indexed contact.
+// Changes of the owner can change which feeds are pruned, so the sets walk again instead.
+func (b *builder) contactChanged(from, to *refs.FeedRef, following bool) {
+	if b.owner != nil {
+		if from.Equal(b.owner) {
+			b.live.markStale()
+			return
+		}
+		blocked, err := b.ownerBlocked()
+		if err != nil {
+			b.live.markStale()
+			return
+		}
+		if blocked.Has(to) {
+			// follows of pruned feeds don't change the results
+			return
+		}
+	}
+	b.live.edgeChanged(from, to, following)
+}
@@ -237,7 +237,7 @@ type PeopleTestCase struct {
 	asserts []PeopleAssertMaker
 }
 
-func (tc PeopleTestCase) run(mk func(t *testing.T) testStore) func(t *testing.T) {
+func (tc PeopleTestCase) run(mk func(t testing.TB) testStore) func(t *testing.T) {
 	return func(t *testing.T) {
 		r := require.New(t)
 		a := assert.New(t)
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.cryptoscope.co/margaret"
+	"go.cryptoscope.co/margaret/multilog"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb/internal/mutil"
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+)
+
+// ErrNoProvenance is returned by EdgeProvenance if there is no contact message for the pair of feeds,
+// for instance because the edge was imported or the messages of the author were deleted.
+var ErrNoProvenance = errors.New("ssb/graph: no contact message for edge")
+
+func (b *builder) EdgeProvenance(ctx context.Context, from, to *refs.FeedRef, receiveLog margaret.Log, userFeeds multilog.MultiLog) (*refs.MessageRef, int64, error) {
+	return edgeProvenance(ctx, from, to, receiveLog, userFeeds)
+}
+
+func (b *logBuilder) EdgeProvenance(ctx context.Context, from, to *refs.FeedRef, receiveLog margaret.Log, userFeeds multilog.MultiLog) (*refs.MessageRef, int64, error) {
+	return edgeProvenance(ctx, from, to, receiveLog, userFeeds)
+}
+
+// edgeProvenance reads the feed of from backwards until it finds the latest contact message about to.
+// That is the one the current state of the edge comes from, since every contact message replaces the state of the ones before it.
+// The returned sequence is the one of the message in the feed of from.
+func edgeProvenance(ctx context.Context, from, to *refs.FeedRef, receiveLog margaret.Log, userFeeds multilog.MultiLog) (*refs.MessageRef, int64, error) {
+	userLog, err := userFeeds.Get(storedrefs.Feed(from))
+	if err != nil {
+		return nil, 0, fmt.Errorf("edgeProvenance: failed to open sublog of %s: %w", from.ShortRef(), err)
+	}
+
+	msg, err := mutil.FindLatest(ctx, receiveLog, userLog, func(msg refs.Message) bool {
+		var c refs.Contact
+		if err := c.UnmarshalJSON(msg.ContentBytes()); err != nil {
+			// not a (valid) contact message
+			return false
+		}
+		return c.Contact.Equal(to)
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("edgeProvenance: %w", err)
+	}
+	if msg == nil {
+		return nil, 0, fmt.Errorf("edgeProvenance(%s -> %s): %w", from.ShortRef(), to.ShortRef(), ErrNoProvenance)
+	}
+	return msg.Key(), msg.Seq(), nil
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+)
+
+// PruneBeyondHops deletes the contact entries of all the feeds that are more than maxHops away from from, see Hops.
+// The entries of from, the feeds of its hop set and the owner of WithOwnerBlocks are kept, which are all the ones the walk reads.
+// It returns the number of deleted entries. Contacts of pruned feeds that are indexed later are stored again.
+func (b *builder) PruneBeyondHops(from *refs.FeedRef, maxHops int) (int, error) {
+	if b.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	// hold the lock while walking, so that the set can't change before the entries are deleted
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	inRange, err := b.walkHops(from, maxHops, nil)
+	if err != nil {
+		return 0, fmt.Errorf("PruneBeyondHops: failed to walk hops: %w", err)
+	}
+	inRange.AddRef(from)
+	if b.owner != nil {
+		inRange.AddRef(b.owner)
+	}
+	lst, err := inRange.List()
+	if err != nil {
+		return 0, fmt.Errorf("PruneBeyondHops: invalid entry in hop set: %w", err)
+	}
+	keep := make(map[string]struct{}, len(lst))
+	for _, f := range lst {
+		keep[string(storedrefs.Feed(f))] = struct{}{}
+	}
+
+	var pruned, seqKeys [][]byte
+	err = b.db().View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			k := iter.Item().Key()
+
+			var pair []byte
+			if _, isPacked := packedWeight(k); isPacked {
+				pair = k[1:]
+			} else if len(k) == contactKeyLen {
+				pair = k
+			} else {
+				continue
+			}
+			author := pair[:34]
+
+			if _, has := keep[string(author)]; has {
+				continue
+			}
+			pruned = append(pruned, iter.Item().KeyCopy(nil))
+			seqKeys = append(seqKeys, []byte(edgeSeqKey(pair)))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("PruneBeyondHops: failed to collect entries: %w", err)
+	}
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	// batched, a large graph has too many entries for one transaction
+	err = deleteKeys(b.db(), append(pruned, seqKeys...))
+	b.invalidate()
+	b.live.markStale()
+	if err != nil {
+		return 0, fmt.Errorf("PruneBeyondHops: %w", err)
+	}
+	return len(pruned), nil
+}
+
+// PruneBeyondHops has nothing to do for the log builder, it reads all the contacts from the log on every Build.
+func (b *logBuilder) PruneBeyondHops(from *refs.FeedRef, maxHops int) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"go.cryptoscope.co/ssb"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// RankFeedsForPeer orders feeds by how relevant they are to peer, most relevant first.
+func (b *builder) RankFeedsForPeer(peer *refs.FeedRef, feeds *ssb.StrFeedSet) ([]*refs.FeedRef, error) {
+	return rankFeedsForPeer(b, peer, feeds)
+}
+
+// RankFeedsForPeer orders feeds by how relevant they are to peer, most relevant first.
+func (b *logBuilder) RankFeedsForPeer(peer *refs.FeedRef, feeds *ssb.StrFeedSet) ([]*refs.FeedRef, error) {
+	return rankFeedsForPeer(b, peer, feeds)
+}
+
+type rankedFeed struct {
+	ref *refs.FeedRef
+
+	// hops is the follow distance from the peer, math.MaxInt64 if it's not reachable
+	hops   int
+	mutual bool
+}
+
+// rankFeedsForPeer sorts by the follow distance from peer first, feeds that peer can't reach come last.
+// Feeds on the same distance that follow peer back come before the others and the rest is ordered by reference, to keep the order stable.
+func rankFeedsForPeer(bld Builder, peer *refs.FeedRef, feeds *ssb.StrFeedSet) ([]*refs.FeedRef, error) {
+	lst, err := feeds.List()
+	if err != nil {
+		return nil, fmt.Errorf("rankFeeds: invalid feed in set: %w", err)
+	}
+
+	g, err := bld.Build()
+	if err != nil {
+		return nil, fmt.Errorf("rankFeeds: failed to build graph: %w", err)
+	}
+
+	dist, err := g.MakeDijkstra(peer)
+	if err != nil {
+		var nsf ErrNoSuchFrom
+		if !errors.As(err, &nsf) {
+			return nil, fmt.Errorf("rankFeeds: failed to construct dijkstra: %w", err)
+		}
+		// the peer doesn't follow anyone, so nothing is reachable
+		dist = nil
+	}
+
+	ranked := make([]rankedFeed, len(lst))
+	for i, f := range lst {
+		rf := rankedFeed{ref: f, hops: math.MaxInt64}
+		switch {
+		case f.Equal(peer):
+			rf.hops = 0
+		case dist != nil:
+			p, d := dist.Dist(f)
+			if len(p) > 1 && !math.IsInf(d, 0) {
+				rf.hops = len(p) - 1
+			}
+		}
+		rf.mutual = g.Follows(peer, f) && g.Follows(f, peer)
+		ranked[i] = rf
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.hops != b.hops {
+			return a.hops < b.hops
+		}
+		if a.mutual != b.mutual {
+			return a.mutual
+		}
+		return a.ref.Ref() < b.ref.Ref()
+	})
+
+	out := make([]*refs.FeedRef, len(ranked))
+	for i, rf := range ranked {
+		out[i] = rf.ref
+	}
+	return out, nil
+}
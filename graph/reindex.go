@@ -0,0 +1,299 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+	"go.cryptoscope.co/luigi"
+	"go.cryptoscope.co/margaret"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// ReindexProgressFunc is told how many of the messages of the receive log were replayed so far.
+type ReindexProgressFunc func(done, total int64)
+
+// reindexProgressInterval is the number of messages between two progress reports
+const reindexProgressInterval = 1000
+
+// contactKeyLen is the length of the keys of the values layout, two stored feed refs
+const contactKeyLen = 68
+
+// ReindexOpts configures ReindexWithOpts.
+type ReindexOpts struct {
+	// Progress is optional and is called every few messages and once at the end
+	Progress ReindexProgressFunc
+
+	// SkipUnchanged keeps the contacts instead of dropping them first and only writes the ones that have a different state.
+	// This is much cheaper for repairs of an index that is mostly correct, but entries that no message sets are kept as they are.
+	SkipUnchanged bool
+}
+
+// Reindex drops all the contacts of the index and replays every message of receiveLog through the index update function,
+// for instance after the index got corrupted. progress is optional and is called every few messages and once at the end.
+// The deny-list is kept. The sink of the index shouldn't be served while this runs.
+// If ctx is canceled, the index is left half done and has to be reindexed again.
+func (b *builder) Reindex(ctx context.Context, receiveLog margaret.Log, progress ReindexProgressFunc) error {
+	return b.ReindexWithOpts(ctx, receiveLog, ReindexOpts{Progress: progress})
+}
+
+// ReindexWithOpts is like Reindex but can skip the contacts that already have the right state, see ReindexOpts.
+func (b *builder) ReindexWithOpts(ctx context.Context, receiveLog margaret.Log, opts ReindexOpts) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	progress := opts.Progress
+
+	total, err := reindexTotal(receiveLog)
+	if err != nil {
+		return err
+	}
+
+	if !opts.SkipUnchanged {
+		if err := b.clearContacts(); err != nil {
+			return fmt.Errorf("reindex: failed to clear the index: %w", err)
+		}
+	}
+
+	src, err := receiveLog.Query(margaret.SeqWrap(true))
+	if err != nil {
+		return fmt.Errorf("reindex: failed to query receive log: %w", err)
+	}
+
+	var (
+		done int64
+		last margaret.Seq
+	)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		v, err := src.Next(ctx)
+		if err != nil {
+			if luigi.IsEOS(err) {
+				break
+			}
+			return fmt.Errorf("reindex: failed to get next message: %w", err)
+		}
+
+		sw, ok := v.(margaret.SeqWrapper)
+		if !ok {
+			return fmt.Errorf("reindex: unexpected value %T", v)
+		}
+		last = sw.Seq()
+
+		unchanged := false
+		if opts.SkipUnchanged {
+			unchanged, err = b.contactUnchanged(sw.Value())
+			if err != nil {
+				return fmt.Errorf("reindex: failed to look up stored contact of message %d: %w", sw.Seq().Seq(), err)
+			}
+		}
+		if !unchanged {
+			if err := b.indexUpdateFunc(ctx, sw.Seq(), sw.Value(), b.idx); err != nil {
+				return fmt.Errorf("reindex: failed to index message %d: %w", sw.Seq().Seq(), err)
+			}
+		}
+
+		done++
+		if progress != nil && done%reindexProgressInterval == 0 {
+			progress(done, total)
+		}
+	}
+
+	if last != nil {
+		if err := b.idx.SetSeq(last); err != nil {
+			return fmt.Errorf("reindex: failed to update the index sequence: %w", err)
+		}
+	}
+	if progress != nil {
+		progress(done, total)
+	}
+	return nil
+}
+
+// reindexTotal returns the number of entries in receiveLog
+func reindexTotal(receiveLog margaret.Log) (int64, error) {
+	v, err := receiveLog.Seq().Value()
+	if err != nil {
+		return 0, fmt.Errorf("reindex: failed to get receive log sequence: %w", err)
+	}
+	seq, ok := v.(margaret.Seq)
+	if !ok {
+		return 0, fmt.Errorf("reindex: unexpected receive log sequence type: %T", v)
+	}
+	// the receive log is 0-indexed
+	return seq.Seq() + 1, nil
+}
+
+// contactUnchanged returns true if val is a contact message and the index already has the state it sets, not counting imported edges.
+func (b *builder) contactUnchanged(val interface{}) (bool, error) {
+	abs, ok := val.(refs.Message)
+	if !ok {
+		return false, nil
+	}
+
+	var c refs.Contact
+	if err := c.UnmarshalJSON(abs.ContentBytes()); err != nil {
+		return false, nil
+	}
+
+	state := packedNeutral
+	switch {
+	case c.Following:
+		state = packedFollow
+	case c.Blocking:
+		state = packedBlock
+	}
+
+	stored, has, err := b.storedState([]byte(storedrefs.Feed(abs.Author()) + storedrefs.Feed(c.Contact)))
+	if err != nil {
+		return false, err
+	}
+	return has && stored == state, nil
+}
+
+// storedState returns the state of the pair of feeds in addr as one of the packed prefixes, for both layouts.
+// Imported edges are reported as missing, so that their contact message replaces them.
+func (b *builder) storedState(addr []byte) (byte, bool, error) {
+	var (
+		state byte
+		has   bool
+	)
+	err := b.db().View(func(txn *badger.Txn) error {
+		if b.layout == LayoutPacked {
+			for _, p := range packedPrefixes {
+				it, err := txn.Get(packedKey(p, addr))
+				if err == badger.ErrKeyNotFound {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				return it.Value(func(v []byte) error {
+					state, has = p, !(len(v) == 1 && v[0] == importedMarker)
+					return nil
+				})
+			}
+			return nil
+		}
+
+		it, err := txn.Get(addr)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return it.Value(func(v []byte) error {
+			if len(v) != 1 {
+				return nil
+			}
+			switch v[0] {
+			case '0':
+				state, has = packedNeutral, true
+			case '1':
+				state, has = packedFollow, true
+			case '2':
+				state, has = packedBlock, true
+			}
+			return nil
+		})
+	})
+	return state, has, err
+}
+
+// clearContacts deletes the contact entries of both layouts.
+func (b *builder) clearContacts() error {
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+	// after the entries are gone, see cacheLock
+	defer func() {
+		b.invalidate()
+		b.live.markStale()
+	}()
+
+	var keys [][]byte
+	err := b.db().View(func(txn *badger.Txn) error {
+		iterOpts := badger.DefaultIteratorOptions
+		iterOpts.PrefetchValues = false
+		iter := txn.NewIterator(iterOpts)
+		defer iter.Close()
+
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			k := iter.Item().Key()
+			if _, isPacked := packedWeight(k); isPacked || len(k) == contactKeyLen || isEdgeSeqKey(k) {
+				keys = append(keys, iter.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return deleteKeys(b.db(), keys)
+}
+
+// deleteKeys deletes keys with a write batch, which commits as many transactions as needed instead of failing with ErrTxnTooBig.
+func deleteKeys(db *badger.DB, keys [][]byte) error {
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range keys {
+		if err := wb.Delete(k); err != nil {
+			return fmt.Errorf("failed to drop record %x: %w", k, err)
+		}
+	}
+	return wb.Flush()
+}
+
+// Reindex replays receiveLog into a new graph, see the badger builder.
+func (b *logBuilder) Reindex(ctx context.Context, receiveLog margaret.Log, progress ReindexProgressFunc) error {
+	total, err := reindexTotal(receiveLog)
+	if err != nil {
+		return err
+	}
+
+	src, err := receiveLog.Query()
+	if err != nil {
+		return fmt.Errorf("reindex: failed to query receive log: %w", err)
+	}
+
+	// the live query would keep writing into the old graph
+	b.mu.Lock()
+	if b.currentQueryCancel != nil {
+		b.currentQueryCancel()
+		b.currentQueryCancel = nil
+	}
+	b.current = NewGraph()
+	b.mu.Unlock()
+
+	var done int64
+	for {
+		v, err := src.Next(ctx)
+		if err != nil {
+			if luigi.IsEOS(err) {
+				break
+			}
+			return fmt.Errorf("reindex: failed to get next message: %w", err)
+		}
+		if nulled, ok := v.(error); ok && margaret.IsErrNulled(nulled) {
+			// nothing to index
+		} else if err := b.buildGraph(ctx, v, nil); err != nil {
+			return fmt.Errorf("reindex: failed to index message: %w", err)
+		}
+
+		done++
+		if progress != nil && done%reindexProgressInterval == 0 {
+			progress(done, total)
+		}
+	}
+	if progress != nil {
+		progress(done, total)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/go-kit/kit/log/level"
+)
+
+var (
+	// txnAttempts is how often a transaction is tried before its error is returned
+	txnAttempts = 4
+
+	// txnBackoff is the delay before the first retry, it doubles with every further one
+	txnBackoff = 10 * time.Millisecond
+)
+
+// isTransientTxnErr reports errors of a transaction that might not happen again, like a conflict with a concurrent writer
+func isTransientTxnErr(err error) bool {
+	return errors.Is(err, badger.ErrConflict)
+}
+
+// retryTxn calls fn until it succeeds, fails with an error that isn't transient or txnAttempts are used up.
+// fn has to start from scratch on every call. Only the commit of an update can conflict, reads don't need this.
+func (b *builder) retryTxn(op string, fn func() error) error {
+	delay := txnBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientTxnErr(err) || attempt >= txnAttempts {
+			return err
+		}
+		level.Debug(b.log).Log("event", "graph-txn-retry", "op", op, "attempt", attempt, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// update runs fn in an update transaction and retries it if the commit conflicts, see retryTxn.
+func (b *builder) update(op string, fn func(txn *badger.Txn) error) error {
+	return b.retryTxn(op, func() error {
+		return b.db().Update(fn)
+	})
+}
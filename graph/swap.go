@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+	"go.cryptoscope.co/librarian"
+	libbadger "go.cryptoscope.co/librarian/badger"
+	"go.cryptoscope.co/luigi"
+	"go.cryptoscope.co/margaret"
+)
+
+// db returns the current database of the builder, see SwapDB
+func (b *builder) db() *badger.DB {
+	b.kvMu.RLock()
+	defer b.kvMu.RUnlock()
+	return b.kv
+}
+
+// SwapDB replaces the database of the builder with newDB, for instance with a compacted copy of the current one.
+// The index returned by OpenIndex keeps working and writes to newDB from then on.
+// The cached graphs are dropped. The old database is returned, the caller has to close it once the reads that are still running are done.
+func (b *builder) SwapDB(newDB *badger.DB) (*badger.DB, error) {
+	if newDB == nil {
+		return nil, errors.New("ssb/graph: can't swap to a nil database")
+	}
+	if b.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	b.cacheLock.Lock()
+	defer b.cacheLock.Unlock()
+
+	b.kvMu.Lock()
+	old := b.kv
+	b.kv = newDB
+	b.idx.swap(libbadger.NewIndex(newDB, 0))
+	b.kvMu.Unlock()
+
+	b.invalidate()
+	b.live.markStale()
+	return old, nil
+}
+
+// swappableIndex passes all calls on to the index over the current database.
+// The sink index of the builder is made over it, so that SwapDB doesn't need to replace that.
+type swappableIndex struct {
+	mu  sync.RWMutex
+	cur librarian.SeqSetterIndex
+}
+
+var _ librarian.SeqSetterIndex = (*swappableIndex)(nil)
+
+func newSwappableIndex(idx librarian.SeqSetterIndex) *swappableIndex {
+	return &swappableIndex{cur: idx}
+}
+
+func (si *swappableIndex) swap(idx librarian.SeqSetterIndex) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.cur = idx
+}
+
+func (si *swappableIndex) current() librarian.SeqSetterIndex {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+	return si.cur
+}
+
+func (si *swappableIndex) Get(ctx context.Context, addr librarian.Addr) (luigi.Observable, error) {
+	return si.current().Get(ctx, addr)
+}
+
+func (si *swappableIndex) Set(ctx context.Context, addr librarian.Addr, v interface{}) error {
+	return si.current().Set(ctx, addr, v)
+}
+
+func (si *swappableIndex) Delete(ctx context.Context, addr librarian.Addr) error {
+	return si.current().Delete(ctx, addr)
+}
+
+func (si *swappableIndex) SetSeq(seq margaret.Seq) error {
+	return si.current().SetSeq(seq)
+}
+
+func (si *swappableIndex) GetSeq() (margaret.Seq, error) {
+	return si.current().GetSeq()
+}
+
+func (si *swappableIndex) Close() error {
+	return si.current().Close()
+}
+
+// readOnlyIndex is the index OpenIndex returns for read-only builders. Reads go to the index, all writes return ErrReadOnly.
+type readOnlyIndex struct {
+	idx librarian.SeqSetterIndex
+}
+
+var _ librarian.SeqSetterIndex = readOnlyIndex{}
+
+func (ro readOnlyIndex) Get(ctx context.Context, addr librarian.Addr) (luigi.Observable, error) {
+	return ro.idx.Get(ctx, addr)
+}
+
+func (ro readOnlyIndex) Set(context.Context, librarian.Addr, interface{}) error {
+	return ErrReadOnly
+}
+
+func (ro readOnlyIndex) Delete(context.Context, librarian.Addr) error {
+	return ErrReadOnly
+}
+
+func (ro readOnlyIndex) SetSeq(margaret.Seq) error {
+	return ErrReadOnly
+}
+
+func (ro readOnlyIndex) GetSeq() (margaret.Seq, error) {
+	return ro.idx.GetSeq()
+}
+
+// Close does nothing, the database is closed by the builder
+func (ro readOnlyIndex) Close() error {
+	return nil
+}
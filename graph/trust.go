@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT
+
+package graph
+
+import (
+	"fmt"
+
+	"go.cryptoscope.co/ssb"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// trustDamping is how much of a feeds trust is passed on to the feeds it follows.
+const trustDamping = 0.5
+
+// HopsOpts tune the result of HopsWithOpts
+type HopsOpts struct {
+	// MinTrust drops feeds with a trust score below it, even if they are in hop range.
+	// The score is between 0 and 1. A direct follow scores 0.5 and every additional hop halves it,
+	// while each additional follower in the walked set raises it. Zero disables the check.
+	MinTrust float64
+}
+
+// HopsWithOpts is like Hops but can prune feeds that are only reachable through weak links.
+func (b *builder) HopsWithOpts(from *refs.FeedRef, max int, opts HopsOpts) (*ssb.StrFeedSet, error) {
+	dists, err := b.HopsWithDistance(from, max)
+	if err != nil {
+		return nil, err
+	}
+
+	var scores map[string]float64
+	if opts.MinTrust > 0 {
+		scores, err = b.trustScores(from, dists)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	set := ssb.NewFeedSet(len(dists))
+	for ref := range dists {
+		if scores != nil && scores[ref] < opts.MinTrust {
+			continue
+		}
+		fr, err := refs.ParseFeedRef(ref)
+		if err != nil {
+			return nil, fmt.Errorf("HopsWithOpts: invalid walked feed %q: %w", ref, err)
+		}
+		if err := set.AddRef(fr); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// trustScores computes a score for each feed in dists, as returned by HopsWithDistance.
+// Trust flows from from (which has a trust of one) along follow edges to feeds that are further away.
+// A feed followed by parents p1..pn ends up with 1 - (1-d*t(p1)) * ... * (1-d*t(pn)), where d is the trustDamping.
+func (b *builder) trustScores(from *refs.FeedRef, dists map[string]int) (map[string]float64, error) {
+	var levels [][]string
+	for ref, d := range dists {
+		for len(levels) <= d {
+			levels = append(levels, nil)
+		}
+		levels[d] = append(levels[d], ref)
+	}
+
+	// distrust holds the product of the (1-d*t(p)) terms for each feed
+	distrust := make(map[string]float64, len(dists))
+	for ref := range dists {
+		distrust[ref] = 1
+	}
+
+	scores := make(map[string]float64, len(dists))
+	passOn := func(parent *refs.FeedRef, parentDist int, trust float64) error {
+		follows, err := b.Follows(parent)
+		if err != nil {
+			return fmt.Errorf("trustScores: follows of %s failed: %w", parent.ShortRef(), err)
+		}
+		lst, err := follows.List()
+		if err != nil {
+			return fmt.Errorf("trustScores: invalid entry in feed set: %w", err)
+		}
+		for _, followed := range lst {
+			d, has := dists[followed.Ref()]
+			if !has || d <= parentDist {
+				continue
+			}
+			distrust[followed.Ref()] *= 1 - trustDamping*trust
+		}
+		return nil
+	}
+
+	if err := passOn(from, -1, 1); err != nil {
+		return nil, err
+	}
+
+	for d, level := range levels {
+		// the scores of a level are final once all the levels before it passed on their trust
+		for _, ref := range level {
+			scores[ref] = 1 - distrust[ref]
+		}
+
+		if d == len(levels)-1 {
+			break
+		}
+
+		for _, ref := range level {
+			fr, err := refs.ParseFeedRef(ref)
+			if err != nil {
+				return nil, fmt.Errorf("trustScores: invalid walked feed %q: %w", ref, err)
+			}
+			if err := passOn(fr, d, scores[ref]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return scores, nil
+}
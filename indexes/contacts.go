@@ -7,6 +7,7 @@ import (
 
 	"github.com/dgraph-io/badger"
 	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 	"go.cryptoscope.co/librarian"
 
 	"go.cryptoscope.co/ssb/graph"
@@ -15,10 +16,11 @@ import (
 
 const FolderNameContacts = "contacts"
 
-func OpenContacts(log kitlog.Logger, r repo.Interface) (graph.Builder, librarian.SeqSetterIndex, librarian.SinkIndex, error) {
+// OpenContacts opens the badger backed contact graph of the repo. The counter can be nil.
+func OpenContacts(log kitlog.Logger, r repo.Interface, ctr metrics.Counter) (graph.Builder, librarian.SeqSetterIndex, librarian.SinkIndex, error) {
 	var builder graph.IndexingBuilder
 	f := func(db *badger.DB) (librarian.SeqSetterIndex, librarian.SinkIndex) {
-		builder = graph.NewBuilder(kitlog.With(log, "module", "graph"), db)
+		builder = graph.NewBuilder(kitlog.With(log, "module", "graph"), db, ctr)
 		return builder.OpenIndex()
 	}
 
@@ -4,7 +4,11 @@ package luigiutils
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.cryptoscope.co/margaret"
 	"go.cryptoscope.co/muxrpc/v2"
@@ -20,22 +24,75 @@ type MultiSink struct {
 
 	mu    sync.Mutex
 	sinks mapOfSinks
+
+	// sinks of peers that failed are kept in parked for the grace period, so that they can resume
+	grace  time.Duration
+	parked map[string]*parkedSink
+
+	// snapshot holds a *sinkSnapshot that is replaced after every change, see Snapshot
+	snapshot atomic.Value
+}
+
+// sinkSnapshot is a copy of the state of a MultiSink that can be read without mu
+type sinkSnapshot struct {
+	seq    int64
+	sinks  []SinkState
+	parked []time.Time
 }
 
-type mapOfSinks map[*muxrpc.ByteSink]sinkContext
+type mapOfSinks map[*muxrpc.ByteSink]*sinkContext
 
 type sinkContext struct {
-	ctx   context.Context
-	until int64
+	ctx    context.Context
+	sent   int64
+	until  int64
+	filter MessageFilter
+
+	// peer is the identity of the remote, empty if the sink can't be resumed
+	peer string
+}
+
+// MaxParkedMessages is the number of messages a parked sink buffers before it is dropped.
+// The peer has to query the history again after that.
+const MaxParkedMessages = 512
+
+type parkedSink struct {
+	sent    int64
+	expires time.Time
+
+	buffered []parkedMessage
 }
 
+type parkedMessage struct {
+	seq int64
+	msg []byte
+	val interface{}
+}
+
+// MessageFilter can drop a message for a registered sink by returning false or rewrite it by returning different bytes.
+// val is the value that was passed to SendValue, nil for Send and SendSeq.
+// If it returns an error, the sink is closed with it and unregistered.
+type MessageFilter func(msg []byte, val interface{}) (out []byte, keep bool, err error)
+
 var _ margaret.Seq = (*MultiSink)(nil)
 
 func NewMultiSink(seq int64) *MultiSink {
-	return &MultiSink{
-		seq:   seq,
-		sinks: make(mapOfSinks),
+	f := &MultiSink{
+		seq:    seq,
+		sinks:  make(mapOfSinks),
+		parked: make(map[string]*parkedSink),
 	}
+	f.publishSnapshot()
+	return f
+}
+
+// SetResumeGrace sets how long the sink of a peer is kept around after writing to it failed.
+// Messages that are sent in that time are buffered and passed on if the peer resumes.
+// A duration of zero (the default) disables this.
+func (f *MultiSink) SetResumeGrace(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.grace = d
 }
 
 func (f *MultiSink) Seq() int64 {
@@ -47,12 +104,116 @@ func (f *MultiSink) Register(
 	ctx context.Context,
 	sink *muxrpc.ByteSink,
 	until int64,
+) {
+	f.RegisterFrom(ctx, sink, 0, until, nil)
+}
+
+// RegisterFrom is like Register but the sink already received everything upto and including sequence 'sent'.
+// Messages with a sequence lower or equal to that are not passed on to it again.
+// If filter is not nil, messages are passed through it before they are written.
+func (f *MultiSink) RegisterFrom(
+	ctx context.Context,
+	sink *muxrpc.ByteSink,
+	sent, until int64,
+	filter MessageFilter,
+) {
+	f.RegisterPeer(ctx, "", sink, sent, until, filter)
+}
+
+// RegisterPeer is like RegisterFrom but remembers the sink for peer, so that it can be resumed with Resume.
+func (f *MultiSink) RegisterPeer(
+	ctx context.Context,
+	peer string,
+	sink *muxrpc.ByteSink,
+	sent, until int64,
+	filter MessageFilter,
 ) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.sinks[sink] = sinkContext{
-		ctx:   ctx,
-		until: until,
+	defer f.publishSnapshot()
+	f.sinks[sink] = &sinkContext{
+		ctx:    ctx,
+		sent:   sent,
+		until:  until,
+		filter: filter,
+		peer:   peer,
+	}
+}
+
+// Resume reattaches peer with a new sink, if it has a parked sink or if its old sink is still registered.
+// have is the sequence of the last message the peer has. Buffered messages after it are written to sink
+// before it is registered. Resume returns false if the peer can't be resumed, for instance because
+// the grace period is over or because it is missing messages that were sent to the old sink.
+func (f *MultiSink) Resume(
+	ctx context.Context,
+	peer string,
+	sink *muxrpc.ByteSink,
+	have, until int64,
+	filter MessageFilter,
+) (bool, error) {
+	if peer == "" {
+		return false, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.publishSnapshot()
+	f.expireParked(time.Now())
+
+	if p, has := f.parked[peer]; has {
+		delete(f.parked, peer)
+		if have < p.sent {
+			return false, nil
+		}
+
+		sent := have
+		for _, pm := range p.buffered {
+			if pm.seq <= sent || pm.seq > until {
+				continue
+			}
+			out, keep := pm.msg, true
+			if filter != nil {
+				var err error
+				out, keep, err = filter(pm.msg, pm.val)
+				if err != nil {
+					return false, fmt.Errorf("multisink: failed to filter buffered message: %w", err)
+				}
+			}
+			if keep {
+				if _, err := sink.Write(out); err != nil {
+					return false, fmt.Errorf("multisink: failed to write buffered message: %w", err)
+				}
+			}
+			sent = pm.seq
+		}
+
+		f.sinks[sink] = &sinkContext{ctx: ctx, sent: sent, until: until, filter: filter, peer: peer}
+		return true, nil
+	}
+
+	for old, sc := range f.sinks {
+		if sc.peer != peer {
+			continue
+		}
+		if have < sc.sent {
+			return false, nil
+		}
+		// the old connection is gone, even if writing to it didn't fail yet
+		delete(f.sinks, old)
+		old.Close()
+		f.sinks[sink] = &sinkContext{ctx: ctx, sent: have, until: until, filter: filter, peer: peer}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// expireParked drops the parked sinks whose grace period is over.
+func (f *MultiSink) expireParked(now time.Time) {
+	for peer, p := range f.parked {
+		if now.After(p.expires) {
+			delete(f.parked, peer)
+		}
 	}
 }
 
@@ -61,9 +222,26 @@ func (f *MultiSink) Unregister(
 ) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	defer f.publishSnapshot()
 	delete(f.sinks, sink)
 }
 
+// CloseAll closes and unregisters all the sinks.
+// It returns the first error it encountered but tries to close all of them.
+func (f *MultiSink) CloseAll() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer f.publishSnapshot()
+	var firstErr error
+	for s := range f.sinks {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(f.sinks, s)
+	}
+	return firstErr
+}
+
 // Count returns the number of registerd sinks
 func (f *MultiSink) Count() uint {
 	f.mu.Lock()
@@ -71,25 +249,154 @@ func (f *MultiSink) Count() uint {
 	return uint(len(f.sinks))
 }
 
+// SinkState describes one registered sink, see Sinks.
+type SinkState struct {
+	Peer  string
+	Sent  int64
+	Until int64
+}
+
+// Sinks returns the state of the registered sinks, ordered by peer and sent sequence.
+func (f *MultiSink) Sinks() []SinkState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sinkStates()
+}
+
+// sinkStates expects mu to be held
+func (f *MultiSink) sinkStates() []SinkState {
+	states := make([]SinkState, 0, len(f.sinks))
+	for _, sc := range f.sinks {
+		states = append(states, SinkState{Peer: sc.peer, Sent: sc.sent, Until: sc.until})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Peer != states[j].Peer {
+			return states[i].Peer < states[j].Peer
+		}
+		return states[i].Sent < states[j].Sent
+	})
+	return states
+}
+
+// publishSnapshot replaces the copy that Snapshot reads. It expects mu to be held.
+func (f *MultiSink) publishSnapshot() {
+	snap := &sinkSnapshot{
+		seq:   f.seq,
+		sinks: f.sinkStates(),
+	}
+	for _, p := range f.parked {
+		snap.parked = append(snap.parked, p.expires)
+	}
+	f.snapshot.Store(snap)
+}
+
+// Snapshot returns the sequence, the registered sinks and the number of parked sinks like Seq, Sinks and Parked.
+// It reads a copy that is updated after every change instead of waiting for mu, which is held while the sinks are written to.
+// So it doesn't block on a slow sink but can miss a write that is in progress.
+func (f *MultiSink) Snapshot() (seq int64, sinks []SinkState, parked uint) {
+	snap := f.snapshot.Load().(*sinkSnapshot)
+	now := time.Now()
+	for _, expires := range snap.parked {
+		if !now.After(expires) {
+			parked++
+		}
+	}
+	return snap.seq, snap.sinks, parked
+}
+
+// Parked returns the number of sinks that wait to be resumed
+func (f *MultiSink) Parked() uint {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expireParked(time.Now())
+	return uint(len(f.parked))
+}
+
 func (f *MultiSink) Close() error {
 	f.isClosed = true
 	return nil
 }
 
+// Send passes msg on to all registered sinks as the next message in the sequence.
 func (f *MultiSink) Send(msg []byte) {
+	f.SendSeq(f.seq+1, msg)
+}
+
+// SendSeq passes msg with the sequence seq on to all registered sinks which didn't receive it yet.
+func (f *MultiSink) SendSeq(seq int64, msg []byte) {
+	f.SendValue(seq, msg, nil)
+}
+
+// SendValue is like SendSeq but also passes val to the filters of the sinks, for instance the message msg was encoded from.
+func (f *MultiSink) SendValue(seq int64, msg []byte, val interface{}) {
 	if f.isClosed {
 		return
 	}
-	f.seq++
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	defer f.publishSnapshot()
 
-	for s, ctx := range f.sinks {
-		_, err := s.Write(msg)
-		if err != nil || ctx.until <= f.seq {
-			delete(f.sinks, s)
+	if seq > f.seq {
+		f.seq = seq
+	}
+
+	f.expireParked(time.Now())
+	for peer, p := range f.parked {
+		if seq <= p.sent {
+			continue
+		}
+		if n := len(p.buffered); n > 0 && seq <= p.buffered[n-1].seq {
+			continue
 		}
+		if len(p.buffered) >= MaxParkedMessages {
+			delete(f.parked, peer)
+			continue
+		}
+		p.buffered = append(p.buffered, parkedMessage{seq: seq, msg: append([]byte(nil), msg...), val: val})
+	}
 
+	for s, sc := range f.sinks {
+		if seq <= sc.sent {
+			continue
+		}
+		out := msg
+		if sc.filter != nil {
+			var (
+				keep bool
+				err  error
+			)
+			out, keep, err = sc.filter(msg, val)
+			if err != nil {
+				delete(f.sinks, s)
+				s.CloseWithError(err)
+				continue
+			}
+			if !keep {
+				sc.sent = seq
+				if sc.until <= seq {
+					delete(f.sinks, s)
+				}
+				continue
+			}
+		}
+		_, err := s.Write(out)
+		if err != nil {
+			delete(f.sinks, s)
+			if sc.peer != "" && f.grace > 0 {
+				// the message didn't make it, keep it for when the peer comes back
+				f.parked[sc.peer] = &parkedSink{
+					sent:     sc.sent,
+					expires:  time.Now().Add(f.grace),
+					buffered: []parkedMessage{{seq: seq, msg: append([]byte(nil), msg...), val: val}},
+				}
+			}
+			continue
+		}
+		if sc.until <= seq {
+			delete(f.sinks, s)
+			continue
+		}
+		sc.sent = seq
 	}
 }
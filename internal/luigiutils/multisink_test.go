@@ -1,10 +1,12 @@
 package luigiutils
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"go.cryptoscope.co/muxrpc/v2"
 
@@ -71,6 +73,96 @@ func TestMultiLogSinkWrapped(t *testing.T) {
 
 }
 
+func TestMultiSinkResume(t *testing.T) {
+	r := require.New(t)
+	ctx := context.TODO()
+
+	mSink := NewMultiSink(0)
+	mSink.SetResumeGrace(time.Minute)
+
+	// bob drops after the first message, alice after the second
+	var alice, bob cutWriter
+	mSink.RegisterPeer(ctx, "alice", muxrpc.NewTestSink(&alice), 0, 100, nil)
+	mSink.RegisterPeer(ctx, "bob", muxrpc.NewTestSink(&bob), 0, 100, nil)
+
+	mSink.Send([]byte("msg 1"))
+	bob.cut = true
+	mSink.Send([]byte("msg 2"))
+	alice.cut = true
+	mSink.Send([]byte("msg 3"))
+	mSink.Send([]byte("msg 4"))
+	r.EqualValues(0, mSink.Count())
+	r.EqualValues(2, mSink.Parked())
+
+	// alice got 1 and 2 and gets 3 and 4 from the buffer
+	var aliceBuf bytes.Buffer
+	ok, err := mSink.Resume(ctx, "alice", muxrpc.NewTestSink(&aliceBuf), 2, 100, nil)
+	r.NoError(err)
+	r.True(ok)
+	r.EqualValues(1, mSink.Count())
+	r.Contains(aliceBuf.String(), "msg 3")
+	r.Contains(aliceBuf.String(), "msg 4")
+	r.NotContains(aliceBuf.String(), "msg 2")
+
+	// bob claims to have less than was sent to him before the drop, which the buffer can't fill
+	ok, err = mSink.Resume(ctx, "bob", muxrpc.NewTestSink(new(bytes.Buffer)), 0, 100, nil)
+	r.NoError(err)
+	r.False(ok)
+	r.EqualValues(0, mSink.Parked())
+
+	// parked sinks are dropped after the grace period
+	mSink.SetResumeGrace(time.Millisecond)
+	claire := cutWriter{cut: true}
+	mSink.RegisterPeer(ctx, "claire", muxrpc.NewTestSink(&claire), 4, 100, nil)
+	mSink.Send([]byte("msg 5"))
+	time.Sleep(10 * time.Millisecond)
+	r.EqualValues(0, mSink.Parked())
+	ok, err = mSink.Resume(ctx, "claire", muxrpc.NewTestSink(new(bytes.Buffer)), 4, 100, nil)
+	r.NoError(err)
+	r.False(ok)
+}
+
+func TestMultiSinkFilterError(t *testing.T) {
+	r := require.New(t)
+	ctx := context.TODO()
+
+	mSink := NewMultiSink(0)
+
+	// the filter of alice fails on the value of the second message, bob has none
+	var alice, bob bytes.Buffer
+	failOnTwo := func(msg []byte, val interface{}) ([]byte, bool, error) {
+		if val == 2 {
+			return nil, false, fmt.Errorf("can't filter %v", val)
+		}
+		return msg, true, nil
+	}
+	mSink.RegisterFrom(ctx, muxrpc.NewTestSink(&alice), 0, 100, failOnTwo)
+	mSink.RegisterFrom(ctx, muxrpc.NewTestSink(&bob), 0, 100, nil)
+
+	mSink.SendValue(1, []byte("msg 1"), 1)
+	mSink.SendValue(2, []byte("msg 2"), 2)
+	mSink.SendValue(3, []byte("msg 3"), 3)
+	r.EqualValues(1, mSink.Count())
+
+	r.Contains(alice.String(), "msg 1")
+	r.Contains(alice.String(), "can't filter 2")
+	r.NotContains(alice.String(), "msg 3")
+	r.Contains(bob.String(), "msg 3")
+}
+
+// cutWriter fails all writes once cut is set
+type cutWriter struct {
+	bytes.Buffer
+	cut bool
+}
+
+func (cw *cutWriter) Write(b []byte) (int, error) {
+	if cw.cut {
+		return 0, io.ErrClosedPipe
+	}
+	return cw.Buffer.Write(b)
+}
+
 type failingWriter int
 
 func (f *failingWriter) Close() error { return nil }
@@ -82,3 +174,54 @@ func (f *failingWriter) Write(b []byte) (int, error) {
 	*f--
 	return len(b), nil
 }
+
+// blockingWriter blocks every write until release is closed
+type blockingWriter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bw blockingWriter) Write(b []byte) (int, error) {
+	close(bw.started)
+	<-bw.release
+	return len(b), nil
+}
+
+func TestMultiSinkSnapshot(t *testing.T) {
+	r := require.New(t)
+
+	mSink := NewMultiSink(0)
+	bw := blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	mSink.RegisterPeer(context.TODO(), "peer", muxrpc.NewTestSink(bw), 0, 100, nil)
+
+	seq, sinks, parked := mSink.Snapshot()
+	r.EqualValues(0, seq)
+	r.Equal([]SinkState{{Peer: "peer", Sent: 0, Until: 100}}, sinks)
+	r.EqualValues(0, parked)
+
+	sent := make(chan struct{})
+	go func() {
+		mSink.SendSeq(1, []byte("hello"))
+		close(sent)
+	}()
+	<-bw.started
+
+	// the write is still in progress, the snapshot doesn't wait for it
+	done := make(chan struct{})
+	go func() {
+		_, sinks, _ = mSink.Snapshot()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("snapshot waited for the write")
+	}
+	r.EqualValues(0, sinks[0].Sent)
+
+	close(bw.release)
+	<-sent
+	seq, sinks, _ = mSink.Snapshot()
+	r.EqualValues(1, seq)
+	r.EqualValues(1, sinks[0].Sent)
+}
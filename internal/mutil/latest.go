@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MIT
+
+package mutil
+
+import (
+	"context"
+	"fmt"
+
+	"go.cryptoscope.co/luigi"
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// FindLatest reads the messages of userLog from root, latest first, and returns the first one match accepts.
+// Nulled messages are skipped. It returns nil if none matches.
+func FindLatest(ctx context.Context, root, userLog margaret.Log, match func(refs.Message) bool) (refs.Message, error) {
+	src, err := Indirect(root, userLog).Query(margaret.Reverse(true))
+	if err != nil {
+		return nil, fmt.Errorf("findLatest: failed to query user log: %w", err)
+	}
+
+	for {
+		v, err := src.Next(ctx)
+		if err != nil {
+			if luigi.IsEOS(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("findLatest: failed to get next message: %w", err)
+		}
+
+		switch tv := v.(type) {
+		case refs.Message:
+			if match(tv) {
+				return tv, nil
+			}
+		case error:
+			if margaret.IsErrNulled(tv) {
+				continue
+			}
+			return nil, tv
+		default:
+			return nil, fmt.Errorf("findLatest: unexpected value %T", v)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/cryptix/go/encodedTime"
 	"go.cryptoscope.co/luigi"
@@ -17,9 +18,23 @@ import (
 	refs "go.mindeco.de/ssb-refs"
 )
 
+// MessageWriter gets the encoded messages of NewKeyValueWriter, one Write per message.
+// muxrpc.ByteSink is one.
+type MessageWriter interface {
+	io.Writer
+	Close() error
+	CloseWithError(error) error
+}
+
 // NewKeyValueWrapper turns a value into a key-value message.
 // If keyWrap is true, it sends the JSON of the ssb.KeyValueRaw value on the passed ByteSink.
 func NewKeyValueWrapper(mw *muxrpc.ByteSink, keyWrap bool) luigi.Sink {
+	mw.SetEncoding(muxrpc.TypeJSON)
+	return NewKeyValueWriter(mw, keyWrap)
+}
+
+// NewKeyValueWriter is like NewKeyValueWrapper but writes to any MessageWriter.
+func NewKeyValueWriter(mw MessageWriter, keyWrap bool) luigi.Sink {
 
 	noNulled := mfr.FilterFunc(func(ctx context.Context, v interface{}) (bool, error) {
 		switch tv := v.(type) {
@@ -43,8 +58,6 @@ func NewKeyValueWrapper(mw *muxrpc.ByteSink, keyWrap bool) luigi.Sink {
 		return true, nil
 	})
 
-	mw.SetEncoding(muxrpc.TypeJSON)
-
 	mapToKV := luigi.FuncSink(func(ctx context.Context, v interface{}, err error) error {
 		if err != nil {
 			if luigi.IsEOS(err) {
@@ -124,6 +124,27 @@ func LoadKeyPair(fname string) (*KeyPair, error) {
 	return ParseKeyPair(nocomment.NewReader(f))
 }
 
+// LoadKeyPairFromReader is like LoadKeyPair but reads the secret from r instead of a file, like stdin.
+// Lines starting with # are ignored as well.
+func LoadKeyPairFromReader(r io.Reader) (*KeyPair, error) {
+	return ParseKeyPair(nocomment.NewReader(r))
+}
+
+// LoadKeyPairFromEnv parses the secret from the environment variable varName.
+// This way the secret doesn't need to be stored on disk, for instance if it's injected by a secrets manager.
+func LoadKeyPairFromEnv(varName string) (*KeyPair, error) {
+	secret, has := os.LookupEnv(varName)
+	if !has {
+		return nil, fmt.Errorf("ssb.LoadKeyPairFromEnv: environment variable %s is not set", varName)
+	}
+
+	kp, err := LoadKeyPairFromReader(strings.NewReader(secret))
+	if err != nil {
+		return nil, fmt.Errorf("ssb.LoadKeyPairFromEnv: failed to parse %s: %w", varName, err)
+	}
+	return kp, nil
+}
+
 // ParseKeyPair json decodes an object from the reader.
 // It expects std base64 encoded data under the `private` and `public` fields.
 func ParseKeyPair(r io.Reader) (*KeyPair, error) {
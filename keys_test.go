@@ -1,8 +1,10 @@
 package ssb
 
 import (
+	"bytes"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -62,3 +64,46 @@ func TestLoadKeyPair(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadKeyPairFromReader(t *testing.T) {
+	r := require.New(t)
+
+	keys, err := NewKeyPair(nil)
+	r.NoError(err)
+
+	var buf bytes.Buffer
+	buf.WriteString("# this is your SECRET name.\n")
+	r.NoError(EncodeKeyPairAsJSON(keys, &buf))
+
+	loaded, err := LoadKeyPairFromReader(strings.NewReader(buf.String()))
+	r.NoError(err)
+	r.True(keys.Id.Equal(loaded.Id))
+	r.Equal(keys.Pair.Secret, loaded.Pair.Secret)
+
+	_, err = LoadKeyPairFromReader(strings.NewReader("{}"))
+	r.Error(err)
+}
+
+func TestLoadKeyPairFromEnv(t *testing.T) {
+	r := require.New(t)
+
+	const varName = "GO_SSB_TEST_SECRET"
+
+	_, err := LoadKeyPairFromEnv(varName)
+	r.Error(err, "should fail if the variable isn't set")
+
+	keys, err := NewKeyPair(nil)
+	r.NoError(err)
+
+	var buf bytes.Buffer
+	r.NoError(EncodeKeyPairAsJSON(keys, &buf))
+
+	r.NoError(os.Setenv(varName, buf.String()))
+	defer os.Unsetenv(varName)
+
+	loaded, err := LoadKeyPairFromEnv(varName)
+	r.NoError(err)
+	r.True(keys.Id.Equal(loaded.Id))
+	r.Equal(keys.Pair.Public, loaded.Pair.Public)
+	r.Equal(keys.Pair.Secret, loaded.Pair.Secret)
+}
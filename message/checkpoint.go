@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.cryptoscope.co/margaret"
+
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// DefaultCheckpointInterval is the number of messages between two checkpoints if no interval is set.
+const DefaultCheckpointInterval = 100
+
+// Checkpoint is the progress of a verify sink on a feed.
+type Checkpoint struct {
+	// Sequence of the last verified and saved message
+	Sequence int64 `json:"sequence"`
+
+	// Key of that message, the next one has to point to it
+	Key *refs.MessageRef `json:"key"`
+}
+
+// CheckpointStore persists the progress of verify sinks, so that they can resume after a crash.
+type CheckpointStore interface {
+	SaveCheckpoint(feed *refs.FeedRef, cp Checkpoint) error
+
+	// LoadCheckpoint returns false if there is no checkpoint for the feed.
+	LoadCheckpoint(feed *refs.FeedRef) (Checkpoint, bool, error)
+}
+
+// NewCheckpointedVerifySink is like NewVerifySink but resumes from the checkpoint of who in store, if it is ahead of abs.
+// The message at the checkpoint is fetched from saver, which has to implement StoredMessageGetter, and has to have the key of the checkpoint.
+// If saver doesn't have it, the messages after abs were lost after the checkpoint was written and the sink continues from abs,
+// so that they are fetched again. A stored message with a different key is an error, so is a checkpoint at abs that doesn't match it.
+// After every interval verified messages, it saves a new checkpoint. An interval below one uses DefaultCheckpointInterval.
+func NewCheckpointedVerifySink(
+	who *refs.FeedRef,
+	abs refs.Message,
+	saver SaveMessager,
+	hmacKey *[32]byte,
+	store CheckpointStore,
+	interval int,
+	opts ...VerifySinkOption,
+) (SequencedSink, error) {
+	cp, has, err := store.LoadCheckpoint(who)
+	if err != nil {
+		return nil, fmt.Errorf("verify sink(%s): failed to load checkpoint: %w", who.ShortRef(), err)
+	}
+
+	if has {
+		resumed, err := resumeCheckpoint(who, cp, abs, saver)
+		if err != nil {
+			return nil, fmt.Errorf("verify sink(%s): %w", who.ShortRef(), err)
+		}
+		if resumed != nil {
+			abs = resumed
+		}
+	}
+
+	if interval < 1 {
+		interval = DefaultCheckpointInterval
+	}
+
+	sd := newStreamDrain(who, margaret.BaseSeq(abs.Seq()), abs, saver, hmacKey, opts)
+	sd.checkpoints = store
+	sd.checkpointInterval = interval
+	return sd, nil
+}
+
+// resumeCheckpoint returns the stored message at cp if it is ahead of abs, nil if the sink should continue from abs.
+func resumeCheckpoint(who *refs.FeedRef, cp Checkpoint, abs refs.Message, saver SaveMessager) (refs.Message, error) {
+	switch {
+	case cp.Sequence < abs.Seq():
+		return nil, nil
+	case cp.Sequence == abs.Seq():
+		if cp.Key == nil || !cp.Key.Equal(abs.Key()) {
+			return nil, fmt.Errorf("checkpoint at %d doesn't match the log", cp.Sequence)
+		}
+		return nil, nil
+	}
+
+	getter, ok := saver.(StoredMessageGetter)
+	if !ok {
+		return nil, nil
+	}
+	msg, has, err := getter.StoredMessage(who, cp.Sequence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the message of the checkpoint: %w", err)
+	}
+	if !has {
+		return nil, nil
+	}
+	if cp.Key == nil || !cp.Key.Equal(msg.Key()) || !msg.Author().Equal(who) {
+		return nil, fmt.Errorf("checkpoint at %d doesn't match the stored message", cp.Sequence)
+	}
+	return msg, nil
+}
+
+// checkpoint is called after each saved message and writes a new checkpoint every checkpointInterval messages.
+// It expects ld.mu to be held.
+func (ld *streamDrain) checkpoint() error {
+	if ld.checkpoints == nil {
+		return nil
+	}
+	ld.sinceCheckpoint++
+	if ld.sinceCheckpoint < ld.checkpointInterval {
+		return nil
+	}
+
+	err := ld.checkpoints.SaveCheckpoint(ld.who, Checkpoint{
+		Sequence: ld.latestMsg.Seq(),
+		Key:      ld.latestMsg.Key(),
+	})
+	if err != nil {
+		return fmt.Errorf("message(%s:%d): saved but failed to write checkpoint: %w", ld.who.ShortRef(), ld.latestSeq.Seq(), err)
+	}
+	ld.sinceCheckpoint = 0
+	return nil
+}
+
+// FileCheckpointStore keeps one small JSON file per feed in a directory.
+type FileCheckpointStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+var _ CheckpointStore = (*FileCheckpointStore)(nil)
+
+// NewFileCheckpointStore creates dir if it doesn't exist and returns a store that keeps the checkpoints in it.
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("checkpoints: failed to create directory: %w", err)
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+func (fs *FileCheckpointStore) path(feed *refs.FeedRef) string {
+	return filepath.Join(fs.dir, hex.EncodeToString([]byte(storedrefs.Feed(feed))))
+}
+
+// SaveCheckpoint replaces the checkpoint of feed.
+// The file is written next to the old one and then renamed, so that a crash doesn't leave a broken checkpoint behind.
+func (fs *FileCheckpointStore) SaveCheckpoint(feed *refs.FeedRef, cp Checkpoint) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("checkpoints: failed to encode: %w", err)
+	}
+
+	p := fs.path(feed)
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("checkpoints: failed to write %s: %w", feed.ShortRef(), err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("checkpoints: failed to replace %s: %w", feed.ShortRef(), err)
+	}
+	return nil
+}
+
+// LoadCheckpoint reads the checkpoint of feed.
+func (fs *FileCheckpointStore) LoadCheckpoint(feed *refs.FeedRef) (Checkpoint, bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var cp Checkpoint
+	b, err := ioutil.ReadFile(fs.path(feed))
+	if os.IsNotExist(err) {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, fmt.Errorf("checkpoints: failed to read %s: %w", feed.ShortRef(), err)
+	}
+
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return cp, false, fmt.Errorf("checkpoints: invalid checkpoint for %s: %w", feed.ShortRef(), err)
+	}
+	return cp, true, nil
+}
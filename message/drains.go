@@ -4,6 +4,8 @@
 package message
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
@@ -26,37 +28,135 @@ type SaveMessager interface {
 	Save(refs.Message) error
 }
 
+// MessageValidator can be used to apply custom policy on messages before they are saved.
+// It is called after the signature and the position in the feed are verified.
+// A returned error aborts the feed.
+type MessageValidator func(refs.Message) error
+
+// VerifyFailureFunc is told about messages of author that failed verification, before the error is returned by Verify.
+// seq is the sequence the message had or, if it couldn't be decoded, the one that was expected next.
+type VerifyFailureFunc func(author *refs.FeedRef, seq int64, err error)
+
+// AcceptedFunc is told the key of every message that was verified and saved, as it was computed while verifying the message.
+// It can be used to keep an index of the keys without hashing the messages again.
+// It is called while the sink is locked and shouldn't call back into it.
+type AcceptedFunc func(ref *refs.MessageRef, seq int64)
+
+// VerifySinkOption configures the sinks made by NewVerifySink and NewCheckpointedVerifySink.
+type VerifySinkOption func(*streamDrain)
+
+// WithValidator applies validate to every message before it is saved, see MessageValidator.
+func WithValidator(validate MessageValidator) VerifySinkOption {
+	return func(sd *streamDrain) { sd.validate = validate }
+}
+
+// WithOnFailure tells fn about the messages that fail verification, see VerifyFailureFunc.
+func WithOnFailure(fn VerifyFailureFunc) VerifySinkOption {
+	return func(sd *streamDrain) { sd.onFailure = fn }
+}
+
+// WithOnAccepted tells fn about the messages that were verified and saved, see AcceptedFunc.
+func WithOnAccepted(fn AcceptedFunc) VerifySinkOption {
+	return func(sd *streamDrain) { sd.onAccepted = fn }
+}
+
 // NewVerifySink returns a sink that does message verification and appends corret messages to the passed log.
 // it has to be used on a feed by feed bases, the feed format is decided by the passed feed reference.
 // TODO: start and abs could be the same parameter
 // TODO: needs configuration for hmac and what not..
 // => maybe construct those from a (global) ref register where all the suffixes live with their corresponding network configuration?
-func NewVerifySink(who *refs.FeedRef, start margaret.Seq, abs refs.Message, saver SaveMessager, hmacKey *[32]byte) SequencedSink {
+func NewVerifySink(who *refs.FeedRef, start margaret.Seq, abs refs.Message, saver SaveMessager, hmacKey *[32]byte, opts ...VerifySinkOption) SequencedSink {
+	return newStreamDrain(who, start, abs, saver, hmacKey, opts)
+}
+
+func newStreamDrain(who *refs.FeedRef, start margaret.Seq, abs refs.Message, saver SaveMessager, hmacKey *[32]byte, opts []VerifySinkOption) *streamDrain {
 	sd := &streamDrain{
 		who:       who,
 		latestSeq: margaret.BaseSeq(start.Seq()),
 		latestMsg: abs,
 		storage:   saver,
 	}
-	switch who.Algo {
-	case refs.RefAlgoFeedSSB1:
-		sd.verify = legacyVerify{hmacKey: hmacKey}
-	case refs.RefAlgoFeedGabby:
-		sd.verify = gabbyVerify{hmacKey: hmacKey}
+	sd.verify = newVerifier(who.Algo, hmacKey)
+	for _, o := range opts {
+		o(sd)
 	}
 	return sd
 }
 
+// Verify checks a single message with the verifier for the feed format algo.
+// If algo is empty, the format is detected with DetectFormat.
+func Verify(raw []byte, algo refs.RefAlgo, hmacSecret *[32]byte) (refs.Message, error) {
+	if algo == "" {
+		var err error
+		algo, err = DetectFormat(raw)
+		if err != nil {
+			return nil, fmt.Errorf("verify: %w", err)
+		}
+	}
+
+	v := newVerifier(algo, hmacSecret)
+	if v == nil {
+		return nil, fmt.Errorf("verify: unsupported feed format: %s", algo)
+	}
+	return v.Verify(raw)
+}
+
+// DetectFormat returns the feed format of a raw message by looking at its framing, without verifying it.
+// Legacy messages are JSON objects with an author, gabby grove messages are CBOR encoded transfer objects.
+func DetectFormat(raw []byte) (refs.RefAlgo, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return "", errors.New("detect format: empty message")
+	}
+
+	if trimmed[0] == '{' {
+		var msg struct {
+			Author string `json:"author"`
+		}
+		if err := json.Unmarshal(trimmed, &msg); err != nil {
+			return "", fmt.Errorf("detect format: invalid JSON message: %w", err)
+		}
+		if msg.Author == "" {
+			return "", errors.New("detect format: JSON message without author")
+		}
+		author, err := refs.ParseFeedRef(msg.Author)
+		if err != nil {
+			return "", fmt.Errorf("detect format: invalid author: %w", err)
+		}
+		if author.Algo != refs.RefAlgoFeedSSB1 {
+			return "", fmt.Errorf("detect format: JSON message by a %s feed", author.Algo)
+		}
+		return refs.RefAlgoFeedSSB1, nil
+	}
+
+	var tr gabbygrove.Transfer
+	if err := tr.UnmarshalCBOR(raw); err != nil {
+		return "", fmt.Errorf("detect format: neither JSON nor a gabby grove transfer: %w", err)
+	}
+	return refs.RefAlgoFeedGabby, nil
+}
+
 type verifier interface {
 	Verify([]byte) (refs.Message, error)
 }
 
+// newVerifier returns nil for unsupported feed formats
+func newVerifier(algo refs.RefAlgo, hmacKey *[32]byte) verifier {
+	switch algo {
+	case refs.RefAlgoFeedSSB1:
+		return legacyVerify{v: legacy.NewVerifier(hmacKey)}
+	case refs.RefAlgoFeedGabby:
+		return gabbyVerify{hmacKey: hmacKey}
+	}
+	return nil
+}
+
 type legacyVerify struct {
-	hmacKey *[32]byte
+	v *legacy.Verifier
 }
 
 func (lv legacyVerify) Verify(rmsg []byte) (refs.Message, error) {
-	ref, dmsg, err := legacy.Verify(rmsg, lv.hmacKey)
+	ref, dmsg, err := lv.v.Verify(rmsg)
 	if err != nil {
 		return nil, err
 	}
@@ -111,6 +211,15 @@ type streamDrain struct {
 	latestMsg refs.Message
 
 	storage SaveMessager
+
+	validate   MessageValidator
+	onFailure  VerifyFailureFunc
+	onAccepted AcceptedFunc
+
+	// checkpoints is optional, see NewCheckpointedVerifySink
+	checkpoints        CheckpointStore
+	checkpointInterval int
+	sinceCheckpoint    int
 }
 
 func (ld *streamDrain) Seq() int64 {
@@ -121,24 +230,36 @@ func (ld *streamDrain) Seq() int64 {
 
 // Verify passes the raw message bytes to the verifaction function for the message format (legacy or gabby grove).
 // If it passes the message is checked with the current message using ValidateNext().
-// If that also passes it is saved to the storage system.
+// Messages at sequences that were already verified are skipped, unless they differ from the stored ones (see ErrForkDetected).
+// If that also passes and the optional validator doesn't object, it is saved to the storage system.
 func (ld *streamDrain) Verify(msg []byte) error {
 	ld.mu.Lock()
 	defer ld.mu.Unlock()
 
 	next, err := ld.verify.Verify(msg)
 	if err != nil {
-		return fmt.Errorf("message(%s:%d) verify failed: %w", ld.who.ShortRef(), ld.latestSeq.Seq(), err)
+		err = fmt.Errorf("message(%s:%d) verify failed: %w", ld.who.ShortRef(), ld.latestSeq.Seq(), err)
+		ld.failed(ld.latestSeq.Seq()+1, err)
+		return err
 	}
 
 	err = ValidateNext(ld.latestMsg, next)
 	if err != nil {
 		if err == errSkip {
-			return nil
+			return ld.checkFork(next)
 		}
+		ld.failed(next.Seq(), err)
 		return err
 	}
 
+	if ld.validate != nil {
+		if err := ld.validate(next); err != nil {
+			err = fmt.Errorf("message(%s:%d): rejected by validator: %w", ld.who.ShortRef(), next.Seq(), err)
+			ld.failed(next.Seq(), err)
+			return err
+		}
+	}
+
 	err = ld.storage.Save(next)
 	if err != nil {
 		return fmt.Errorf("message(%s): failed to append message(%s:%d): %w", ld.who.ShortRef(), next.Key().Ref(), next.Seq(), err)
@@ -146,7 +267,16 @@ func (ld *streamDrain) Verify(msg []byte) error {
 
 	ld.latestSeq = margaret.BaseSeq(next.Seq())
 	ld.latestMsg = next
-	return nil
+	if ld.onAccepted != nil {
+		ld.onAccepted(next.Key(), next.Seq())
+	}
+	return ld.checkpoint()
+}
+
+func (ld *streamDrain) failed(seq int64, err error) {
+	if ld.onFailure != nil {
+		ld.onFailure(ld.who, seq, err)
+	}
 }
 
 var errSkip = errors.New("ValidateNext: already got message")
@@ -0,0 +1,406 @@
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/margaret"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/message/legacy"
+	gabbygrove "go.mindeco.de/ssb-gabbygrove"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+type sliceSaver []refs.Message
+
+func (ss *sliceSaver) Save(msg refs.Message) error {
+	*ss = append(*ss, msg)
+	return nil
+}
+
+func (ss *sliceSaver) StoredMessage(author *refs.FeedRef, seq int64) (refs.Message, bool, error) {
+	for _, msg := range *ss {
+		if msg.Author().Equal(author) && msg.Seq() == seq {
+			return msg, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// makeTestFeed signs the passed content values as a legacy feed and returns the raw messages
+func makeTestFeed(t *testing.T, kp *ssb.KeyPair, content ...interface{}) [][]byte {
+	r := require.New(t)
+	create := legacyCreate{key: *kp}
+
+	var (
+		prev *refs.MessageRef
+		raws [][]byte
+	)
+	for i, c := range content {
+		msg, err := create.Create(c, prev, margaret.BaseSeq(i+1))
+		r.NoError(err)
+		prev = msg.Key()
+
+		stored, ok := msg.(*legacy.StoredMessage)
+		r.True(ok)
+		raws = append(raws, stored.Raw_)
+	}
+	return raws
+}
+
+func TestVerifySinkValidator(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	raws := makeTestFeed(t, kp,
+		map[string]interface{}{"type": "test", "i": 1},
+		map[string]interface{}{"type": "test", "i": 2},
+		map[string]interface{}{"type": "banned", "i": 3},
+		map[string]interface{}{"type": "test", "i": 4},
+	)
+
+	errBanned := fmt.Errorf("banned type")
+	validate := func(msg refs.Message) error {
+		var c struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(msg.ContentBytes(), &c); err != nil {
+			return err
+		}
+		if c.Type == "banned" {
+			return errBanned
+		}
+		return nil
+	}
+
+	var saved sliceSaver
+	snk := NewVerifySink(kp.Id, margaret.BaseSeq(0), firstMessage(kp.Id), &saved, nil, WithValidator(validate))
+
+	r.NoError(snk.Verify(raws[0]))
+	r.NoError(snk.Verify(raws[1]))
+
+	err = snk.Verify(raws[2])
+	r.Error(err)
+	r.True(errors.Is(err, errBanned), "wrong error: %s", err)
+
+	r.Len(saved, 2)
+	r.EqualValues(2, snk.Seq())
+
+	// the feed can't continue after the rejected message
+	err = snk.Verify(raws[3])
+	r.Error(err)
+	r.Len(saved, 2)
+}
+
+func TestVerifySinkCheckpoints(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	var content []interface{}
+	for i := 1; i <= 10; i++ {
+		content = append(content, map[string]interface{}{"type": "test", "i": i})
+	}
+	raws := makeTestFeed(t, kp, content...)
+
+	dir, err := ioutil.TempDir("", t.Name())
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileCheckpointStore(dir)
+	r.NoError(err)
+
+	var saved sliceSaver
+	snk, err := NewCheckpointedVerifySink(kp.Id, firstMessage(kp.Id), &saved, nil, store, 3)
+	r.NoError(err)
+	for _, raw := range raws[:7] {
+		r.NoError(snk.Verify(raw))
+	}
+	r.EqualValues(7, snk.Seq())
+
+	// crash after the 7th message, the last checkpoint was written after the 6th
+	store, err = NewFileCheckpointStore(dir)
+	r.NoError(err)
+	cp, has, err := store.LoadCheckpoint(kp.Id)
+	r.NoError(err)
+	r.True(has)
+	r.EqualValues(6, cp.Sequence)
+	r.True(cp.Key.Equal(saved[5].Key()))
+
+	// the sink starts over from the beginning of the feed, but resumes from the checkpoint the saver still has
+	before := len(saved)
+	snk, err = NewCheckpointedVerifySink(kp.Id, firstMessage(kp.Id), &saved, nil, store, 3)
+	r.NoError(err)
+	r.EqualValues(6, snk.Seq(), "didn't resume from the checkpoint")
+
+	// the start of the feed is skipped as already verified
+	r.NoError(snk.Verify(raws[0]))
+	r.Len(saved, before)
+
+	for _, raw := range raws[6:] {
+		r.NoError(snk.Verify(raw))
+	}
+	r.Len(saved, before+4)
+	r.EqualValues(7, saved[before].Seq())
+	r.EqualValues(10, snk.Seq())
+
+	// the log lost the messages after the 4th, the checkpoint at 9 doesn't skip them
+	cp, has, err = store.LoadCheckpoint(kp.Id)
+	r.NoError(err)
+	r.True(has)
+	r.EqualValues(9, cp.Sequence)
+
+	var lost sliceSaver
+	snk, err = NewCheckpointedVerifySink(kp.Id, saved[3], &lost, nil, store, 3)
+	r.NoError(err)
+	r.EqualValues(4, snk.Seq())
+	for _, raw := range raws[4:] {
+		r.NoError(snk.Verify(raw))
+	}
+	r.Len(lost, 6)
+	r.EqualValues(5, lost[0].Seq())
+
+	// the stored message has to be the one of the checkpoint
+	r.NoError(store.SaveCheckpoint(kp.Id, Checkpoint{Sequence: 2, Key: saved[0].Key()}))
+	_, err = NewCheckpointedVerifySink(kp.Id, firstMessage(kp.Id), &saved, nil, store, 3)
+	r.Error(err)
+
+	// a checkpoint at the same sequence has to match the log
+	other := makeTestFeed(t, kp, "fork 1", "fork 2", "fork 3")
+	forked, err := Verify(other[0], refs.RefAlgoFeedSSB1, nil)
+	r.NoError(err)
+	r.NoError(store.SaveCheckpoint(kp.Id, Checkpoint{Sequence: 1, Key: saved[0].Key()}))
+	_, err = NewCheckpointedVerifySink(kp.Id, forked, new(sliceSaver), nil, store, 3)
+	r.Error(err)
+
+	snk, err = NewCheckpointedVerifySink(kp.Id, saved[0], new(sliceSaver), nil, store, 3)
+	r.NoError(err)
+	r.NoError(snk.Verify(raws[1]))
+	r.Error(snk.Verify(other[2]))
+}
+
+func TestVerifySinkOnFailure(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	raws := makeTestFeed(t, kp,
+		map[string]interface{}{"type": "test", "i": 1},
+		map[string]interface{}{"type": "test", "i": 2},
+		map[string]interface{}{"type": "test", "i": 3},
+	)
+
+	type failure struct {
+		author *refs.FeedRef
+		seq    int64
+		err    error
+	}
+	var failures []failure
+	onFailure := func(author *refs.FeedRef, seq int64, err error) {
+		failures = append(failures, failure{author, seq, err})
+	}
+
+	var saved sliceSaver
+	snk := NewVerifySink(kp.Id, margaret.BaseSeq(0), firstMessage(kp.Id), &saved, nil, WithOnFailure(onFailure))
+	r.NoError(snk.Verify(raws[0]))
+	r.Len(failures, 0)
+
+	// change the content of the 2nd message, which breaks its signature
+	badSig := bytes.Replace(raws[1], []byte(`"i": 2`), []byte(`"i": 20`), 1)
+	r.NotEqual(raws[1], badSig)
+	err = snk.Verify(badSig)
+	r.Error(err)
+	r.Len(failures, 1)
+	r.True(failures[0].author.Equal(kp.Id))
+	r.EqualValues(2, failures[0].seq)
+	r.Equal(err, failures[0].err)
+
+	// skipping a message is also reported, with the sequence of the message
+	err = snk.Verify(raws[2])
+	r.Error(err)
+	r.Len(failures, 2)
+	r.EqualValues(3, failures[1].seq)
+
+	r.Len(saved, 1)
+}
+
+func TestVerifyDispatch(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	legacyRaw := makeTestFeed(t, kp, map[string]interface{}{"type": "test"})[0]
+
+	gabbyKP := *kp
+	gabbyKP.Id = &refs.FeedRef{ID: kp.Id.ID, Algo: refs.RefAlgoFeedGabby}
+	create := gabbyCreate{enc: gabbygrove.NewEncoder(gabbyKP.Pair.Secret)}
+	gabbyMsg, err := create.Create(map[string]interface{}{"type": "test"}, nil, margaret.BaseSeq(1))
+	r.NoError(err)
+	tr, ok := gabbyMsg.(*gabbygrove.Transfer)
+	r.True(ok)
+	gabbyRaw, err := tr.MarshalCBOR()
+	r.NoError(err)
+
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+		algo refs.RefAlgo
+		want refs.RefAlgo
+	}{
+		{"legacy", legacyRaw, refs.RefAlgoFeedSSB1, refs.RefAlgoFeedSSB1},
+		{"legacy sniffed", legacyRaw, "", refs.RefAlgoFeedSSB1},
+		{"gabby", gabbyRaw, refs.RefAlgoFeedGabby, refs.RefAlgoFeedGabby},
+		{"gabby sniffed", gabbyRaw, "", refs.RefAlgoFeedGabby},
+	} {
+		msg, err := Verify(tc.raw, tc.algo, nil)
+		r.NoError(err, tc.name)
+		r.EqualValues(1, msg.Seq(), tc.name)
+		r.Equal(tc.want, msg.Author().Algo, tc.name)
+	}
+
+	// wrong format
+	_, err = Verify(legacyRaw, refs.RefAlgoFeedGabby, nil)
+	r.Error(err)
+
+	_, err = Verify(legacyRaw, "unknown", nil)
+	r.Error(err)
+}
+
+func TestDetectFormat(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	legacyRaw := makeTestFeed(t, kp, map[string]interface{}{"type": "test"})[0]
+
+	gabbyKP := *kp
+	gabbyKP.Id = &refs.FeedRef{ID: kp.Id.ID, Algo: refs.RefAlgoFeedGabby}
+	create := gabbyCreate{enc: gabbygrove.NewEncoder(gabbyKP.Pair.Secret)}
+	gabbyMsg, err := create.Create(map[string]interface{}{"type": "test"}, nil, margaret.BaseSeq(1))
+	r.NoError(err)
+	gabbyRaw, err := gabbyMsg.(*gabbygrove.Transfer).MarshalCBOR()
+	r.NoError(err)
+
+	algo, err := DetectFormat(legacyRaw)
+	r.NoError(err)
+	r.Equal(refs.RefAlgoFeedSSB1, algo)
+
+	algo, err = DetectFormat(gabbyRaw)
+	r.NoError(err)
+	r.Equal(refs.RefAlgoFeedGabby, algo)
+
+	for _, garbage := range [][]byte{
+		nil,
+		[]byte("   "),
+		[]byte(`{"no":"author"}`),
+		[]byte(`{"author":"not a ref"}`),
+		[]byte(`{"author":`),
+		{0xde, 0xad, 0xbe, 0xef},
+	} {
+		_, err := DetectFormat(garbage)
+		r.Error(err, "%q", garbage)
+	}
+}
+
+func TestVerifySinkForkDetection(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	raws := makeTestFeed(t, kp,
+		map[string]interface{}{"type": "test", "i": 1},
+		map[string]interface{}{"type": "test", "i": 2},
+		map[string]interface{}{"type": "test", "i": 3},
+	)
+	forked := makeTestFeed(t, kp,
+		map[string]interface{}{"type": "test", "i": 1},
+		map[string]interface{}{"type": "test", "i": 2, "fork": true},
+		map[string]interface{}{"type": "test", "i": 3, "fork": true},
+	)
+
+	var failed []error
+	onFailure := func(author *refs.FeedRef, seq int64, err error) {
+		failed = append(failed, err)
+	}
+
+	var saved sliceSaver
+	snk := NewVerifySink(kp.Id, margaret.BaseSeq(0), firstMessage(kp.Id), &saved, nil, WithOnFailure(onFailure))
+	for _, raw := range raws {
+		r.NoError(snk.Verify(raw))
+	}
+	r.Len(saved, 3)
+
+	// the same messages again are skipped
+	r.NoError(snk.Verify(raws[1]))
+	r.NoError(snk.Verify(forked[0]), "the first message is the same in both")
+
+	for i, seq := range []int64{2, 3} {
+		err = snk.Verify(forked[seq-1])
+		r.Error(err)
+
+		var forkErr ErrForkDetected
+		r.True(errors.As(err, &forkErr), "wrong error: %s", err)
+		r.Equal(seq, forkErr.Sequence)
+		r.True(forkErr.Author.Equal(kp.Id))
+		r.True(forkErr.Stored.Equal(saved[seq-1].Key()))
+		r.False(forkErr.Offered.Equal(forkErr.Stored))
+		r.Len(failed, i+1)
+	}
+
+	r.Len(saved, 3)
+	r.EqualValues(3, snk.Seq())
+}
+
+func TestVerifySinkOnAccepted(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	raws := makeTestFeed(t, kp,
+		map[string]interface{}{"type": "test", "i": 1},
+		map[string]interface{}{"type": "test", "i": 2},
+		map[string]interface{}{"type": "test", "i": 3},
+	)
+
+	accepted := make(map[int64]*refs.MessageRef)
+	onAccepted := func(ref *refs.MessageRef, seq int64) {
+		accepted[seq] = ref
+	}
+
+	var saved sliceSaver
+	snk := NewVerifySink(kp.Id, margaret.BaseSeq(0), firstMessage(kp.Id), &saved, nil, WithOnAccepted(onAccepted))
+	for _, raw := range raws {
+		r.NoError(snk.Verify(raw))
+	}
+
+	// skipped messages aren't reported again
+	r.NoError(snk.Verify(raws[0]))
+
+	// neither are broken ones
+	r.Error(snk.Verify(bytes.Replace(raws[2], []byte(`"i": 3`), []byte(`"i": 4`), 1)))
+
+	r.Len(accepted, len(raws))
+	for i, raw := range raws {
+		msg, err := Verify(raw, refs.RefAlgoFeedSSB1, nil)
+		r.NoError(err)
+		seq := int64(i + 1)
+		r.True(msg.Key().Equal(accepted[seq]), "wrong key for %d", seq)
+	}
+}
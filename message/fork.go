@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"fmt"
+
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// ErrForkDetected is returned by the verify sink if a feed offers a different message at a sequence that is already stored.
+// Both messages are signed by the author, so the feed is forked and one of the two histories has to be dropped.
+type ErrForkDetected struct {
+	Author   *refs.FeedRef
+	Sequence int64
+
+	// Stored is the message we already have, Offered the one that conflicts with it
+	Stored, Offered *refs.MessageRef
+}
+
+func (e ErrForkDetected) Error() string {
+	return fmt.Sprintf("message(%s:%d): fork detected, stored %s but got %s",
+		e.Author.ShortRef(),
+		e.Sequence,
+		e.Stored.Ref(),
+		e.Offered.Ref(),
+	)
+}
+
+// StoredMessageGetter can be implemented by a SaveMessager to return the stored message of a feed at a sequence.
+// The verify sink uses it to check messages it has already seen for forks.
+// Without it, only messages at the latest sequence are checked.
+type StoredMessageGetter interface {
+	// StoredMessage returns false if there is no message of author at seq.
+	StoredMessage(author *refs.FeedRef, seq int64) (refs.Message, bool, error)
+}
+
+// checkFork compares a message at an already verified sequence with the one we have.
+// It expects ld.mu to be held.
+func (ld *streamDrain) checkFork(next refs.Message) error {
+	var stored refs.Message
+	if ld.latestMsg != nil && ld.latestMsg.Seq() == next.Seq() {
+		stored = ld.latestMsg
+	} else if getter, ok := ld.storage.(StoredMessageGetter); ok {
+		msg, has, err := getter.StoredMessage(ld.who, next.Seq())
+		if err != nil {
+			return fmt.Errorf("message(%s:%d): failed to look up stored message: %w", ld.who.ShortRef(), next.Seq(), err)
+		}
+		if !has {
+			return nil
+		}
+		stored = msg
+	} else {
+		return nil
+	}
+
+	storedKey := stored.Key()
+	if storedKey == nil || storedKey.Equal(next.Key()) {
+		return nil
+	}
+
+	err := ErrForkDetected{
+		Author:   ld.who,
+		Sequence: next.Seq(),
+		Stored:   storedKey,
+		Offered:  next.Key(),
+	}
+	ld.failed(next.Seq(), err)
+	return err
+}
@@ -11,11 +11,24 @@ import (
 	"strings"
 )
 
+// maxEncodeDepth is how deep objects and arrays can be nested, the same limit encoding/json uses
+const maxEncodeDepth = 10000
+
+var stringEscaper = strings.NewReplacer("\\", `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, `"`, `\"`)
+
+// quoteString escapes s like JSON.stringify does
+func quoteString(s string) string {
+	return `"` + unicodeEscapeSome(stringEscaper.Replace(s)) + `"`
+}
+
 func formatArray(depth int, b *bytes.Buffer, dec *json.Decoder) error {
+	if depth > maxEncodeDepth {
+		return fmt.Errorf("formatArray(%d): nested too deep", depth)
+	}
 	for {
 		t, err := dec.Token()
 		if err == io.EOF {
-			return nil
+			return fmt.Errorf("formatArray(%d): %w", depth, io.ErrUnexpectedEOF)
 		}
 		if err != nil {
 			return fmt.Errorf("message Encode: unexpected error from Token(): %w", err)
@@ -34,14 +47,28 @@ func formatArray(depth int, b *bytes.Buffer, dec *json.Decoder) error {
 				return nil
 			case '{':
 				fmt.Fprint(b, strings.Repeat("  ", depth))
-				fmt.Fprint(b, "{\n")
-				if err := formatObject(depth+1, b, dec); err != nil {
+				fmt.Fprint(b, "{")
+				var d = depth + 1
+				if dec.More() {
+					fmt.Fprint(b, "\n")
+				} else {
+					// empty object, see formatObject
+					d = 1
+				}
+				if err := formatObject(d, b, dec); err != nil {
 					return fmt.Errorf("formatArray(%d): decend failed: %w", depth, err)
 				}
 			case '[':
 				fmt.Fprint(b, strings.Repeat("  ", depth))
-				fmt.Fprint(b, "[\n")
-				if err := formatArray(depth+1, b, dec); err != nil {
+				fmt.Fprint(b, "[")
+				var d = depth + 1
+				if dec.More() {
+					fmt.Fprint(b, "\n")
+				} else {
+					// empty array, see formatObject
+					d = 1
+				}
+				if err := formatArray(d, b, dec); err != nil {
 					return fmt.Errorf("formatArray(%d): decend failed: %w", depth, err)
 				}
 			default:
@@ -50,7 +77,7 @@ func formatArray(depth int, b *bytes.Buffer, dec *json.Decoder) error {
 
 		case string:
 			fmt.Fprint(b, strings.Repeat("  ", depth))
-			fmt.Fprintf(b, "%q", v)
+			fmt.Fprint(b, quoteString(v))
 			if dec.More() {
 				fmt.Fprintf(b, ",")
 			}
@@ -79,12 +106,18 @@ func formatArray(depth int, b *bytes.Buffer, dec *json.Decoder) error {
 	}
 }
 
+// formatObject rejects objects with duplicate keys.
+// JSON.parse keeps the last value at the position of the first key, which the streamed output can't reproduce.
 func formatObject(depth int, b *bytes.Buffer, dec *json.Decoder) error {
+	if depth > maxEncodeDepth {
+		return fmt.Errorf("formatObject(%d): nested too deep", depth)
+	}
 	var isKey = true // key:value pair toggle
+	seen := make(map[string]struct{})
 	for {
 		t, err := dec.Token()
 		if err == io.EOF {
-			return nil
+			return fmt.Errorf("formatObject(%d): %w", depth, io.ErrUnexpectedEOF)
 		}
 		if err != nil {
 			return fmt.Errorf("message Encode: unexpected error from Token(): %w", err)
@@ -137,10 +170,13 @@ func formatObject(depth int, b *bytes.Buffer, dec *json.Decoder) error {
 
 		case string:
 			if isKey {
-				fmt.Fprintf(b, "%s%q: ", strings.Repeat("  ", depth), v)
+				if _, dup := seen[v]; dup {
+					return fmt.Errorf("formatObject(%d): duplicate key %q", depth, v)
+				}
+				seen[v] = struct{}{}
+				fmt.Fprintf(b, "%s%s: ", strings.Repeat("  ", depth), quoteString(v))
 			} else {
-				r := strings.NewReplacer("\\", `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, `"`, `\"`)
-				fmt.Fprintf(b, `"%s"`, unicodeEscapeSome(r.Replace(v)))
+				fmt.Fprint(b, quoteString(v))
 				if dec.More() {
 					fmt.Fprint(b, ",")
 				}
@@ -197,9 +233,15 @@ func EncodePreserveOrder(b []byte) ([]byte, error) {
 	if v, ok := t.(json.Delim); !ok || v != '{' {
 		return nil, fmt.Errorf("message Encode: wanted { got %v: %w", t, err)
 	}
-	fmt.Fprint(&buf, "{\n")
+	fmt.Fprint(&buf, "{")
+	if dec.More() {
+		fmt.Fprint(&buf, "\n")
+	}
 	if err := formatObject(1, &buf, dec); err != nil {
 		return nil, fmt.Errorf("message Encode: failed to format message as object: %w", err)
 	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("message Encode: unexpected data after the object")
+	}
 	return bytes.Trim(buf.Bytes(), "\n"), nil
 }
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MIT
+
+//go:build go1.18
+// +build go1.18
+
+package legacy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func FuzzEncodePreserveOrder(f *testing.F) {
+	n := len(testMessages)
+	if n > 200 {
+		n = 200
+	}
+	for i := 1; i < n; i++ {
+		f.Add(testMessages[i].Input)
+	}
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`{"a":[],"b":{},"c":[{},[]]}`))
+	// duplicate keys are rejected, JSON.parse would collapse them
+	f.Add([]byte(`{"z":1,"a":2,"z":3}`))
+	f.Add([]byte(`{"big":123456789012345678901234567890,"small":-1.5e-300}`))
+	f.Add([]byte(`{"ctrl":"\u0001\u0007\b\f\u000b\u007f ","\u0001key":["\u0000"]}`))
+	f.Add([]byte(`{"a":{"b":{"c":{"d":[[[[{"e":null}]]]]}}}}`))
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		out, err := EncodePreserveOrder(in)
+		if err != nil {
+			return
+		}
+
+		wantKeys, ok := topLevelKeys(in)
+		if !ok {
+			t.Fatalf("accepted invalid input %q as %q", in, out)
+		}
+
+		var want, got interface{}
+		if err := decodeNumbers(in, &want); err != nil {
+			t.Fatalf("input didn't decode: %s", err)
+		}
+		if err := decodeNumbers(out, &got); err != nil {
+			t.Fatalf("output isn't valid JSON: %s\n%q", err, out)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("output has a different value\nwant: %#v\ngot:  %#v", want, got)
+		}
+
+		gotKeys, ok := topLevelKeys(out)
+		if !ok {
+			t.Fatalf("output isn't an object: %q", out)
+		}
+		if !reflect.DeepEqual(wantKeys, gotKeys) {
+			t.Fatalf("key order changed\nwant: %v\ngot:  %v", wantKeys, gotKeys)
+		}
+	})
+}
+
+func decodeNumbers(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// topLevelKeys returns the keys of the object in b, including duplicates.
+// It returns false if b isn't a single valid JSON object.
+func topLevelKeys(b []byte) ([]string, bool) {
+	if !json.Valid(b) {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	t, err := dec.Token()
+	if err != nil || t != json.Delim('{') {
+		return nil, false
+	}
+	keys := []string{}
+	for dec.More() {
+		k, err := dec.Token()
+		if err != nil {
+			return nil, false
+		}
+		keys = append(keys, k.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, false
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return keys, true
+}
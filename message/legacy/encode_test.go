@@ -142,3 +142,38 @@ func TestComparePreserve(t *testing.T) {
 		}
 	}
 }
+
+// TestEncodeEdgeCases checks the output against JSON.stringify(JSON.parse(in), null, 2).
+// Duplicate keys, which JSON.parse collapses, are rejected instead.
+func TestEncodeEdgeCases(t *testing.T) {
+	for i, tc := range []struct {
+		in, want string
+		fails    bool
+	}{
+		{in: `{}`, want: `{}`},
+		{in: `{"a":[{},[]],"b":{},"c":[1,{"d":true}]}`, want: "{\n  \"a\": [\n    {},\n    []\n  ],\n  \"b\": {},\n  \"c\": [\n    1,\n    {\n      \"d\": true\n    }\n  ]\n}"},
+		{in: `{"k\u0001":["\u0007\t","\u007f"]}`, want: "{\n  \"k\\u0001\": [\n    \"\\u0007\\t\",\n    \"\u007f\"\n  ]\n}"},
+		{in: `{"z":1,"a":2,"z":3}`, fails: true},
+		{in: `{"a":[{"b":1,"b":2}]}`, fails: true},
+		{in: `{"a":{"b":1},"c":{"b":2}}`, want: "{\n  \"a\": {\n    \"b\": 1\n  },\n  \"c\": {\n    \"b\": 2\n  }\n}"},
+		{in: `{"a":1`, fails: true},
+		{in: `{"a":[1,2}`, fails: true},
+		{in: `{"a":1} {}`, fails: true},
+		{in: `[1]`, fails: true},
+	} {
+		got, err := EncodePreserveOrder([]byte(tc.in))
+		if tc.fails {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got %q", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("case %d: %s", i, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("case %d:\nwant: %q\ngot:  %q", i, tc.want, got)
+		}
+	}
+}
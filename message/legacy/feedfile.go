@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: MIT
+
+package legacy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// VerifyFeedFile checks a dumped feed against expectedAuthor.
+// The file has to hold the signed messages as consecutive JSON values in sequence order, starting at the first message of the feed,
+// like the output of createHistoryStream with keys:false.
+//
+// Every message is verified with Verify and has to be by expectedAuthor and point to the message before it.
+// It returns the number of valid messages. If a message fails one of the checks,
+// the error says which sequence and the count is the number of valid messages before it.
+func VerifyFeedFile(path string, expectedAuthor *refs.FeedRef, hmacSecret *[32]byte) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("VerifyFeedFile: failed to open feed file: %w", err)
+	}
+	defer f.Close()
+
+	var (
+		count   int
+		prevKey *refs.MessageRef
+	)
+
+	dec := json.NewDecoder(f)
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		seq := int64(count + 1)
+		if err != nil {
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): failed to read message: %w", expectedAuthor.ShortRef(), seq, err)
+		}
+
+		key, dmsg, err := Verify(raw, hmacSecret)
+		if err != nil {
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): %w", expectedAuthor.ShortRef(), seq, err)
+		}
+
+		if !dmsg.Author.Equal(expectedAuthor) {
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): wrong author: %s", expectedAuthor.ShortRef(), seq, dmsg.Author.ShortRef())
+		}
+
+		if got := dmsg.Sequence.Seq(); got != seq {
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): wrong sequence: %d", expectedAuthor.ShortRef(), seq, got)
+		}
+
+		switch {
+		case prevKey == nil && dmsg.Previous != nil:
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): first message has a previous: %s", expectedAuthor.ShortRef(), seq, dmsg.Previous.Ref())
+		case prevKey != nil && dmsg.Previous == nil:
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): previous is missing", expectedAuthor.ShortRef(), seq)
+		case prevKey != nil && dmsg.Previous.Ref() != prevKey.Ref():
+			return count, fmt.Errorf("VerifyFeedFile(%s:%d): previous %s doesn't match %s", expectedAuthor.ShortRef(), seq, dmsg.Previous.Ref(), prevKey.Ref())
+		}
+
+		prevKey = key
+		count++
+	}
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: MIT
+
+package legacy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+func TestVerifyFeedFile(t *testing.T) {
+	r := require.New(t)
+
+	dir, err := ioutil.TempDir("", t.Name())
+	r.NoError(err)
+	defer os.RemoveAll(dir)
+
+	const n = 10
+	author := testMessages[1].Author
+
+	writeFeed := func(name string, msgs [][]byte) string {
+		p := filepath.Join(dir, name)
+		r.NoError(ioutil.WriteFile(p, bytes.Join(msgs, []byte("\n")), 0600))
+		return p
+	}
+
+	var good [][]byte
+	for i := 1; i <= n; i++ {
+		good = append(good, testMessages[i].Input)
+	}
+	goodPath := writeFeed("good", good)
+
+	count, err := VerifyFeedFile(goodPath, author, nil)
+	r.NoError(err)
+	r.Equal(n, count)
+
+	// the same feed doesn't verify for someone else
+	other := &refs.FeedRef{ID: bytes.Repeat([]byte{1}, 32), Algo: refs.RefAlgoFeedSSB1}
+	count, err = VerifyFeedFile(goodPath, other, nil)
+	r.Error(err)
+	r.Contains(err.Error(), "wrong author")
+	r.Equal(0, count)
+
+	// change the timestamp of the 5th message, which breaks its signature
+	corrupted := make([][]byte, n)
+	copy(corrupted, good)
+	corrupted[4] = bytes.Replace(good[4], []byte(`"timestamp": `), []byte(`"timestamp": 1`), 1)
+	r.NotEqual(good[4], corrupted[4])
+
+	count, err = VerifyFeedFile(writeFeed("corrupted", corrupted), author, nil)
+	r.Error(err)
+	r.Contains(err.Error(), ":5)")
+	r.Equal(4, count)
+
+	// a message is missing
+	gap := append(append([][]byte{}, good[:3]...), good[4:]...)
+	count, err = VerifyFeedFile(writeFeed("gap", gap), author, nil)
+	r.Error(err)
+	r.Contains(err.Error(), "wrong sequence")
+	r.Equal(3, count)
+
+	_, err = VerifyFeedFile(filepath.Join(dir, "nope"), author, nil)
+	r.Error(err)
+}
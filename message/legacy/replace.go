@@ -19,7 +19,7 @@ func unicodeEscapeSome(s string) string {
 	var b bytes.Buffer
 	for i, r := range s {
 		// https://spec.scuttlebutt.nz/feed/datamodel.html#signing-encoding-strings
-		// the rest is already handled by %q in encode.go
+		// quotes, backslashes, \t, \n and \r are already escaped by stringEscaper in encode.go
 		if r == 0x000008 {
 			// (backspace) \b
 			b.Write([]byte{0x5C, 0x62})
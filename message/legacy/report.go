@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+
+package legacy
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// the checks of VerifyReport, in the order they are done
+const (
+	CheckEncode    = "encode"
+	CheckDecode    = "decode"
+	CheckContent   = "content"
+	CheckHash      = "hash"
+	CheckType      = "type"
+	CheckSignature = "signature"
+	CheckKey       = "key"
+)
+
+// ReportIssue is one problem VerifyReport found
+type ReportIssue struct {
+	Check string
+	Err   error
+}
+
+func (ri ReportIssue) Error() string {
+	return fmt.Sprintf("%s: %s", ri.Check, ri.Err)
+}
+
+func (ri ReportIssue) Unwrap() error { return ri.Err }
+
+// Report lists everything VerifyReport found wrong with a message.
+type Report struct {
+	Issues []ReportIssue
+
+	// Skipped are the checks that couldn't be done because one they depend on failed
+	Skipped []string
+
+	// Key is the key of the message, if it could be computed
+	Key *refs.MessageRef
+}
+
+// OK returns true if no issues were found.
+func (r Report) OK() bool { return len(r.Issues) == 0 }
+
+func (r Report) String() string {
+	if r.OK() {
+		return "ok"
+	}
+	issues := make([]string, len(r.Issues))
+	for i, is := range r.Issues {
+		issues[i] = is.Error()
+	}
+	s := strings.Join(issues, "; ")
+	if len(r.Skipped) > 0 {
+		s += fmt.Sprintf(" (skipped: %s)", strings.Join(r.Skipped, ", "))
+	}
+	return s
+}
+
+func (r *Report) add(check string, err error) {
+	r.Issues = append(r.Issues, ReportIssue{Check: check, Err: err})
+}
+
+func (r *Report) skip(checks ...string) {
+	r.Skipped = append(r.Skipped, checks...)
+}
+
+func (r *Report) computeKey(enc []byte) {
+	mr, err := messageKey(enc, newHashSum(sha256.New))
+	if err != nil {
+		r.add(CheckKey, err)
+		return
+	}
+	r.Key = mr
+}
+
+// VerifyReport does the checks of Verify but doesn't stop at the first problem, for instance to validate a dump of a feed.
+// On top of those, it also reports an unsupported hash field and content without a type.
+// The length of the type is checked with the default bounds, see WithTypeLength.
+// The deserialized message is returned if it could be decoded, even if it has issues.
+func VerifyReport(raw []byte, hmacSecret *[32]byte) (Report, *DeserializedMessage) {
+	var rep Report
+
+	enc, err := EncodePreserveOrder(raw)
+	if err != nil {
+		rep.add(CheckEncode, err)
+		// without the pretty printed form nothing can be signed or hashed
+		rep.skip(CheckSignature, CheckKey)
+	}
+
+	var dmsg DeserializedMessage
+	if err := json.Unmarshal(raw, &dmsg); err != nil {
+		rep.add(CheckDecode, err)
+		rep.skip(CheckContent, CheckHash, CheckType)
+		if enc != nil {
+			// the author is needed to check the signature
+			rep.skip(CheckSignature)
+			rep.computeKey(enc)
+		}
+		return rep, nil
+	}
+
+	contentErr := checkContent(dmsg.Content)
+	if contentErr != nil {
+		rep.add(CheckContent, contentErr)
+	}
+
+	if dmsg.Hash != "sha256" {
+		rep.add(CheckHash, fmt.Errorf("unsupported hash %q", dmsg.Hash))
+	}
+
+	if contentErr != nil {
+		rep.skip(CheckType)
+	} else if err := checkContentType(dmsg.Content); err != nil {
+		rep.add(CheckType, err)
+	}
+
+	if enc == nil {
+		return rep, &dmsg
+	}
+	dmsg.keyOrder = topLevelKeyOrder(enc)
+
+	if woSig, sig, err := ExtractSignature(enc); err != nil {
+		rep.add(CheckSignature, err)
+	} else {
+		if mac := naclMAC(hmacSecret); mac != nil {
+			woSig = mac(woSig)
+		}
+		if err := sig.Verify(woSig, &dmsg.Author); err != nil {
+			rep.add(CheckSignature, err)
+		}
+	}
+
+	rep.computeKey(enc)
+	return rep, &dmsg
+}
+
+// checkContentType expects content to be encrypted, which is a string, or an object with a type of the default length
+func checkContentType(content json.RawMessage) error {
+	var boxed string
+	if err := json.Unmarshal(content, &boxed); err == nil {
+		return nil
+	}
+
+	var typed struct {
+		Type interface{} `json:"type"`
+	}
+	if err := json.Unmarshal(content, &typed); err != nil {
+		return fmt.Errorf("content is neither a string nor an object: %w", err)
+	}
+	tipe, ok := typed.Type.(string)
+	if !ok || tipe == "" {
+		return fmt.Errorf("content has no type")
+	}
+	return checkTypeLength(content, DefaultMinTypeLen, DefaultMaxTypeLen)
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 
 	"go.cryptoscope.co/margaret"
 	refs "go.mindeco.de/ssb-refs"
@@ -22,6 +23,110 @@ type DeserializedMessage struct {
 	Timestamp float64          `json:"timestamp"`
 	Hash      string           `json:"hash"`
 	Content   json.RawMessage  `json:"content"`
+	Signature Signature        `json:"signature"`
+
+	// keyOrder is the order of the fields in the verified message, if it differs from defaultKeyOrder
+	keyOrder []string
+
+	// loose is set if the signature only matched the received bytes, see WithLenientEncoding
+	loose bool
+}
+
+// LooselyVerified returns true if the signature of the message didn't match its canonical encoding but only the bytes as they were received.
+// Verify only accepts such messages with WithLenientEncoding.
+func (dm *DeserializedMessage) LooselyVerified() bool { return dm.loose }
+
+// defaultKeyOrder is the order of the fields of a signed message, as written by current clients.
+// Older feeds have sequence before author.
+var defaultKeyOrder = []string{"previous", "author", "sequence", "timestamp", "hash", "content", "signature"}
+
+// CanonicalJSON encodes the message again, in the same form that Verify checks the signature of and hashes.
+// Messages returned by Verify keep the order of their fields, so the result matches EncodePreserveOrder of the original message.
+//
+// There are some limitations, since only the parsed values are kept:
+// the timestamp is written in its shortest form, like JSON.stringify does, and not in the form it was sent in.
+// Messages that weren't returned by Verify use the field order of current clients.
+func (dm *DeserializedMessage) CanonicalJSON() ([]byte, error) {
+	if dm.Signature == "" {
+		return nil, fmt.Errorf("CanonicalJSON(%s:%d): message has no signature", dm.Author.Ref(), dm.Sequence)
+	}
+	if len(dm.Content) == 0 {
+		return nil, fmt.Errorf("CanonicalJSON(%s:%d): message has no content", dm.Author.Ref(), dm.Sequence)
+	}
+
+	order := dm.keyOrder
+	if order == nil {
+		order = defaultKeyOrder
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, key := range order {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString(quoteString(key) + ":")
+
+		switch key {
+		case "previous":
+			if dm.Previous == nil {
+				buf.WriteString("null")
+			} else {
+				buf.WriteString(quoteString(dm.Previous.Ref()))
+			}
+		case "author":
+			buf.WriteString(quoteString(dm.Author.Ref()))
+		case "sequence":
+			buf.WriteString(strconv.FormatInt(dm.Sequence.Seq(), 10))
+		case "timestamp":
+			buf.WriteString(strconv.FormatFloat(dm.Timestamp, 'f', -1, 64))
+		case "hash":
+			buf.WriteString(quoteString(dm.Hash))
+		case "content":
+			buf.Write(dm.Content)
+		case "signature":
+			buf.WriteString(quoteString(string(dm.Signature)))
+		default:
+			return nil, fmt.Errorf("CanonicalJSON(%s:%d): unknown field %q", dm.Author.Ref(), dm.Sequence, key)
+		}
+	}
+	buf.WriteString("}")
+
+	enc, err := EncodePreserveOrder(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("CanonicalJSON(%s:%d): %w", dm.Author.Ref(), dm.Sequence, err)
+	}
+	return enc, nil
+}
+
+// topLevelKeyOrder returns the keys of the object that EncodePreserveOrder formatted in enc.
+// Only the top-level keys are indented by exactly two spaces. It returns nil if they are in defaultKeyOrder.
+func topLevelKeyOrder(enc []byte) []string {
+	var keys []string
+	for _, line := range bytes.Split(enc, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte(`  "`)) {
+			continue
+		}
+		end := bytes.IndexByte(line[3:], '"')
+		if end < 0 {
+			continue
+		}
+		keys = append(keys, string(line[3:3+end]))
+	}
+
+	if len(keys) == len(defaultKeyOrder) {
+		same := true
+		for i, k := range keys {
+			if k != defaultKeyOrder[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+	return keys
 }
 
 type LegacyMessage struct {
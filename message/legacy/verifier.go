@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: MIT
+
+package legacy
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"hash"
+	"sync"
+
+	refs "go.mindeco.de/ssb-refs"
+	"golang.org/x/crypto/nacl/auth"
+)
+
+// Verifier verifies messages of one network, that is with the same hmac key and options.
+// It is safe for concurrent use.
+//
+// nacl's crypto_auth() is HMAC-SHA-512 truncated to 32 bytes. auth.Sum keys a new HMAC for every message,
+// the Verifier keeps keyed instances around and only resets them, which saves hashing the padded key twice per message.
+type Verifier struct {
+	opts verifyOptions
+
+	// nil if there is no hmac key
+	macs *sync.Pool
+
+	// the hashes for the message keys, see WithHasher
+	hashes *sync.Pool
+}
+
+// NewVerifier returns a Verifier for messages that are signed with hmacSecret, which may be nil like for Verify.
+// The options are applied to every message, see WithMaxFutureSkew.
+func NewVerifier(hmacSecret *[32]byte, opts ...VerifyOption) *Verifier {
+	var v Verifier
+	for _, o := range opts {
+		o(&v.opts)
+	}
+
+	newHash := v.opts.hasher()
+	v.hashes = &sync.Pool{
+		New: func() interface{} {
+			return newHash()
+		},
+	}
+
+	if hmacSecret != nil {
+		// copy the key so that the caller can't change it under our feet
+		key := make([]byte, len(hmacSecret))
+		copy(key, hmacSecret[:])
+		v.macs = &sync.Pool{
+			New: func() interface{} {
+				return hmac.New(sha512.New, key)
+			},
+		}
+	}
+	return &v
+}
+
+// Verify does the same as the package level Verify with the secret and options of the Verifier.
+func (v *Verifier) Verify(raw []byte) (*refs.MessageRef, *DeserializedMessage, error) {
+	return verify(raw, v.mac(), v.hashSum, v.opts)
+}
+
+// VerifySignatureOnly does the same as the package level VerifySignatureOnly with the secret of the Verifier.
+// Unlike that one, it uses WithLenientEncoding if the Verifier was made with it. The other options aren't checked.
+func (v *Verifier) VerifySignatureOnly(raw []byte) (*DeserializedMessage, error) {
+	_, dmsg, err := verifySignature(raw, v.mac(), v.opts.lenient)
+	return dmsg, err
+}
+
+func (v *Verifier) mac() macFunc {
+	if v.macs == nil {
+		return nil
+	}
+	return v.sum
+}
+
+// sum computes the same as auth.Sum with a pooled HMAC instance.
+func (v *Verifier) sum(msg []byte) []byte {
+	h := v.macs.Get().(hash.Hash)
+	h.Reset()
+	h.Write(msg)
+	var out [sha512.Size]byte
+	sum := h.Sum(out[:0])
+	v.macs.Put(h)
+	return sum[:auth.Size]
+}
+
+// hashSum computes the message key hash with a pooled instance.
+func (v *Verifier) hashSum(msg []byte) []byte {
+	h := v.hashes.Get().(hash.Hash)
+	h.Reset()
+	h.Write(msg)
+	sum := h.Sum(nil)
+	v.hashes.Put(h)
+	return sum
+}
@@ -10,8 +10,13 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"hash"
+	"math"
+	"regexp"
+	"time"
+	"unicode/utf16"
 
 	refs "go.mindeco.de/ssb-refs"
 	"golang.org/x/crypto/nacl/auth"
@@ -35,7 +40,116 @@ func ExtractSignature(b []byte) ([]byte, Signature, error) {
 // If hmacSecret is non nil, it uses that as the Key for NACL crypto_auth() and verifies the signature against the hash of the message.
 // At last it uses internalV8Binary to create a the SHA256 hash for the message key.
 // If you find a buggy message, use `node ./encode_test.js $feedID` to generate a new testdata.zip
-func Verify(raw []byte, hmacSecret *[32]byte) (*refs.MessageRef, *DeserializedMessage, error) {
+// The content type has to have between DefaultMinTypeLen and DefaultMaxTypeLen characters, unless WithTypeLength changes that.
+// Earlier versions didn't check the type length at all, so messages that were accepted before can be rejected now.
+//
+// The options add checks on top of that, like WithMaxFutureSkew.
+func Verify(raw []byte, hmacSecret *[32]byte, opts ...VerifyOption) (*refs.MessageRef, *DeserializedMessage, error) {
+	var vo verifyOptions
+	for _, o := range opts {
+		o(&vo)
+	}
+	return verify(raw, naclMAC(hmacSecret), vo.sum(), vo)
+}
+
+func verify(raw []byte, mac macFunc, sum hashFunc, vo verifyOptions) (*refs.MessageRef, *DeserializedMessage, error) {
+	enc, dmsg, err := verifySignature(raw, mac, vo.lenient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := vo.check(dmsg); err != nil {
+		return nil, nil, err
+	}
+
+	mr, err := messageKey(enc, sum)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ssb Verify(%s:%d): could hash convert message: %w", dmsg.Author.Ref(), dmsg.Sequence, err)
+	}
+	return mr, dmsg, nil
+}
+
+// hashFunc returns the sha256 of msg, see WithHasher
+type hashFunc func(msg []byte) []byte
+
+// newHashSum returns a hashFunc that uses a new instance of newHash for every message
+func newHashSum(newHash func() hash.Hash) hashFunc {
+	return func(msg []byte) []byte {
+		h := newHash()
+		h.Write(msg)
+		return h.Sum(nil)
+	}
+}
+
+// messageKey computes the key of the pretty printed message enc
+func messageKey(enc []byte, sum hashFunc) (*refs.MessageRef, error) {
+	// hash the message - it's sadly the internal string rep of v8 that get's hashed, not the json string
+	v8warp, err := InternalV8Binary(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &refs.MessageRef{
+		Hash: sum(v8warp),
+		Algo: refs.RefAlgoMessageSSB1,
+	}, nil
+}
+
+// VerifySignatureOnly only checks the content and the signature of the message, it skips computing the message key.
+// Use it if you only need to know wether the signature is valid, since the v8 conversion and hashing are comparatively expensive.
+// Unlike Verify, it doesn't check the length of the content type and the signature has to match the canonical encoding.
+func VerifySignatureOnly(raw []byte, hmacSecret *[32]byte) (*DeserializedMessage, error) {
+	_, dmsg, err := verifySignature(raw, naclMAC(hmacSecret), false)
+	return dmsg, err
+}
+
+// VerifyExpected is Verify for a message that was requested as message expectSeq of expectAuthor.
+// On top of the signature it checks that the message is the requested one and returns ErrUnexpectedAuthor or ErrUnexpectedSequence if it isn't.
+func VerifyExpected(raw []byte, expectAuthor *refs.FeedRef, expectSeq int64, hmacSecret *[32]byte) (*refs.MessageRef, error) {
+	if expectAuthor == nil {
+		return nil, fmt.Errorf("ssb Verify: no expected author")
+	}
+
+	ref, dmsg, err := Verify(raw, hmacSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dmsg.Author.Equal(expectAuthor) {
+		return nil, fmt.Errorf("ssb Verify(%s:%d): %w: wanted %s", dmsg.Author.Ref(), dmsg.Sequence, ErrUnexpectedAuthor, expectAuthor.Ref())
+	}
+	if got := dmsg.Sequence.Seq(); got != expectSeq {
+		return nil, fmt.Errorf("ssb Verify(%s:%d): %w: wanted %d", dmsg.Author.Ref(), got, ErrUnexpectedSequence, expectSeq)
+	}
+	return ref, nil
+}
+
+var (
+	// ErrUnexpectedAuthor is returned by VerifyExpected if the message is of another feed
+	ErrUnexpectedAuthor = errors.New("message has an unexpected author")
+
+	// ErrUnexpectedSequence is returned by VerifyExpected if the message has another sequence
+	ErrUnexpectedSequence = errors.New("message has an unexpected sequence")
+)
+
+// macFunc authenticates the signed part of a message for a specific network.
+// A nil macFunc means the network doesn't use an hmac key and the message is signed as is.
+type macFunc func(msg []byte) []byte
+
+// naclMAC returns a macFunc that uses hmacSecret with nacl's crypto_auth() or nil if hmacSecret is nil.
+func naclMAC(hmacSecret *[32]byte) macFunc {
+	if hmacSecret == nil {
+		return nil
+	}
+	return func(msg []byte) []byte {
+		mac := auth.Sum(msg, hmacSecret)
+		return mac[:]
+	}
+}
+
+// verifySignature returns the pretty printed message, which is needed to compute the key, and the deserialized message if the signature is valid.
+// If lenient is set and the signature doesn't match the pretty printed message, raw is tried as well and returned instead, see WithLenientEncoding.
+func verifySignature(raw []byte, mac macFunc, lenient bool) ([]byte, *DeserializedMessage, error) {
 	enc, err := EncodePreserveOrder(raw)
 	if err != nil {
 		if len(raw) > 15 {
@@ -52,32 +166,213 @@ func Verify(raw []byte, hmacSecret *[32]byte) (*refs.MessageRef, *DeserializedMe
 		}
 		return nil, nil, fmt.Errorf("ssb Verify: could not json.Unmarshal message (%q): %w", raw, err)
 	}
+	dmsg.keyOrder = topLevelKeyOrder(enc)
+
+	if err := checkContent(dmsg.Content); err != nil {
+		return nil, nil, fmt.Errorf("ssb Verify(%s:%d): %w", dmsg.Author.Ref(), dmsg.Sequence, err)
+	}
 
 	woSig, sig, err := ExtractSignature(enc)
 	if err != nil {
 		return nil, nil, fmt.Errorf("ssb Verify(%s:%d): could not extract signature: %w", dmsg.Author.Ref(), dmsg.Sequence, err)
 	}
 
-	if hmacSecret != nil {
-		mac := auth.Sum(woSig, hmacSecret)
-		woSig = mac[:]
+	if mac != nil {
+		woSig = mac(woSig)
 	}
 
 	if err := sig.Verify(woSig, &dmsg.Author); err != nil {
+		if lenient && verifyAsReceived(raw, sig, mac, &dmsg.Author) {
+			dmsg.loose = true
+			return raw, &dmsg, nil
+		}
 		return nil, nil, fmt.Errorf("ssb Verify(%s:%d): could not verify message: %w", dmsg.Author.Ref(), dmsg.Sequence, err)
 	}
 
-	// hash the message - it's sadly the internal string rep of v8 that get's hashed, not the json string
-	v8warp, err := InternalV8Binary(enc)
-	if err != nil {
-		return nil, nil, fmt.Errorf("ssb Verify(%s:%d): could hash convert message: %w", dmsg.Author.Ref(), dmsg.Sequence, err)
+	return enc, &dmsg, nil
+}
+
+// receivedSignatureRegexp matches the signature as the last field of a received message, in any layout like compact JSON.
+var receivedSignatureRegexp = regexp.MustCompile(`,\s*"signature"\s*:\s*"([A-Za-z0-9/+=.]+)"(\s*}\s*)$`)
+
+// verifyAsReceived checks if sig is valid for raw without re-encoding it, for messages of old clients that didn't sign the canonical form.
+// Unlike ExtractSignature it doesn't expect the pretty printed layout, the signature only has to be the last field.
+func verifyAsReceived(raw []byte, sig Signature, mac macFunc, author *refs.FeedRef) bool {
+	m := receivedSignatureRegexp.FindSubmatchIndex(raw)
+	if m == nil || Signature(raw[m[2]:m[3]]) != sig {
+		return false
 	}
-	h := sha256.New()
-	io.Copy(h, bytes.NewReader(v8warp))
+	woSig := append(append([]byte(nil), raw[:m[0]]...), raw[m[4]:]...)
+	if mac != nil {
+		woSig = mac(woSig)
+	}
+	return sig.Verify(woSig, author) == nil
+}
 
-	mr := refs.MessageRef{
-		Hash: h.Sum(nil),
-		Algo: refs.RefAlgoMessageSSB1,
+var (
+	// ErrNoContent is returned by Verify for messages without a content field
+	ErrNoContent = errors.New("message has no content")
+
+	// ErrNullContent is returned by Verify for messages whose content is null
+	ErrNullContent = errors.New("message content is null")
+
+	// ErrEmptyContent is returned by Verify for messages whose content is an empty object, which has no type
+	ErrEmptyContent = errors.New("message content is an empty object without a type")
+)
+
+// checkContent rejects the content values that can't be a message, before looking at the signature.
+// Everything else is left to the validation of the content types.
+func checkContent(content json.RawMessage) error {
+	trimmed := bytes.TrimSpace(content)
+	switch {
+	case len(trimmed) == 0:
+		return ErrNoContent
+	case bytes.Equal(trimmed, []byte("null")):
+		return ErrNullContent
+	case len(trimmed) >= 2 && trimmed[0] == '{' && len(bytes.TrimSpace(trimmed[1:len(trimmed)-1])) == 0:
+		return ErrEmptyContent
+	}
+	return nil
+}
+
+// ErrTypeLength is returned by Verify for messages whose content type is too short or too long, see WithTypeLength
+var ErrTypeLength = errors.New("message content type has an invalid length")
+
+// checkTypeLength checks the number of characters of the content type against minLen and maxLen.
+// They are counted in UTF-16 code units like the .length of the JavaScript implementation, so characters outside of the BMP count twice.
+// Encrypted content and content without a type are left to the validation of the content types.
+func checkTypeLength(content json.RawMessage, minLen, maxLen int) error {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(content, &typed); err != nil || typed.Type == "" {
+		return nil
+	}
+
+	n := len(utf16.Encode([]rune(typed.Type)))
+	if n < minLen || (maxLen > 0 && n > maxLen) {
+		return fmt.Errorf("%w: %d characters", ErrTypeLength, n)
 	}
-	return &mr, &dmsg, nil
+	return nil
+}
+
+// VerifyOption adds a check to Verify.
+type VerifyOption func(*verifyOptions)
+
+type verifyOptions struct {
+	maxFutureSkew time.Duration
+	now           func() time.Time
+	lenient       bool
+	newHash       func() hash.Hash
+
+	// typeLen are the bounds of WithTypeLength, nil for the defaults
+	typeLen *[2]int
+}
+
+// the bounds for the length of the content type that the protocol allows, see WithTypeLength
+const (
+	DefaultMinTypeLen = 3
+	DefaultMaxTypeLen = 53
+)
+
+// WithTypeLength replaces the bounds for the number of characters of the content type, which are DefaultMinTypeLen and DefaultMaxTypeLen.
+// The default check is new, WithTypeLength(0, 0) turns it off for callers that need to accept what earlier versions did.
+// Messages outside of them are rejected with ErrTypeLength. A maxLen of zero or less means no upper bound.
+// Other implementations reject messages that don't keep to the defaults, so only relax them on private networks.
+func WithTypeLength(minLen, maxLen int) VerifyOption {
+	return func(vo *verifyOptions) {
+		vo.typeLen = &[2]int{minLen, maxLen}
+	}
+}
+
+// WithMaxFutureSkew makes Verify reject messages whose timestamp is more than skew ahead of the local clock with ErrFutureTimestamp.
+//
+// The timestamp is asserted by the author and can't be trusted: clocks are off and messages can be backdated at will.
+// This only catches messages that are dated far into the future, for instance to stay on top of views that are sorted by it.
+// Keep skew generous, a message that is rejected now would be valid a bit later.
+func WithMaxFutureSkew(skew time.Duration) VerifyOption {
+	return func(vo *verifyOptions) {
+		vo.maxFutureSkew = skew
+	}
+}
+
+// WithLenientEncoding makes Verify accept messages whose signature doesn't match their canonical encoding but the bytes as they were received.
+// Some old clients signed slightly different bytes than the canonical form, which makes their messages fail otherwise.
+// The key of such messages is computed from the received bytes, too. DeserializedMessage.LooselyVerified tells them apart.
+func WithLenientEncoding() VerifyOption {
+	return func(vo *verifyOptions) {
+		vo.lenient = true
+	}
+}
+
+// WithHasher replaces sha256.New for computing the message keys, for instance with a hardware accelerated implementation.
+// It has to return sha256 instances, other hashes give wrong keys.
+// The package level Verify makes a new instance for every message, a Verifier keeps them in a pool and resets them.
+func WithHasher(newHash func() hash.Hash) VerifyOption {
+	return func(vo *verifyOptions) {
+		vo.newHash = newHash
+	}
+}
+
+// hasher returns the constructor of the hash for the message keys
+func (vo verifyOptions) hasher() func() hash.Hash {
+	if vo.newHash != nil {
+		return vo.newHash
+	}
+	return sha256.New
+}
+
+func (vo verifyOptions) sum() hashFunc {
+	return newHashSum(vo.hasher())
+}
+
+func (vo verifyOptions) check(dmsg *DeserializedMessage) error {
+	minLen, maxLen := DefaultMinTypeLen, DefaultMaxTypeLen
+	if vo.typeLen != nil {
+		minLen, maxLen = vo.typeLen[0], vo.typeLen[1]
+	}
+	if err := checkTypeLength(dmsg.Content, minLen, maxLen); err != nil {
+		return fmt.Errorf("ssb Verify(%s:%d): %w", dmsg.Author.Ref(), dmsg.Sequence, err)
+	}
+
+	if vo.maxFutureSkew <= 0 {
+		return nil
+	}
+	now := time.Now
+	if vo.now != nil {
+		now = vo.now
+	}
+
+	// compared in milliseconds, timestamps far in the future don't fit into a time.Duration
+	nowMillis := float64(now().UnixNano()) / float64(time.Millisecond)
+	maxMillis := nowMillis + float64(vo.maxFutureSkew)/float64(time.Millisecond)
+	if dmsg.Timestamp > maxMillis {
+		return ErrFutureTimestamp{
+			Author:   dmsg.Author.Copy(),
+			Sequence: dmsg.Sequence.Seq(),
+			Claimed:  millisToTime(dmsg.Timestamp),
+			MaxSkew:  vo.maxFutureSkew,
+		}
+	}
+	return nil
+}
+
+// millisToTime converts a message timestamp, timestamps after the year 2262 are capped to that.
+func millisToTime(ms float64) time.Time {
+	if ms >= float64(math.MaxInt64/int64(time.Millisecond)) {
+		return time.Unix(0, math.MaxInt64)
+	}
+	return time.Unix(0, int64(ms*float64(time.Millisecond)))
+}
+
+// ErrFutureTimestamp is returned by Verify for messages that are dated too far into the future, see WithMaxFutureSkew.
+type ErrFutureTimestamp struct {
+	Author   *refs.FeedRef
+	Sequence int64
+	Claimed  time.Time
+	MaxSkew  time.Duration
+}
+
+func (e ErrFutureTimestamp) Error() string {
+	return fmt.Sprintf("ssb Verify(%s:%d): timestamp %s is more than %s in the future", e.Author.Ref(), e.Sequence, e.Claimed.Format(time.RFC3339), e.MaxSkew)
 }
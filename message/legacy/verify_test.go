@@ -3,9 +3,19 @@
 package legacy
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
 	"testing"
+	"time"
 
 	"go.cryptoscope.co/margaret"
+	"go.cryptoscope.co/ssb"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/auth"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -50,3 +60,464 @@ func TestVerifyBugs(t *testing.T) {
 		a.Equal(tc.seq, dmsg.Sequence)
 	}
 }
+
+var npmPackagesMsg = []byte(`{"previous":"%Ym5QnkNCtIHgZG8yk0NBU/ZibTc6qNk1QQov5k5JTl4=.sha256","author":"@f/6sQ6d2CMxRUhLpspgGIulDxDCwYD7DzFzPNr7u5AU=.ed25519","sequence":7836,"timestamp":1508190205432,"hash":"sha256","content":{"type":"npm-packages","mentions":[[null,false]]},"signature":"+uX4y2HwatiR4pvwqIzJL30x4XfTA/MeusQAMI6gT9rawbT5Y7uU40Y8JLgKXKYJtwQ9E5zR70kDYqefbHYVCw==.sig.ed25519"}`)
+
+func TestCanonicalJSON(t *testing.T) {
+	a, r := assert.New(t), require.New(t)
+	n := len(testMessages)
+	if testing.Short() {
+		n = min(50, n)
+	}
+	for i := 1; i < n; i++ {
+		want, err := EncodePreserveOrder(testMessages[i].Input)
+		r.NoError(err)
+
+		_, dmsg, err := Verify(testMessages[i].Input, nil)
+		r.NoError(err, "verify failed")
+
+		got, err := dmsg.CanonicalJSON()
+		r.NoError(err, "message %d", i)
+		a.Equal(string(want), string(got), "message %d", i)
+	}
+
+	// without the field order of Verify the current one is used
+	_, dmsg, err := Verify(npmPackagesMsg, nil)
+	r.NoError(err)
+	want, err := EncodePreserveOrder(npmPackagesMsg)
+	r.NoError(err)
+	cpy := *dmsg
+	cpy.keyOrder = nil
+	got, err := cpy.CanonicalJSON()
+	r.NoError(err)
+	a.Equal(string(want), string(got))
+
+	cpy.Signature = ""
+	_, err = cpy.CanonicalJSON()
+	r.Error(err)
+}
+
+func TestVerifySignatureOnly(t *testing.T) {
+	a, r := assert.New(t), require.New(t)
+	n := len(testMessages)
+	if testing.Short() {
+		n = min(50, n)
+	}
+	for i := 1; i < n; i++ {
+		dmsg, err := VerifySignatureOnly(testMessages[i].Input, nil)
+		r.NoError(err, "verify failed")
+		a.True(dmsg.Author.Equal(testMessages[i].Author), "author mismatch %d", i)
+	}
+
+	dmsg, err := VerifySignatureOnly(npmPackagesMsg, nil)
+	r.NoError(err)
+	a.EqualValues(7836, dmsg.Sequence)
+
+	tampered := bytes.Replace(npmPackagesMsg, []byte(`"npm-packages"`), []byte(`"npm-packagez"`), 1)
+	r.NotEqual(npmPackagesMsg, tampered)
+	_, err = VerifySignatureOnly(tampered, nil)
+	r.Error(err, "accepted a tampered message")
+
+	// a valid message doesn't verify with the wrong hmac key
+	var hmacKey [32]byte
+	hmacKey[0] = 1
+	_, err = VerifySignatureOnly(npmPackagesMsg, &hmacKey)
+	r.Error(err, "accepted a message signed without hmac")
+}
+
+func BenchmarkVerify(b *testing.B) {
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := Verify(npmPackagesMsg, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("signature-only", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := VerifySignatureOnly(npmPackagesMsg, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// the Verifier reuses the hashes for the message keys
+	b.Run("verifier", func(b *testing.B) {
+		v := NewVerifier(nil)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := v.Verify(npmPackagesMsg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestVerifyWithHasher(t *testing.T) {
+	r := require.New(t)
+
+	want, _, err := Verify(npmPackagesMsg, nil)
+	r.NoError(err)
+
+	var made int
+	counting := func() hash.Hash {
+		made++
+		return sha256.New()
+	}
+
+	got, _, err := Verify(npmPackagesMsg, nil, WithHasher(counting))
+	r.NoError(err)
+	r.Equal(want.Ref(), got.Ref())
+	r.Equal(1, made)
+
+	v := NewVerifier(nil, WithHasher(counting))
+	for i := 0; i < 3; i++ {
+		got, _, err = v.Verify(npmPackagesMsg)
+		r.NoError(err)
+		r.Equal(want.Ref(), got.Ref())
+	}
+	r.True(made >= 2, "verifier didn't use the hasher")
+}
+
+func TestVerifyFutureTimestamp(t *testing.T) {
+	a, r := assert.New(t), require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{7}, 32)))
+	r.NoError(err)
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	atNow := func(vo *verifyOptions) { vo.now = func() time.Time { return now } }
+
+	var lm LegacyMessage
+	lm.Author = kp.Id.Ref()
+	lm.Sequence = 1
+	lm.Hash = "sha256"
+	lm.Timestamp = now.Add(24*time.Hour).UnixNano() / int64(time.Millisecond)
+	lm.Content = map[string]interface{}{"type": "test"}
+	_, future, err := lm.Sign(kp.Pair.Secret[:], nil)
+	r.NoError(err)
+
+	// off by default
+	_, _, err = Verify(future, nil)
+	r.NoError(err)
+
+	_, _, err = Verify(future, nil, WithMaxFutureSkew(time.Hour), atNow)
+	r.Error(err)
+	var tsErr ErrFutureTimestamp
+	r.True(errors.As(err, &tsErr), "wrong error: %v", err)
+	a.True(tsErr.Author.Equal(kp.Id))
+	a.EqualValues(1, tsErr.Sequence)
+	a.Equal(time.Hour, tsErr.MaxSkew)
+
+	_, _, err = Verify(future, nil, WithMaxFutureSkew(48*time.Hour), atNow)
+	r.NoError(err)
+
+	// too far ahead to be counted in nanoseconds
+	lm.Timestamp = 1e16
+	_, farFuture, err := lm.Sign(kp.Pair.Secret[:], nil)
+	r.NoError(err)
+	_, _, err = Verify(farFuture, nil, WithMaxFutureSkew(48*time.Hour), atNow)
+	r.True(errors.As(err, &tsErr), "wrong error: %v", err)
+	a.True(tsErr.Claimed.After(now))
+
+	// old messages are fine
+	_, _, err = Verify(npmPackagesMsg, nil, WithMaxFutureSkew(time.Hour), atNow)
+	r.NoError(err)
+}
+
+func TestVerifyTypeLength(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{8}, 32)))
+	r.NoError(err)
+
+	sign := func(tipe string) []byte {
+		var lm LegacyMessage
+		lm.Author = kp.Id.Ref()
+		lm.Sequence = 1
+		lm.Hash = "sha256"
+		lm.Timestamp = 1
+		lm.Content = map[string]interface{}{"type": tipe}
+		_, signed, err := lm.Sign(kp.Pair.Secret[:], nil)
+		r.NoError(err)
+		return signed
+	}
+
+	long := sign(strings.Repeat("x", 60))
+	_, _, err = Verify(long, nil)
+	r.Error(err)
+	r.True(errors.Is(err, ErrTypeLength), "wrong error: %v", err)
+
+	_, _, err = NewVerifier(nil).Verify(long)
+	r.True(errors.Is(err, ErrTypeLength), "wrong error: %v", err)
+
+	_, _, err = Verify(long, nil, WithTypeLength(1, 64))
+	r.NoError(err)
+	_, _, err = Verify(long, nil, WithTypeLength(1, 0))
+	r.NoError(err, "no upper bound")
+
+	short := sign("ab")
+	_, _, err = Verify(short, nil)
+	r.True(errors.Is(err, ErrTypeLength), "wrong error: %v", err)
+	_, _, err = Verify(short, nil, WithTypeLength(1, DefaultMaxTypeLen))
+	r.NoError(err)
+
+	// the bounds are inclusive
+	_, _, err = Verify(sign(strings.Repeat("x", DefaultMaxTypeLen)), nil)
+	r.NoError(err)
+	_, _, err = Verify(sign("abc"), nil)
+	r.NoError(err)
+
+	// characters outside of the BMP count twice, like in JavaScript
+	_, _, err = Verify(sign("\U0001F600x"), nil)
+	r.NoError(err)
+	_, _, err = Verify(sign(strings.Repeat("\U0001F600", 27)), nil)
+	r.True(errors.Is(err, ErrTypeLength), "wrong error: %v", err)
+
+	rep, _ := VerifyReport(long, nil)
+	r.False(rep.OK())
+	r.Equal(CheckType, rep.Issues[0].Check)
+}
+
+func TestVerifier(t *testing.T) {
+	a, r := assert.New(t), require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{3}, 32)))
+	r.NoError(err)
+
+	var hk [32]byte
+	copy(hk[:], bytes.Repeat([]byte{9}, 32))
+
+	// the mac of the pooled instances has to match nacl's
+	v := NewVerifier(&hk)
+	for _, m := range [][]byte{nil, []byte("a"), bytes.Repeat([]byte("hello"), 100)} {
+		want := auth.Sum(m, &hk)
+		a.Equal(want[:], v.sum(m))
+	}
+
+	var signed [][]byte
+	for i := 1; i <= 5; i++ {
+		var lm LegacyMessage
+		lm.Author = kp.Id.Ref()
+		lm.Sequence = margaret.BaseSeq(i)
+		lm.Hash = "sha256"
+		lm.Timestamp = int64(i)
+		lm.Content = map[string]interface{}{"type": "test", "i": i}
+		_, msg, err := lm.Sign(kp.Pair.Secret[:], &hk)
+		r.NoError(err)
+		signed = append(signed, msg)
+	}
+
+	for i, msg := range signed {
+		ref, dmsg, err := v.Verify(msg)
+		r.NoError(err, "msg %d failed", i)
+		a.EqualValues(i+1, dmsg.Sequence)
+
+		wantRef, _, err := Verify(msg, &hk)
+		r.NoError(err)
+		a.True(wantRef.Equal(ref), "key mismatch %d", i)
+
+		_, err = v.VerifySignatureOnly(msg)
+		r.NoError(err)
+	}
+
+	// the key is copied
+	hk[0] = 0
+	_, _, err = v.Verify(signed[0])
+	r.NoError(err)
+
+	// wrong or missing hmac keys
+	_, _, err = NewVerifier(nil).Verify(signed[0])
+	r.Error(err, "accepted a message signed with hmac")
+	_, _, err = NewVerifier(&hk).Verify(signed[0])
+	r.Error(err, "accepted a message signed with another hmac key")
+
+	_, _, err = NewVerifier(nil).Verify(npmPackagesMsg)
+	r.NoError(err)
+	_, err = NewVerifier(nil).VerifySignatureOnly(npmPackagesMsg)
+	r.NoError(err)
+
+	// options are applied to every message
+	_, _, err = NewVerifier(nil, WithMaxFutureSkew(time.Hour), func(vo *verifyOptions) {
+		vo.now = func() time.Time { return time.Unix(0, 0) }
+	}).Verify(npmPackagesMsg)
+	var tsErr ErrFutureTimestamp
+	r.True(errors.As(err, &tsErr), "wrong error: %v", err)
+}
+
+func TestVerifyEmptyContent(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{5}, 32)))
+	r.NoError(err)
+
+	sign := func(content interface{}) []byte {
+		var lm LegacyMessage
+		lm.Author = kp.Id.Ref()
+		lm.Sequence = 1
+		lm.Hash = "sha256"
+		lm.Timestamp = 1
+		lm.Content = content
+		_, msg, err := lm.Sign(kp.Pair.Secret[:], nil)
+		r.NoError(err)
+		return msg
+	}
+
+	_, _, err = Verify(sign(nil), nil)
+	r.True(errors.Is(err, ErrNullContent), "wrong error: %v", err)
+
+	_, _, err = Verify(sign(map[string]interface{}{}), nil)
+	r.True(errors.Is(err, ErrEmptyContent), "wrong error: %v", err)
+
+	_, err = VerifySignatureOnly(sign(map[string]interface{}{}), nil)
+	r.True(errors.Is(err, ErrEmptyContent), "wrong error: %v", err)
+
+	_, dmsg, err := Verify(sign(map[string]interface{}{"type": "test"}), nil)
+	r.NoError(err)
+	r.JSONEq(`{"type":"test"}`, string(dmsg.Content))
+
+	// boxed content is a string
+	_, _, err = Verify(sign("c2VjcmV0.box"), nil)
+	r.NoError(err)
+}
+
+func TestVerifyExpected(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{3}, 32)))
+	r.NoError(err)
+	other, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{4}, 32)))
+	r.NoError(err)
+
+	var lm LegacyMessage
+	lm.Author = kp.Id.Ref()
+	lm.Sequence = 1
+	lm.Hash = "sha256"
+	lm.Timestamp = 1
+	lm.Content = map[string]interface{}{"type": "test"}
+	wantRef, msg, err := lm.Sign(kp.Pair.Secret[:], nil)
+	r.NoError(err)
+
+	ref, err := VerifyExpected(msg, kp.Id, 1, nil)
+	r.NoError(err)
+	r.True(wantRef.Equal(ref))
+
+	_, err = VerifyExpected(msg, other.Id, 1, nil)
+	r.True(errors.Is(err, ErrUnexpectedAuthor), "wrong error: %v", err)
+
+	_, err = VerifyExpected(msg, kp.Id, 2, nil)
+	r.True(errors.Is(err, ErrUnexpectedSequence), "wrong error: %v", err)
+
+	// the signature is still checked first
+	tampered := bytes.Replace(msg, []byte(`"test"`), []byte(`"tezt"`), 1)
+	_, err = VerifyExpected(tampered, kp.Id, 1, nil)
+	r.Error(err)
+	r.False(errors.Is(err, ErrUnexpectedAuthor) || errors.Is(err, ErrUnexpectedSequence))
+}
+
+func TestVerifyReport(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{6}, 32)))
+	r.NoError(err)
+
+	sign := func(hash string, content interface{}) []byte {
+		var lm LegacyMessage
+		lm.Author = kp.Id.Ref()
+		lm.Sequence = 1
+		lm.Hash = hash
+		lm.Timestamp = 1
+		lm.Content = content
+		_, msg, err := lm.Sign(kp.Pair.Secret[:], nil)
+		r.NoError(err)
+		return msg
+	}
+
+	checks := func(rep Report) []string {
+		var names []string
+		for _, is := range rep.Issues {
+			names = append(names, is.Check)
+		}
+		return names
+	}
+
+	wantRef, good, err := Verify(sign("sha256", map[string]interface{}{"type": "test"}), nil)
+	r.NoError(err)
+	rep, dmsg := VerifyReport(sign("sha256", map[string]interface{}{"type": "test"}), nil)
+	r.True(rep.OK(), "issues: %s", rep)
+	r.NotNil(dmsg)
+	r.True(wantRef.Equal(rep.Key))
+	r.EqualValues(1, good.Sequence)
+
+	// wrong hash, no type and tampered after signing
+	broken := sign("blake2", map[string]interface{}{"text": "hi"})
+	broken = bytes.Replace(broken, []byte(`"hi"`), []byte(`"ho"`), 1)
+	rep, dmsg = VerifyReport(broken, nil)
+	r.False(rep.OK())
+	r.NotNil(dmsg)
+	r.Equal([]string{CheckHash, CheckType, CheckSignature}, checks(rep), "issues: %s", rep)
+	r.Len(rep.Skipped, 0)
+	r.NotNil(rep.Key, "the key can still be computed")
+
+	_, _, err = Verify(broken, nil)
+	r.Error(err)
+
+	// empty content can't have a type
+	rep, _ = VerifyReport(sign("sha256", map[string]interface{}{}), nil)
+	r.Equal([]string{CheckContent}, checks(rep), "issues: %s", rep)
+	r.Equal([]string{CheckType}, rep.Skipped)
+	r.True(errors.Is(rep.Issues[0], ErrEmptyContent))
+
+	// not even json
+	rep, dmsg = VerifyReport([]byte(`{"author": `), nil)
+	r.Nil(dmsg)
+	r.Equal([]string{CheckEncode, CheckDecode}, checks(rep), "issues: %s", rep)
+	r.Nil(rep.Key)
+}
+
+func TestVerifyLenientEncoding(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{8}, 32)))
+	r.NoError(err)
+
+	// an old client that indented the content wrongly and signed that
+	body := fmt.Sprintf("{\n  \"previous\": null,\n  \"author\": %q,\n  \"sequence\": 1,\n  \"timestamp\": 1,\n  \"hash\": \"sha256\",\n  \"content\": {\n      \"type\": \"test\"\n  }", kp.Id.Ref())
+	sig := EncodeSignature(ed25519.Sign(kp.Pair.Secret[:], []byte(body+"\n}")))
+	loose := []byte(body + ",\n  \"signature\": \"" + string(sig) + "\"\n}")
+
+	_, _, err = Verify(loose, nil)
+	r.Error(err, "strict mode accepted it")
+
+	ref, dmsg, err := Verify(loose, nil, WithLenientEncoding())
+	r.NoError(err)
+	r.NotNil(ref)
+	r.True(dmsg.LooselyVerified())
+	r.EqualValues(1, dmsg.Sequence)
+
+	v := NewVerifier(nil, WithLenientEncoding())
+	dmsg, err = v.VerifySignatureOnly(loose)
+	r.NoError(err)
+	r.True(dmsg.LooselyVerified())
+
+	// canonical messages are verified as usual
+	_, dmsg, err = Verify(npmPackagesMsg, nil, WithLenientEncoding())
+	r.NoError(err)
+	r.False(dmsg.LooselyVerified())
+
+	// it's still the signature of the author
+	tampered := bytes.Replace(loose, []byte(`"test"`), []byte(`"tezt"`), 1)
+	_, _, err = Verify(tampered, nil, WithLenientEncoding())
+	r.Error(err)
+
+	// compact messages are found as well
+	compactBody := fmt.Sprintf(`{"previous":null,"author":%q,"sequence":1,"timestamp":1,"hash":"sha256","content":{"type":"test"}`, kp.Id.Ref())
+	compactSig := EncodeSignature(ed25519.Sign(kp.Pair.Secret[:], []byte(compactBody+"}")))
+	compact := []byte(compactBody + `,"signature":"` + string(compactSig) + `"}`)
+	_, dmsg, err = Verify(compact, nil, WithLenientEncoding())
+	r.NoError(err)
+	r.True(dmsg.LooselyVerified())
+}
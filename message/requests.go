@@ -19,7 +19,7 @@ func NewCreateHistArgsFromMap(argMap map[string]interface{}) (*CreateHistArgs, e
 	var qry CreateHistArgs
 	for k, v := range argMap {
 		switch k = strings.ToLower(k); k {
-		case "live", "keys", "values", "reverse", "asjson", "private":
+		case "live", "keys", "values", "reverse", "asjson", "private", "headersonly", "liveonly", "withcursor":
 			b, ok := v.(bool)
 			if !ok {
 				return nil, fmt.Errorf("ssb/message: not a bool for %s", k)
@@ -37,21 +37,52 @@ func NewCreateHistArgsFromMap(argMap map[string]interface{}) (*CreateHistArgs, e
 				qry.AsJSON = b
 			case "private":
 				qry.Private = b
+			case "headersonly":
+				qry.HeadersOnly = b
+			case "liveonly":
+				qry.LiveOnly = b
+			case "withcursor":
+				qry.WithCursor = b
 			}
 
-		case "type", "id":
+		case "type", "id", "compress", "afterref", "streamid", "cursor":
 			val, ok := v.(string)
 			if !ok {
 				return nil, fmt.Errorf("ssb/message: not string (but %T) for %s", v, k)
 			}
 			switch k {
+			case "compress":
+				qry.Compress = val
+			case "streamid":
+				qry.StreamID = val
+			case "cursor":
+				qry.Cursor = val
 			case "id":
 				var err error
 				qry.ID, err = refs.ParseFeedRef(val)
 				if err != nil {
 					return nil, fmt.Errorf("ssb/message: not a feed ref: %w", err)
 				}
+			case "afterref":
+				var err error
+				qry.AfterRef, err = refs.ParseMessageRef(val)
+				if err != nil {
+					return nil, fmt.Errorf("ssb/message: not a message ref: %w", err)
+				}
 			}
+		case "contenttypes":
+			lst, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("ssb/message: not a list (but %T) for %s", v, k)
+			}
+			for i, elem := range lst {
+				tipe, ok := elem.(string)
+				if !ok {
+					return nil, fmt.Errorf("ssb/message: not string (but %T) for %s entry %d", elem, k, i)
+				}
+				qry.ContentTypes = append(qry.ContentTypes, tipe)
+			}
+
 		case "seq", "limit", "gt", "lt":
 			n, ok := v.(float64)
 			if !ok {
@@ -102,7 +133,58 @@ type CreateHistArgs struct {
 	ID  *refs.FeedRef `json:"id,omitempty"`
 	Seq int64         `json:"seq,omitempty"`
 
+	// AfterRef starts the stream with the message after this one, instead of at Seq.
+	// It has to be a message of ID, otherwise the request fails.
+	AfterRef *refs.MessageRef `json:"afterRef,omitempty"`
+
 	AsJSON bool `json:"asJSON,omitempty"`
+
+	// ContentTypes limits the stream to messages of these types.
+	// The messages are still read from disk and filtered while sending,
+	// so this only saves bandwidth but not work on the serving side.
+	ContentTypes []string `json:"contentTypes,omitempty"`
+
+	// HeadersOnly sends a MessageHeader for each message instead of the full message.
+	// The result can't be verified, it's meant for building an index and fetching the content later.
+	HeadersOnly bool `json:"headersOnly,omitempty"`
+
+	// Compress asks for the messages in compressed chunks instead of one by one, like "gzip".
+	// Each chunk is a binary packet that holds length prefixed messages, the receiver has to decompress them.
+	// It can't be used for live streams.
+	Compress string `json:"compress,omitempty"`
+
+	// WithCursor ends the stream with a HistoryCursor if it was cut short by Limit.
+	// It can't be used for live, reversed or compressed streams.
+	WithCursor bool `json:"withCursor,omitempty"`
+
+	// Cursor continues the stream where the one that returned it ended. It replaces ID and Seq.
+	Cursor string `json:"cursor,omitempty"`
+
+	// StreamID names the request on the serving side, so that it can be stopped with FeedManager.CancelStream.
+	// It is chosen by the client and has to be unique among its requests.
+	StreamID string `json:"streamId,omitempty"`
+
+	// LiveOnly skips the stored messages and only sends the ones that arrive after the request, like tail -f.
+	// It needs Live to be set and Seq is ignored.
+	LiveOnly bool `json:"liveOnly,omitempty"`
+}
+
+// HistoryCursor is the last record of a createHistoryStream with CreateHistArgs.WithCursor that was cut short by its limit.
+// Pass Cursor as CreateHistArgs.Cursor to get the next page.
+type HistoryCursor struct {
+	Cursor string `json:"cursor"`
+}
+
+// MessageHeader is the compact form of a message that is sent for CreateHistArgs.HeadersOnly
+type MessageHeader struct {
+	Sequence int64         `json:"sequence"`
+	Author   *refs.FeedRef `json:"author"`
+
+	// Timestamp is the claimed time of the message in milliseconds
+	Timestamp int64 `json:"timestamp"`
+
+	// Type is empty for encrypted messages
+	Type string `json:"type,omitempty"`
 }
 
 // CreateLogArgs defines the query parameters for the createLogStream rpc call
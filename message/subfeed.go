@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"encoding/json"
+	"fmt"
+
+	refs "go.mindeco.de/ssb-refs"
+	"golang.org/x/crypto/ed25519"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/message/legacy"
+)
+
+// The content types with which a metafeed announces its subfeeds.
+const (
+	SubfeedAddExistingType = "metafeed/add/existing"
+	SubfeedAddDerivedType  = "metafeed/add/derived"
+)
+
+// SubfeedAnnouncement is the content of a message with which a metafeed announces one of its subfeeds.
+// The subfeed signs the announcement, so that a metafeed can't claim feeds that aren't its own, see Sign.
+type SubfeedAnnouncement struct {
+	Type        string        `json:"type"`
+	Subfeed     *refs.FeedRef `json:"subfeed"`
+	Metafeed    *refs.FeedRef `json:"metafeed"`
+	FeedPurpose string        `json:"feedpurpose"`
+
+	SubfeedSignature legacy.Signature `json:"subfeedSignature,omitempty"`
+}
+
+// signedBytes returns what the subfeed signs, the JSON encoding of the announcement without the signature.
+// Other fields of the content aren't covered.
+func (ann SubfeedAnnouncement) signedBytes() ([]byte, error) {
+	ann.SubfeedSignature = ""
+	return json.Marshal(ann)
+}
+
+// Sign sets SubfeedSignature to the signature of subfeed over the other fields.
+func (ann *SubfeedAnnouncement) Sign(subfeed *ssb.KeyPair) error {
+	b, err := ann.signedBytes()
+	if err != nil {
+		return fmt.Errorf("subfeed announcement: failed to encode: %w", err)
+	}
+	ann.SubfeedSignature = legacy.EncodeSignature(ed25519.Sign(subfeed.Pair.Secret, b))
+	return nil
+}
+
+// ErrInvalidSubfeed is returned if an announcement doesn't establish Subfeed as a subfeed of Parent.
+type ErrInvalidSubfeed struct {
+	Parent, Subfeed *refs.FeedRef
+
+	Reason string
+}
+
+func (e ErrInvalidSubfeed) Error() string {
+	return fmt.Sprintf("message: %s is not a subfeed of %s: %s", e.Subfeed.ShortRef(), e.Parent.ShortRef(), e.Reason)
+}
+
+// VerifySubfeed checks that announcement was published by parent, announces subfeed as one of its subfeeds and is signed by subfeed.
+// The announcement message itself is expected to be verified already, for instance by the verify sink of parent.
+func VerifySubfeed(parent, subfeed *refs.FeedRef, announcement refs.Message) error {
+	invalid := func(format string, args ...interface{}) error {
+		return ErrInvalidSubfeed{Parent: parent, Subfeed: subfeed, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if !announcement.Author().Equal(parent) {
+		return invalid("announcement is authored by %s", announcement.Author().ShortRef())
+	}
+
+	var ann SubfeedAnnouncement
+	if err := json.Unmarshal(announcement.ContentBytes(), &ann); err != nil {
+		return invalid("failed to decode announcement: %s", err)
+	}
+
+	if ann.Type != SubfeedAddExistingType && ann.Type != SubfeedAddDerivedType {
+		return invalid("announcement has type %q", ann.Type)
+	}
+
+	if ann.Metafeed == nil || !ann.Metafeed.Equal(parent) {
+		return invalid("announcement is for another metafeed")
+	}
+
+	if ann.Subfeed == nil || !ann.Subfeed.Equal(subfeed) {
+		return invalid("announcement is for another subfeed")
+	}
+
+	if ann.SubfeedSignature == "" {
+		return invalid("announcement isn't signed by the subfeed")
+	}
+	signed, err := ann.signedBytes()
+	if err != nil {
+		return invalid("failed to encode announcement: %s", err)
+	}
+	if err := ann.SubfeedSignature.Verify(signed, subfeed); err != nil {
+		return invalid("invalid subfeed signature: %s", err)
+	}
+
+	return nil
+}
+
+// SubfeedValidator returns a MessageValidator for the verify sink of subfeed, pass it to NewVerifySink with WithValidator.
+// It fails right away if announcement doesn't link subfeed to parent and afterwards only accepts messages by subfeed.
+func SubfeedValidator(parent, subfeed *refs.FeedRef, announcement refs.Message) (MessageValidator, error) {
+	if err := VerifySubfeed(parent, subfeed, announcement); err != nil {
+		return nil, err
+	}
+
+	return func(msg refs.Message) error {
+		if !msg.Author().Equal(subfeed) {
+			return ErrInvalidSubfeed{
+				Parent:  parent,
+				Subfeed: msg.Author(),
+				Reason:  fmt.Sprintf("announcement is for %s", subfeed.ShortRef()),
+			}
+		}
+		return nil
+	}, nil
+}
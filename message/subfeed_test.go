@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+func TestSubfeedValidator(t *testing.T) {
+	r := require.New(t)
+
+	mkKeyPair := func() *ssb.KeyPair {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		return kp
+	}
+	parent, sub, other := mkKeyPair(), mkKeyPair(), mkKeyPair()
+
+	publish := func(author *ssb.KeyPair, content interface{}) refs.Message {
+		raws := makeTestFeed(t, author, content)
+		msg, err := Verify(raws[0], refs.RefAlgoFeedSSB1, nil)
+		r.NoError(err)
+		return msg
+	}
+	signed := func(tipe string, signer *ssb.KeyPair, subfeed, metafeed *refs.FeedRef) SubfeedAnnouncement {
+		ann := SubfeedAnnouncement{
+			Type:        tipe,
+			Subfeed:     subfeed,
+			Metafeed:    metafeed,
+			FeedPurpose: "test",
+		}
+		r.NoError(ann.Sign(signer))
+		return ann
+	}
+	announce := func(author *ssb.KeyPair, subfeed, metafeed *refs.FeedRef) refs.Message {
+		return publish(author, signed(SubfeedAddExistingType, sub, subfeed, metafeed))
+	}
+	announcement := announce(parent, sub.Id, parent.Id)
+
+	derived := publish(parent, signed(SubfeedAddDerivedType, sub, sub.Id, parent.Id))
+	r.NoError(VerifySubfeed(parent.Id, sub.Id, derived))
+
+	validate, err := SubfeedValidator(parent.Id, sub.Id, announcement)
+	r.NoError(err)
+
+	raws := makeTestFeed(t, sub,
+		map[string]interface{}{"type": "test", "i": 1},
+		map[string]interface{}{"type": "test", "i": 2},
+	)
+
+	var saved sliceSaver
+	snk := NewVerifySink(sub.Id, margaret.BaseSeq(0), firstMessage(sub.Id), &saved, nil, WithValidator(validate))
+	for _, raw := range raws {
+		r.NoError(snk.Verify(raw))
+	}
+	r.Len(saved, 2)
+
+	// messages of other feeds aren't covered by the announcement
+	otherRaws := makeTestFeed(t, other, map[string]interface{}{"type": "test"})
+	otherMsg, err := Verify(otherRaws[0], refs.RefAlgoFeedSSB1, nil)
+	r.NoError(err)
+	var invalid ErrInvalidSubfeed
+	r.True(errors.As(validate(otherMsg), &invalid))
+
+	plainRaws := makeTestFeed(t, parent, map[string]interface{}{"type": "test"})
+	plain, err := Verify(plainRaws[0], refs.RefAlgoFeedSSB1, nil)
+	r.NoError(err)
+
+	tests := []struct {
+		name         string
+		announcement refs.Message
+	}{
+		{"other author", announce(other, sub.Id, parent.Id)},
+		{"other metafeed", announce(parent, sub.Id, other.Id)},
+		{"other subfeed", announce(parent, other.Id, parent.Id)},
+		{"not an announcement", plain},
+		{"type with a suffix", publish(parent, signed(SubfeedAddExistingType+"s", sub, sub.Id, parent.Id))},
+		{"not signed", publish(parent, SubfeedAnnouncement{Type: SubfeedAddExistingType, Subfeed: sub.Id, Metafeed: parent.Id})},
+		{"signed by the metafeed", publish(parent, signed(SubfeedAddExistingType, parent, sub.Id, parent.Id))},
+	}
+	for _, tc := range tests {
+		err := VerifySubfeed(parent.Id, sub.Id, tc.announcement)
+		r.True(errors.As(err, &invalid), "%s: expected invalid subfeed error, got: %v", tc.name, err)
+		r.True(invalid.Subfeed.Equal(sub.Id), tc.name)
+
+		_, err = SubfeedValidator(parent.Id, sub.Id, tc.announcement)
+		r.Error(err, tc.name)
+	}
+}
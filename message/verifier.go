@@ -34,6 +34,35 @@ type VerifySink struct {
 
 	mu    *sync.Mutex
 	sinks verifyFanIn
+
+	checkpoints        CheckpointStore
+	checkpointInterval int
+
+	onFailure  VerifyFailureFunc
+	onAccepted AcceptedFunc
+}
+
+// OnFailure sets a callback for the sinks that are created afterwards, see VerifyFailureFunc.
+// It can be used to find out which peers send bad messages.
+func (vs *VerifySink) OnFailure(fn VerifyFailureFunc) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.onFailure = fn
+}
+
+// OnAccepted sets a callback for the sinks that are created afterwards, see AcceptedFunc.
+func (vs *VerifySink) OnAccepted(fn AcceptedFunc) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.onAccepted = fn
+}
+
+// UseCheckpoints makes the sinks that are created afterwards save their progress to store, see NewCheckpointedVerifySink.
+func (vs *VerifySink) UseCheckpoints(store CheckpointStore, interval int) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.checkpoints = store
+	vs.checkpointInterval = interval
 }
 
 func (vs *VerifySink) GetSink(ref *refs.FeedRef) (SequencedSink, error) {
@@ -51,21 +80,127 @@ func (vs *VerifySink) GetSink(ref *refs.FeedRef) (SequencedSink, error) {
 		return nil, err
 	}
 
-	var ms = MargaretSaver{vs.rxlog}
-	snk = NewVerifySink(ref, msg, msg, ms, vs.hmacSec)
+	var (
+		ms   = MargaretSaver{Log: vs.rxlog, UserFeeds: vs.feeds}
+		opts = []VerifySinkOption{WithOnFailure(vs.onFailure), WithOnAccepted(vs.onAccepted)}
+	)
+	if vs.checkpoints != nil {
+		snk, err = NewCheckpointedVerifySink(ref, msg, ms, vs.hmacSec, vs.checkpoints, vs.checkpointInterval, opts...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		snk = NewVerifySink(ref, msg, msg, ms, vs.hmacSec, opts...)
+	}
 	vs.sinks[ref.Ref()] = snk
 	return snk, nil
 }
 
+// MargaretSaver appends messages to the wrapped log.
+// If UserFeeds is set, it is used to skip messages that are already stored.
 type MargaretSaver struct {
 	margaret.Log
+
+	UserFeeds multilog.MultiLog
 }
 
 func (ms MargaretSaver) Save(msg refs.Message) error {
-	_, err := ms.Log.Append(msg)
+	_, err := ms.SaveSeq(msg)
 	return err
 }
 
+// SaveSeq is like Save but also returns the sequence of the message in the log.
+// If the message is already stored, the sequence of the existing entry is returned.
+func (ms MargaretSaver) SaveSeq(msg refs.Message) (margaret.Seq, error) {
+	if ms.UserFeeds != nil {
+		seq, has, err := ms.lookup(msg)
+		if err != nil {
+			return nil, fmt.Errorf("margaretSaver: failed to check for existing message: %w", err)
+		}
+		if has {
+			return seq, nil
+		}
+	}
+	return ms.Log.Append(msg)
+}
+
+// lookup checks if the message is already stored at its position in the feed of its author
+func (ms MargaretSaver) lookup(msg refs.Message) (margaret.Seq, bool, error) {
+	rxSeq, storedMsg, err := ms.messageAt(msg.Author(), msg.Seq())
+	if err != nil || storedMsg == nil {
+		return nil, false, err
+	}
+	if !storedMsg.Key().Equal(msg.Key()) {
+		return nil, false, nil
+	}
+	return rxSeq, true, nil
+}
+
+// StoredMessage returns the message of author at seq. It needs UserFeeds to be set.
+func (ms MargaretSaver) StoredMessage(author *refs.FeedRef, seq int64) (refs.Message, bool, error) {
+	if ms.UserFeeds == nil {
+		return nil, false, nil
+	}
+	_, msg, err := ms.messageAt(author, seq)
+	if err != nil {
+		return nil, false, fmt.Errorf("margaretSaver: %w", err)
+	}
+	return msg, msg != nil, nil
+}
+
+// messageAt returns the message of author at seq and its sequence in the log.
+// The message is nil if there is none.
+func (ms MargaretSaver) messageAt(author *refs.FeedRef, seq int64) (margaret.Seq, refs.Message, error) {
+	userLog, err := ms.UserFeeds.Get(storedrefs.Feed(author))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open sublog for user: %w", err)
+	}
+
+	latest, err := userLog.Seq().Value()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to observe latest: %w", err)
+	}
+
+	// sublogs are 0-indexed
+	idx := margaret.BaseSeq(seq - 1)
+	switch v := latest.(type) {
+	case librarian.UnsetValue:
+		return nil, nil, nil
+	case margaret.BaseSeq:
+		if idx < 0 || idx > v {
+			return nil, nil, nil
+		}
+	default:
+		return nil, nil, fmt.Errorf("unexpected return value from index: %T", latest)
+	}
+
+	rxVal, err := userLog.Get(idx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up root seq: %w", err)
+	}
+	rxSeq, ok := rxVal.(margaret.Seq)
+	if !ok {
+		return nil, nil, fmt.Errorf("wrong type in sublog: %T", rxVal)
+	}
+
+	stored, err := ms.Log.Get(rxSeq)
+	if err != nil {
+		if margaret.IsErrNulled(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed retreive stored message: %w", err)
+	}
+	if nulled, ok := stored.(error); ok && margaret.IsErrNulled(nulled) {
+		return nil, nil, nil
+	}
+
+	storedMsg, ok := stored.(refs.Message)
+	if !ok {
+		return nil, nil, fmt.Errorf("wrong message type. expected refs.Message - got %T", stored)
+	}
+	return rxSeq, storedMsg, nil
+}
+
 func firstMessage(r *refs.FeedRef) refs.KeyValueRaw {
 	author := r.Copy()
 	return refs.KeyValueRaw{
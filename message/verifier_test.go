@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+
+package message
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/margaret"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/asynctesting"
+	"go.cryptoscope.co/ssb/multilogs"
+	"go.cryptoscope.co/ssb/repo"
+)
+
+func TestMargaretSaverDedup(t *testing.T) {
+	r := require.New(t)
+
+	rpath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(rpath)
+
+	testRepo := repo.New(rpath)
+	rl, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, userFeedsSnk, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	create := legacyCreate{key: *kp}
+	msg, err := create.Create(map[string]interface{}{"type": "test"}, nil, margaret.BaseSeq(1))
+	r.NoError(err)
+
+	saver := MargaretSaver{Log: rl, UserFeeds: userFeeds}
+
+	seq, err := saver.SaveSeq(msg)
+	r.NoError(err)
+	r.EqualValues(0, seq.Seq())
+
+	errc := asynctesting.ServeLog(context.TODO(), t.Name(), rl, userFeedsSnk, false)
+	r.NoError(<-errc)
+
+	seq, err = saver.SaveSeq(msg)
+	r.NoError(err)
+	r.EqualValues(0, seq.Seq(), "expected the sequence of the existing entry")
+
+	r.NoError(saver.Save(msg))
+
+	current, err := rl.Seq().Value()
+	r.NoError(err)
+	r.EqualValues(0, current.(margaret.Seq).Seq(), "expected only one entry in the receive log")
+
+	// without the user feeds it just appends
+	plain := MargaretSaver{Log: rl}
+	r.NoError(plain.Save(msg))
+
+	current, err = rl.Seq().Value()
+	r.NoError(err)
+	r.EqualValues(1, current.(margaret.Seq).Seq())
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -81,6 +82,10 @@ type node struct {
 	remotesLock sync.Mutex
 	remotes     map[string]muxrpc.Endpoint
 
+	// retryAt keeps the hints of failed authorizations, see noteRetryHint
+	retryLock sync.Mutex
+	retryAt   map[string]time.Time
+
 	edpWrapper func(muxrpc.Endpoint) muxrpc.Endpoint
 	evtCtr     metrics.Counter
 	sysGauge   metrics.Gauge
@@ -95,6 +100,7 @@ func New(opts Options) (*node, error) {
 	n := &node{
 		opts:    opts,
 		remotes: make(map[string]muxrpc.Endpoint),
+		retryAt: make(map[string]time.Time),
 	}
 
 	if opts.ConnTracker == nil {
@@ -276,6 +282,12 @@ func (n *node) handleConnection(ctx context.Context, origConn net.Conn, isServer
 	}
 	rLogger := log.With(n.log, "peer", remoteRef.ShortRef())
 
+	if err := n.retryLater(remoteRef); err != nil {
+		conn.Close()
+		level.Debug(rLogger).Log("conn", "ignored", "err", err)
+		return
+	}
+
 	ok, ctx := n.connTracker.OnAccept(ctx, conn)
 	if !ok {
 		err := conn.Close()
@@ -295,6 +307,10 @@ func (n *node) handleConnection(ctx context.Context, origConn net.Conn, isServer
 
 	h, err := n.opts.MakeHandler(conn)
 	if err != nil {
+		if n.noteRetryHint(remoteRef, err) {
+			level.Debug(rLogger).Log("conn", "mkHandler", "err", err)
+			return
+		}
 		var eOOR ssb.ErrOutOfReach
 		if errors.As(err, &eOOR) {
 			return // ignore silently
@@ -446,6 +462,12 @@ func (n *node) Connect(ctx context.Context, addr net.Addr) error {
 		return errors.New("node/connect: expected shs-bs address to be of type secretstream.Addr")
 	}
 
+	if remoteRef, err := ssb.GetFeedRefFromAddr(addr); err == nil {
+		if err := n.retryLater(remoteRef); err != nil {
+			return fmt.Errorf("node/connect: %w", err)
+		}
+	}
+
 	conn, err := n.dialer(netwrap.GetAddr(addr, "tcp"), append(n.beforeCryptoConnWrappers,
 		n.secretClient.ConnWrapper(pubKey))...)
 	if err != nil {
@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MIT
+
+package network
+
+import (
+	"fmt"
+	"time"
+
+	"go.cryptoscope.co/ssb"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// noteRetryHint remembers when peer may be connected to again, if err has a retry hint.
+// It returns true if it had one.
+func (n *node) noteRetryHint(peer *refs.FeedRef, err error) bool {
+	after, has := ssb.RetryAfter(err)
+	if !has || after <= 0 {
+		return false
+	}
+
+	n.retryLock.Lock()
+	defer n.retryLock.Unlock()
+	n.retryAt[peer.Ref()] = time.Now().Add(after)
+
+	if n.evtCtr != nil {
+		n.evtCtr.With("event", "retry-hint").Add(1)
+	}
+	return true
+}
+
+// RetryAt returns the time before which connections to and from peer are refused
+// because its authorization failed with a retry hint, see ssb.ErrRetryLater.
+// It returns false if there is no such hint or it already expired.
+func (n *node) RetryAt(peer refs.FeedRef) (time.Time, bool) {
+	n.retryLock.Lock()
+	defer n.retryLock.Unlock()
+
+	ref := peer.Ref()
+	at, has := n.retryAt[ref]
+	if !has {
+		return time.Time{}, false
+	}
+	if !time.Now().Before(at) {
+		delete(n.retryAt, ref)
+		return time.Time{}, false
+	}
+	return at, true
+}
+
+// retryLater returns an ssb.ErrRetryLater if peer shouldn't be connected to yet, otherwise nil.
+func (n *node) retryLater(peer *refs.FeedRef) error {
+	at, has := n.RetryAt(*peer)
+	if !has {
+		return nil
+	}
+	return ssb.ErrRetryLater{
+		Err:   fmt.Errorf("node: authorization of %s failed earlier", peer.ShortRef()),
+		After: time.Until(at),
+	}
+}
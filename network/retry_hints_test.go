@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: MIT
+
+package network_test
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/muxrpc/v2"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/network"
+)
+
+func TestRetryHintOfBlockedPeer(t *testing.T) {
+	r := require.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var appkey = make([]byte, 32)
+	rand.Read(appkey)
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+
+	kpBlocked, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	kpPub, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+
+	blocked, err := network.New(network.Options{
+		Logger:  logger,
+		AppKey:  appkey,
+		KeyPair: kpBlocked,
+
+		ListenAddr: &net.TCPAddr{Port: 0},
+
+		MakeHandler: makeServerHandler(t, true),
+	})
+	r.NoError(err)
+
+	const retryAfter = time.Hour
+	pub, err := network.New(network.Options{
+		Logger:  logger,
+		AppKey:  appkey,
+		KeyPair: kpPub,
+
+		ListenAddr: &net.TCPAddr{Port: 0},
+
+		MakeHandler: func(net.Conn) (muxrpc.Handler, error) {
+			return nil, ssb.ErrRetryLater{Err: errors.New("peer blocked"), After: retryAfter}
+		},
+	})
+	r.NoError(err)
+
+	serve := func(n ssb.Network) {
+		go func() {
+			err := n.Serve(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				panic(err)
+			}
+		}()
+	}
+	serve(blocked)
+	serve(pub)
+
+	start := time.Now()
+	r.NoError(blocked.Connect(ctx, pub.GetListenAddr()))
+
+	var retryAt time.Time
+	r.Eventually(func() bool {
+		var has bool
+		retryAt, has = pub.RetryAt(*kpBlocked.Id)
+		return has
+	}, 5*time.Second, 50*time.Millisecond, "pub didn't note the retry hint")
+	r.True(retryAt.After(start.Add(retryAfter-time.Minute)), "next attempt too early: %s", retryAt)
+
+	// the pub doesn't dial the blocked peer until then
+	err = pub.Connect(ctx, blocked.GetListenAddr())
+	r.Error(err)
+	var retryErr ssb.ErrRetryLater
+	r.True(errors.As(err, &retryErr), "wrong error: %v", err)
+	r.True(retryErr.RetryAfter() > retryAfter-time.Minute, "retry after too short: %s", retryErr.After)
+
+	_, has := pub.RetryAt(*kpPub.Id)
+	r.False(has, "no hint for other peers")
+
+	blocked.Close()
+	pub.Close()
+}
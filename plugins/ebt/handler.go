@@ -41,9 +41,23 @@ type MUXRPCHandler struct {
 
 	verify *message.VerifySink
 
+	// ranker is optional and decides the order of the notes in sendState
+	ranker FeedRanker
+
 	Sessions Sessions
 }
 
+// FeedRanker orders feeds by their relevance to a peer, like graph.Builder does.
+type FeedRanker interface {
+	RankFeedsForPeer(peer *refs.FeedRef, feeds *ssb.StrFeedSet) ([]*refs.FeedRef, error)
+}
+
+// SetRanker makes the handler send the notes most relevant to the remote first.
+// Without one, they are sent in the order of encoding/json, which sorts them by reference.
+func (h *MUXRPCHandler) SetRanker(r FeedRanker) {
+	h.ranker = r
+}
+
 func (h *MUXRPCHandler) check(err error) {
 	if err != nil && !muxrpc.IsSinkClosed(err) {
 		level.Error(h.info).Log("error", err)
@@ -119,6 +133,19 @@ func (h *MUXRPCHandler) sendState(ctx context.Context, tx *muxrpc.ByteSink, remo
 	}
 
 	tx.SetEncoding(muxrpc.TypeJSON)
+	if h.ranker != nil {
+		ranked, err := h.rankedState(remote, currState)
+		if err == nil {
+			_, err = tx.Write(ranked)
+			if err != nil {
+				return fmt.Errorf("failed to send currState: %d: %w", len(currState), err)
+			}
+			return nil
+		}
+		// the order is only a hint, send the notes unranked instead
+		level.Warn(h.info).Log("event", "failed to rank frontier", "err", err)
+	}
+
 	err = json.NewEncoder(tx).Encode(currState)
 	if err != nil {
 		return fmt.Errorf("failed to send currState: %d: %w", len(currState), err)
@@ -127,6 +154,47 @@ func (h *MUXRPCHandler) sendState(ctx context.Context, tx *muxrpc.ByteSink, remo
 	return nil
 }
 
+// rankedState encodes the frontier with the notes ordered by the ranker.
+func (h *MUXRPCHandler) rankedState(remote *refs.FeedRef, currState ssb.NetworkFrontier) ([]byte, error) {
+	feeds := ssb.NewFeedSet(len(currState))
+	for ref := range currState {
+		fr, err := refs.ParseFeedRef(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feed in frontier: %w", err)
+		}
+		if err := feeds.AddRef(fr); err != nil {
+			return nil, err
+		}
+	}
+
+	ranked, err := h.ranker.RankFeedsForPeer(remote, feeds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rank feeds: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, fr := range ranked {
+		ref := fr.Ref()
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(ref)
+		if err != nil {
+			return nil, err
+		}
+		note, err := currState[ref].MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(note)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes(), nil
+}
+
 // Loop executes the ebt logic loop, reading from the peer and sending state and messages as requests
 func (h *MUXRPCHandler) Loop(ctx context.Context, tx *muxrpc.ByteSink, rx *muxrpc.ByteSource, remoteAddr net.Addr) {
 	session := h.Sessions.Started(remoteAddr)
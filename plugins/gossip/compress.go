@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.cryptoscope.co/muxrpc/v2"
+
+	"go.cryptoscope.co/ssb/message"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// CompressGzip is the compression that CreateHistArgs.Compress supports.
+const CompressGzip = "gzip"
+
+// compressedChunkSize is the amount of uncompressed messages that is collected before a chunk is sent.
+const compressedChunkSize = 64 * 1024
+
+// maxMessageSize is the largest message DecompressChunk accepts.
+const maxMessageSize = compressedChunkSize * 16
+
+// maxDecompressedChunk is the most DecompressChunk reads from one chunk.
+// A chunk is sent once it holds compressedChunkSize bytes, so it is at most that plus one message and the length prefixes.
+const maxDecompressedChunk = compressedChunkSize + maxMessageSize + 2*binary.MaxVarintLen64
+
+// checkCompression returns an error if the compression of arg isn't supported.
+func checkCompression(arg *message.CreateHistArgs) error {
+	switch arg.Compress {
+	case "":
+		return nil
+	case CompressGzip:
+	default:
+		return fmt.Errorf("unsupported compression %q", arg.Compress)
+	}
+
+	if arg.Live {
+		return errors.New("compression is not supported for live streams")
+	}
+	if arg.ID.Algo == refs.RefAlgoFeedGabby && !arg.AsJSON && !arg.HeadersOnly {
+		return errors.New("compression needs JSON encoded messages, use asJSON")
+	}
+	return nil
+}
+
+// chunkWriter collects the encoded messages of a stream and sends them as gzip compressed chunks.
+// Inside a chunk, each message is prefixed with its length as a uvarint.
+// A chunk is sent once it holds compressedChunkSize bytes of messages and when the writer is closed.
+type chunkWriter struct {
+	sink *muxrpc.ByteSink
+
+	batch bytes.Buffer
+	zbuf  bytes.Buffer
+	zw    *gzip.Writer
+}
+
+func newChunkWriter(sink *muxrpc.ByteSink) *chunkWriter {
+	sink.SetEncoding(muxrpc.TypeBinary)
+	cw := &chunkWriter{sink: sink}
+	cw.zw = gzip.NewWriter(&cw.zbuf)
+	return cw
+}
+
+func (cw *chunkWriter) Write(msg []byte) (int, error) {
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(msg)))
+	cw.batch.Write(hdr[:n])
+	cw.batch.Write(msg)
+	if cw.batch.Len() >= compressedChunkSize {
+		if err := cw.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(msg), nil
+}
+
+// flush compresses and sends the collected messages, if there are any.
+func (cw *chunkWriter) flush() error {
+	if cw.batch.Len() == 0 {
+		return nil
+	}
+
+	cw.zbuf.Reset()
+	cw.zw.Reset(&cw.zbuf)
+	if _, err := cw.zw.Write(cw.batch.Bytes()); err != nil {
+		return fmt.Errorf("compress: failed to compress chunk: %w", err)
+	}
+	if err := cw.zw.Close(); err != nil {
+		return fmt.Errorf("compress: failed to finish chunk: %w", err)
+	}
+	cw.batch.Reset()
+
+	_, err := cw.sink.Write(cw.zbuf.Bytes())
+	return err
+}
+
+// Close sends the last chunk and closes the sink.
+func (cw *chunkWriter) Close() error {
+	if err := cw.flush(); err != nil {
+		return cw.sink.CloseWithError(err)
+	}
+	return cw.sink.Close()
+}
+
+func (cw *chunkWriter) CloseWithError(err error) error {
+	return cw.sink.CloseWithError(err)
+}
+
+// DecompressChunk returns the messages of a chunk that was sent for a request with CreateHistArgs.Compress set to CompressGzip.
+func DecompressChunk(chunk []byte) ([]json.RawMessage, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(chunk))
+	if err != nil {
+		return nil, fmt.Errorf("decompress: invalid chunk: %w", err)
+	}
+	defer zr.Close()
+
+	// one byte more than allowed, to tell a chunk that is too large from one that ends at the limit
+	limited := &io.LimitedReader{R: zr, N: maxDecompressedChunk + 1}
+	tooLarge := func() bool { return limited.N == 0 }
+
+	var msgs []json.RawMessage
+	rd := bufio.NewReader(limited)
+	for {
+		n, err := binary.ReadUvarint(rd)
+		if tooLarge() {
+			return nil, fmt.Errorf("decompress: chunk is larger than %d bytes", maxDecompressedChunk)
+		}
+		if errors.Is(err, io.EOF) {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decompress: failed to read message length: %w", err)
+		}
+		if n > maxMessageSize {
+			return nil, fmt.Errorf("decompress: message length %d is too large", n)
+		}
+
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(rd, msg); err != nil {
+			if tooLarge() {
+				return nil, fmt.Errorf("decompress: chunk is larger than %d bytes", maxDecompressedChunk)
+			}
+			return nil, fmt.Errorf("decompress: failed to read message: %w", err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
@@ -0,0 +1,73 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.cryptoscope.co/luigi/mfr"
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// ContentTransformFunc returns the content that is served instead of the content of msg, see SetContentTransform.
+type ContentTransformFunc func(msg refs.Message) (json.RawMessage, error)
+
+// errTransformNeedsJSON is returned for binary streams if a content transform is set, they can't carry changed content.
+var errTransformNeedsJSON = errors.New("gossip: content transform is only supported on JSON streams")
+
+// SetContentTransform makes createHistoryStream serve the content returned by fn instead of the stored one,
+// for instance to redact fields in a read-only gateway. It applies to the stored and the live part of all streams.
+// If fn returns an error, the stream is aborted.
+//
+// WARNING: the signatures don't cover the new content, peers can't verify transformed messages and won't replicate them.
+// Binary gabby grove streams are refused while a transform is set, headers only streams are sent as is.
+func (m *FeedManager) SetContentTransform(fn ContentTransformFunc) {
+	m.transformMut.Lock()
+	defer m.transformMut.Unlock()
+	m.transform = fn
+}
+
+func (m *FeedManager) getContentTransform() ContentTransformFunc {
+	m.transformMut.Lock()
+	defer m.transformMut.Unlock()
+	return m.transform
+}
+
+// transformMessage returns a copy of msg with the content returned by fn.
+func transformMessage(fn ContentTransformFunc, msg refs.Message) (refs.Message, error) {
+	content, err := fn(msg)
+	if err != nil {
+		return nil, fmt.Errorf("content transform of %s failed: %w", msg.Key().Ref(), err)
+	}
+
+	var kv refs.KeyValueRaw
+	kv.Key_ = msg.Key()
+	kv.Value = *msg.ValueContent()
+	kv.Value.Content = content
+	return kv, nil
+}
+
+// contentTransformMap applies fn to the messages of a stream, everything else is passed on as is.
+func contentTransformMap(fn ContentTransformFunc) mfr.MapFunc {
+	return func(ctx context.Context, v interface{}) (interface{}, error) {
+		switch tv := v.(type) {
+		case refs.Message:
+			return transformMessage(fn, tv)
+		case margaret.SeqWrapper:
+			msg, ok := tv.Value().(refs.Message)
+			if !ok {
+				return v, nil
+			}
+			transformed, err := transformMessage(fn, msg)
+			if err != nil {
+				return nil, err
+			}
+			return margaret.WrapWithSeq(transformed, tv.Seq()), nil
+		}
+		return v, nil
+	}
+}
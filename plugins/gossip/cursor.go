@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.cryptoscope.co/muxrpc/v2"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb/message"
+)
+
+// encodeCursor returns the cursor to continue the feed with the message seq, see CreateHistArgs.WithCursor.
+// Clients shouldn't look into it, it's the base64 of the feed and seq.
+func encodeCursor(feed *refs.FeedRef, seq int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(feed.Ref() + ":" + strconv.FormatInt(seq, 10)))
+}
+
+// decodeCursor returns the feed and sequence of the next message of a cursor made by encodeCursor
+func decodeCursor(cursor string) (*refs.FeedRef, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid cursor: %w", err)
+	}
+	i := strings.LastIndexByte(string(raw), ':')
+	if i < 0 {
+		return nil, 0, fmt.Errorf("invalid cursor: no sequence")
+	}
+	feed, err := refs.ParseFeedRef(string(raw[:i]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid cursor: %w", err)
+	}
+	seq, err := strconv.ParseInt(string(raw[i+1:]), 10, 64)
+	if err != nil || seq < 1 {
+		return nil, 0, fmt.Errorf("invalid cursor: bad sequence")
+	}
+	return feed, seq, nil
+}
+
+// applyCursor sets the feed and sequence of the request from arg.Cursor.
+func applyCursor(arg *message.CreateHistArgs) error {
+	if arg.Seq != 0 || arg.AfterRef != nil || arg.LiveOnly {
+		return fmt.Errorf("cursor can't be combined with seq, afterRef or liveOnly")
+	}
+	feed, seq, err := decodeCursor(arg.Cursor)
+	if err != nil {
+		return err
+	}
+	if arg.ID != nil && !arg.ID.Equal(feed) {
+		return fmt.Errorf("cursor is for another feed")
+	}
+	arg.ID = feed
+	arg.Seq = seq
+	return nil
+}
+
+// checkCursorMode rejects WithCursor for the requests that can't end with a cursor record
+func checkCursorMode(arg *message.CreateHistArgs) error {
+	if !arg.WithCursor {
+		return nil
+	}
+	if arg.Live || arg.Reverse {
+		return fmt.Errorf("withCursor can't be used for live or reversed streams")
+	}
+	if arg.Compress != "" || streamEncoding(arg) != "json" {
+		return fmt.Errorf("withCursor needs an uncompressed json stream")
+	}
+	return nil
+}
+
+// writeCursor sends the record that ends a page, next is the sequence of the first message of the next one.
+func writeCursor(sink *muxrpc.ByteSink, feed *refs.FeedRef, next int64) error {
+	rec, err := json.Marshal(message.HistoryCursor{Cursor: encodeCursor(feed, next)})
+	if err != nil {
+		return fmt.Errorf("failed to encode cursor: %w", err)
+	}
+	sink.SetEncoding(muxrpc.TypeJSON)
+	_, err = sink.Write(rec)
+	return err
+}
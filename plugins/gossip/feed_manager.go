@@ -3,11 +3,14 @@
 package gossip
 
 import (
+	"container/list"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/cryptix/go/logging"
 	"github.com/go-kit/kit/log"
@@ -15,6 +18,7 @@ import (
 	"github.com/go-kit/kit/metrics"
 	"go.cryptoscope.co/librarian"
 	"go.cryptoscope.co/luigi"
+	"go.cryptoscope.co/luigi/mfr"
 	"go.cryptoscope.co/margaret"
 	"go.cryptoscope.co/margaret/multilog"
 	"go.cryptoscope.co/muxrpc/v2"
@@ -30,8 +34,6 @@ import (
 
 // FeedManager handles serving gossip about User Feeds.
 type FeedManager struct {
-	rootCtx context.Context
-
 	ReceiveLog margaret.Log
 	UserFeeds  multilog.MultiLog
 	logger     logging.Interface
@@ -39,6 +41,47 @@ type FeedManager struct {
 	liveFeeds    map[string]*luigiutils.MultiSink
 	liveFeedsMut sync.Mutex
 
+	// liveQueues send the messages of each live feed from a goroutine of their own, see liveQueue
+	liveQueues map[string]*liveQueue
+
+	// maxLiveFeeds caps the number of live feeds, zero means no limit.
+	// liveOrder has the refs of the live feeds, the one that was poured to most recently in front.
+	maxLiveFeeds int
+	liveOrder    *list.List
+	liveElems    map[string]*list.Element
+
+	// resumeGrace is how long live streams of a peer are buffered after its connection broke
+	resumeGrace time.Duration
+
+	// idleTimeout aborts streams that didn't make progress, see SetIdleTimeout
+	idleTimeout time.Duration
+	idleMut     sync.Mutex
+
+	// transform rewrites the served content, see SetContentTransform
+	transform    ContentTransformFunc
+	transformMut sync.Mutex
+
+	// peerAuth decides which feeds a peer may request, see SetPeerAuthorizer
+	peerAuth    PeerAuthorizerFunc
+	peerAuthMut sync.Mutex
+
+	// livePos is the root log sequence of the last message that was poured into the live feeds.
+	// It is only used by the goroutine that serves them, which restarts its query after it.
+	livePos    margaret.BaseSeq
+	livePosSet bool
+
+	stopServing context.CancelFunc
+	serveDone   chan struct{}
+
+	// streams are the cancel functions of the requests with a StreamID by streamKey, see CancelStream
+	streams    map[string]*trackedStream
+	streamsMut sync.Mutex
+
+	// draining is set by Drain, after which no new requests are accepted
+	draining    bool
+	drainingMut sync.Mutex
+	inflight    sync.WaitGroup
+
 	// metrics
 	sysGauge metrics.Gauge
 	sysCtr   metrics.Counter
@@ -58,16 +101,178 @@ func NewFeedManager(
 		ReceiveLog: rxlog,
 		UserFeeds:  userFeeds,
 		logger:     info,
-		rootCtx:    ctx,
 		sysCtr:     sysCtr,
 		sysGauge:   sysGauge,
 		liveFeeds:  make(map[string]*luigiutils.MultiSink),
+		liveQueues: make(map[string]*liveQueue),
+		liveOrder:  list.New(),
+		liveElems:  make(map[string]*list.Element),
+		streams:    make(map[string]*trackedStream),
+
+		resumeGrace: DefaultResumeGrace,
+
+		serveDone: make(chan struct{}),
 	}
-	// QUESTION: How should the error case be handled?
-	go fm.serveLiveFeeds()
+	serveCtx, stop := context.WithCancel(ctx)
+	fm.stopServing = stop
+	go fm.superviseLiveFeeds(serveCtx)
 	return fm
 }
 
+// Close stops pouring new messages into the live feeds and drops the ones that are still queued.
+// The streams of the live feeds stay open, see Drain to close them.
+func (m *FeedManager) Close() error {
+	m.stopServing()
+	<-m.serveDone
+
+	m.liveFeedsMut.Lock()
+	defer m.liveFeedsMut.Unlock()
+	for _, q := range m.liveQueues {
+		q.close()
+	}
+	return nil
+}
+
+// DefaultResumeGrace is the default for SetResumeGrace.
+const DefaultResumeGrace = 5 * time.Second
+
+// SetResumeGrace sets how long the live streams of a peer are kept after its connection broke.
+// If the peer requests the same feed again in that time, the messages that were published in between
+// are sent from a buffer instead of querying the history of the feed again. Zero disables this.
+//
+// Only requests made with CreateStreamHistoryFor know the peer and can be resumed.
+func (m *FeedManager) SetResumeGrace(d time.Duration) {
+	m.liveFeedsMut.Lock()
+	defer m.liveFeedsMut.Unlock()
+	m.resumeGrace = d
+	for _, liveFeed := range m.liveFeeds {
+		liveFeed.SetResumeGrace(d)
+	}
+}
+
+// SetMaxLiveFeeds limits the number of feeds with live streams.
+// If a new feed would exceed the limit, the streams of the feed that got a new message the longest time ago are closed.
+// The peers of those have to request the feed again. Zero, the default, means no limit.
+func (m *FeedManager) SetMaxLiveFeeds(n int) {
+	m.liveFeedsMut.Lock()
+	defer m.liveFeedsMut.Unlock()
+	m.maxLiveFeeds = n
+	m.evictLiveFeeds()
+}
+
+// PeerAuthorizerFunc returns the authorizer that decides which feeds peer may request.
+type PeerAuthorizerFunc func(peer *refs.FeedRef) ssb.Authorizer
+
+// SetPeerAuthorizer makes CreateStreamHistoryFor reject requests for feeds that the authorizer of the requesting peer doesn't allow.
+// Unlike the authorization of connections, which is about who we want to talk to, this scopes what is served to each peer,
+// for instance to the feeds in its own hop range. Requests without a peer are not checked. nil removes it.
+func (m *FeedManager) SetPeerAuthorizer(fn PeerAuthorizerFunc) {
+	m.peerAuthMut.Lock()
+	defer m.peerAuthMut.Unlock()
+	m.peerAuth = fn
+}
+
+// authorizePeer returns an error if peer may not request feed.
+func (m *FeedManager) authorizePeer(peer, feed *refs.FeedRef) error {
+	m.peerAuthMut.Lock()
+	fn := m.peerAuth
+	m.peerAuthMut.Unlock()
+
+	if fn == nil || peer == nil {
+		return nil
+	}
+	if err := fn(peer).Authorize(feed); err != nil {
+		if m.sysCtr != nil {
+			m.sysCtr.With("event", "gossip-peer-denied").Add(1)
+		}
+		return err
+	}
+	return nil
+}
+
+// FeedsToServe returns the feeds of peerWants that the authorizer of peer allows, see SetPeerAuthorizer.
+// Without an authorizer or a peer all of them are returned.
+func (m *FeedManager) FeedsToServe(peer *refs.FeedRef, peerWants *ssb.StrFeedSet) (*ssb.StrFeedSet, error) {
+	if peerWants == nil {
+		return ssb.NewFeedSet(0), nil
+	}
+	wants, err := peerWants.List()
+	if err != nil {
+		return nil, fmt.Errorf("feeds to serve: invalid entry in wanted feeds: %w", err)
+	}
+
+	m.peerAuthMut.Lock()
+	fn := m.peerAuth
+	m.peerAuthMut.Unlock()
+
+	var auth ssb.Authorizer
+	if fn != nil && peer != nil {
+		auth = fn(peer)
+	}
+
+	serve := ssb.NewFeedSet(len(wants))
+	for _, feed := range wants {
+		if auth != nil && auth.Authorize(feed) != nil {
+			continue
+		}
+		if err := serve.AddRef(feed); err != nil {
+			return nil, fmt.Errorf("feeds to serve: %w", err)
+		}
+	}
+	return serve, nil
+}
+
+// touchLiveFeed marks the live feed of ref as the most recently used one. It expects liveFeedsMut to be held.
+func (m *FeedManager) touchLiveFeed(ref string) {
+	if el, has := m.liveElems[ref]; has {
+		m.liveOrder.MoveToFront(el)
+		return
+	}
+	m.liveElems[ref] = m.liveOrder.PushFront(ref)
+}
+
+// dropLiveFeed stops the queue of the live feed of ref and removes it. It expects liveFeedsMut to be held.
+// The streams are closed from a goroutine of their own, so that a slow subscriber doesn't hold up the lock.
+// It doesn't touch liveOrder.
+func (m *FeedManager) dropLiveFeed(ref, event string) {
+	if q, has := m.liveQueues[ref]; has {
+		q.close()
+		delete(m.liveQueues, ref)
+	}
+	if liveFeed, has := m.liveFeeds[ref]; has {
+		delete(m.liveFeeds, ref)
+		go func() {
+			if err := liveFeed.CloseAll(); err != nil {
+				level.Warn(m.logger).Log("event", event, "msg", "failed to close live feed", "fr", ref, "err", err)
+			}
+		}()
+	}
+}
+
+// evictLiveFeeds closes the least recently used live feeds until there are at most maxLiveFeeds.
+// It expects liveFeedsMut to be held.
+func (m *FeedManager) evictLiveFeeds() {
+	if m.maxLiveFeeds <= 0 {
+		return
+	}
+	for len(m.liveFeeds) > m.maxLiveFeeds {
+		oldest := m.liveOrder.Back()
+		if oldest == nil {
+			return
+		}
+		ref := m.liveOrder.Remove(oldest).(string)
+		delete(m.liveElems, ref)
+
+		m.dropLiveFeed(ref, "gossip-livefeed-evicted")
+		if m.sysCtr != nil {
+			m.sysCtr.With("event", "gossip-livefeed-evicted").Add(1)
+		}
+	}
+	if m.sysGauge != nil {
+		m.sysGauge.With("part", "gossip-livefeeds").Set(float64(len(m.liveFeeds)))
+	}
+}
+
 func (m *FeedManager) pour(ctx context.Context, val interface{}, err error) error {
 	m.liveFeedsMut.Lock()
 	defer m.liveFeedsMut.Unlock()
@@ -83,70 +288,586 @@ func (m *FeedManager) pour(ctx context.Context, val interface{}, err error) erro
 	}
 
 	msg := val.(refs.Message)
-	author := msg.Author()
-	sink, ok := m.liveFeeds[author.Ref()]
+	ref := msg.Author().Ref()
+	q, ok := m.liveQueues[ref]
 	if !ok {
 		return nil
 	}
-	sink.Send(msg.ValueContentJSON())
+	m.touchLiveFeed(ref)
+
+	// the content transform is applied by the filters of the subscribers, see liveFilter
+	if !q.push(msg) {
+		// the subscribers can't keep up, they have to ask again
+		level.Warn(logger).Log("msg", "live feed overflowed", "fr", ref)
+		m.abandonLiveFeed(ref, "gossip-livefeed-overflow")
+	}
 	return nil
 }
 
-func (m *FeedManager) serveLiveFeeds() {
-	seqv, err := m.ReceiveLog.Seq().Value()
-	if err != nil {
-		err = fmt.Errorf("failed to get root log sequence: %w", err)
-		panic(err)
+// abandonLiveFeed closes the live feed of ref and its subscribers while it is in use and counts event.
+func (m *FeedManager) abandonLiveFeed(ref, event string) {
+	m.dropLiveFeed(ref, event)
+	if el, has := m.liveElems[ref]; has {
+		m.liveOrder.Remove(el)
+		delete(m.liveElems, ref)
+	}
+	if m.sysCtr != nil {
+		m.sysCtr.With("event", event).Add(1)
+	}
+	if m.sysGauge != nil {
+		m.sysGauge.With("part", "gossip-livefeeds").Set(float64(len(m.liveFeeds)))
+	}
+}
+
+// liveRestartDelay is how long superviseLiveFeeds waits before it starts a failed live query again.
+var liveRestartDelay = time.Second
+
+// superviseLiveFeeds runs serveLiveFeeds until ctx is done or the manager is shut down.
+// If the live query fails or ends, that is logged and it is started again after liveRestartDelay.
+func (m *FeedManager) superviseLiveFeeds(ctx context.Context) {
+	defer close(m.serveDone)
+	for {
+		err := m.serveLiveFeeds(ctx)
+		if ctx.Err() != nil || errors.Is(err, ssb.ErrShuttingDown) || errors.Is(err, context.Canceled) {
+			return
+		}
+		level.Warn(m.logger).Log("event", "live qry on rxlog exited", "err", err, "restart-in", liveRestartDelay)
+		if m.sysCtr != nil {
+			m.sysCtr.With("event", "gossip-live-restarted").Add(1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(liveRestartDelay):
+		}
+	}
+}
+
+// serveLiveFeeds pours the new messages of the root log into the live feeds.
+// The first time it starts at the latest message, afterwards after the last one that was poured.
+func (m *FeedManager) serveLiveFeeds(ctx context.Context) error {
+	if !m.livePosSet {
+		seqv, err := m.ReceiveLog.Seq().Value()
+		if err != nil {
+			return fmt.Errorf("failed to get root log sequence: %w", err)
+		}
+		seq, ok := seqv.(margaret.BaseSeq)
+		if !ok {
+			return fmt.Errorf("wrong type of root log sequence: %T", seqv)
+		}
+		m.livePos, m.livePosSet = seq, true
 	}
 
 	src, err := m.ReceiveLog.Query(
-		margaret.Gt(seqv.(margaret.BaseSeq)),
+		margaret.Gt(m.livePos),
 		margaret.Live(true),
+		margaret.SeqWrap(true),
 	)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to query root log: %w", err)
 	}
 
-	err = luigi.Pump(m.rootCtx, luigi.FuncSink(m.pour), src)
-	if err != nil && err != ssb.ErrShuttingDown && err != context.Canceled {
-		err = fmt.Errorf("error while serving live feed: %w", err)
-		panic(err)
+	snk := luigi.FuncSink(func(ctx context.Context, v interface{}, err error) error {
+		if err != nil {
+			return m.pour(ctx, v, err)
+		}
+		sw, ok := v.(margaret.SeqWrapper)
+		if !ok {
+			return fmt.Errorf("wrong type of live value: %T", v)
+		}
+		if err := m.pour(ctx, sw.Value(), nil); err != nil {
+			return err
+		}
+		m.livePos = margaret.BaseSeq(sw.Seq().Seq())
+		return nil
+	})
+
+	err = luigi.Pump(ctx, snk, src)
+	if err != nil {
+		return fmt.Errorf("error while serving live feed: %w", err)
 	}
-	level.Warn(m.logger).Log("event", "live qry on rxlog exited")
+	return nil
 }
 
+// addLiveFeed registers sink for new messages of the feed in arg.ID.
+// sent is the sequence of the last message the sink already got and until the last one it wants.
+//
+// Messages that were appended after the non-live portion was served are sent first, without blocking pour.
+// The sink is only registered once the stored feed has nothing newer than what it got, while pour is blocked,
+// so that the handoff doesn't skip or duplicate any of them.
 func (m *FeedManager) addLiveFeed(
 	ctx context.Context,
+	peer *refs.FeedRef,
 	sink *muxrpc.ByteSink,
-	ssbID string,
-	seq, limit int64,
+	arg *message.CreateHistArgs,
+	sent, until int64,
 ) error {
-	// TODO: ensure all messages make it to the live query
-	//  Messages could be lost when written after the non-live portion and
-	//  registering to live feed.
-	m.liveFeedsMut.Lock()
-	defer m.liveFeedsMut.Unlock()
+	userLog, err := m.UserFeeds.Get(storedrefs.Feed(arg.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open sublog for user: %w", err)
+	}
 
+	for {
+		if sent < until {
+			sent, err = m.catchUp(ctx, userLog, sink, arg, sent, until)
+			if err != nil {
+				return err
+			}
+		}
+		if sent >= until {
+			return sink.Close()
+		}
+
+		m.liveFeedsMut.Lock()
+		stored, err := feedLength(userLog)
+		if err != nil {
+			m.liveFeedsMut.Unlock()
+			return err
+		}
+		if stored <= sent {
+			m.registerLiveFeed(ctx, peer, sink, arg, sent, until)
+			m.liveFeedsMut.Unlock()
+			return nil
+		}
+		// more messages were stored while catching up
+		m.liveFeedsMut.Unlock()
+	}
+}
+
+// catchUp sends the messages of userLog after sent and up to until to sink and returns the sequence of the last one it sent.
+func (m *FeedManager) catchUp(
+	ctx context.Context,
+	userLog margaret.Log,
+	sink *muxrpc.ByteSink,
+	arg *message.CreateHistArgs,
+	sent, until int64,
+) (int64, error) {
+	qryArgs := []margaret.QuerySpec{
+		margaret.Gte(margaret.BaseSeq(sent)), // sublogs are 0-indexed
+	}
+	if until != math.MaxInt64 {
+		qryArgs = append(qryArgs, margaret.Limit(int(until-sent)))
+	}
+
+	resolved := mutil.Indirect(m.ReceiveLog, userLog)
+	src, err := resolved.Query(qryArgs...)
+	if err != nil {
+		return sent, fmt.Errorf("invalid user log query: %w", err)
+	}
+	// until is a sequence, so the limit of the query is right here
+	src = filterContentTypes(src, arg)
+
+	luigiSink, err := newStreamSink(arg, sink, nil, m.getContentTransform())
+	if err != nil {
+		return sent, err
+	}
+
+	tracker := &seqTrackingSink{next: luigiSink, seq: sent}
+	err = luigi.Pump(ctx, tracker, src)
+	if err != nil {
+		return sent, fmt.Errorf("failed to catch up before going live: %w", err)
+	}
+	return tracker.seq, nil
+}
+
+// registerLiveFeed adds sink to the live feed of arg.ID, which is created if needed. It expects liveFeedsMut to be held.
+func (m *FeedManager) registerLiveFeed(
+	ctx context.Context,
+	peer *refs.FeedRef,
+	sink *muxrpc.ByteSink,
+	arg *message.CreateHistArgs,
+	sent, until int64,
+) {
+	ssbID := arg.ID.Ref()
 	liveFeed, ok := m.liveFeeds[ssbID]
 	if !ok {
-		m.liveFeeds[ssbID] = luigiutils.NewMultiSink(seq)
-		liveFeed = m.liveFeeds[ssbID]
+		liveFeed = luigiutils.NewMultiSink(sent)
+		liveFeed.SetResumeGrace(m.resumeGrace)
+		m.liveFeeds[ssbID] = liveFeed
+		m.liveQueues[ssbID] = newLiveQueue(liveFeed)
+		m.touchLiveFeed(ssbID)
+		m.evictLiveFeeds()
 	}
 
 	if m.sysGauge != nil {
 		m.sysGauge.With("part", "gossip-livefeeds").Set(float64(len(m.liveFeeds)))
 	}
 
-	until := seq + limit
-	if limit == -1 {
-		until = math.MaxInt64
+	var peerRef string
+	if peer != nil {
+		peerRef = peer.Ref()
+	}
+	liveFeed.RegisterPeer(ctx, peerRef, sink, sent, until, liveFilter(arg, m.getContentTransform()))
+	if arg.StreamID != "" {
+		m.streamWentLive(ctx, streamKey(peer, arg.StreamID), func() {
+			liveFeed.Unregister(sink)
+			sink.Close()
+		})
+	}
+	// TODO: Remove multiSink from map when complete
+}
+
+// feedLength returns the number of messages in userLog.
+func feedLength(userLog margaret.Log) (int64, error) {
+	latest, err := userLog.Seq().Value()
+	if err != nil {
+		return 0, fmt.Errorf("failed to observe latest: %w", err)
+	}
+	switch v := latest.(type) {
+	case librarian.UnsetValue:
+		return 0, nil
+	case margaret.BaseSeq:
+		return v.Seq() + 1, nil // sublogs are 0-indexed
+	default:
+		return 0, fmt.Errorf("wrong type in index. expected margaret.BaseSeq - got %T", v)
+	}
+}
+
+// addLiveOnlyFeed registers sink on the live feed of arg.ID after the latest stored message, without querying the history.
+func (m *FeedManager) addLiveOnlyFeed(
+	ctx context.Context,
+	peer *refs.FeedRef,
+	sink *muxrpc.ByteSink,
+	arg *message.CreateHistArgs,
+) error {
+	userLog, err := m.UserFeeds.Get(storedrefs.Feed(arg.ID))
+	if err != nil {
+		return fmt.Errorf("failed to open sublog for user: %w", err)
+	}
+	// getLatestSeq can't tell an empty feed from one with a single message
+	next, err := feedLength(userLog)
+	if err != nil {
+		return err
 	}
 
-	liveFeed.Register(ctx, sink, until)
+	arg.Seq = next
+	sink.SetEncoding(muxrpc.TypeJSON)
+	return m.addLiveFeed(ctx, peer, sink, arg, next, liveUntil(arg))
+}
 
-	m.liveFeeds[ssbID] = liveFeed
-	// TODO: Remove multiSink from map when complete
-	return nil
+// resumeLiveFeed tries to reattach peer to the live feed of arg.ID it was registered on before its connection broke.
+// It returns false if there is nothing to resume, in which case the request needs to be served as usual.
+// arg.Seq is expected to be decremented already, like for addLiveFeed.
+func (m *FeedManager) resumeLiveFeed(
+	ctx context.Context,
+	peer *refs.FeedRef,
+	sink *muxrpc.ByteSink,
+	arg *message.CreateHistArgs,
+) (bool, error) {
+	m.liveFeedsMut.Lock()
+	defer m.liveFeedsMut.Unlock()
+
+	liveFeed, ok := m.liveFeeds[arg.ID.Ref()]
+	if !ok {
+		return false, nil
+	}
+
+	sink.SetEncoding(muxrpc.TypeJSON)
+	resumed, err := liveFeed.Resume(ctx, peer.Ref(), sink, arg.Seq, liveUntil(arg), liveFilter(arg, m.getContentTransform()))
+	if err != nil {
+		return false, fmt.Errorf("failed to resume live feed: %w", err)
+	}
+	if resumed && m.sysCtr != nil {
+		m.sysCtr.With("event", "gossip-resumed").Add(1)
+	}
+	return resumed, nil
+}
+
+// liveFilter applies the content transform, the content types and HeadersOnly of arg to the JSON encoded messages of the live feeds.
+// The transform is applied for each subscriber, so that a failure only aborts the streams it happens on.
+// Like for the stored messages, headers only streams aren't transformed.
+func liveFilter(arg *message.CreateHistArgs, transform ContentTransformFunc) luigiutils.MessageFilter {
+	if arg.HeadersOnly {
+		transform = nil
+	}
+	if len(arg.ContentTypes) == 0 && !arg.HeadersOnly && transform == nil {
+		return nil
+	}
+	return func(msg []byte, v interface{}) ([]byte, bool, error) {
+		if orig, ok := v.(refs.Message); ok && transform != nil {
+			transformed, err := transformMessage(transform, orig)
+			if err != nil {
+				return nil, false, err
+			}
+			msg = transformed.ValueContentJSON()
+		}
+
+		var val struct {
+			Sequence  int64           `json:"sequence"`
+			Author    *refs.FeedRef   `json:"author"`
+			Timestamp float64         `json:"timestamp"`
+			Content   json.RawMessage `json:"content"`
+		}
+		if err := json.Unmarshal(msg, &val); err != nil {
+			return nil, false, nil
+		}
+
+		if len(arg.ContentTypes) > 0 && !hasContentType(val.Content, arg.ContentTypes) {
+			return nil, false, nil
+		}
+
+		if !arg.HeadersOnly {
+			return msg, true, nil
+		}
+
+		hdr, err := json.Marshal(message.MessageHeader{
+			Sequence:  val.Sequence,
+			Author:    val.Author,
+			Timestamp: int64(val.Timestamp),
+			Type:      contentType(val.Content),
+		})
+		if err != nil {
+			return nil, false, nil
+		}
+		return hdr, true, nil
+	}
+}
+
+// seqTrackingSink passes messages on to the next sink and remembers the sequence of the last one.
+// It doesn't close the next sink, so that the live portion of a stream can continue on it.
+type seqTrackingSink struct {
+	next luigi.Sink
+	seq  int64
+}
+
+func (s *seqTrackingSink) Pour(ctx context.Context, v interface{}) error {
+	switch tv := v.(type) {
+	case refs.Message:
+		s.seq = tv.Seq()
+	case margaret.SeqWrapper:
+		if msg, ok := tv.Value().(refs.Message); ok {
+			s.seq = msg.Seq()
+		}
+	}
+	return s.next.Pour(ctx, v)
+}
+
+func (s *seqTrackingSink) Close() error { return nil }
+
+// gossipTxEvent returns the event the sent messages of a request are counted as, like gossiptx.ssb1.json.
+// The format and encoding are part of the event value, since the system counter only has the event label.
+func gossipTxEvent(arg *message.CreateHistArgs) string {
+	return "gossiptx." + feedFormatLabel(arg.ID) + "." + streamEncoding(arg)
+}
+
+// feedFormatLabel names the format of feed in the gossiptx metrics
+func feedFormatLabel(feed *refs.FeedRef) string {
+	switch feed.Algo {
+	case refs.RefAlgoFeedSSB1:
+		return "ssb1"
+	case refs.RefAlgoFeedGabby:
+		return "gabby"
+	}
+	return "unknown"
+}
+
+// streamEncoding returns how newStreamSink sends the messages of a request, json or binary
+func streamEncoding(arg *message.CreateHistArgs) string {
+	switch {
+	case arg.Compress != "":
+		return "binary"
+	case arg.HeadersOnly:
+		return "json"
+	case arg.ID.Algo == refs.RefAlgoFeedGabby && !arg.AsJSON:
+		return "binary"
+	}
+	return "json"
+}
+
+// newStreamSink returns the sink that encodes messages for the format of the requested feed.
+// If the request has content types, messages of other types are dropped.
+// chunks is only set for compressed requests, the encoded messages are written to it instead of the sink.
+// The optional contentTransform is applied to the messages before they are encoded, see SetContentTransform.
+func newStreamSink(arg *message.CreateHistArgs, sink *muxrpc.ByteSink, chunks *chunkWriter, contentTransform ContentTransformFunc) (luigi.Sink, error) {
+	var formatSink luigi.Sink
+	switch {
+	case chunks != nil && arg.HeadersOnly:
+		formatSink = newHeaderSink(chunks)
+
+	case chunks != nil:
+		formatSink = transform.NewKeyValueWriter(chunks, arg.Keys)
+
+	case arg.HeadersOnly:
+		if err := ssb.IsValidFeedFormat(arg.ID); err != nil {
+			return nil, err
+		}
+		sink.SetEncoding(muxrpc.TypeJSON)
+		formatSink = newHeaderSink(sink)
+
+	case arg.ID.Algo == refs.RefAlgoFeedSSB1:
+		formatSink = transform.NewKeyValueWrapper(sink, arg.Keys)
+
+	case arg.ID.Algo == refs.RefAlgoFeedGabby:
+		if arg.AsJSON {
+			formatSink = transform.NewKeyValueWrapper(sink, arg.Keys)
+		} else if contentTransform != nil {
+			return nil, errTransformNeedsJSON
+		} else {
+			formatSink = luigiutils.NewGabbyStreamSink(sink)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported feed format")
+	}
+
+	if contentTransform != nil && !arg.HeadersOnly {
+		formatSink = mfr.SinkMap(formatSink, contentTransformMap(contentTransform))
+	}
+
+	return formatSink, nil
+}
+
+// filterContentTypes drops the messages from src that don't have one of the content types of arg, if it has any.
+// It is applied to the query, before the limit, so that limited requests get as many messages as they asked for.
+func filterContentTypes(src luigi.Source, arg *message.CreateHistArgs) luigi.Source {
+	if len(arg.ContentTypes) == 0 {
+		return src
+	}
+	return mfr.SourceFilter(src, contentTypeFilter(arg.ContentTypes))
+}
+
+// limitSource ends after left values of src
+type limitSource struct {
+	src  luigi.Source
+	left int64
+}
+
+func (ls *limitSource) Next(ctx context.Context) (interface{}, error) {
+	if ls.left <= 0 {
+		return nil, luigi.EOS{}
+	}
+	v, err := ls.src.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ls.left--
+	return v, nil
+}
+
+// contentTypeFilter only lets messages through that have one of the passed content types.
+// Everything that isn't a message, like nulled entries, is passed on as is.
+func contentTypeFilter(types []string) mfr.FilterFunc {
+	return func(ctx context.Context, v interface{}) (bool, error) {
+		var msg refs.Message
+		switch tv := v.(type) {
+		case refs.Message:
+			msg = tv
+		case margaret.SeqWrapper:
+			var ok bool
+			msg, ok = tv.Value().(refs.Message)
+			if !ok {
+				return true, nil
+			}
+		default:
+			return true, nil
+		}
+		return hasContentType(msg.ContentBytes(), types), nil
+	}
+}
+
+// hasContentType checks if the JSON encoded content has one of the passed types.
+// Encrypted content never matches.
+func hasContentType(content []byte, types []string) bool {
+	typ := contentType(content)
+	if typ == "" {
+		return false
+	}
+	for _, t := range types {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// contentType returns the type of the JSON encoded content or an empty string for encrypted content.
+func contentType(content []byte) string {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(content, &typed); err != nil {
+		return ""
+	}
+	return typed.Type
+}
+
+// newHeaderSink writes a message.MessageHeader for each message to sink and closes it at the end of the stream.
+// Nulled messages are skipped.
+func newHeaderSink(sink transform.MessageWriter) luigi.Sink {
+	return luigi.FuncSink(func(ctx context.Context, v interface{}, err error) error {
+		if err != nil {
+			if luigi.IsEOS(err) {
+				return sink.Close()
+			}
+			return sink.CloseWithError(err)
+		}
+
+		var msg refs.Message
+		switch tv := v.(type) {
+		case refs.Message:
+			msg = tv
+		case margaret.SeqWrapper:
+			var ok bool
+			msg, ok = tv.Value().(refs.Message)
+			if !ok {
+				return nil
+			}
+		case error:
+			if margaret.IsErrNulled(tv) {
+				return nil
+			}
+			return tv
+		default:
+			return fmt.Errorf("headers: unexpected value %T", v)
+		}
+
+		hdr, err := json.Marshal(message.MessageHeader{
+			Sequence:  msg.Seq(),
+			Author:    msg.Author(),
+			Timestamp: msg.Claimed().UnixNano() / int64(time.Millisecond),
+			Type:      contentType(msg.ContentBytes()),
+		})
+		if err != nil {
+			return fmt.Errorf("headers: failed to encode header: %w", err)
+		}
+		_, err = sink.Write(hdr)
+		return err
+	})
+}
+
+// sequenceOf returns the feed sequence of the message ref of feed, see CreateHistArgs.AfterRef.
+// The feed is searched from the latest message backwards, since clients usually ask for the recent ones.
+func (m *FeedManager) sequenceOf(ctx context.Context, feed *refs.FeedRef, ref *refs.MessageRef) (int64, error) {
+	userLog, err := m.UserFeeds.Get(storedrefs.Feed(feed))
+	if err != nil {
+		return 0, fmt.Errorf("failed to open sublog for user: %w", err)
+	}
+
+	msg, err := mutil.FindLatest(ctx, m.ReceiveLog, userLog, func(msg refs.Message) bool {
+		return msg.Key().Equal(ref)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up %s: %w", ref.ShortRef(), err)
+	}
+	if msg == nil {
+		return 0, fmt.Errorf("bad request: %s is not a message of %s", ref.ShortRef(), feed.ShortRef())
+	}
+	return msg.Seq(), nil
+}
+
+// Sequence conventions for CreateStreamHistory:
+// requests use the 1-based sequence of the feed (the first message has seq 1) and seq 0 means "from the start", the same as 1.
+// The sublogs of the user feeds are 0-based, so CreateStreamHistory decrements a non-zero arg.Seq to get the index of the first message to send.
+// The helpers below expect arg.Seq to be decremented already and curSeq to be the 0-based index of the latest message.
+
+// liveUntil returns the sequence of the last message that should be sent for a live CreateStreamHistory request.
+func liveUntil(arg *message.CreateHistArgs) int64 {
+	if arg.Limit == -1 {
+		return math.MaxInt64
+	}
+	// the index of the last message is arg.Seq+arg.Limit-1, the feed sequence one more
+	return arg.Seq + arg.Limit
 }
 
 // nonliveLimit returns the upper limit for a CreateStreamHistory request given
@@ -158,6 +879,7 @@ func nonliveLimit(
 	if arg.Limit == -1 {
 		return -1
 	}
+	// arg.Seq is 0 for both "from the start" and "from seq 1", which are the same index
 	lastSeq := arg.Seq + arg.Limit - 1
 	if lastSeq > curSeq {
 		lastSeq = curSeq
@@ -165,24 +887,6 @@ func nonliveLimit(
 	return lastSeq - arg.Seq + 1
 }
 
-// liveLimit returns the limit for serving the 'live' portion for a
-// CreateStreamHistory request given the current User Feeds latest sequence.
-func liveLimit(
-	arg *message.CreateHistArgs,
-	curSeq int64,
-) int64 {
-	if arg.Limit == -1 {
-		return -1
-	}
-
-	startSeq := curSeq + 1
-	lastSeq := arg.Seq + arg.Limit - 1
-	if lastSeq < curSeq {
-		return 0
-	}
-	return lastSeq - startSeq + 1
-}
-
 // getLatestSeq returns the latest Sequence number for the given log.
 // TODO: this should probably be on margret itself... (ie. observable less way to get the current sequence)
 func getLatestSeq(log margaret.Log) (int64, error) {
@@ -200,17 +904,234 @@ func getLatestSeq(log margaret.Log) (int64, error) {
 	}
 }
 
+// trackedStream is a request with a StreamID that can be canceled
+type trackedStream struct {
+	cancel func()
+
+	// live streams are kept after CreateStreamHistory returned
+	live bool
+}
+
+// streamKey returns the key of a StreamID in streams. The ids are picked by the clients, so they are only unique per peer.
+func streamKey(peer *refs.FeedRef, id string) string {
+	if peer == nil {
+		return ":" + id
+	}
+	return peer.Ref() + ":" + id
+}
+
+// trackStream registers the request under key and returns the context to serve it with.
+// A previous request with the same key can't be canceled anymore.
+func (m *FeedManager) trackStream(ctx context.Context, key string) (context.Context, *trackedStream) {
+	ctx, cancel := context.WithCancel(ctx)
+	ts := &trackedStream{cancel: cancel}
+
+	m.streamsMut.Lock()
+	m.streams[key] = ts
+	m.streamsMut.Unlock()
+	return ctx, ts
+}
+
+// untrackStream drops ts once CreateStreamHistory returned, unless it went live.
+func (m *FeedManager) untrackStream(key string, ts *trackedStream) {
+	m.streamsMut.Lock()
+	defer m.streamsMut.Unlock()
+	if ts.live {
+		return
+	}
+	m.dropStream(key, ts)
+	ts.cancel()
+}
+
+// dropStream removes ts from streams, unless the key was reused. It expects streamsMut to be held.
+func (m *FeedManager) dropStream(key string, ts *trackedStream) {
+	if m.streams[key] == ts {
+		delete(m.streams, key)
+	}
+}
+
+// streamWentLive makes CancelStream of key call stop, too, to take the sink off the live feed.
+// The entry is removed once ctx, the one the live sink was registered with, is done.
+func (m *FeedManager) streamWentLive(ctx context.Context, key string, stop func()) {
+	m.streamsMut.Lock()
+	defer m.streamsMut.Unlock()
+	ts, ok := m.streams[key]
+	if !ok {
+		return
+	}
+	cancel := ts.cancel
+	ts.cancel = func() {
+		cancel()
+		stop()
+	}
+	ts.live = true
+
+	go func() {
+		<-ctx.Done()
+		m.streamsMut.Lock()
+		m.dropStream(key, ts)
+		m.streamsMut.Unlock()
+	}()
+}
+
+// CancelStream stops the request that peer made with the StreamID id, for instance if the client told us out-of-band that it doesn't need it anymore.
+// peer is nil for requests that were made without one, see CreateStreamHistory.
+// The history that is still being sent is aborted and live streams are closed. It returns false if there is no such request.
+func (m *FeedManager) CancelStream(peer *refs.FeedRef, id string) bool {
+	key := streamKey(peer, id)
+	m.streamsMut.Lock()
+	ts, ok := m.streams[key]
+	delete(m.streams, key)
+	m.streamsMut.Unlock()
+
+	if !ok {
+		return false
+	}
+	ts.cancel()
+	if m.sysCtr != nil {
+		m.sysCtr.With("event", "gossip-stream-canceled").Add(1)
+	}
+	return true
+}
+
+// ErrDraining is returned for requests that come in after Drain was called.
+var ErrDraining = errors.New("gossip: feed manager is draining")
+
+// Drain stops accepting new requests and waits for the streams that are in flight to finish their non-live portion.
+// Afterwards all the live feeds are closed. If ctx is done before all the streams finished, the live feeds are still closed and the error of ctx is returned.
+func (m *FeedManager) Drain(ctx context.Context) error {
+	m.drainingMut.Lock()
+	m.draining = true
+	m.drainingMut.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("gossip: drain interrupted: %w", ctx.Err())
+	}
+
+	m.liveFeedsMut.Lock()
+	defer m.liveFeedsMut.Unlock()
+	for ref := range m.liveFeeds {
+		m.dropLiveFeed(ref, "drain")
+	}
+	m.liveOrder.Init()
+	m.liveElems = make(map[string]*list.Element)
+	return err
+}
+
+// startRequest registers a new request as in flight, unless the manager is draining.
+func (m *FeedManager) startRequest() bool {
+	m.drainingMut.Lock()
+	defer m.drainingMut.Unlock()
+	if m.draining {
+		return false
+	}
+	m.inflight.Add(1)
+	return true
+}
+
 // CreateStreamHistory serves the sink a CreateStreamHistory request to the sink.
 func (m *FeedManager) CreateStreamHistory(
 	ctx context.Context,
 	sink *muxrpc.ByteSink,
 	arg *message.CreateHistArgs,
 ) error {
+	return m.CreateStreamHistoryFor(ctx, nil, sink, arg)
+}
+
+// CreateStreamHistoryFor is like CreateStreamHistory but for a request made by peer.
+// If peer reconnects within the resume grace period and asks for the live feed where it left off,
+// it is reattached to it instead of querying the history again.
+func (m *FeedManager) CreateStreamHistoryFor(
+	ctx context.Context,
+	peer *refs.FeedRef,
+	sink *muxrpc.ByteSink,
+	arg *message.CreateHistArgs,
+) error {
+	if arg.Cursor != "" {
+		if err := applyCursor(arg); err != nil {
+			return fmt.Errorf("bad request: %w", err)
+		}
+	}
 	if arg.ID == nil {
 		return fmt.Errorf("bad request: missing id argument")
 	}
+	// check the format before touching the indexes, newStreamSink would only fail after the queries are made
+	if err := ssb.IsValidFeedFormat(arg.ID); err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+	if err := checkCompression(arg); err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+	// the live handoff continues after the last message that was sent, which is only the latest one for a forward stream of the whole feed
+	if arg.Live && (arg.Reverse || arg.Lt != 0 || arg.Gt != 0) {
+		return fmt.Errorf("bad request: live streams can't be reversed or use lt and gt")
+	}
+	if arg.LiveOnly && !arg.Live {
+		return fmt.Errorf("bad request: liveOnly needs live")
+	}
+	if arg.AfterRef != nil && (arg.Seq != 0 || arg.LiveOnly) {
+		return fmt.Errorf("bad request: afterRef can't be combined with seq or liveOnly")
+	}
+	if err := checkCursorMode(arg); err != nil {
+		return fmt.Errorf("bad request: %w", err)
+	}
+	if err := m.authorizePeer(peer, arg.ID); err != nil {
+		return fmt.Errorf("not authorized for %s: %w", arg.ID.ShortRef(), err)
+	}
+	if !m.startRequest() {
+		return ErrDraining
+	}
+	defer m.inflight.Done()
 	feedLogger := log.With(m.logger, "fr", arg.ID.ShortRef())
 
+	if arg.StreamID != "" {
+		var ts *trackedStream
+		key := streamKey(peer, arg.StreamID)
+		ctx, ts = m.trackStream(ctx, key)
+		defer m.untrackStream(key, ts)
+	}
+
+	if arg.Live && arg.Limit == 0 {
+		arg.Limit = -1
+	}
+
+	if arg.LiveOnly {
+		return m.addLiveOnlyFeed(ctx, peer, sink, arg)
+	}
+
+	if arg.AfterRef != nil {
+		seq, err := m.sequenceOf(ctx, arg.ID, arg.AfterRef)
+		if err != nil {
+			return err
+		}
+		// continue with the message after it, like a request for that seq
+		arg.Seq = seq + 1
+	}
+
+	if arg.Seq != 0 {
+		arg.Seq-- // our idx is 0 ed
+
+		if peer != nil && arg.Live {
+			resumed, err := m.resumeLiveFeed(ctx, peer, sink, arg)
+			if err != nil {
+				return err
+			}
+			if resumed {
+				level.Debug(feedLogger).Log("event", "gossip-resumed", "peer", peer.ShortRef(), "starting", arg.Seq)
+				return nil
+			}
+		}
+	}
+
 	// check what we got
 	userLog, err := m.UserFeeds.Get(storedrefs.Feed(arg.ID))
 	if err != nil {
@@ -222,15 +1143,10 @@ func (m *FeedManager) CreateStreamHistory(
 	}
 
 	if arg.Seq != 0 {
-		arg.Seq--             // our idx is 0 ed
 		if arg.Seq > latest { // more than we got
 			if arg.Live {
-				return m.addLiveFeed(
-					ctx, sink,
-					arg.ID.Ref(),
-					latest,
-					liveLimit(arg, latest),
-				)
+				// the peer already has everything upto arg.Seq
+				return m.addLiveFeed(ctx, peer, sink, arg, arg.Seq, liveUntil(arg))
 			}
 			err = sink.Close()
 			if err != nil {
@@ -239,16 +1155,15 @@ func (m *FeedManager) CreateStreamHistory(
 			return err
 		}
 	}
-	if arg.Live && arg.Limit == 0 {
-		arg.Limit = -1
-	}
 
 	// Make query
 	limit := nonliveLimit(arg, latest)
 	qryArgs := []margaret.QuerySpec{
-		margaret.Limit(int(limit)),
 		margaret.Reverse(arg.Reverse),
 	}
+	if len(arg.ContentTypes) == 0 {
+		qryArgs = append(qryArgs, margaret.Limit(int(limit)))
+	}
 
 	if arg.Seq > 0 {
 		qryArgs = append(qryArgs, margaret.Gte(margaret.BaseSeq(arg.Seq)))
@@ -267,30 +1182,61 @@ func (m *FeedManager) CreateStreamHistory(
 	if err != nil {
 		return fmt.Errorf("invalid user log query: %w", err)
 	}
+	if len(arg.ContentTypes) > 0 {
+		src = filterContentTypes(src, arg)
+		if limit >= 0 {
+			src = &limitSource{src: src, left: limit}
+		}
+	}
 
-	var luigiSink luigi.Sink
-	switch arg.ID.Algo {
-	case refs.RefAlgoFeedSSB1:
-		luigiSink = transform.NewKeyValueWrapper(sink, arg.Keys)
+	var chunks *chunkWriter
+	if arg.Compress != "" {
+		chunks = newChunkWriter(sink)
+	}
 
-	case refs.RefAlgoFeedGabby:
-		switch {
-		case arg.AsJSON:
-			luigiSink = transform.NewKeyValueWrapper(sink, arg.Keys)
-		default:
-			luigiSink = luigiutils.NewGabbyStreamSink(sink)
-		}
+	luigiSink, err := newStreamSink(arg, sink, chunks, m.getContentTransform())
+	if err != nil {
+		return err
+	}
 
-	default:
-		return fmt.Errorf("unsupported feed format")
+	// the live portion continues on the same sink, so don't close it after the non-live part.
+	// The cursor needs to know the last message, too.
+	var tracker *seqTrackingSink
+	if arg.Live || arg.WithCursor {
+		tracker = &seqTrackingSink{next: luigiSink, seq: arg.Seq}
+		luigiSink = tracker
+	}
+
+	var idle *idleSink
+	pumpCtx := ctx
+	if timeout := m.getIdleTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		pumpCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		idle = newIdleSink(luigiSink, timeout, func() {
+			level.Warn(feedLogger).Log("event", "gossip-idle-timeout", "timeout", timeout)
+			if m.sysCtr != nil {
+				m.sysCtr.With("event", "gossip-idle-timeout").Add(1)
+			}
+			cancel()
+			// closing might block on the stuck writer, too
+			go sink.CloseWithError(ErrIdleTimeout)
+		})
+		luigiSink = idle
 	}
 
 	sent := 0
-	err = luigi.Pump(ctx, luigiutils.NewSinkCounter(&sent, luigiSink), src)
+	err = luigi.Pump(pumpCtx, luigiutils.NewSinkCounter(&sent, luigiSink), src)
+	if idle != nil {
+		idle.stop()
+		if idle.timedOut() {
+			return fmt.Errorf("stream of %s aborted: %w", arg.ID.ShortRef(), ErrIdleTimeout)
+		}
+	}
 
 	// track number of messages sent
 	if m.sysCtr != nil {
-		m.sysCtr.With("event", "gossiptx").Add(float64(sent))
+		m.sysCtr.With("event", gossipTxEvent(arg)).Add(float64(sent))
 	} else {
 		if sent > 0 {
 			level.Debug(feedLogger).Log("event", "gossiptx", "n", sent, "starting", arg.Seq)
@@ -304,15 +1250,16 @@ func (m *FeedManager) CreateStreamHistory(
 		return fmt.Errorf("failed to pump messages to peer: %w", err)
 	}
 
-	// cryptix: this seems to produce some hangs
-	// TODO: make tests with leaving and joining peers while messages are published
 	if arg.Live {
-		return m.addLiveFeed(
-			ctx, sink,
-			arg.ID.Ref(),
-			latest,
-			liveLimit(arg, latest),
-		)
+		return m.addLiveFeed(ctx, peer, sink, arg, tracker.seq, liveUntil(arg))
+	}
+	if arg.WithCursor && arg.Limit > 0 && int64(sent) >= arg.Limit {
+		if err := writeCursor(sink, arg.ID, tracker.seq+1); err != nil {
+			return fmt.Errorf("failed to send cursor: %w", err)
+		}
+	}
+	if chunks != nil {
+		return chunks.Close()
 	}
 	return sink.Close()
 }
@@ -4,21 +4,30 @@ package gossip
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"go.cryptoscope.co/muxrpc/v2/codec"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
 	"github.com/stretchr/testify/require"
 	refs "go.mindeco.de/ssb-refs"
 
 	"go.cryptoscope.co/librarian"
+	"go.cryptoscope.co/luigi"
 	"go.cryptoscope.co/margaret"
 	"go.cryptoscope.co/margaret/multilog"
 	"go.cryptoscope.co/muxrpc/v2"
@@ -182,6 +191,1563 @@ func TestCreateHistoryStream(t *testing.T) {
 	}
 }
 
+func TestCreateHistoryStreamResume(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+	infoAlice := log.With(l, "bot", "alice")
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	create(t, 10, "prefill")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, infoAlice, nil, nil)
+
+	// the first connection drops after the 5th message
+	var firstBuf = new(bytes.Buffer)
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(firstBuf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		Seq:        1,
+		StreamArgs: message.StreamArgs{Limit: 5},
+	})
+	r.NoError(err)
+	r.Equal([]int64{1, 2, 3, 4, 5}, readSequences(t, firstBuf))
+
+	// the reconnect resumes at 6 and stays live
+	var secondBuf = new(lockedBuffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(secondBuf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		Seq:        6,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+
+	create(t, 5, "post/live")
+
+	var got []int64
+	for i := 0; i < 20; i++ {
+		got = readSequences(t, secondBuf.copy())
+		if len(got) >= 10 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var want []int64
+	for i := int64(6); i <= 15; i++ {
+		want = append(want, i)
+	}
+	r.Equal(want, got, "expected no gaps or duplicates")
+}
+
+func TestLiveFeedReconnect(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	create(t, 3, "prefill")
+
+	counted := &countingUserFeeds{MultiLog: userFeeds}
+	fm := NewFeedManager(ctx, rootLog, counted, log.With(l, "bot", "alice"), nil, nil)
+	fm.SetResumeGrace(time.Minute)
+
+	peerKp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte("peer"), 8)))
+	r.NoError(err)
+	peer := peerKp.Id
+
+	first := new(droppingWriter)
+	err = fm.CreateStreamHistoryFor(ctx, peer, muxrpc.NewTestSink(first), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+	r.Equal([]int64{1, 2, 3}, readSequences(t, first.copy()))
+
+	// the connection blips while new messages are published
+	first.drop()
+	create(t, 2, "blip")
+
+	parked := func() bool {
+		fm.liveFeedsMut.Lock()
+		defer fm.liveFeedsMut.Unlock()
+		liveFeed, has := fm.liveFeeds[keyPair.Id.Ref()]
+		return has && liveFeed.Parked() == 1
+	}
+	r.Eventually(parked, 5*time.Second, 50*time.Millisecond, "sink wasn't parked")
+
+	// the peer comes back and asks for what it is missing
+	counted.reset()
+	second := new(lockedBuffer)
+	err = fm.CreateStreamHistoryFor(ctx, peer, muxrpc.NewTestSink(second), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		Seq:        4,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+	r.EqualValues(0, counted.count(), "history was queried again")
+
+	create(t, 2, "after")
+
+	want := []int64{4, 5, 6, 7}
+	r.Eventually(func() bool {
+		got := readSequences(t, second.copy())
+		return len(got) == len(want)
+	}, 5*time.Second, 50*time.Millisecond, "didn't get all the messages")
+	r.Equal(want, readSequences(t, second.copy()), "expected no gaps or duplicates")
+	r.Equal([]int64{1, 2, 3}, readSequences(t, first.copy()))
+}
+
+func TestCreateHistoryStreamLiveOnly(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	create(t, 5, "history")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	buf := new(lockedBuffer)
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		Seq:        1,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+		LiveOnly:   true,
+	})
+	r.NoError(err)
+	r.Len(readSequences(t, buf.copy()), 0, "got stored messages")
+
+	create(t, 2, "live")
+
+	want := []int64{6, 7}
+	r.Eventually(func() bool {
+		return len(readSequences(t, buf.copy())) == len(want)
+	}, 5*time.Second, 50*time.Millisecond, "didn't get the live messages")
+	r.Equal(want, readSequences(t, buf.copy()))
+
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(lockedBuffer)), &message.CreateHistArgs{
+		ID:       keyPair.Id,
+		LiveOnly: true,
+	})
+	r.Error(err, "liveOnly without live")
+}
+
+func TestCreateHistoryStreamPeerAuthorizer(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	create(t, 3, "hops")
+
+	mkPeer := func(b byte) *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+		r.NoError(err)
+		return kp.Id
+	}
+	near, far := mkPeer(1), mkPeer(2)
+
+	// only near has our feed in its hops
+	inHops := map[string]*ssb.StrFeedSet{
+		near.Ref(): ssb.NewFeedSet(1),
+		far.Ref():  ssb.NewFeedSet(0),
+	}
+	r.NoError(inHops[near.Ref()].AddRef(keyPair.Id))
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+	fm.SetPeerAuthorizer(func(peer *refs.FeedRef) ssb.Authorizer {
+		return hopsAuthorizer{inHops[peer.Ref()]}
+	})
+
+	request := func(peer *refs.FeedRef, buf io.Writer) error {
+		return fm.CreateStreamHistoryFor(ctx, peer, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+			ID:         keyPair.Id,
+			StreamArgs: message.StreamArgs{Limit: -1},
+		})
+	}
+
+	var nearBuf bytes.Buffer
+	r.NoError(request(near, &nearBuf))
+	r.Equal([]int64{1, 2, 3}, readSequences(t, &nearBuf))
+
+	var farBuf bytes.Buffer
+	err := request(far, &farBuf)
+	r.Error(err)
+	r.True(errors.As(err, new(ssb.ErrDenied)), "wrong error: %s", err)
+	r.Len(readSequences(t, &farBuf), 0)
+
+	// requests without a peer aren't checked
+	var localBuf bytes.Buffer
+	r.NoError(request(nil, &localBuf))
+	r.Equal([]int64{1, 2, 3}, readSequences(t, &localBuf))
+}
+
+// hopsAuthorizer allows the feeds in the set
+type hopsAuthorizer struct {
+	set *ssb.StrFeedSet
+}
+
+func (ha hopsAuthorizer) Authorize(feed *refs.FeedRef) error {
+	if !ha.set.Has(feed) {
+		return ssb.ErrDenied{Who: feed}
+	}
+	return nil
+}
+
+func TestFeedsToServe(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	_, rootLog, userFeeds, _ := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	mkFeed := func(b byte) *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+		r.NoError(err)
+		return kp.Id
+	}
+	peer := mkFeed(1)
+	both, unauthorized, unwanted := mkFeed(2), mkFeed(3), mkFeed(4)
+
+	allowed := ssb.NewFeedSet(2)
+	r.NoError(allowed.AddRef(both))
+	r.NoError(allowed.AddRef(unwanted))
+
+	wants := ssb.NewFeedSet(2)
+	r.NoError(wants.AddRef(both))
+	r.NoError(wants.AddRef(unauthorized))
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	// without an authorizer everything the peer wants is served
+	serve, err := fm.FeedsToServe(peer, wants)
+	r.NoError(err)
+	r.Equal(2, serve.Count())
+
+	fm.SetPeerAuthorizer(func(*refs.FeedRef) ssb.Authorizer {
+		return hopsAuthorizer{allowed}
+	})
+
+	serve, err = fm.FeedsToServe(peer, wants)
+	r.NoError(err)
+	r.Equal(1, serve.Count())
+	r.True(serve.Has(both))
+	r.False(serve.Has(unauthorized), "serves a feed the peer isn't allowed to get")
+	r.False(serve.Has(unwanted), "serves a feed the peer doesn't want")
+
+	serve, err = fm.FeedsToServe(peer, nil)
+	r.NoError(err)
+	r.Equal(0, serve.Count())
+}
+
+func TestLiveFeedsRestart(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	create(t, 2, "before")
+
+	oldDelay := liveRestartDelay
+	liveRestartDelay = 10 * time.Millisecond
+	defer func() { liveRestartDelay = oldDelay }()
+
+	// the first live query fails
+	flaky := &failingQueryLog{Log: rootLog, failures: 1}
+	restarts := new(eventCounter)
+	fm := NewFeedManager(ctx, flaky, userFeeds, log.With(l, "bot", "alice"), nil, restarts)
+
+	r.Eventually(func() bool {
+		return restarts.value("gossip-live-restarted") == 1
+	}, 5*time.Second, 10*time.Millisecond, "live query wasn't restarted")
+
+	buf := new(lockedBuffer)
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+
+	create(t, 2, "after")
+
+	want := []int64{1, 2, 3, 4}
+	r.Eventually(func() bool {
+		return len(readSequences(t, buf.copy())) == len(want)
+	}, 5*time.Second, 50*time.Millisecond, "didn't get the live messages")
+	r.Equal(want, readSequences(t, buf.copy()))
+
+	r.NoError(fm.Close())
+	select {
+	case <-fm.serveDone:
+	default:
+		t.Fatal("still serving after close")
+	}
+}
+
+// failingQueryLog fails the first queries
+type failingQueryLog struct {
+	margaret.Log
+
+	mu       sync.Mutex
+	failures int
+}
+
+func (fl *failingQueryLog) Query(specs ...margaret.QuerySpec) (luigi.Source, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if fl.failures > 0 {
+		fl.failures--
+		return nil, errors.New("transient query failure")
+	}
+	return fl.Log.Query(specs...)
+}
+
+func TestLiveFeedsFairness(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	tRepo := repo.New(repoPath)
+
+	rootLog, err := repo.OpenLog(tRepo)
+	r.NoError(err)
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(tRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	newFeed := func() (func(t *testing.T, num int, text string), *refs.FeedRef) {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		pub, err := message.OpenPublishLog(rootLog, userFeeds, kp)
+		r.NoError(err)
+		return createMessages(pub, refresh, rootLog), kp.Id
+	}
+	createChatty, chatty := newFeed()
+	createQuiet, quiet := newFeed()
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+	defer fm.Close()
+
+	goLive := func(feed *refs.FeedRef, w io.Writer) {
+		err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(w), &message.CreateHistArgs{
+			ID:         feed,
+			StreamArgs: message.StreamArgs{Limit: -1},
+			CommonArgs: message.CommonArgs{Live: true},
+		})
+		r.NoError(err)
+	}
+
+	// the subscriber of the chatty feed takes a while for every message
+	chattyBuf := &slowWriter{delay: 50 * time.Millisecond, started: make(chan struct{})}
+	goLive(chatty, chattyBuf)
+	quietBuf := new(lockedBuffer)
+	goLive(quiet, quietBuf)
+
+	createChatty(t, 100, "chatty")
+	createQuiet(t, 1, "quiet")
+
+	r.Eventually(func() bool {
+		return len(readSequences(t, quietBuf.copy())) == 1
+	}, time.Second, 10*time.Millisecond, "the quiet feed was held up")
+	r.Less(len(readSequences(t, chattyBuf.copy())), 100, "the chatty feed was done already")
+
+	r.Eventually(func() bool {
+		return len(readSequences(t, chattyBuf.copy())) == 100
+	}, 15*time.Second, 50*time.Millisecond, "didn't get all the chatty messages")
+}
+
+func TestCreateHistoryStreamUnsupportedFormat(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	_, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	counted := &countingUserFeeds{MultiLog: userFeeds}
+	fm := NewFeedManager(ctx, rootLog, counted, log.With(l, "bot", "alice"), nil, nil)
+
+	bogus := &refs.FeedRef{ID: keyPair.Id.ID, Algo: "bogus"}
+	var buf = new(bytes.Buffer)
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         bogus,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.Error(err)
+	r.Contains(err.Error(), "unsupported feed format")
+
+	r.Equal(0, counted.count(), "the user feeds shouldn't be opened")
+	r.Equal(0, buf.Len(), "nothing should be written")
+	fm.liveFeedsMut.Lock()
+	r.Len(fm.liveFeeds, 0, "no live feed should be registered")
+	fm.liveFeedsMut.Unlock()
+}
+
+func TestCreateHistoryStreamContentTypes(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	keyPair, err := repo.DefaultKeyPair(testRepo)
+	r.NoError(err)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	pub, err := message.OpenPublishLog(rootLog, userFeeds, keyPair)
+	r.NoError(err)
+
+	types := []string{"post", "contact", "post", "about", "post", "vote"}
+	for i, tipe := range types {
+		_, err := pub.Publish(map[string]interface{}{"type": tipe, "i": i})
+		r.NoError(err)
+	}
+	errc := asynctesting.ServeLog(ctx, "userFeeds", rootLog, refresh, false)
+	r.NoError(<-errc)
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	var buf = new(bytes.Buffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:           keyPair.Id,
+		StreamArgs:   message.StreamArgs{Limit: -1},
+		ContentTypes: []string{"post"},
+	})
+	r.NoError(err)
+
+	r.Equal([]int64{1, 3, 5}, readSequences(t, buf), "expected only the post messages")
+
+	// the limit counts the matching messages
+	buf.Reset()
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:           keyPair.Id,
+		StreamArgs:   message.StreamArgs{Limit: 2},
+		ContentTypes: []string{"post"},
+	})
+	r.NoError(err)
+	r.Equal([]int64{1, 3}, readSequences(t, buf))
+}
+
+func TestCreateHistoryStreamContentTransform(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	keyPair, err := repo.DefaultKeyPair(testRepo)
+	r.NoError(err)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	pub, err := message.OpenPublishLog(rootLog, userFeeds, keyPair)
+	r.NoError(err)
+
+	publish := func(i int) {
+		_, err := pub.Publish(map[string]interface{}{"type": "post", "text": "secret", "i": i})
+		r.NoError(err)
+	}
+	for i := 0; i < 3; i++ {
+		publish(i)
+	}
+	errc := asynctesting.ServeLog(ctx, "userFeeds", rootLog, refresh, false)
+	r.NoError(<-errc)
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+	fm.SetContentTransform(func(msg refs.Message) (json.RawMessage, error) {
+		var content map[string]interface{}
+		if err := json.Unmarshal(msg.ContentBytes(), &content); err != nil {
+			return nil, err
+		}
+		delete(content, "text")
+		return json.Marshal(content)
+	})
+
+	type servedContent struct {
+		Text *string `json:"text"`
+		I    int     `json:"i"`
+	}
+	served := func(buf *lockedBuffer) []servedContent {
+		var contents []servedContent
+		for _, pkt := range readAllPackets(buf.copy()) {
+			if pkt.Flag.Get(codec.FlagEndErr) {
+				continue
+			}
+			var val struct {
+				Content servedContent `json:"content"`
+			}
+			r.NoError(json.Unmarshal(pkt.Body, &val))
+			contents = append(contents, val.Content)
+		}
+		return contents
+	}
+
+	buf := new(lockedBuffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+
+	// the live message is transformed, too
+	publish(3)
+	r.Eventually(func() bool {
+		return len(served(buf)) == 4
+	}, 5*time.Second, 50*time.Millisecond, "didn't get the live message")
+
+	for i, c := range served(buf) {
+		r.Nil(c.Text, "message %d wasn't redacted", i)
+		r.Equal(i, c.I)
+	}
+
+	// binary streams can't carry the changed content
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         &refs.FeedRef{ID: keyPair.Id.ID, Algo: refs.RefAlgoFeedGabby},
+		StreamArgs: message.StreamArgs{Limit: -1},
+	})
+	r.True(errors.Is(err, errTransformNeedsJSON), "wrong error: %v", err)
+}
+
+func TestMaxLiveFeeds(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	evictions := new(eventCounter)
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, evictions)
+	fm.SetMaxLiveFeeds(2)
+
+	goLive := func(feed *refs.FeedRef) *lockedBuffer {
+		buf := new(lockedBuffer)
+		err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+			ID:         feed,
+			StreamArgs: message.StreamArgs{Limit: -1},
+			CommonArgs: message.CommonArgs{Live: true},
+		})
+		r.NoError(err)
+		return buf
+	}
+	closed := func(buf *lockedBuffer) bool {
+		for _, pkt := range readAllPackets(buf.copy()) {
+			if pkt.Flag.Get(codec.FlagEndErr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	mkFeed := func(b byte) *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+		r.NoError(err)
+		return kp.Id
+	}
+
+	first := goLive(keyPair.Id)
+	second := goLive(mkFeed(1))
+
+	// a new message makes the first feed the most recently used one
+	create(t, 1, "poured")
+	r.Eventually(func() bool {
+		return len(readSequences(t, first.copy())) == 1
+	}, 5*time.Second, 50*time.Millisecond, "didn't get the live message")
+
+	third := goLive(mkFeed(2))
+
+	r.Eventually(func() bool {
+		return closed(second)
+	}, 5*time.Second, 50*time.Millisecond, "the least recently used feed should be closed")
+	r.False(closed(first))
+	r.False(closed(third))
+	r.EqualValues(1, evictions.value("gossip-livefeed-evicted"))
+
+	fm.liveFeedsMut.Lock()
+	r.Len(fm.liveFeeds, 2)
+	_, has := fm.liveFeeds[mkFeed(1).Ref()]
+	r.False(has)
+	fm.liveFeedsMut.Unlock()
+}
+
+func TestCreateHistoryStreamIdleTimeout(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+	create(t, 5, "stuck")
+
+	timeouts := new(eventCounter)
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, timeouts)
+	fm.SetIdleTimeout(100 * time.Millisecond)
+
+	stuck := &stuckWriter{accept: 2, release: make(chan struct{})}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(stuck), &message.CreateHistArgs{
+			ID:         keyPair.Id,
+			StreamArgs: message.StreamArgs{Limit: -1},
+		})
+	}()
+
+	r.Eventually(func() bool {
+		return timeouts.value("gossip-idle-timeout") == 1
+	}, 5*time.Second, 20*time.Millisecond, "stream wasn't aborted")
+
+	// the peer finally gives up, too
+	close(stuck.release)
+
+	select {
+	case err := <-errc:
+		r.True(errors.Is(err, ErrIdleTimeout), "expected idle timeout, got: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream wasn't torn down")
+	}
+}
+
+// eventCounter counts the events of the feed manager by their name.
+// Like the system counter of go-sbot, it only accepts the event label.
+type eventCounter struct {
+	mu     sync.Mutex
+	events map[string]float64
+}
+
+func (ec *eventCounter) With(labelValues ...string) metrics.Counter {
+	if len(labelValues) != 2 || labelValues[0] != "event" {
+		panic(fmt.Sprintf("eventCounter: unexpected labels %v", labelValues))
+	}
+	return eventCounterFor{ec, labelValues[1]}
+}
+
+func (ec *eventCounter) Add(float64) {}
+
+func (ec *eventCounter) value(event string) float64 {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.events[event]
+}
+
+type eventCounterFor struct {
+	ec    *eventCounter
+	event string
+}
+
+func (ecf eventCounterFor) With(...string) metrics.Counter { return ecf }
+
+func (ecf eventCounterFor) Add(delta float64) {
+	ecf.ec.mu.Lock()
+	defer ecf.ec.mu.Unlock()
+	if ecf.ec.events == nil {
+		ecf.ec.events = make(map[string]float64)
+	}
+	ecf.ec.events[ecf.event] += delta
+}
+
+func TestCreateHistoryStreamFormatMetrics(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	legacyKP, err := repo.DefaultKeyPair(testRepo)
+	r.NoError(err)
+	gabbyKP, err := repo.NewKeyPair(testRepo, "gabby", refs.RefAlgoFeedGabby)
+	r.NoError(err)
+
+	for i, kp := range []*ssb.KeyPair{legacyKP, gabbyKP} {
+		pub, err := message.OpenPublishLog(rootLog, userFeeds, kp)
+		r.NoError(err)
+		for j := 0; j <= i+1; j++ {
+			_, err := pub.Publish(map[string]interface{}{"type": "test", "i": j})
+			r.NoError(err)
+		}
+	}
+	errc := asynctesting.ServeLog(ctx, "userFeeds", rootLog, refresh, false)
+	r.NoError(<-errc)
+
+	counter := new(eventCounter)
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, counter)
+
+	serve := func(arg *message.CreateHistArgs) {
+		arg.StreamArgs.Limit = -1
+		err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), arg)
+		r.NoError(err)
+	}
+	serve(&message.CreateHistArgs{ID: legacyKP.Id})
+	serve(&message.CreateHistArgs{ID: gabbyKP.Id})
+	serve(&message.CreateHistArgs{ID: gabbyKP.Id, AsJSON: true})
+
+	r.EqualValues(2, counter.value("gossiptx.ssb1.json"))
+	r.EqualValues(3, counter.value("gossiptx.gabby.binary"))
+	r.EqualValues(3, counter.value("gossiptx.gabby.json"))
+	r.EqualValues(0, counter.value("gossiptx.ssb1.binary"))
+}
+
+func TestCancelStream(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+	const n = 200
+	create(t, n, "long")
+
+	counter := new(eventCounter)
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, counter)
+
+	r.False(fm.CancelStream(nil, "unknown"))
+
+	slow := &slowWriter{delay: 10 * time.Millisecond, started: make(chan struct{})}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(slow), &message.CreateHistArgs{
+			ID:         keyPair.Id,
+			StreamArgs: message.StreamArgs{Limit: -1},
+			StreamID:   "long-one",
+		})
+	}()
+
+	select {
+	case <-slow.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream didn't start")
+	}
+	r.True(fm.CancelStream(nil, "long-one"))
+
+	select {
+	case err := <-errc:
+		r.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("stream wasn't stopped")
+	}
+	r.True(len(readAllPackets(slow.copy())) < n, "sent the whole feed")
+	r.EqualValues(1, counter.value("gossip-stream-canceled"))
+
+	// it's gone after it was canceled or finished
+	r.False(fm.CancelStream(nil, "long-one"))
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamID:   "short-one",
+		StreamArgs: message.StreamArgs{Limit: 1},
+	})
+	r.NoError(err)
+	r.False(fm.CancelStream(nil, "short-one"))
+
+	// ids are only looked up for the peer that made the request
+	other, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+	liveCtx, liveCancel := context.WithCancel(ctx)
+	err = fm.CreateStreamHistory(liveCtx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamID:   "live-one",
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+	r.False(fm.CancelStream(other.Id, "live-one"))
+
+	// and live ones are dropped once their request ends
+	liveCancel()
+	r.Eventually(func() bool {
+		fm.streamsMut.Lock()
+		defer fm.streamsMut.Unlock()
+		return len(fm.streams) == 0
+	}, time.Second, 10*time.Millisecond)
+	r.False(fm.CancelStream(nil, "live-one"))
+}
+
+func TestCreateHistoryStreamLiveBounds(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+	create(t, 10, "bounds")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	// a reversed live stream would hand off after the lowest sequence and send the feed again
+	for _, sa := range []message.StreamArgs{
+		{Limit: -1, Reverse: true},
+		{Limit: -1, Gt: 3},
+		{Limit: -1, Lt: 5},
+	} {
+		var buf bytes.Buffer
+		err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(&buf), &message.CreateHistArgs{
+			ID:         keyPair.Id,
+			StreamArgs: sa,
+			CommonArgs: message.CommonArgs{Live: true},
+		})
+		r.Error(err, "accepted %+v", sa)
+		r.Empty(readAllPackets(&buf), "sent messages for %+v", sa)
+	}
+
+	// without live, reversed streams send every message once
+	var buf bytes.Buffer
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(&buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1, Reverse: true},
+	})
+	r.NoError(err)
+	seen := make(map[string]bool)
+	for _, pkt := range readAllPackets(&buf) {
+		if pkt.Flag.Get(codec.FlagEndErr) {
+			continue
+		}
+		r.False(seen[string(pkt.Body)], "got a message twice")
+		seen[string(pkt.Body)] = true
+	}
+	r.Len(seen, 10)
+}
+
+func TestCreateHistoryStreamHeadersOnly(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	keyPair, err := repo.DefaultKeyPair(testRepo)
+	r.NoError(err)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	pub, err := message.OpenPublishLog(rootLog, userFeeds, keyPair)
+	r.NoError(err)
+
+	types := []string{"post", "contact", "about"}
+	for i, tipe := range types {
+		_, err := pub.Publish(map[string]interface{}{"type": tipe, "text": fmt.Sprintf("some longer text that is not part of the header #%d", i)})
+		r.NoError(err)
+	}
+	errc := asynctesting.ServeLog(ctx, "userFeeds", rootLog, refresh, false)
+	r.NoError(<-errc)
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	var full = new(bytes.Buffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(full), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+	})
+	r.NoError(err)
+
+	var headers = new(bytes.Buffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(headers), &message.CreateHistArgs{
+		ID:          keyPair.Id,
+		StreamArgs:  message.StreamArgs{Limit: -1},
+		HeadersOnly: true,
+	})
+	r.NoError(err)
+	r.True(headers.Len() < full.Len(), "headers (%d bytes) should be smaller than the messages (%d bytes)", headers.Len(), full.Len())
+
+	var i int
+	for _, pkt := range readAllPackets(headers) {
+		if pkt.Flag.Get(codec.FlagEndErr) {
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		r.NoError(json.Unmarshal(pkt.Body, &fields))
+		r.NotContains(fields, "content")
+		r.NotContains(fields, "signature")
+
+		var hdr message.MessageHeader
+		r.NoError(json.Unmarshal(pkt.Body, &hdr))
+		r.EqualValues(i+1, hdr.Sequence)
+		r.True(hdr.Author.Equal(keyPair.Id))
+		r.NotZero(hdr.Timestamp)
+		r.Equal(types[i], hdr.Type)
+		i++
+	}
+	r.Equal(len(types), i)
+}
+
+func TestCreateHistoryStreamCompressed(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	keyPair, err := repo.DefaultKeyPair(testRepo)
+	r.NoError(err)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	pub, err := message.OpenPublishLog(rootLog, userFeeds, keyPair)
+	r.NoError(err)
+
+	const n = 50
+	for i := 0; i < n; i++ {
+		_, err := pub.Publish(map[string]interface{}{"type": "post", "text": fmt.Sprintf("the same old story, told for the %d. time", i)})
+		r.NoError(err)
+	}
+	errc := asynctesting.ServeLog(ctx, "userFeeds", rootLog, refresh, false)
+	r.NoError(<-errc)
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	var full = new(bytes.Buffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(full), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+	})
+	r.NoError(err)
+
+	var compressed = new(bytes.Buffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(compressed), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		Compress:   CompressGzip,
+	})
+	r.NoError(err)
+	r.True(compressed.Len() < full.Len(), "compressed (%d bytes) should be smaller than the messages (%d bytes)", compressed.Len(), full.Len())
+
+	var want []string
+	for _, pkt := range readAllPackets(full) {
+		if pkt.Flag.Get(codec.FlagEndErr) {
+			continue
+		}
+		want = append(want, string(pkt.Body))
+	}
+	r.Len(want, n)
+
+	var got []string
+	for _, pkt := range readAllPackets(compressed) {
+		if pkt.Flag.Get(codec.FlagEndErr) {
+			continue
+		}
+		msgs, err := DecompressChunk(pkt.Body)
+		r.NoError(err)
+		for _, msg := range msgs {
+			got = append(got, string(msg))
+		}
+	}
+	r.Equal(want, got)
+
+	// unknown algorithms and live streams are rejected
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		Compress:   "zstd",
+	})
+	r.Error(err)
+	r.Contains(err.Error(), "unsupported compression")
+
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+		Compress:   CompressGzip,
+	})
+	r.Error(err)
+}
+
+func TestDecompressChunkLimit(t *testing.T) {
+	r := require.New(t)
+
+	// small messages that add up to more than a chunk can hold
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	msg := bytes.Repeat([]byte("a"), 1024)
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(len(msg)))
+	for written := 0; written <= maxDecompressedChunk; written += n + len(msg) {
+		zw.Write(hdr[:n])
+		zw.Write(msg)
+	}
+	r.NoError(zw.Close())
+
+	_, err := DecompressChunk(zbuf.Bytes())
+	r.Error(err)
+	r.Contains(err.Error(), "chunk is larger")
+}
+
+func TestNonliveLimit(t *testing.T) {
+	tests := []struct {
+		seq, limit, curSeq int64
+		want               int64
+	}{
+		// seq 0 and 1 both end up as index 0
+		{seq: 0, limit: -1, curSeq: 9, want: -1},
+		{seq: 0, limit: 1, curSeq: 9, want: 1},
+		{seq: 0, limit: 5, curSeq: 9, want: 5},
+		{seq: 0, limit: 10, curSeq: 9, want: 10},
+		{seq: 0, limit: 20, curSeq: 9, want: 10},
+		{seq: 0, limit: 3, curSeq: 0, want: 1},
+		// index 5 is feed sequence 6
+		{seq: 5, limit: 3, curSeq: 9, want: 3},
+		{seq: 5, limit: 10, curSeq: 9, want: 5},
+		{seq: 9, limit: 10, curSeq: 9, want: 1},
+	}
+	for _, tc := range tests {
+		arg := &message.CreateHistArgs{
+			Seq:        tc.seq,
+			StreamArgs: message.StreamArgs{Limit: tc.limit},
+		}
+		got := nonliveLimit(arg, tc.curSeq)
+		require.Equal(t, tc.want, got, "seq:%d limit:%d cur:%d", tc.seq, tc.limit, tc.curSeq)
+	}
+}
+
+func TestCreateHistoryStreamFromStart(t *testing.T) {
+	for _, feedLen := range []int{0, 1, 5, 10} {
+		t.Run(fmt.Sprintf("len%d", feedLen), func(t *testing.T) {
+			r := require.New(t)
+			l := testutils.NewRelativeTimeLogger(nil)
+
+			ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+			defer cancel()
+
+			repoPath := filepath.Join("testrun", t.Name())
+			create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+			defer userFeeds.Close()
+
+			create(t, feedLen, "prefill")
+
+			fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+			for _, limit := range []int{1, 3, 5, 10, 20} {
+				for _, seq := range []int64{0, 1} {
+					var buf = new(bytes.Buffer)
+					err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+						ID:         keyPair.Id,
+						Seq:        seq,
+						StreamArgs: message.StreamArgs{Limit: int64(limit)},
+					})
+					r.NoError(err)
+
+					n := limit
+					if n > feedLen {
+						n = feedLen
+					}
+					var want []int64
+					for i := 1; i <= n; i++ {
+						want = append(want, int64(i))
+					}
+					r.Equal(want, readSequences(t, buf), "seq:%d limit:%d", seq, limit)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateHistoryStreamAfterRef(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	keyPair, err := repo.DefaultKeyPair(testRepo)
+	r.NoError(err)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, refresh, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	pub, err := message.OpenPublishLog(rootLog, userFeeds, keyPair)
+	r.NoError(err)
+
+	var published []*refs.MessageRef
+	for i := 0; i < 5; i++ {
+		ref, err := pub.Publish(map[string]interface{}{"type": "test", "i": i})
+		r.NoError(err)
+		published = append(published, ref)
+	}
+	errc := asynctesting.ServeLog(ctx, "userFeeds", rootLog, refresh, false)
+	r.NoError(<-errc)
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	var buf = new(bytes.Buffer)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		AfterRef:   published[2],
+	})
+	r.NoError(err)
+	r.Equal([]int64{4, 5}, readSequences(t, buf))
+
+	// after the latest message there is nothing to send
+	buf.Reset()
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		AfterRef:   published[4],
+	})
+	r.NoError(err)
+	r.Len(readSequences(t, buf), 0)
+
+	// a message that isn't part of the feed
+	unknown, err := refs.ParseMessageRef("%AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=.sha256")
+	r.NoError(err)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		AfterRef:   unknown,
+	})
+	r.Error(err)
+}
+
+func TestCreateHistoryStreamCursor(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	const n = 10
+	create(t, n, "prefill")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	// readPage returns the sequences of a page and the cursor at its end
+	readPage := func(buf *bytes.Buffer) ([]int64, string) {
+		var (
+			seqs   []int64
+			cursor string
+		)
+		for _, pkt := range readAllPackets(buf) {
+			if pkt.Flag.Get(codec.FlagEndErr) {
+				continue
+			}
+			r.Empty(cursor, "got data after the cursor")
+			var val struct {
+				Sequence int64  `json:"sequence"`
+				Cursor   string `json:"cursor"`
+			}
+			r.NoError(json.Unmarshal(pkt.Body, &val))
+			if val.Cursor != "" {
+				cursor = val.Cursor
+				continue
+			}
+			seqs = append(seqs, val.Sequence)
+		}
+		return seqs, cursor
+	}
+
+	var buf = new(bytes.Buffer)
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		Limit:      6,
+		WithCursor: true,
+	})
+	r.NoError(err)
+	first, cursor := readPage(buf)
+	r.Equal([]int64{1, 2, 3, 4, 5, 6}, first)
+	r.NotEmpty(cursor, "no cursor after a full page")
+
+	buf.Reset()
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(buf), &message.CreateHistArgs{
+		Cursor:     cursor,
+		Limit:      6,
+		WithCursor: true,
+	})
+	r.NoError(err)
+	second, cursor := readPage(buf)
+	r.Equal([]int64{7, 8, 9, 10}, second)
+	r.Empty(cursor, "cursor after the last page")
+
+	// both pages together are the whole feed, without overlap or gaps
+	all := append(first, second...)
+	for i, seq := range all {
+		r.EqualValues(i+1, seq)
+	}
+	r.Len(all, n)
+
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		Cursor: "not-a-cursor",
+	})
+	r.Error(err)
+}
+
+func TestFeedManagerDumpState(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	create(t, 3, "prefill")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+	r.Len(fm.DumpState(), 0)
+
+	mkKey := func() *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		return kp.Id
+	}
+	empty := mkKey()
+	bob := mkKey()
+	claire := mkKey()
+
+	// two subscribers of our feed, one of them with a limit
+	err := fm.CreateStreamHistoryFor(ctx, bob, muxrpc.NewTestSink(new(lockedBuffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(lockedBuffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: 10},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+
+	// and one of a feed we don't have messages of
+	err = fm.CreateStreamHistoryFor(ctx, claire, muxrpc.NewTestSink(new(lockedBuffer)), &message.CreateHistArgs{
+		ID:         empty,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+
+	want := []LiveFeedState{
+		{
+			Feed:     keyPair.Id.Ref(),
+			Sequence: 3,
+			Sinks: []LiveSinkState{
+				{Peer: "", Sent: 3, Until: 10},
+				{Peer: bob.Ref(), Sent: 3, Until: math.MaxInt64},
+			},
+		},
+		{
+			Feed:     empty.Ref(),
+			Sequence: 0,
+			Sinks: []LiveSinkState{
+				{Peer: claire.Ref(), Sent: 0, Until: math.MaxInt64},
+			},
+		},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Feed < want[j].Feed })
+	r.Equal(want, fm.DumpState())
+}
+
+func TestFeedManagerDrain(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	create, rootLog, userFeeds, keyPair := loadTestRepo(t, repoPath)
+	defer userFeeds.Close()
+
+	const n = 20
+	create(t, n, "prefill")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	// a live stream that should be closed by the drain
+	liveBuf := new(lockedBuffer)
+	err := fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(liveBuf), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		Seq:        n + 1,
+		StreamArgs: message.StreamArgs{Limit: -1},
+		CommonArgs: message.CommonArgs{Live: true},
+	})
+	r.NoError(err)
+
+	// a slow non-live stream that is still going when the drain starts
+	slow := &slowWriter{delay: 20 * time.Millisecond, started: make(chan struct{})}
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(slow), &message.CreateHistArgs{
+			ID:         keyPair.Id,
+			Seq:        1,
+			StreamArgs: message.StreamArgs{Limit: -1},
+		})
+	}()
+
+	select {
+	case <-slow.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream didn't start")
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer drainCancel()
+	r.NoError(fm.Drain(drainCtx))
+
+	// the stream finished before Drain returned
+	select {
+	case err := <-streamErr:
+		r.NoError(err)
+	default:
+		t.Fatal("drain returned before the stream finished")
+	}
+
+	var want []int64
+	for i := int64(1); i <= n; i++ {
+		want = append(want, i)
+	}
+	r.Equal(want, readSequences(t, slow.copy()), "expected all the messages before the close")
+
+	fm.liveFeedsMut.Lock()
+	r.Len(fm.liveFeeds, 0, "live feeds should be closed")
+	fm.liveFeedsMut.Unlock()
+
+	err = fm.CreateStreamHistory(ctx, muxrpc.NewTestSink(new(bytes.Buffer)), &message.CreateHistArgs{
+		ID:         keyPair.Id,
+		StreamArgs: message.StreamArgs{Limit: -1},
+	})
+	r.True(errors.Is(err, ErrDraining), "expected draining error, got: %v", err)
+}
+
+// slowWriter delays every write and closes started after the first one
+type slowWriter struct {
+	lockedBuffer
+
+	delay   time.Duration
+	once    sync.Once
+	started chan struct{}
+}
+
+func (sw *slowWriter) Write(b []byte) (int, error) {
+	sw.once.Do(func() { close(sw.started) })
+	time.Sleep(sw.delay)
+	return sw.lockedBuffer.Write(b)
+}
+
+// stuckWriter takes accept writes and then blocks until release is closed, like a peer that stopped reading
+type stuckWriter struct {
+	lockedBuffer
+
+	accept  int
+	release chan struct{}
+}
+
+func (sw *stuckWriter) Write(b []byte) (int, error) {
+	sw.mu.Lock()
+	if sw.accept > 0 {
+		sw.accept--
+		sw.mu.Unlock()
+		return sw.lockedBuffer.Write(b)
+	}
+	sw.mu.Unlock()
+	<-sw.release
+	return 0, io.ErrClosedPipe
+}
+
+// droppingWriter fails all writes after drop was called, like a broken connection
+type droppingWriter struct {
+	lockedBuffer
+
+	dropped bool
+}
+
+func (dw *droppingWriter) drop() {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	dw.dropped = true
+}
+
+func (dw *droppingWriter) Write(b []byte) (int, error) {
+	dw.mu.Lock()
+	dropped := dw.dropped
+	dw.mu.Unlock()
+	if dropped {
+		return 0, io.ErrClosedPipe
+	}
+	return dw.lockedBuffer.Write(b)
+}
+
+// countingUserFeeds counts how often a sublog is opened, which every history query does
+type countingUserFeeds struct {
+	multilog.MultiLog
+
+	mu   sync.Mutex
+	gets int
+}
+
+func (c *countingUserFeeds) Get(addr librarian.Addr) (margaret.Log, error) {
+	c.mu.Lock()
+	c.gets++
+	c.mu.Unlock()
+	return c.MultiLog.Get(addr)
+}
+
+func (c *countingUserFeeds) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gets
+}
+
+func (c *countingUserFeeds) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gets = 0
+}
+
+// readSequences returns the sequence fields of all the complete messages in the packet stream
+func readSequences(t *testing.T, r io.Reader) []int64 {
+	var seqs []int64
+	cr := codec.NewReader(r)
+	for {
+		pkt, err := cr.ReadPacket()
+		if err != nil {
+			// io.EOF or a packet that is still being written
+			break
+		}
+		if pkt.Flag.Get(codec.FlagEndErr) {
+			continue
+		}
+		var val struct {
+			Sequence int64 `json:"sequence"`
+		}
+		err = json.Unmarshal(pkt.Body, &val)
+		require.NoError(t, err)
+		seqs = append(seqs, val.Sequence)
+	}
+	return seqs
+}
+
+// lockedBuffer is a bytes.Buffer that can be written to from the live feed while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(b []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(b)
+}
+
+func (lb *lockedBuffer) copy() *bytes.Buffer {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return bytes.NewBuffer(append([]byte(nil), lb.buf.Bytes()...))
+}
+
 func readAllPackets(r io.Reader) []*codec.Packet {
 	var pkts []*codec.Packet
 	cr := codec.NewReader(r)
@@ -225,7 +225,7 @@ func (g *LegacyGossip) HandleCall(
 			// dbgLog.Log("msg", "feed access granted")
 		}
 
-		err = g.feedManager.CreateStreamHistory(ctx, snk, &query)
+		err = g.feedManager.CreateStreamHistoryFor(ctx, remote, snk, &query)
 		if err != nil {
 			if luigi.IsEOS(err) {
 				req.Stream.Close()
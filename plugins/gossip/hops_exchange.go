@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cryptix/go/logging"
+	"go.cryptoscope.co/muxrpc/v2"
+	"go.cryptoscope.co/muxrpc/v2/typemux"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+// exchangeHopsMethod lets pubs ask each other which feeds they replicate on behalf of a feed
+var exchangeHopsMethod = muxrpc.Method{"gossip", "exchangeHops"}
+
+// maxHopSetSize limits how large an encoded hop set read by ReadHopSet may be
+const maxHopSetSize = 16 << 20
+
+// ExchangeHopsArgs are the arguments of gossip.exchangeHops
+type ExchangeHopsArgs struct {
+	// Feed is the feed whose hop set is requested
+	Feed *refs.FeedRef `json:"feed"`
+
+	// Max is the number of hops, it is capped by the answering pub
+	Max int `json:"max"`
+}
+
+// HopsProvider computes the hop sets that are served by gossip.exchangeHops, graph.Builder implements it.
+type HopsProvider interface {
+	Hops(*refs.FeedRef, int) *ssb.StrFeedSet
+}
+
+// NewHopsExchange returns a plugin for gossip.exchangeHops.
+// It answers with a single binary frame holding the hop set of the requested feed, see WriteHopSet.
+// Requests for more than maxHops are answered with the hop set for maxHops.
+// If auth is set, the authorizer of the calling peer has to allow the requested feed, like for SetPeerAuthorizer.
+// Without it, all callers are answered, so it should only be registered on trusted connections.
+func NewHopsExchange(log logging.Interface, hops HopsProvider, maxHops int, auth PeerAuthorizerFunc) ssb.Plugin {
+	mux := typemux.New(log)
+	mux.RegisterSource(exchangeHopsMethod, exchangeHopsSrc{
+		hops:    hops,
+		maxHops: maxHops,
+		auth:    auth,
+	})
+	return hopsExchangePlugin{h: &mux}
+}
+
+type hopsExchangePlugin struct {
+	h muxrpc.Handler
+}
+
+func (hopsExchangePlugin) Name() string { return "exchangeHops" }
+
+func (hopsExchangePlugin) Method() muxrpc.Method { return exchangeHopsMethod }
+
+func (p hopsExchangePlugin) Handler() muxrpc.Handler { return p.h }
+
+type exchangeHopsSrc struct {
+	hops    HopsProvider
+	maxHops int
+	auth    PeerAuthorizerFunc
+}
+
+func (h exchangeHopsSrc) HandleSource(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+	var args []ExchangeHopsArgs
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+		return fmt.Errorf("exchangeHops: invalid arguments: %w", err)
+	}
+	if len(args) != 1 || args[0].Feed == nil {
+		return errors.New("exchangeHops: expected one argument with a feed")
+	}
+
+	if h.auth != nil {
+		peer, err := ssb.GetFeedRefFromAddr(req.RemoteAddr())
+		if err != nil {
+			return fmt.Errorf("exchangeHops: failed to get the calling peer: %w", err)
+		}
+		if err := h.auth(peer).Authorize(args[0].Feed); err != nil {
+			return fmt.Errorf("exchangeHops: %s may not request %s: %w", peer.ShortRef(), args[0].Feed.ShortRef(), err)
+		}
+	}
+
+	max := args[0].Max
+	if max > h.maxHops {
+		max = h.maxHops
+	}
+
+	set := h.hops.Hops(args[0].Feed, max)
+	if set == nil {
+		return fmt.Errorf("exchangeHops: no hops for %s", args[0].Feed.ShortRef())
+	}
+
+	snk.SetEncoding(muxrpc.TypeBinary)
+	if err := WriteHopSet(snk, set); err != nil {
+		return fmt.Errorf("exchangeHops: failed to send hop set: %w", err)
+	}
+	return snk.Close()
+}
+
+// WriteHopSet writes set with a single call to w, encoded by its MarshalBinary and prefixed with the length of that as an uvarint.
+func WriteHopSet(w io.Writer, set *ssb.StrFeedSet) error {
+	data, err := set.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+
+	frame := make([]byte, 0, n+len(data))
+	frame = append(frame, lenBuf[:n]...)
+	frame = append(frame, data...)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadHopSet reads a hop set that was written by WriteHopSet.
+func ReadHopSet(r io.Reader) (*ssb.StrFeedSet, error) {
+	br := bufio.NewReader(r)
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("hop set: failed to read length: %w", err)
+	}
+	if size > maxHopSetSize {
+		return nil, fmt.Errorf("hop set: %d bytes are too many", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, fmt.Errorf("hop set: failed to read %d bytes: %w", size, err)
+	}
+
+	set := ssb.NewFeedSet(0)
+	if err := set.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("hop set: %w", err)
+	}
+	return set, nil
+}
+
+// FetchHops asks the pub behind edp for its hop set of feed, see NewHopsExchange.
+func FetchHops(ctx context.Context, edp muxrpc.Endpoint, feed *refs.FeedRef, max int) (*ssb.StrFeedSet, error) {
+	src, err := edp.Source(ctx, muxrpc.TypeBinary, exchangeHopsMethod, ExchangeHopsArgs{Feed: feed, Max: max})
+	if err != nil {
+		return nil, fmt.Errorf("exchangeHops(%s): failed to create source: %w", feed.ShortRef(), err)
+	}
+
+	if !src.Next(ctx) {
+		if err := src.Err(); err != nil {
+			return nil, fmt.Errorf("exchangeHops(%s): %w", feed.ShortRef(), err)
+		}
+		return nil, fmt.Errorf("exchangeHops(%s): stream ended without a hop set", feed.ShortRef())
+	}
+
+	var set *ssb.StrFeedSet
+	err = src.Reader(func(r io.Reader) error {
+		var err error
+		set, err = ReadHopSet(r)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("exchangeHops(%s): %w", feed.ShortRef(), err)
+	}
+	return set, nil
+}
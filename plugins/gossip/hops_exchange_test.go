@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/muxrpc/v2"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+// fixedHops returns the same set for every feed and remembers the requested hops
+type fixedHops struct {
+	set       *ssb.StrFeedSet
+	requested int
+}
+
+func (fh *fixedHops) Hops(_ *refs.FeedRef, hops int) *ssb.StrFeedSet {
+	fh.requested = hops
+	return fh.set
+}
+
+func TestHopSetOverPipe(t *testing.T) {
+	r := require.New(t)
+
+	set := ssb.NewFeedSet(10)
+	for i := byte(0); i < 10; i++ {
+		kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{i}, 32)))
+		r.NoError(err)
+		r.NoError(set.AddRef(kp.Id))
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- WriteHopSet(server, set)
+		server.Close()
+	}()
+
+	got, err := ReadHopSet(client)
+	r.NoError(err)
+	r.NoError(<-errc)
+
+	want, err := set.List()
+	r.NoError(err)
+	r.Equal(set.Count(), got.Count())
+	for _, feed := range want {
+		r.True(got.Has(feed), "missing %s", feed.ShortRef())
+	}
+
+	// truncated frames are rejected
+	var buf bytes.Buffer
+	r.NoError(WriteHopSet(&buf, set))
+	_, err = ReadHopSet(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	r.Error(err)
+}
+
+func TestExchangeHopsHandler(t *testing.T) {
+	r := require.New(t)
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+	set := ssb.NewFeedSet(1)
+	r.NoError(set.AddRef(kp.Id))
+
+	provider := &fixedHops{set: set}
+	h := exchangeHopsSrc{hops: provider, maxHops: 2}
+
+	args := fmt.Sprintf(`[{"feed": %q, "max": 5}]`, kp.Id.Ref())
+	var buf bytes.Buffer
+	err = h.HandleSource(context.Background(), &muxrpc.Request{RawArgs: json.RawMessage(args)}, muxrpc.NewTestSink(&buf))
+	r.NoError(err)
+	r.Equal(2, provider.requested, "expected the hops to be capped")
+
+	pkts := readAllPackets(&buf)
+	r.NotEmpty(pkts)
+	got, err := ReadHopSet(bytes.NewReader(pkts[0].Body))
+	r.NoError(err)
+	r.Equal(1, got.Count())
+	r.True(got.Has(kp.Id))
+
+	// a feed is required
+	err = h.HandleSource(context.Background(), &muxrpc.Request{RawArgs: json.RawMessage(`[{"max": 1}]`)}, muxrpc.NewTestSink(new(bytes.Buffer)))
+	r.Error(err)
+
+	// with an authorizer, callers that aren't known are refused
+	h.auth = func(*refs.FeedRef) ssb.Authorizer {
+		r.Fail("authorizer asked without a peer")
+		return nil
+	}
+	provider.requested = 0
+	err = h.HandleSource(context.Background(), &muxrpc.Request{RawArgs: json.RawMessage(args)}, muxrpc.NewTestSink(new(bytes.Buffer)))
+	r.Error(err)
+	r.Equal(0, provider.requested)
+}
@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.cryptoscope.co/luigi"
+)
+
+// ErrIdleTimeout is returned by CreateStreamHistory if the peer didn't take a message for too long, see SetIdleTimeout.
+var ErrIdleTimeout = errors.New("gossip: stream idle timeout")
+
+// SetIdleTimeout aborts the stored portion of createHistoryStream requests if no message could be sent for d.
+// The stream is closed with ErrIdleTimeout, so that stuck or dead peers don't hold on to the query. Zero, the default, disables it.
+func (m *FeedManager) SetIdleTimeout(d time.Duration) {
+	m.idleMut.Lock()
+	defer m.idleMut.Unlock()
+	m.idleTimeout = d
+}
+
+func (m *FeedManager) getIdleTimeout() time.Duration {
+	m.idleMut.Lock()
+	defer m.idleMut.Unlock()
+	return m.idleTimeout
+}
+
+// idleSink passes messages on to next and calls onIdle once if none of them went through for timeout.
+// The timer starts when it is created and is reset after every message that was poured.
+type idleSink struct {
+	next    luigi.Sink
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu    sync.Mutex
+	fired bool
+}
+
+func newIdleSink(next luigi.Sink, timeout time.Duration, onIdle func()) *idleSink {
+	is := &idleSink{next: next, timeout: timeout}
+	is.timer = time.AfterFunc(timeout, func() {
+		is.mu.Lock()
+		is.fired = true
+		is.mu.Unlock()
+		onIdle()
+	})
+	return is
+}
+
+func (is *idleSink) Pour(ctx context.Context, v interface{}) error {
+	if is.timedOut() {
+		return ErrIdleTimeout
+	}
+	if err := is.next.Pour(ctx, v); err != nil {
+		return err
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	if is.fired {
+		return ErrIdleTimeout
+	}
+	is.timer.Reset(is.timeout)
+	return nil
+}
+
+func (is *idleSink) Close() error {
+	is.stop()
+	return is.next.Close()
+}
+
+// stop disarms the timer, for instance once the stored messages were sent and the stream goes live.
+func (is *idleSink) stop() {
+	is.timer.Stop()
+}
+
+func (is *idleSink) timedOut() bool {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.fired
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"runtime"
+	"sync"
+
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb/internal/luigiutils"
+)
+
+// liveQuantum is the number of messages a live feed sends before it lets the other feeds go first.
+const liveQuantum = 16
+
+// maxLivePending is the number of messages that can wait to be sent on a live feed.
+// If its subscribers fall further behind than that, their streams are closed and they have to ask again.
+const maxLivePending = 4096
+
+// liveQueue passes the messages of one live feed on to its subscribers from a goroutine of its own,
+// so that a busy feed or slow subscribers don't hold up the messages of the other feeds.
+// pour only queues the messages and the goroutine sends at most liveQuantum of them per turn.
+type liveQueue struct {
+	sink *luigiutils.MultiSink
+
+	mu      sync.Mutex
+	pending []queuedMessage
+	stopped bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type queuedMessage struct {
+	seq int64
+	msg []byte
+	val refs.Message
+}
+
+func newLiveQueue(sink *luigiutils.MultiSink) *liveQueue {
+	q := &liveQueue{
+		sink: sink,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues msg for the subscribers. It returns false if too many messages are waiting already.
+func (q *liveQueue) push(msg refs.Message) bool {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return true
+	}
+	if len(q.pending) >= maxLivePending {
+		q.mu.Unlock()
+		return false
+	}
+	q.pending = append(q.pending, queuedMessage{seq: msg.Seq(), msg: msg.ValueContentJSON(), val: msg})
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// take removes up to n messages from the front of the queue.
+func (q *liveQueue) take(n int) []queuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+	batch := make([]queuedMessage, n)
+	copy(batch, q.pending)
+	q.pending = q.pending[n:]
+	if len(q.pending) == 0 {
+		// don't hold on to the old backing array
+		q.pending = nil
+	}
+	return batch
+}
+
+// depth returns the number of messages that wait to be sent.
+func (q *liveQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *liveQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		}
+
+		for {
+			batch := q.take(liveQuantum)
+			if len(batch) == 0 {
+				break
+			}
+			for _, qm := range batch {
+				q.sink.SendValue(qm.seq, qm.msg, qm.val)
+			}
+
+			select {
+			case <-q.stop:
+				return
+			default:
+			}
+			// let the other feeds have a turn
+			runtime.Gosched()
+		}
+	}
+}
+
+// close stops the goroutine and drops the messages that are still waiting. It doesn't wait for a send that is in progress.
+func (q *liveQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+	q.pending = nil
+	close(q.stop)
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import "sort"
+
+// LiveFeedState is a snapshot of one live feed, see DumpState.
+type LiveFeedState struct {
+	// Feed is the ref of the feed
+	Feed string
+
+	// Sequence is the latest message that was passed to the subscribers
+	Sequence int64
+
+	// Pending is the number of messages that wait to be sent to the subscribers
+	Pending int
+
+	// Parked is the number of subscribers that wait to be resumed after their connection broke
+	Parked uint
+
+	Sinks []LiveSinkState
+}
+
+// LiveSinkState is one subscriber of a live feed.
+type LiveSinkState struct {
+	// Peer is the ref of the peer that asked for the feed, empty if it isn't known
+	Peer string
+
+	// Sent is the latest message the subscriber got
+	Sent int64
+
+	// Until is the last message it wants, math.MaxInt64 if there is no limit
+	Until int64
+}
+
+// DumpState returns the state of the live feeds, sorted by feed.
+// It's meant for logging and debugging, for instance if a peer doesn't get new messages.
+// The sinks are read from their snapshots, so that a feed that is stuck writing doesn't block it.
+func (m *FeedManager) DumpState() []LiveFeedState {
+	m.liveFeedsMut.Lock()
+	defer m.liveFeedsMut.Unlock()
+
+	states := make([]LiveFeedState, 0, len(m.liveFeeds))
+	for ref, liveFeed := range m.liveFeeds {
+		seq, sinks, parked := liveFeed.Snapshot()
+		state := LiveFeedState{
+			Feed:     ref,
+			Sequence: seq,
+			Parked:   parked,
+		}
+		if q, has := m.liveQueues[ref]; has {
+			state.Pending = q.depth()
+		}
+		for _, s := range sinks {
+			state.Sinks = append(state.Sinks, LiveSinkState{
+				Peer:  s.Peer,
+				Sent:  s.Sent,
+				Until: s.Until,
+			})
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Feed < states[j].Feed
+	})
+	return states
+}
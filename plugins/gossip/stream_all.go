@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cryptix/go/logging"
+	"go.cryptoscope.co/luigi"
+	"go.cryptoscope.co/luigi/mfr"
+	"go.cryptoscope.co/margaret"
+	"go.cryptoscope.co/muxrpc/v2"
+	"go.cryptoscope.co/muxrpc/v2/typemux"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/transform"
+)
+
+// streamAllMethod streams the messages of all feeds in the order of the receive log
+var streamAllMethod = muxrpc.Method{"gossip", "streamAll"}
+
+// StreamAllArgs are the arguments of gossip.streamAll
+type StreamAllArgs struct {
+	// FromSeq is the sequence of the receive log to start at
+	FromSeq int64 `json:"fromSeq"`
+
+	// Types optionally limits the stream to messages with one of these content types
+	Types []string `json:"types,omitempty"`
+
+	// Live keeps the stream open for new messages
+	Live bool `json:"live,omitempty"`
+}
+
+// StreamAll sends the messages of all feeds from the receive log on sink, starting at arg.FromSeq.
+// Every message is wrapped with its key and its sequence in the receive log, so that consumers can continue where they left off.
+// Nulled entries are skipped and the content transform applies, see SetContentTransform.
+func (m *FeedManager) StreamAll(ctx context.Context, sink *muxrpc.ByteSink, arg StreamAllArgs) error {
+	if arg.FromSeq < 0 {
+		return fmt.Errorf("streamAll: invalid sequence %d", arg.FromSeq)
+	}
+
+	src, err := m.ReceiveLog.Query(
+		margaret.Gte(margaret.BaseSeq(arg.FromSeq)),
+		margaret.Live(arg.Live),
+		margaret.SeqWrap(true),
+	)
+	if err != nil {
+		return fmt.Errorf("streamAll: invalid receive log query: %w", err)
+	}
+
+	snk := transform.NewKeyValueWrapper(sink, true)
+	if fn := m.getContentTransform(); fn != nil {
+		snk = mfr.SinkMap(snk, contentTransformMap(fn))
+	}
+	if len(arg.Types) > 0 {
+		snk = mfr.SinkFilter(snk, contentTypeFilter(arg.Types))
+	}
+
+	err = luigi.Pump(ctx, snk, src)
+	if errors.Is(err, context.Canceled) || muxrpc.IsSinkClosed(err) {
+		sink.Close()
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("streamAll: failed to pump messages: %w", err)
+	}
+	return sink.Close()
+}
+
+// NewStreamAll returns a plugin for gossip.streamAll, see FeedManager.StreamAll.
+func NewStreamAll(log logging.Interface, fm *FeedManager) ssb.Plugin {
+	mux := typemux.New(log)
+	mux.RegisterSource(streamAllMethod, streamAllSrc{fm: fm})
+	return streamAllPlugin{h: &mux}
+}
+
+type streamAllPlugin struct {
+	h muxrpc.Handler
+}
+
+func (streamAllPlugin) Name() string { return "streamAll" }
+
+func (streamAllPlugin) Method() muxrpc.Method { return streamAllMethod }
+
+func (p streamAllPlugin) Handler() muxrpc.Handler { return p.h }
+
+type streamAllSrc struct {
+	fm *FeedManager
+}
+
+func (h streamAllSrc) HandleSource(ctx context.Context, req *muxrpc.Request, snk *muxrpc.ByteSink) error {
+	var args []StreamAllArgs
+	if err := json.Unmarshal(req.RawArgs, &args); err != nil {
+		return fmt.Errorf("streamAll: invalid arguments: %w", err)
+	}
+
+	var arg StreamAllArgs
+	if len(args) == 1 {
+		arg = args[0]
+	} else if len(args) > 1 {
+		return errors.New("streamAll: expected at most one argument")
+	}
+	return h.fm.StreamAll(ctx, snk, arg)
+}
@@ -0,0 +1,135 @@
+// SPDX-License-Identifier: MIT
+
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/require"
+	"go.cryptoscope.co/muxrpc/v2"
+	"go.cryptoscope.co/muxrpc/v2/codec"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/ctxutils"
+	"go.cryptoscope.co/ssb/internal/testutils"
+	"go.cryptoscope.co/ssb/message"
+	"go.cryptoscope.co/ssb/multilogs"
+	"go.cryptoscope.co/ssb/repo"
+)
+
+func TestStreamAll(t *testing.T) {
+	r := require.New(t)
+	l := testutils.NewRelativeTimeLogger(nil)
+
+	ctx, cancel := ctxutils.WithError(context.Background(), ssb.ErrShuttingDown)
+	defer cancel()
+
+	repoPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(repoPath)
+	testRepo := repo.New(repoPath)
+
+	rootLog, err := repo.OpenLog(testRepo)
+	r.NoError(err)
+
+	userFeeds, _, err := multilogs.OpenUserFeeds(testRepo)
+	r.NoError(err)
+	defer userFeeds.Close()
+
+	mkPublisher := func() (ssb.Publisher, *refs.FeedRef) {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		pub, err := message.OpenPublishLog(rootLog, userFeeds, kp)
+		r.NoError(err)
+		return pub, kp.Id
+	}
+	alice, aliceRef := mkPublisher()
+	bob, bobRef := mkPublisher()
+
+	var wantAuthors []*refs.FeedRef
+	publish := func(pub ssb.Publisher, author *refs.FeedRef, tipe string) {
+		_, err := pub.Publish(map[string]interface{}{"type": tipe})
+		r.NoError(err)
+		wantAuthors = append(wantAuthors, author)
+	}
+	publish(alice, aliceRef, "post")
+	publish(bob, bobRef, "post")
+	publish(alice, aliceRef, "contact")
+	publish(bob, bobRef, "post")
+	publish(alice, aliceRef, "post")
+
+	fm := NewFeedManager(ctx, rootLog, userFeeds, log.With(l, "bot", "alice"), nil, nil)
+
+	type entry struct {
+		Seq   int64 `json:"seq"`
+		Value struct {
+			Key   string `json:"key"`
+			Value struct {
+				Author  *refs.FeedRef `json:"author"`
+				Content struct {
+					Type string `json:"type"`
+				} `json:"content"`
+			} `json:"value"`
+		} `json:"value"`
+	}
+	read := func(buf *lockedBuffer) []entry {
+		var entries []entry
+		for _, pkt := range readAllPackets(buf.copy()) {
+			if pkt.Flag.Get(codec.FlagEndErr) {
+				continue
+			}
+			var e entry
+			r.NoError(json.Unmarshal(pkt.Body, &e))
+			entries = append(entries, e)
+		}
+		return entries
+	}
+
+	buf := new(lockedBuffer)
+	err = fm.StreamAll(ctx, muxrpc.NewTestSink(buf), StreamAllArgs{})
+	r.NoError(err)
+
+	all := read(buf)
+	r.Len(all, len(wantAuthors))
+	for i, e := range all {
+		r.EqualValues(i, e.Seq, "not in log order")
+		r.True(wantAuthors[i].Equal(e.Value.Value.Author), "wrong author at %d", i)
+	}
+
+	buf = new(lockedBuffer)
+	err = fm.StreamAll(ctx, muxrpc.NewTestSink(buf), StreamAllArgs{FromSeq: 1, Types: []string{"post"}})
+	r.NoError(err)
+
+	var seqs []int64
+	for _, e := range read(buf) {
+		r.Equal("post", e.Value.Value.Content.Type)
+		seqs = append(seqs, e.Seq)
+	}
+	r.Equal([]int64{1, 3, 4}, seqs)
+
+	// live streams get the new messages, too
+	liveCtx, liveCancel := context.WithCancel(ctx)
+	buf = new(lockedBuffer)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fm.StreamAll(liveCtx, muxrpc.NewTestSink(buf), StreamAllArgs{FromSeq: 4, Live: true})
+	}()
+
+	publish(bob, bobRef, "post")
+	r.Eventually(func() bool {
+		return len(read(buf)) == 2
+	}, 5*time.Second, 50*time.Millisecond, "didn't get the live message")
+
+	live := read(buf)
+	r.EqualValues(5, live[1].Seq)
+	r.True(bobRef.Equal(live[1].Value.Value.Author))
+
+	liveCancel()
+	r.NoError(<-errc)
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"context"
+	"fmt"
+
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb/internal/mutil"
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+)
+
+// FollowDiagnosis tells how far a follow made it, from the published message to the replication set. See DiagnoseFollow.
+type FollowDiagnosis struct {
+	// Published is true if the feed has a contact message about the target
+	Published bool
+
+	// Message and Sequence are the ones of the latest contact message about the target
+	Message  *refs.MessageRef
+	Sequence int64
+
+	// LatestIsFollow is true if that message is a follow, and not an unfollow or a block
+	LatestIsFollow bool
+
+	// Indexed is true if the graph has the follow
+	Indexed bool
+
+	// InFollows and InHops are true if the target is part of Follows and Hops
+	InFollows bool
+	InHops    bool
+}
+
+// the steps of a follow that FollowDiagnosis.Gap returns
+const (
+	FollowGapNotPublished = "not published"
+	FollowGapNotLatest    = "replaced by a later contact message"
+	FollowGapNotIndexed   = "not indexed"
+	FollowGapNotInFollows = "not in follows"
+	FollowGapNotInHops    = "not in hops"
+)
+
+// Gap returns the first step the follow didn't make, or an empty string if it made all of them.
+func (fd FollowDiagnosis) Gap() string {
+	switch {
+	case !fd.Published:
+		return FollowGapNotPublished
+	case !fd.LatestIsFollow:
+		return FollowGapNotLatest
+	case !fd.Indexed:
+		return FollowGapNotIndexed
+	case !fd.InFollows:
+		return FollowGapNotInFollows
+	case !fd.InHops:
+		return FollowGapNotInHops
+	}
+	return ""
+}
+
+// DiagnoseFollow checks why me doesn't (or does) follow target: if me published a follow for target,
+// if that is still the latest contact message about it, if the graph has the edge and if target is part of Follows and Hops.
+func (s *Sbot) DiagnoseFollow(me, target *refs.FeedRef) (FollowDiagnosis, error) {
+	var fd FollowDiagnosis
+
+	latest, err := s.latestContact(s.rootCtx, me, target)
+	if err != nil {
+		return fd, fmt.Errorf("diagnose follow: %w", err)
+	}
+	if latest != nil {
+		fd.Published = true
+		fd.Message = latest.Key()
+		fd.Sequence = latest.Seq()
+
+		var c refs.Contact
+		if err := c.UnmarshalJSON(latest.ContentBytes()); err == nil {
+			fd.LatestIsFollow = c.Following && !c.Blocking
+		}
+	}
+
+	g, err := s.GraphBuilder.Build()
+	if err != nil {
+		return fd, fmt.Errorf("diagnose follow: failed to build graph: %w", err)
+	}
+	fd.Indexed = g.Follows(me, target)
+
+	follows, err := s.GraphBuilder.Follows(me)
+	if err != nil {
+		return fd, fmt.Errorf("diagnose follow: failed to get follows: %w", err)
+	}
+	fd.InFollows = follows.Has(target)
+
+	hops := s.GraphBuilder.Hops(me, int(s.hopCount))
+	if hops == nil {
+		return fd, fmt.Errorf("diagnose follow: failed to get hops")
+	}
+	fd.InHops = hops.Has(target)
+
+	return fd, nil
+}
+
+// latestContact reads the feed of who backwards until it finds a contact message about target. It returns nil if there is none.
+func (s *Sbot) latestContact(ctx context.Context, who, target *refs.FeedRef) (refs.Message, error) {
+	userLog, err := s.Users.Get(storedrefs.Feed(who))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sublog of %s: %w", who.ShortRef(), err)
+	}
+
+	return mutil.FindLatest(ctx, s.ReceiveLog, userLog, func(msg refs.Message) bool {
+		var c refs.Contact
+		if err := c.UnmarshalJSON(msg.ContentBytes()); err != nil {
+			// not a (valid) contact message
+			return false
+		}
+		return c.Contact.Equal(target)
+	})
+}
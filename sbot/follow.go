@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"fmt"
+
+	refs "go.mindeco.de/ssb-refs"
+)
+
+// FollowAll publishes a follow message for each of the feeds, one after the other, and returns their references.
+// Feeds that are already followed or that appear more than once are skipped, so the result can be shorter than feeds.
+// If publishing fails, the references of the messages that were published before are returned with the error.
+func (s *Sbot) FollowAll(feeds []*refs.FeedRef) ([]*refs.MessageRef, error) {
+	following, err := s.GraphBuilder.Follows(s.KeyPair.Id)
+	if err != nil {
+		return nil, fmt.Errorf("follow all: failed to get current follows: %w", err)
+	}
+
+	var published []*refs.MessageRef
+	for _, feed := range feeds {
+		if following.Has(feed) {
+			continue
+		}
+
+		ref, err := s.PublishLog.Publish(refs.NewContactFollow(feed))
+		if err != nil {
+			return published, fmt.Errorf("follow all: failed to publish follow for %s: %w", feed.ShortRef(), err)
+		}
+		published = append(published, ref)
+
+		if err := following.AddRef(feed); err != nil {
+			return published, err
+		}
+	}
+	return published, nil
+}
@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+func TestFollowAll(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+
+	var feeds []*refs.FeedRef
+	for i := 0; i < 5; i++ {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		feeds = append(feeds, kp.Id)
+	}
+
+	// the first two are already followed
+	for _, f := range feeds[:2] {
+		_, err := theBot.PublishLog.Publish(refs.NewContactFollow(f))
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		following, err := theBot.GraphBuilder.Follows(theBot.KeyPair.Id)
+		return err == nil && following.Count() == 2
+	}, 5*time.Second, 50*time.Millisecond, "follows weren't indexed")
+
+	// one of the new ones is listed twice
+	published, err := theBot.FollowAll(append(feeds, feeds[3]))
+	r.NoError(err)
+	r.Len(published, 3)
+
+	r.Eventually(func() bool {
+		note, err := theBot.CurrentSequence(theBot.KeyPair.Id)
+		return err == nil && note.Seq == 5
+	}, 5*time.Second, 50*time.Millisecond, "new messages weren't indexed")
+
+	for i, ref := range published {
+		r.Eventually(func() bool {
+			_, err := theBot.Get(*ref)
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond, "message %d wasn't indexed", i)
+
+		msg, err := theBot.Get(*ref)
+		r.NoError(err)
+		r.EqualValues(i+3, msg.Seq(), "wrong sequence")
+
+		var c refs.Contact
+		r.NoError(json.Unmarshal(msg.ContentBytes(), &c))
+		r.True(c.Following)
+		r.True(c.Contact.Equal(feeds[i+2]))
+	}
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
+
+func TestDiagnoseFollow(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+	me := theBot.KeyPair.Id
+
+	kp, err := ssb.NewKeyPair(nil)
+	r.NoError(err)
+	target := kp.Id
+
+	diag, err := theBot.DiagnoseFollow(me, target)
+	r.NoError(err)
+	r.Equal(FollowGapNotPublished, diag.Gap())
+
+	ref, err := theBot.PublishLog.Publish(refs.NewContactFollow(target))
+	r.NoError(err)
+	r.Eventually(func() bool {
+		diag, err = theBot.DiagnoseFollow(me, target)
+		return err == nil && diag.Gap() == ""
+	}, 5*time.Second, 50*time.Millisecond, "follow wasn't indexed: %+v", diag)
+	r.True(ref.Equal(diag.Message))
+	r.EqualValues(1, diag.Sequence)
+
+	// the message is there but the index lost the edge
+	r.NoError(theBot.GraphBuilder.DeleteAuthor(me))
+	diag, err = theBot.DiagnoseFollow(me, target)
+	r.NoError(err)
+	r.True(diag.Published)
+	r.True(diag.LatestIsFollow)
+	r.False(diag.Indexed)
+	r.False(diag.InFollows)
+	r.Equal(FollowGapNotIndexed, diag.Gap())
+
+	_, err = theBot.PublishLog.Publish(refs.NewContactBlock(target))
+	r.NoError(err)
+	r.Eventually(func() bool {
+		diag, err = theBot.DiagnoseFollow(me, target)
+		return err == nil && diag.Sequence == 2
+	}, 5*time.Second, 50*time.Millisecond, "block wasn't indexed: %+v", diag)
+	r.Equal(FollowGapNotLatest, diag.Gap())
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
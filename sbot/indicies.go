@@ -17,6 +17,7 @@ import (
 	"go.cryptoscope.co/margaret"
 	"go.cryptoscope.co/margaret/multilog"
 	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/graph"
 	"go.cryptoscope.co/ssb/plugins2"
 	"go.cryptoscope.co/ssb/repo"
 )
@@ -177,7 +178,7 @@ func (s *Sbot) serveIndexFrom(name string, snk librarian.SinkIndex, msgs margare
 
 		err = luigi.Pump(s.rootCtx, &ps, src)
 		cancel()
-		if errors.Is(err, ssb.ErrShuttingDown) || errors.Is(err, context.Canceled) {
+		if indexStopped(err) {
 			return nil
 		}
 		if err != nil {
@@ -203,7 +204,7 @@ func (s *Sbot) serveIndexFrom(name string, snk librarian.SinkIndex, msgs margare
 		s.indexStateMu.Unlock()
 
 		err = luigi.Pump(s.rootCtx, snk, src)
-		if errors.Is(err, ssb.ErrShuttingDown) || errors.Is(err, context.Canceled) {
+		if indexStopped(err) {
 			return nil
 		}
 		if err != nil {
@@ -217,6 +218,12 @@ func (s *Sbot) serveIndexFrom(name string, snk librarian.SinkIndex, msgs margare
 	})
 }
 
+// indexStopped tells if err only means that the bot is shutting down.
+// The contact index refuses updates once the graph builder is closed, which isn't a failure either.
+func indexStopped(err error) bool {
+	return errors.Is(err, ssb.ErrShuttingDown) || errors.Is(err, context.Canceled) || errors.Is(err, graph.ErrClosed)
+}
+
 type progressSink struct {
 	erred error
 
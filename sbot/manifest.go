@@ -105,7 +105,9 @@ const manifestBlob manifestHandler = `
 	
 	"gossip": {
 	  "connect": "async",
-	  "ping": "duplex"
+	  "ping": "duplex",
+	  "exchangeHops": "source",
+	  "streamAll": "source"
 	},
 
 	"replicate": {
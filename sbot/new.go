@@ -331,12 +331,14 @@ func initSbot(s *Sbot) (*Sbot, error) {
 			return nil, fmt.Errorf("sbot: NewLogBuilder failed: %w", err)
 		}
 	} else {
-		gb, seqSetter, updateIdx, err := indexes.OpenContacts(kitlog.With(log, "module", "graph"), r)
+		gb, seqSetter, updateIdx, err := indexes.OpenContacts(kitlog.With(log, "module", "graph"), r, s.eventCounter)
 		if err != nil {
 			return nil, fmt.Errorf("sbot: OpenContacts failed: %w", err)
 		}
 
 		s.serveIndexFrom("contacts", updateIdx, justContacts)
+		// the builder syncs the contacts before the index closes the database
+		s.closers.AddCloser(gb)
 		s.closers.AddCloser(seqSetter)
 		s.GraphBuilder = gb
 	}
@@ -468,6 +470,9 @@ func initSbot(s *Sbot) (*Sbot, error) {
 		if err == nil {
 			return s.public.MakeHandler(conn)
 		}
+		if hinted, blocked := s.blockedRetryHint(remote, err); blocked {
+			return nil, hinted
+		}
 
 		// shit - don't see a way to pass being a different feedtype with shs1
 		// we also need to pass this up the stack...!
@@ -524,6 +529,15 @@ func initSbot(s *Sbot) (*Sbot, error) {
 		s.systemGauge,
 		s.eventCounter,
 	)
+	fm.SetResumeGrace(s.liveResumeGrace)
+	s.closers.AddCloser(fm)
+	fm.SetMaxLiveFeeds(s.maxLiveFeeds)
+	fm.SetIdleTimeout(s.streamIdle)
+	var peerAuth gossip.PeerAuthorizerFunc
+	if s.peerHops >= 0 {
+		peerAuth = newPeerAuthorizers(s.GraphBuilder, s.peerHops).get
+		fm.SetPeerAuthorizer(peerAuth)
+	}
 
 	// outgoing gossip behavior
 	var histOpts = []interface{}{
@@ -547,6 +561,13 @@ func initSbot(s *Sbot) (*Sbot, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.verifyCheckpoints > 0 {
+		checkpoints, err := message.NewFileCheckpointStore(r.GetPath("verify-checkpoints"))
+		if err != nil {
+			return nil, fmt.Errorf("sbot: failed to open verify checkpoints: %w", err)
+		}
+		verifySink.UseCheckpoints(checkpoints, s.verifyCheckpoints)
+	}
 
 	if s.disableLegacyLiveReplication {
 		histOpts = append(histOpts, gossip.WithLive(!s.disableLegacyLiveReplication))
@@ -573,6 +594,7 @@ func initSbot(s *Sbot) (*Sbot, error) {
 			sm,
 			verifySink,
 		)
+		ebtPlug.SetRanker(s.GraphBuilder)
 		s.public.Register(ebtPlug)
 
 		rn := negPlugin{replicateNegotiator{
@@ -594,6 +616,22 @@ func initSbot(s *Sbot) (*Sbot, error) {
 		histOpts...)
 	s.public.Register(hist)
 
+	// lets other pubs ask which feeds we replicate for a feed, only local clients can ask without a peer authorizer
+	hopsExchange := gossip.NewHopsExchange(
+		kitlog.With(log, "unit", "gossip/hops"),
+		s.GraphBuilder,
+		int(s.hopCount),
+		peerAuth,
+	)
+	if peerAuth != nil {
+		s.public.Register(hopsExchange)
+	} else {
+		s.master.Register(hopsExchange)
+	}
+
+	// firehose of all the messages for local indexers
+	s.master.Register(gossip.NewStreamAll(kitlog.With(log, "unit", "gossip/all"), fm))
+
 	// get idx muxrpc handler
 	s.master.Register(get.New(s, s.ReceiveLog, s.Groups))
 
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cryptix/go/logging"
 	kitlog "github.com/go-kit/kit/log"
@@ -33,6 +34,7 @@ import (
 	"go.cryptoscope.co/ssb/internal/statematrix"
 	"go.cryptoscope.co/ssb/message/multimsg"
 	"go.cryptoscope.co/ssb/network"
+	"go.cryptoscope.co/ssb/plugins/gossip"
 	"go.cryptoscope.co/ssb/private"
 	"go.cryptoscope.co/ssb/repo"
 )
@@ -62,6 +64,16 @@ type Sbot struct {
 	promisc  bool
 	hopCount uint
 
+	liveResumeGrace time.Duration
+	maxLiveFeeds    int
+	streamIdle      time.Duration
+
+	// peerHops scopes the served feeds to the hops of the requesting peer, if it isn't negative
+	peerHops int
+
+	// verifyCheckpoints is the interval of the verify sink checkpoints, zero disables them
+	verifyCheckpoints int
+
 	disableEBT                   bool
 	disableLegacyLiveReplication bool
 
@@ -81,6 +93,9 @@ type Sbot struct {
 
 	authorizer ssb.Authorizer
 
+	// blockedRetry is the retry hint for connections of blocked peers, see WithBlockedRetryAfter
+	blockedRetry time.Duration
+
 	enableAdverts   bool
 	enableDiscovery bool
 
@@ -117,6 +132,15 @@ type Sbot struct {
 
 	GraphBuilder graph.Builder
 
+	// replCache holds the hop set of the local identity for ShouldReplicate
+	replCacheMu    sync.Mutex
+	replCacheGraph *graph.Graph
+	replCacheHops  *ssb.StrFeedSet
+
+	// recentCache holds the latest receive time of each feed for RecentFeeds
+	recentCacheMu sync.Mutex
+	recentCache   map[string]recentFeed
+
 	BlobStore   ssb.BlobStore
 	WantManager ssb.WantManager
 
@@ -457,6 +481,51 @@ func WithHops(h uint) Option {
 	}
 }
 
+// WithLiveResumeGrace sets how long the live streams of a peer are buffered after its connection broke,
+// so that it can pick up where it left off when it reconnects. Zero disables it.
+func WithLiveResumeGrace(d time.Duration) Option {
+	return func(s *Sbot) error {
+		s.liveResumeGrace = d
+		return nil
+	}
+}
+
+// WithMaxLiveFeeds limits the number of feeds that are streamed live to peers.
+// Above it, the streams of the feed that didn't get a new message for the longest time are closed. Zero means no limit.
+func WithMaxLiveFeeds(n int) Option {
+	return func(s *Sbot) error {
+		s.maxLiveFeeds = n
+		return nil
+	}
+}
+
+// WithStreamIdleTimeout aborts createHistoryStream requests of peers that didn't take a message for d.
+// Zero, the default, disables it.
+func WithStreamIdleTimeout(d time.Duration) Option {
+	return func(s *Sbot) error {
+		s.streamIdle = d
+		return nil
+	}
+}
+
+// WithVerifyCheckpoints makes the verify sinks of fetched feeds save their progress every interval messages,
+// so that a sync that was interrupted by a crash resumes from there. Zero, the default, disables it.
+func WithVerifyCheckpoints(interval int) Option {
+	return func(s *Sbot) error {
+		s.verifyCheckpoints = interval
+		return nil
+	}
+}
+
+// WithPeerHops makes createHistoryStream only serve the feeds that are at most hops away from the requesting peer,
+// going by the follows of that peer that we know of instead of our own. A negative number, the default, disables it.
+func WithPeerHops(hops int) Option {
+	return func(s *Sbot) error {
+		s.peerHops = hops
+		return nil
+	}
+}
+
 // WithPromisc when enabled bypasses graph-distance lookups on connections and makes the gossip handler fetch the remotes feed
 func WithPromisc(yes bool) Option {
 	return func(s *Sbot) error {
@@ -477,6 +546,16 @@ func WithPublicAuthorizer(auth ssb.Authorizer) Option {
 	}
 }
 
+// WithBlockedRetryAfter makes connections of peers that we block or that are on the deny-list fail with an ssb.ErrRetryLater.
+// The network layer then refuses connections to and from those peers until d passed, instead of checking them again on every attempt.
+// Zero, the default, disables it.
+func WithBlockedRetryAfter(d time.Duration) Option {
+	return func(s *Sbot) error {
+		s.blockedRetry = d
+		return nil
+	}
+}
+
 // WithReplicator overwrites the default graph based decision maker, of which feeds to copy or block
 func WithReplicator(r ssb.Replicator) Option {
 	return func(s *Sbot) error {
@@ -507,6 +586,8 @@ func New(fopts ...Option) (*Sbot, error) {
 	s.indexStates = make(map[string]string)
 
 	s.disableLegacyLiveReplication = true
+	s.liveResumeGrace = gossip.DefaultResumeGrace
+	s.peerHops = -1
 
 	for i, opt := range fopts {
 		err := opt(&s)
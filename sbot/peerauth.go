@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"sync"
+
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/graph"
+)
+
+// peerAuthorizers keeps one authorizer per peer for the gossip peer authorizer, so that they can reuse their distances between requests.
+// They are all dropped once the graph changes.
+type peerAuthorizers struct {
+	builder graph.Builder
+	hops    int
+
+	mu     sync.Mutex
+	graph  *graph.Graph
+	byPeer map[string]ssb.Authorizer
+}
+
+func newPeerAuthorizers(builder graph.Builder, hops int) *peerAuthorizers {
+	return &peerAuthorizers{
+		builder: builder,
+		hops:    hops,
+		byPeer:  make(map[string]ssb.Authorizer),
+	}
+}
+
+func (pa *peerAuthorizers) get(peer *refs.FeedRef) ssb.Authorizer {
+	g, err := pa.builder.Build()
+	if err != nil {
+		// not cached, the authorizer returns the error
+		return pa.builder.Authorizer(peer, pa.hops)
+	}
+
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if g != pa.graph {
+		pa.graph = g
+		pa.byPeer = make(map[string]ssb.Authorizer)
+	}
+
+	auth, has := pa.byPeer[peer.Ref()]
+	if !has {
+		auth = pa.builder.Authorizer(peer, pa.hops)
+		pa.byPeer[peer.Ref()] = auth
+	}
+	return auth
+}
@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.cryptoscope.co/librarian"
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+	"go.mindeco.de/ssb-refs/tfk"
+)
+
+// recentFeed is the latest message of a feed, as far as RecentFeeds is concerned
+type recentFeed struct {
+	feed *refs.FeedRef
+
+	// seq is the sequence of the sublog entry the timestamp was taken from
+	seq      margaret.Seq
+	received time.Time
+}
+
+// RecentFeeds returns the n feeds that we received a message of most recently, newest first.
+// The receive time of the latest message of each feed is cached, so only feeds that got new messages are looked up again.
+func (s *Sbot) RecentFeeds(n int) ([]*refs.FeedRef, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	addrs, err := s.Users.List()
+	if err != nil {
+		return nil, fmt.Errorf("recent feeds: failed to list feeds: %w", err)
+	}
+
+	s.recentCacheMu.Lock()
+	defer s.recentCacheMu.Unlock()
+
+	if s.recentCache == nil {
+		s.recentCache = make(map[string]recentFeed)
+	}
+
+	latest := make([]recentFeed, 0, len(addrs))
+	for _, addr := range addrs {
+		subLog, err := s.Users.Get(addr)
+		if err != nil {
+			return nil, fmt.Errorf("recent feeds: failed to open sublog: %w", err)
+		}
+
+		sv, err := subLog.Seq().Value()
+		if err != nil {
+			return nil, fmt.Errorf("recent feeds: failed to get sublog sequence: %w", err)
+		}
+		var seq margaret.BaseSeq
+		switch v := sv.(type) {
+		case librarian.UnsetValue:
+			// nothing stored for this feed
+			continue
+		case margaret.BaseSeq:
+			if v < 0 {
+				continue
+			}
+			seq = v
+		default:
+			return nil, fmt.Errorf("recent feeds: unexpected sublog sequence: %T", sv)
+		}
+
+		cached, has := s.recentCache[string(addr)]
+		if has && cached.seq.Seq() == seq.Seq() {
+			latest = append(latest, cached)
+			continue
+		}
+
+		rxVal, err := subLog.Get(seq)
+		if err != nil {
+			if margaret.IsErrNulled(err) {
+				continue
+			}
+			return nil, fmt.Errorf("recent feeds: failed to get latest entry: %w", err)
+		}
+
+		rxSeq, ok := rxVal.(margaret.Seq)
+		if !ok {
+			return nil, fmt.Errorf("recent feeds: wrong type in sublog: %T", rxVal)
+		}
+
+		v, err := s.ReceiveLog.Get(rxSeq)
+		if err != nil {
+			if margaret.IsErrNulled(err) {
+				continue
+			}
+			return nil, fmt.Errorf("recent feeds: failed to get latest message: %w", err)
+		}
+
+		msg, ok := v.(refs.Message)
+		if !ok {
+			return nil, fmt.Errorf("recent feeds: wrong message type: %T", v)
+		}
+
+		var sr tfk.Feed
+		if err := sr.UnmarshalBinary([]byte(addr)); err != nil {
+			return nil, fmt.Errorf("recent feeds: failed to decode feed: %w", err)
+		}
+
+		entry := recentFeed{
+			feed:     sr.Feed(),
+			seq:      seq,
+			received: msg.Received(),
+		}
+		s.recentCache[string(addr)] = entry
+		latest = append(latest, entry)
+	}
+
+	sort.Slice(latest, func(i, j int) bool {
+		if latest[i].received.Equal(latest[j].received) {
+			return latest[i].feed.Ref() < latest[j].feed.Ref()
+		}
+		return latest[i].received.After(latest[j].received)
+	})
+
+	if len(latest) > n {
+		latest = latest[:n]
+	}
+
+	feeds := make([]*refs.FeedRef, len(latest))
+	for i, rf := range latest {
+		feeds[i] = rf.feed
+	}
+	return feeds, nil
+}
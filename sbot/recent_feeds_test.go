@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	refs "go.mindeco.de/ssb-refs"
+)
+
+func TestRecentFeeds(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+
+	authors := make(map[string]*refs.FeedRef)
+	publish := func(as string) {
+		var (
+			ref *refs.MessageRef
+			err error
+		)
+		if as == "self" {
+			ref, err = theBot.PublishLog.Publish(map[string]interface{}{"type": "test"})
+		} else {
+			ref, err = theBot.PublishAs(as, map[string]interface{}{"type": "test"})
+		}
+		r.NoError(err)
+		msg, err := theBot.Get(*ref)
+		r.NoError(err)
+		authors[as] = msg.Author()
+
+		// spread out the receive times
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publish("one")
+	publish("self")
+	publish("two")
+	publish("one")
+
+	recent := func(n int) []*refs.FeedRef {
+		var feeds []*refs.FeedRef
+		r.Eventually(func() bool {
+			var err error
+			feeds, err = theBot.RecentFeeds(n)
+			r.NoError(err)
+			return len(feeds) == n
+		}, 5*time.Second, 50*time.Millisecond, "feeds weren't indexed")
+		return feeds
+	}
+
+	r.Equal([]*refs.FeedRef{authors["one"], authors["two"], authors["self"]}, recent(3))
+	r.Equal([]*refs.FeedRef{authors["one"], authors["two"]}, recent(2))
+
+	// the cached entries need to be updated with the new message
+	publish("self")
+	r.Eventually(func() bool {
+		feeds, err := theBot.RecentFeeds(1)
+		r.NoError(err)
+		return len(feeds) == 1 && feeds[0].Equal(authors["self"])
+	}, 5*time.Second, 50*time.Millisecond, "expected our own feed to be the most recent")
+	r.Equal([]*refs.FeedRef{authors["self"], authors["one"], authors["two"]}, recent(3))
+
+	empty, err := theBot.RecentFeeds(0)
+	r.NoError(err)
+	r.Len(empty, 0)
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
@@ -13,6 +13,7 @@ import (
 	"go.cryptoscope.co/margaret"
 
 	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/graph"
 	refs "go.mindeco.de/ssb-refs"
 )
 
@@ -142,3 +143,121 @@ func (l lister) Authorize(remote *refs.FeedRef) error {
 
 func (l lister) ReplicationList() *ssb.StrFeedSet { return l.feedWants }
 func (l lister) BlockList() *ssb.StrFeedSet       { return l.blocked }
+
+// FeedsToRequest computes the feeds we should ask peer for once it is connected.
+// That is the intersection of our hop set with the one of peer, if we know about the follows of peer.
+// Otherwise it's just our own hop set. Peer itself is always included, unless we block it.
+// Feeds we block are never part of the result.
+func (s *Sbot) FeedsToRequest(peer *refs.FeedRef) (*ssb.StrFeedSet, error) {
+	mine := s.GraphBuilder.Hops(s.KeyPair.Id, int(s.hopCount))
+	if mine == nil {
+		return nil, fmt.Errorf("feedsToRequest: failed to get our hops")
+	}
+
+	wanted := mine
+	if theirs := s.GraphBuilder.Hops(peer, int(s.hopCount)); theirs != nil && theirs.Count() > 0 {
+		wanted = mine.Intersection(theirs)
+	}
+
+	if err := wanted.AddRef(peer); err != nil {
+		return nil, fmt.Errorf("feedsToRequest: failed to add peer: %w", err)
+	}
+	wanted.Delete(s.KeyPair.Id)
+
+	g, err := s.GraphBuilder.Build()
+	if err != nil {
+		return nil, fmt.Errorf("feedsToRequest: failed to build graph: %w", err)
+	}
+
+	blocked, err := g.BlockedList(s.KeyPair.Id).List()
+	if err != nil {
+		return nil, fmt.Errorf("feedsToRequest: invalid entry in block list: %w", err)
+	}
+	for _, b := range blocked {
+		wanted.Delete(b)
+	}
+
+	return wanted, nil
+}
+
+// ShouldReplicate returns true if feed is in our hop range or was added with Replicate, unless we block it.
+// The hop set is cached until the contact graph changes.
+func (s *Sbot) ShouldReplicate(feed *refs.FeedRef) (bool, error) {
+	if feed.Equal(s.KeyPair.Id) {
+		return true, nil
+	}
+
+	lister := s.Replicator.Lister()
+	if lister.BlockList().Has(feed) {
+		return false, nil
+	}
+
+	g, err := s.GraphBuilder.Build()
+	if err != nil {
+		return false, fmt.Errorf("shouldReplicate: failed to build graph: %w", err)
+	}
+
+	if g.Blocks(s.KeyPair.Id, feed) {
+		return false, nil
+	}
+
+	if lister.ReplicationList().Has(feed) {
+		return true, nil
+	}
+
+	hops, err := s.cachedHops(g)
+	if err != nil {
+		return false, err
+	}
+	return hops.Has(feed), nil
+}
+
+// cachedHops returns our hop set, it is recomputed if g isn't the graph it was computed for.
+// The builder only returns a new graph after the contacts changed.
+func (s *Sbot) cachedHops(g *graph.Graph) (*ssb.StrFeedSet, error) {
+	s.replCacheMu.Lock()
+	defer s.replCacheMu.Unlock()
+
+	if s.replCacheHops != nil && s.replCacheGraph == g {
+		return s.replCacheHops, nil
+	}
+
+	hops := s.GraphBuilder.Hops(s.KeyPair.Id, int(s.hopCount))
+	if hops == nil {
+		return nil, fmt.Errorf("shouldReplicate: failed to get our hops")
+	}
+
+	s.replCacheGraph = g
+	s.replCacheHops = hops
+	return hops, nil
+}
+
+// blockedRetryHint wraps the authorization error of remote in an ssb.ErrRetryLater if we block it, see WithBlockedRetryAfter.
+// Errors that already have a retry hint from the authorizer are returned as they are.
+// It returns false if there is no hint for remote.
+func (s *Sbot) blockedRetryHint(remote *refs.FeedRef, authErr error) (error, bool) {
+	if _, has := ssb.RetryAfter(authErr); has {
+		return authErr, true
+	}
+	if s.blockedRetry <= 0 {
+		return nil, false
+	}
+
+	blocked := s.Replicator.Lister().BlockList().Has(remote)
+	var denied ssb.ErrDenied
+	if errors.As(authErr, &denied) {
+		blocked = true
+	}
+	if !blocked {
+		g, err := s.GraphBuilder.Build()
+		if err != nil {
+			return nil, false
+		}
+		blocked = g.Blocks(s.KeyPair.Id, remote)
+	}
+	if !blocked {
+		return nil, false
+	}
+
+	return ssb.ErrRetryLater{Err: authErr, After: s.blockedRetry}, true
+}
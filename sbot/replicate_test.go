@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+func TestFeedsToRequest(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+
+	mkKey := func() *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		return kp.Id
+	}
+	alice := mkKey()
+	bob := mkKey()
+	eve := mkKey()
+
+	_, err := theBot.PublishLog.Publish(refs.NewContactFollow(alice))
+	r.NoError(err)
+	_, err = theBot.PublishLog.Publish(refs.NewContactFollow(bob))
+	r.NoError(err)
+	_, err = theBot.PublishLog.Publish(refs.NewContactBlock(eve))
+	r.NoError(err)
+	waitForBlock(t, theBot, eve)
+
+	// we don't know who alice follows, so we ask for our own hops
+	fromAlice, err := theBot.FeedsToRequest(alice)
+	r.NoError(err)
+	r.True(fromAlice.Has(alice), "should include the peer")
+	r.True(fromAlice.Has(bob))
+	r.False(fromAlice.Has(eve))
+	r.False(fromAlice.Has(theBot.KeyPair.Id))
+
+	unknown := mkKey()
+	fromUnknown, err := theBot.FeedsToRequest(unknown)
+	r.NoError(err)
+	r.True(fromUnknown.Has(unknown), "should include the peer")
+	r.Equal(3, fromUnknown.Count())
+
+	fromEve, err := theBot.FeedsToRequest(eve)
+	r.NoError(err)
+	r.False(fromEve.Has(eve), "should never include blocked feeds")
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
+
+func TestShouldReplicate(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+
+	mkKey := func() *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		return kp.Id
+	}
+	alice := mkKey()
+	bob := mkKey()
+	claire := mkKey()
+	dan := mkKey()
+	stranger := mkKey()
+
+	for _, f := range []*refs.FeedRef{alice, bob, claire} {
+		_, err := theBot.PublishLog.Publish(refs.NewContactFollow(f))
+		r.NoError(err)
+	}
+	_, err := theBot.PublishLog.Publish(refs.NewContactBlock(claire))
+	r.NoError(err)
+	waitForBlock(t, theBot, claire)
+
+	// bob is in our hops but explicitly blocked
+	theBot.Block(bob)
+
+	shouldReplicate := func(feed *refs.FeedRef) bool {
+		yes, err := theBot.ShouldReplicate(feed)
+		r.NoError(err)
+		return yes
+	}
+
+	r.True(shouldReplicate(theBot.KeyPair.Id))
+	r.True(shouldReplicate(alice))
+	r.False(shouldReplicate(bob), "blocked feeds should never be replicated")
+	r.False(shouldReplicate(claire), "blocked feeds should never be replicated")
+	r.False(shouldReplicate(dan))
+	r.False(shouldReplicate(stranger))
+
+	// the cache is invalidated by new contacts
+	_, err = theBot.PublishLog.Publish(refs.NewContactFollow(dan))
+	r.NoError(err)
+	r.Eventually(func() bool { return shouldReplicate(dan) }, 5*time.Second, 50*time.Millisecond)
+
+	// the allow-list is checked as well
+	theBot.Replicate(stranger)
+	r.True(shouldReplicate(stranger))
+
+	theBot.Replicate(claire)
+	r.False(shouldReplicate(claire), "blocked feeds should never be replicated")
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
+
+// waitForBlock waits until the contacts index has the block of feed by the bot
+func waitForBlock(t *testing.T, bot *Sbot, feed *refs.FeedRef) {
+	require.Eventually(t, func() bool {
+		g, err := bot.GraphBuilder.Build()
+		return err == nil && g.Blocks(bot.KeyPair.Id, feed)
+	}, 5*time.Second, 50*time.Millisecond, "block wasn't indexed")
+}
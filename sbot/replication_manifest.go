@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"go.cryptoscope.co/margaret"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/internal/storedrefs"
+)
+
+// ManifestEntry is one feed of a replication manifest.
+// Sequence is the latest message of the feed the exporting bot had, zero if it had none.
+type ManifestEntry struct {
+	Feed     *refs.FeedRef `json:"feed"`
+	Sequence int64         `json:"sequence"`
+}
+
+// ReplicationManifest is the list of feeds a bot replicates, see ExportReplicationManifest.
+type ReplicationManifest []ManifestEntry
+
+// ReadReplicationManifest decodes a manifest that was written by ExportReplicationManifest.
+func ReadReplicationManifest(r io.Reader) (ReplicationManifest, error) {
+	var manifest ReplicationManifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("replication manifest: failed to decode: %w", err)
+	}
+	for i, entry := range manifest {
+		if entry.Feed == nil {
+			return nil, fmt.Errorf("replication manifest: entry %d has no feed", i)
+		}
+	}
+	return manifest, nil
+}
+
+// Feeds returns the feeds of the manifest as a set.
+func (m ReplicationManifest) Feeds() (*ssb.StrFeedSet, error) {
+	feeds := ssb.NewFeedSet(len(m))
+	for i, entry := range m {
+		if entry.Feed == nil {
+			return nil, fmt.Errorf("replication manifest: entry %d has no feed", i)
+		}
+		if err := feeds.AddRef(entry.Feed); err != nil {
+			return nil, fmt.Errorf("replication manifest: invalid feed in entry %d: %w", i, err)
+		}
+	}
+	return feeds, nil
+}
+
+// ExportReplicationManifest writes the feeds we replicate as a JSON list of ManifestEntry to w, sorted by feed.
+// That is our hop set and the feeds that were added with Replicate, without our own feed and the ones we block.
+// Use ImportReplicationManifest to bootstrap another bot with the same set.
+func (s *Sbot) ExportReplicationManifest(w io.Writer) error {
+	manifest, err := s.replicationManifest()
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(w).Encode(manifest); err != nil {
+		return fmt.Errorf("replication manifest: failed to encode: %w", err)
+	}
+	return nil
+}
+
+// replicationManifest returns the feeds we replicate with their current sequences, see ExportReplicationManifest.
+func (s *Sbot) replicationManifest() (ReplicationManifest, error) {
+	feeds := s.GraphBuilder.Hops(s.KeyPair.Id, int(s.hopCount))
+	if feeds == nil {
+		return nil, fmt.Errorf("replication manifest: failed to get our hops")
+	}
+
+	lister := s.Replicator.Lister()
+	explicit, err := lister.ReplicationList().List()
+	if err != nil {
+		return nil, fmt.Errorf("replication manifest: invalid entry in replication list: %w", err)
+	}
+	for _, f := range explicit {
+		if err := feeds.AddRef(f); err != nil {
+			return nil, fmt.Errorf("replication manifest: failed to add feed: %w", err)
+		}
+	}
+	if err := s.withoutBlocked(feeds); err != nil {
+		return nil, fmt.Errorf("replication manifest: %w", err)
+	}
+	feeds.Delete(s.KeyPair.Id)
+
+	lst, err := feeds.List()
+	if err != nil {
+		return nil, fmt.Errorf("replication manifest: invalid entry in hop set: %w", err)
+	}
+
+	manifest := make(ReplicationManifest, len(lst))
+	for i, f := range lst {
+		subLog, err := s.Users.Get(storedrefs.Feed(f))
+		if err != nil {
+			return nil, fmt.Errorf("replication manifest: failed to open sublog of %s: %w", f.ShortRef(), err)
+		}
+		sv, err := subLog.Seq().Value()
+		if err != nil {
+			return nil, fmt.Errorf("replication manifest: failed to get sequence of %s: %w", f.ShortRef(), err)
+		}
+
+		// sublogs are zero-indexed, feeds start at one
+		manifest[i] = ManifestEntry{
+			Feed:     f,
+			Sequence: sv.(margaret.Seq).Seq() + 1,
+		}
+	}
+	sort.Slice(manifest, func(i, j int) bool {
+		return manifest[i].Feed.Ref() < manifest[j].Feed.Ref()
+	})
+
+	return manifest, nil
+}
+
+// ImportReplicationManifest reads a manifest that was written by ExportReplicationManifest and calls Replicate for each feed in it.
+// Our own feed and the ones we block are skipped. The sequences are only informational, the messages still need to be fetched from peers.
+func (s *Sbot) ImportReplicationManifest(r io.Reader) error {
+	manifest, err := ReadReplicationManifest(r)
+	if err != nil {
+		return err
+	}
+
+	feeds, err := manifest.Feeds()
+	if err != nil {
+		return err
+	}
+	if err := s.withoutBlocked(feeds); err != nil {
+		return fmt.Errorf("replication manifest: %w", err)
+	}
+	feeds.Delete(s.KeyPair.Id)
+
+	lst, err := feeds.List()
+	if err != nil {
+		return fmt.Errorf("replication manifest: invalid entry in feed set: %w", err)
+	}
+	for _, f := range lst {
+		s.Replicate(f)
+	}
+	return nil
+}
+
+// CompareReplication returns the feeds that only we replicate and the ones that only other has,
+// for instance to find out why another bot has feeds we don't. other is usually read with ReadReplicationManifest.
+func (s *Sbot) CompareReplication(other ReplicationManifest) (onlyLocal, onlyRemote *ssb.StrFeedSet, err error) {
+	local, err := s.replicationManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	return compareManifests(local, other)
+}
+
+// compareManifests returns the symmetric difference of the feeds in local and remote
+func compareManifests(local, remote ReplicationManifest) (onlyLocal, onlyRemote *ssb.StrFeedSet, err error) {
+	localFeeds, err := local.Feeds()
+	if err != nil {
+		return nil, nil, fmt.Errorf("compare replication: local %w", err)
+	}
+	remoteFeeds, err := remote.Feeds()
+	if err != nil {
+		return nil, nil, fmt.Errorf("compare replication: remote %w", err)
+	}
+	return localFeeds.Difference(remoteFeeds), remoteFeeds.Difference(localFeeds), nil
+}
+
+// withoutBlocked removes the feeds we block from set.
+func (s *Sbot) withoutBlocked(set *ssb.StrFeedSet) error {
+	g, err := s.GraphBuilder.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build graph: %w", err)
+	}
+
+	blocked, err := g.BlockedList(s.KeyPair.Id).List()
+	if err != nil {
+		return fmt.Errorf("invalid entry in block list: %w", err)
+	}
+	explicit, err := s.Replicator.Lister().BlockList().List()
+	if err != nil {
+		return fmt.Errorf("invalid entry in block list: %w", err)
+	}
+	for _, b := range append(blocked, explicit...) {
+		set.Delete(b)
+	}
+	return nil
+}
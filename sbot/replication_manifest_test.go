@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+func TestReplicationManifestRoundtrip(t *testing.T) {
+	r := require.New(t)
+
+	testPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(testPath)
+	theBot, botOptions := makeTestBot(t)
+
+	mkKey := func() *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		return kp.Id
+	}
+	alice := mkKey()
+	carl := mkKey()
+	eve := mkKey()
+
+	// a feed we have messages of
+	var one *refs.FeedRef
+	for i := 0; i < 2; i++ {
+		ref, err := theBot.PublishAs("one", map[string]interface{}{"type": "test", "i": i})
+		r.NoError(err)
+		msg, err := theBot.Get(*ref)
+		r.NoError(err)
+		one = msg.Author()
+	}
+
+	for _, f := range []*refs.FeedRef{alice, one} {
+		_, err := theBot.PublishLog.Publish(refs.NewContactFollow(f))
+		r.NoError(err)
+	}
+	_, err := theBot.PublishLog.Publish(refs.NewContactBlock(eve))
+	r.NoError(err)
+	waitForBlock(t, theBot, eve)
+	r.Eventually(func() bool {
+		return theBot.GraphBuilder.Hops(theBot.KeyPair.Id, 0).Count() == 2
+	}, 5*time.Second, 50*time.Millisecond, "follows weren't indexed")
+
+	theBot.Replicate(carl)
+
+	var exported bytes.Buffer
+	r.NoError(theBot.ExportReplicationManifest(&exported))
+
+	var manifest []ManifestEntry
+	r.NoError(json.Unmarshal(exported.Bytes(), &manifest))
+	seqs := make(map[string]int64)
+	for _, e := range manifest {
+		seqs[e.Feed.Ref()] = e.Sequence
+	}
+	r.Equal(map[string]int64{
+		alice.Ref(): 0,
+		carl.Ref():  0,
+		one.Ref():   2,
+	}, seqs)
+
+	// import on a fresh bot
+	freshOptions := append(botOptions, WithRepoPath(filepath.Join(testPath, "fresh")))
+	fresh, err := New(freshOptions...)
+	r.NoError(err)
+
+	r.NoError(fresh.ImportReplicationManifest(bytes.NewReader(exported.Bytes())))
+	replicating := fresh.Replicator.Lister().ReplicationList()
+	for _, e := range manifest {
+		r.True(replicating.Has(e.Feed), "fresh bot doesn't replicate %s", e.Feed.ShortRef())
+	}
+
+	// exporting again gives the same feeds
+	var reexported bytes.Buffer
+	r.NoError(fresh.ExportReplicationManifest(&reexported))
+	var again []ManifestEntry
+	r.NoError(json.Unmarshal(reexported.Bytes(), &again))
+	r.Len(again, len(manifest))
+	for i := range again {
+		r.True(again[i].Feed.Equal(manifest[i].Feed), "feed %d differs", i)
+	}
+
+	err = fresh.ImportReplicationManifest(bytes.NewReader([]byte(`[{"sequence": 1}]`)))
+	r.Error(err, "accepted an entry without a feed")
+
+	fresh.Shutdown()
+	r.NoError(fresh.Close())
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
+
+func TestCompareReplication(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+
+	mkKey := func() *refs.FeedRef {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		return kp.Id
+	}
+	alice := mkKey()
+	bob := mkKey()
+	carl := mkKey()
+	dan := mkKey()
+
+	for _, f := range []*refs.FeedRef{alice, bob} {
+		_, err := theBot.PublishLog.Publish(refs.NewContactFollow(f))
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		return theBot.GraphBuilder.Hops(theBot.KeyPair.Id, 0).Count() == 2
+	}, 5*time.Second, 50*time.Millisecond, "follows weren't indexed")
+	theBot.Replicate(carl)
+
+	remote, err := ReadReplicationManifest(strings.NewReader(`[
+		{"feed": "` + bob.Ref() + `", "sequence": 3},
+		{"feed": "` + carl.Ref() + `", "sequence": 0},
+		{"feed": "` + dan.Ref() + `", "sequence": 12}
+	]`))
+	r.NoError(err)
+
+	onlyLocal, onlyRemote, err := theBot.CompareReplication(remote)
+	r.NoError(err)
+	r.Equal(1, onlyLocal.Count())
+	r.True(onlyLocal.Has(alice))
+	r.Equal(1, onlyRemote.Count())
+	r.True(onlyRemote.Has(dan))
+
+	// the same set has no differences
+	var exported bytes.Buffer
+	r.NoError(theBot.ExportReplicationManifest(&exported))
+	same, err := ReadReplicationManifest(&exported)
+	r.NoError(err)
+	onlyLocal, onlyRemote, err = theBot.CompareReplication(same)
+	r.NoError(err)
+	r.Equal(0, onlyLocal.Count())
+	r.Equal(0, onlyRemote.Count())
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"fmt"
+	"sort"
+
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+)
+
+// FeedGap describes a feed where a peer advertised more messages than we have stored.
+type FeedGap struct {
+	Feed *refs.FeedRef
+
+	// Have is the latest sequence we have stored (0 if we have nothing)
+	Have int64
+
+	// Advertised is the latest sequence the peer told us about via its EBT notes
+	Advertised int64
+}
+
+// Missing returns how many messages we are behind the peer.
+func (fg FeedGap) Missing() int64 { return fg.Advertised - fg.Have }
+
+// ReplStatus is the replication completeness of our feeds with regard to one peer.
+type ReplStatus struct {
+	Peer *refs.FeedRef
+
+	// Checked is the number of feeds that were compared
+	Checked int
+
+	// Gaps holds an entry for every feed the peer is ahead of us, sorted by feed reference
+	Gaps []FeedGap
+}
+
+// Complete returns true if the peer doesn't advertise any message we don't have.
+func (rs ReplStatus) Complete() bool { return len(rs.Gaps) == 0 }
+
+// ReplicationStatus compares the feeds we want to replicate against the frontier peer advertised via EBT.
+// Feeds the peer doesn't replicate or didn't tell us about are not reported as gaps.
+func (s *Sbot) ReplicationStatus(peer *refs.FeedRef) (ReplStatus, error) {
+	status := ReplStatus{Peer: peer}
+
+	theirs, err := s.ebtState.Inspect(peer)
+	if err != nil {
+		return status, fmt.Errorf("replication status: failed to get frontier of %s: %w", peer.ShortRef(), err)
+	}
+
+	wanted, err := s.Replicator.Lister().ReplicationList().List()
+	if err != nil {
+		return status, fmt.Errorf("replication status: failed to get replication list: %w", err)
+	}
+
+	for _, feed := range wanted {
+		status.Checked++
+
+		theirNote, has := theirs[feed.Ref()]
+		if !has || !theirNote.Replicate {
+			continue
+		}
+
+		myNote, err := s.CurrentSequence(feed)
+		if err != nil {
+			return status, fmt.Errorf("replication status: %w", err)
+		}
+
+		have := myNote.Seq
+		if have < 0 {
+			have = 0
+		}
+
+		if theirNote.Seq > have {
+			status.Gaps = append(status.Gaps, FeedGap{
+				Feed:       feed,
+				Have:       have,
+				Advertised: theirNote.Seq,
+			})
+		}
+	}
+
+	sort.Slice(status.Gaps, func(i, j int) bool {
+		return status.Gaps[i].Feed.Ref() < status.Gaps[j].Feed.Ref()
+	})
+
+	return status, nil
+}
+
+// PendingFeeds returns the feeds we want to replicate but don't have a single message of yet.
+// The feeds are the same as the ones of ExportReplicationManifest, peers that have them are the most useful to connect to.
+func (s *Sbot) PendingFeeds() (*ssb.StrFeedSet, error) {
+	manifest, err := s.replicationManifest()
+	if err != nil {
+		return nil, fmt.Errorf("pending feeds: %w", err)
+	}
+
+	pending := ssb.NewFeedSet(0)
+	for _, entry := range manifest {
+		if entry.Sequence > 0 {
+			continue
+		}
+		if err := pending.AddRef(entry.Feed); err != nil {
+			return nil, fmt.Errorf("pending feeds: failed to add feed: %w", err)
+		}
+	}
+	return pending, nil
+}
+
+// PeerReplicationSet returns the feeds peer would replicate with hops according to our copy of the graph
+// and the ones of those we don't have a single message of, for instance to fetch them before serving peer.
+func (s *Sbot) PeerReplicationSet(peer *refs.FeedRef, hops int) (wanted, missing *ssb.StrFeedSet, err error) {
+	wanted = s.GraphBuilder.Hops(peer, hops)
+	if wanted == nil {
+		return nil, nil, fmt.Errorf("peer replication set: failed to get hops of %s", peer.ShortRef())
+	}
+
+	lst, err := wanted.List()
+	if err != nil {
+		return nil, nil, fmt.Errorf("peer replication set: invalid entry in hop set: %w", err)
+	}
+
+	missing = ssb.NewFeedSet(0)
+	for _, feed := range lst {
+		note, err := s.CurrentSequence(feed)
+		if err != nil {
+			return nil, nil, fmt.Errorf("peer replication set: %w", err)
+		}
+		if note.Seq > 0 {
+			continue
+		}
+		if err := missing.AddRef(feed); err != nil {
+			return nil, nil, fmt.Errorf("peer replication set: failed to add feed: %w", err)
+		}
+	}
+	return wanted, missing, nil
+}
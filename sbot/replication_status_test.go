@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: MIT
+
+package sbot
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	refs "go.mindeco.de/ssb-refs"
+
+	"go.cryptoscope.co/ssb"
+	"go.cryptoscope.co/ssb/repo"
+)
+
+func TestReplicationStatus(t *testing.T) {
+	r := require.New(t)
+
+	os.RemoveAll(filepath.Join("testrun", t.Name()))
+	theBot, _ := makeTestBot(t)
+
+	const n = 3
+	for i := 0; i < n; i++ {
+		_, err := theBot.PublishLog.Publish(map[string]interface{}{"type": "test", "i": i})
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		note, err := theBot.CurrentSequence(theBot.KeyPair.Id)
+		return err == nil && note.Seq == n
+	}, 5*time.Second, 50*time.Millisecond, "user feed wasn't indexed")
+
+	mkRef := func(b byte) *ssb.KeyPair {
+		kp, err := ssb.NewKeyPair(bytes.NewReader(bytes.Repeat([]byte{b}, 32)))
+		r.NoError(err)
+		return kp
+	}
+	peer := mkRef(1).Id
+	bob := mkRef(2).Id
+	claire := mkRef(3).Id
+	dan := mkRef(4).Id
+	notWanted := mkRef(5).Id
+
+	theBot.Replicate(theBot.KeyPair.Id)
+	theBot.Replicate(bob)
+	theBot.Replicate(claire)
+	theBot.Replicate(dan)
+
+	// the mock peer is ahead on our own feed and bob, equal on claire and doesn't replicate dan
+	_, err := theBot.ebtState.Update(peer, ssb.NetworkFrontier{
+		theBot.KeyPair.Id.Ref(): ssb.Note{Seq: n + 2, Replicate: true, Receive: true},
+		bob.Ref():               ssb.Note{Seq: 7, Replicate: true, Receive: true},
+		claire.Ref():            ssb.Note{Seq: 0, Replicate: true, Receive: true},
+		dan.Ref():               ssb.Note{Seq: 9, Replicate: false},
+		notWanted.Ref():         ssb.Note{Seq: 100, Replicate: true, Receive: true},
+	})
+	r.NoError(err)
+
+	status, err := theBot.ReplicationStatus(peer)
+	r.NoError(err)
+	r.False(status.Complete())
+	r.True(status.Checked >= 4, "checked only %d feeds", status.Checked)
+
+	gaps := make(map[string]FeedGap)
+	for _, g := range status.Gaps {
+		gaps[g.Feed.Ref()] = g
+	}
+	r.Len(gaps, 2, "expected gaps for self and bob: %v", gaps)
+
+	self, has := gaps[theBot.KeyPair.Id.Ref()]
+	r.True(has)
+	r.EqualValues(n, self.Have)
+	r.EqualValues(n+2, self.Advertised)
+	r.EqualValues(2, self.Missing())
+
+	bobGap, has := gaps[bob.Ref()]
+	r.True(has)
+	r.EqualValues(0, bobGap.Have)
+	r.EqualValues(7, bobGap.Advertised)
+
+	// once the peer's frontier matches ours, replication is complete
+	_, err = theBot.ebtState.Update(peer, ssb.NetworkFrontier{
+		theBot.KeyPair.Id.Ref(): ssb.Note{Seq: n, Replicate: true, Receive: true},
+		bob.Ref():               ssb.Note{Seq: 0, Replicate: true, Receive: true},
+	})
+	r.NoError(err)
+
+	status, err = theBot.ReplicationStatus(peer)
+	r.NoError(err)
+	r.True(status.Complete(), "still has gaps: %v", status.Gaps)
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
+
+func TestPendingFeeds(t *testing.T) {
+	r := require.New(t)
+
+	testPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(testPath)
+	theBot, _ := makeTestBot(t)
+
+	tRepo := repo.New(testPath)
+	_, err := repo.NewKeyPair(tRepo, "three", refs.RefAlgoFeedSSB1)
+	r.NoError(err)
+
+	// three feeds we have messages of
+	var present []*refs.FeedRef
+	for _, nick := range []string{"one", "two", "three"} {
+		_, err := theBot.PublishAs(nick, map[string]interface{}{"type": "test", "nick": nick})
+		r.NoError(err)
+		kp, err := repo.LoadKeyPair(tRepo, nick)
+		r.NoError(err)
+		present = append(present, kp.Id)
+	}
+
+	// and two we don't
+	var missing []*refs.FeedRef
+	for i := 0; i < 2; i++ {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		missing = append(missing, kp.Id)
+	}
+
+	for _, f := range append(present, missing...) {
+		_, err := theBot.PublishLog.Publish(refs.NewContactFollow(f))
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		return theBot.GraphBuilder.Hops(theBot.KeyPair.Id, 0).Count() == 5
+	}, 5*time.Second, 50*time.Millisecond, "follows weren't indexed")
+	for _, f := range present {
+		r.Eventually(func() bool {
+			note, err := theBot.CurrentSequence(f)
+			return err == nil && note.Seq == 1
+		}, 5*time.Second, 50*time.Millisecond, "feed %s wasn't indexed", f.ShortRef())
+	}
+
+	pending, err := theBot.PendingFeeds()
+	r.NoError(err)
+	r.Equal(2, pending.Count())
+	for _, f := range missing {
+		r.True(pending.Has(f), "%s isn't pending", f.ShortRef())
+	}
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
+
+func TestPeerReplicationSet(t *testing.T) {
+	r := require.New(t)
+
+	testPath := filepath.Join("testrun", t.Name())
+	os.RemoveAll(testPath)
+	theBot, _ := makeTestBot(t)
+
+	tRepo := repo.New(testPath)
+	peerKP, err := repo.NewKeyPair(tRepo, "peer", refs.RefAlgoFeedSSB1)
+	r.NoError(err)
+	peer := peerKP.Id
+
+	_, err = theBot.PublishAs("one", map[string]interface{}{"type": "test"})
+	r.NoError(err)
+	oneKP, err := repo.LoadKeyPair(tRepo, "one")
+	r.NoError(err)
+	one := oneKP.Id
+
+	var unknown []*refs.FeedRef
+	for i := 0; i < 2; i++ {
+		kp, err := ssb.NewKeyPair(nil)
+		r.NoError(err)
+		unknown = append(unknown, kp.Id)
+	}
+
+	// the peer follows a feed we have and two we don't
+	for _, f := range append([]*refs.FeedRef{one}, unknown...) {
+		_, err := theBot.PublishAs("peer", refs.NewContactFollow(f))
+		r.NoError(err)
+	}
+	r.Eventually(func() bool {
+		return theBot.GraphBuilder.Hops(peer, 0).Count() == 3
+	}, 5*time.Second, 50*time.Millisecond, "follows weren't indexed")
+	r.Eventually(func() bool {
+		note, err := theBot.CurrentSequence(one)
+		return err == nil && note.Seq == 1
+	}, 5*time.Second, 50*time.Millisecond, "feed wasn't indexed")
+
+	wanted, missing, err := theBot.PeerReplicationSet(peer, 0)
+	r.NoError(err)
+	r.True(wanted.Has(one))
+
+	// missing is wanted without the feeds we have messages of
+	lst, err := wanted.List()
+	r.NoError(err)
+	for _, f := range lst {
+		note, err := theBot.CurrentSequence(f)
+		r.NoError(err)
+		r.Equal(note.Seq < 1, missing.Has(f), "wrong state for %s", f.ShortRef())
+	}
+	r.Equal(2, missing.Count())
+	for _, f := range unknown {
+		r.True(missing.Has(f), "%s isn't missing", f.ShortRef())
+	}
+
+	theBot.Shutdown()
+	r.NoError(theBot.Close())
+}
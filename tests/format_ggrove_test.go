@@ -91,7 +91,7 @@ func XTestGabbyFeedFromGo(t *testing.T) {
 	aliceAsGabby := *alice
 	aliceAsGabby.Algo = refs.RefAlgoFeedGabby
 
-	var saver = message.MargaretSaver{s.ReceiveLog}
+	var saver = message.MargaretSaver{Log: s.ReceiveLog}
 
 	snk := message.NewVerifySink(&aliceAsGabby, margaret.BaseSeq(1), nil, saver, nil)
 